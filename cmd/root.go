@@ -44,14 +44,14 @@ var rootCmd = &cobra.Command{
 	Use:     "smtpd-filter-spamclass",
 	Short:   "smtpd filter sets the X-Spam-Class and X-Spam headers",
 	Long: `
-Reads classes config JSON file
+Reads classes config JSON, YAML or TOML file
 default classes file is /etc/mail/filter_rspamd_classes.json
 Scans headers and updates: 'X-Spam-Class' and 'X-Spam'
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		filter, err := filter.NewFilter(os.Stdin, os.Stdout)
 		cobra.CheckErr(err)
-		filter.Run()
+		cobra.CheckErr(filter.Run())
 	},
 }
 
@@ -64,4 +64,5 @@ func Execute() {
 func init() {
 	CobraInit(rootCmd)
 	OptionString(rootCmd, "class-config-file", "", "", "class config filename")
+	OptionString(rootCmd, "class-config-format", "", "", "class config format: json, yaml or toml (default: by file extension)")
 }
@@ -0,0 +1,161 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+)
+
+const ACTION_TAG = "tag"
+const ACTION_JUNK = "junk"
+const ACTION_REJECT = "reject"
+const ACTION_QUARANTINE = "quarantine"
+
+const DEFAULT_REJECT_STATUS = "550 5.7.1 Message rejected as spam"
+
+const COUNTER_REJECTED = "rejected"
+
+var REJECT_STATUS_PATTERN = regexp.MustCompile(`^[45][0-9][0-9] \S.*$`)
+
+// ActionPolicy chooses the action taken for a classified message: ACTION_TAG, ACTION_JUNK,
+// ACTION_REJECT or ACTION_QUARANTINE
+type ActionPolicy interface {
+	Action(session *Session, message *Message, class string) string
+}
+
+// the class_actions config
+var _ ActionPolicy = (*classActions)(nil)
+
+// actions taken for messages by class, in addition to the generated headers
+//
+//	class_actions:  map of class name to action: tag, junk, reject or quarantine
+//	reject_status:  SMTP status returned at commit for rejected messages
+//
+// tag is the default; other actions set the spam flag header regardless of spam_classes,
+// and reject also registers the commit filter phase and refuses the message there;
+// quarantine stores a copy of the message as configured by the quarantine options
+type classActions struct {
+	Actions      map[string]string
+	RejectStatus string
+}
+
+func newClassActions() (*classActions, error) {
+	ViperSetDefault("reject_status", DEFAULT_REJECT_STATUS)
+	actions := classActions{
+		Actions:      make(map[string]string),
+		RejectStatus: ViperGetString("reject_status"),
+	}
+	for class, action := range ViperGetStringMapString("class_actions") {
+		switch action {
+		case ACTION_TAG, ACTION_JUNK, ACTION_REJECT, ACTION_QUARANTINE:
+		default:
+			return nil, fmt.Errorf("unknown class_actions action for class %s: %s", class, action)
+		}
+		actions.Actions[class] = action
+	}
+	if !REJECT_STATUS_PATTERN.MatchString(actions.RejectStatus) {
+		return nil, fmt.Errorf("invalid reject_status: %q", actions.RejectStatus)
+	}
+	if len(actions.Actions) == 0 {
+		return nil, nil
+	}
+	return &actions, nil
+}
+
+// return true if any class is configured with action
+func (a *classActions) uses(action string) bool {
+	if a == nil {
+		return false
+	}
+	for _, classAction := range a.Actions {
+		if classAction == action {
+			return true
+		}
+	}
+	return false
+}
+
+// return the action configured for a class
+func (a *classActions) Action(session *Session, message *Message, class string) string {
+	if a == nil {
+		return ACTION_TAG
+	}
+	action, ok := a.Actions[class]
+	if !ok {
+		return ACTION_TAG
+	}
+	return action
+}
+
+// replace class_actions with an alternate action policy; the commit filter phase is
+// registered so the policy may reject messages
+func (f *Filter) SetActionPolicy(policy ActionPolicy) {
+	f.actionPolicy = policy
+	for _, phase := range f.filters {
+		if phase == "commit" {
+			return
+		}
+	}
+	f.filters = append(f.filters, "commit")
+}
+
+// return the action for a classified message
+func (f *Filter) classAction(name string, session *Session, message *Message, class string) string {
+	if f.actionPolicy == nil {
+		return f.actions.Action(session, message, class)
+	}
+	return f.checkAction(name, f.actionPolicy.Action(session, message, class), class)
+}
+
+// return an action chosen outside class_actions, replacing those this filter cannot perform
+func (f *Filter) checkAction(name, action, class string) string {
+	switch action {
+	case ACTION_TAG, ACTION_JUNK, ACTION_REJECT:
+	case ACTION_QUARANTINE:
+		if f.quarantine == nil {
+			Warning("%s.%s: quarantine action without quarantine_path; delivering as junk", f.Name, name)
+			return ACTION_JUNK
+		}
+	default:
+		Warning("%s.%s: unknown action '%s' for class %s; tagging", f.Name, name, action, class)
+		return ACTION_TAG
+	}
+	return action
+}
+
+// respond to a commit filter request, rejecting messages whose class action refuses delivery
+func (f *Filter) commit(name, sid, token string) {
+	session := f.getSession(name, sid)
+	var message *Message
+	if session != nil {
+		message = session.Messages[session.DataMessage]
+	}
+	// the decision waits for a message still being scanned
+	if message != nil && message.Scanning {
+		message.AfterScan = append(message.AfterScan, func() { f.commitMessage(name, sid, token, session, message) })
+		return
+	}
+	f.commitMessage(name, sid, token, session, message)
+}
+
+// respond to a commit filter request for a message, which may be nil if it is not tracked
+func (f *Filter) commitMessage(name, sid, token string, session *Session, message *Message) {
+	result := "proceed"
+	if message != nil && f.rejected(message) {
+		name = logName(name, session, message)
+		status := f.rejectStatus
+		if f.virusRejected(message) {
+			status = f.clamav.Status
+		}
+		result = "reject|" + status
+		f.count(COUNTER_REJECTED)
+		log.Printf("%s.%s: rejecting message: %s\n", f.Name, name, status)
+	}
+	if f.verbose {
+		log.Printf("%s.%s: sid=%s token=%s result=%s\n", f.Name, name, sid, token, result)
+	}
+	err := f.writeLine(fmt.Sprintf("filter-result|%s|%s|%s", sid, token, result))
+	if err != nil {
+		Warning("commit result output failed with: %v", err)
+	}
+}
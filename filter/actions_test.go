@@ -0,0 +1,112 @@
+package filter
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testCommitLine = "filter|0.7|0000000000.000000|smtp-in|commit|deadbeef|c0ffee"
+
+// return filter protocol input for a message followed by its commit filter request
+func commitInput(data []string) string {
+	input := messageInput(data)
+	commit := "report|0.7|0000000000.000000|smtp-in|tx-commit|"
+	return strings.Replace(input, commit, testCommitLine+"\n"+commit, 1)
+}
+
+func TestClassActions(t *testing.T) {
+	options := map[string]any{
+		"class_actions": map[string]string{"suspected_spam": "junk", "spam": "reject"},
+		"reject_status": "554 5.7.1 go away",
+	}
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	run := func() (string, *Filter) {
+		var output strings.Builder
+		f := newTestFilter(t, options, commitInput(data), &output)
+		f.Run()
+		return output.String(), f
+	}
+	output, _ := run()
+	require.Contains(t, output, "register|filter|smtp-in|commit\n")
+	require.Contains(t, output, "filter-result|deadbeef|c0ffee|proceed\n")
+	require.Contains(t, filteredLines(t, output), "X-Spam: no")
+
+	// junk delivers the message flagged as spam
+	data[0] = "X-Spam-Score: 7.2 / 100"
+	output, _ = run()
+	require.Contains(t, output, "filter-result|deadbeef|c0ffee|proceed\n")
+	require.Contains(t, filteredLines(t, output), "X-Spam-Class: suspected_spam")
+	require.Contains(t, filteredLines(t, output), "X-Spam: yes")
+
+	data[0] = "X-Spam-Score: 50 / 100"
+	output, f := run()
+	require.Contains(t, output, "filter-result|deadbeef|c0ffee|reject|554 5.7.1 go away\n")
+	require.Equal(t, int64(1), f.Counter(COUNTER_REJECTED))
+}
+
+func TestClassActionsCommitNotRegistered(t *testing.T) {
+	var output strings.Builder
+	f := newTestFilter(t, map[string]any{"class_actions": map[string]string{"spam": "junk"}}, messageInput([]string{"To: touser@localdomain.ext", ""}), &output)
+	f.Run()
+	require.NotContains(t, output.String(), "|commit")
+}
+
+func TestClassActionsInvalid(t *testing.T) {
+	for _, options := range []map[string]any{
+		{"class_actions": map[string]string{"spam": "discard"}},
+		{"class_actions": map[string]string{"spam": "reject"}, "reject_status": "250 ok"},
+		{"class_actions": map[string]string{"spam": "quarantine"}},
+	} {
+		Init("smtpd-filter-addheader", Version, "testdata/config.yaml")
+		setTestOptions(t, options)
+		_, err := NewFilter(strings.NewReader(""), io.Discard)
+		require.NotNil(t, err)
+	}
+}
+
+// action policy rejecting messages from one sender and quarantining everything else
+type testActionPolicy struct {
+	classes []string
+}
+
+func (p *testActionPolicy) Action(session *Session, message *Message, class string) string {
+	p.classes = append(p.classes, class)
+	if len(message.EnvelopeFrom) > 0 && message.EnvelopeFrom[0] == "fromuser@example.org" {
+		return ACTION_REJECT
+	}
+	return ACTION_QUARANTINE
+}
+
+func TestActionPolicy(t *testing.T) {
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	run := func(input string) (string, *testActionPolicy) {
+		var output strings.Builder
+		f := newTestFilter(t, nil, input, &output)
+		policy := &testActionPolicy{}
+		f.SetActionPolicy(policy)
+		f.Run()
+		return output.String(), policy
+	}
+	output, policy := run(commitInput(data))
+	require.Contains(t, output, "register|filter|smtp-in|commit\n")
+	require.Contains(t, output, "filter-result|deadbeef|c0ffee|reject|"+DEFAULT_REJECT_STATUS+"\n")
+	require.Equal(t, []string{"applied_class"}, policy.classes)
+
+	// quarantine without quarantine_path delivers as junk
+	output, _ = run(strings.Replace(commitInput(data), "|ok|fromuser@example.org", "|ok|other@example.org", 1))
+	require.Contains(t, output, "filter-result|deadbeef|c0ffee|proceed\n")
+	require.Contains(t, filteredLines(t, output), "X-Spam: yes")
+}
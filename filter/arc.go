@@ -0,0 +1,120 @@
+package filter
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ARC_INSTANCE_PATTERN = regexp.MustCompile(`^\s*i\s*=\s*([0-9]+)\s*$`)
+var ARC_TAG_PATTERN = regexp.MustCompile(`^\s*([a-z]+)\s*=\s*(\S*)\s*$`)
+
+// an ARC set read from the ARC-Seal and ARC-Authentication-Results headers of one instance
+type arcInstance struct {
+	Sealer  string
+	Chain   string
+	Results []string
+	Sealed  bool
+}
+
+// return the instance number and remaining fields of an ARC header value
+func arcFields(value string) (int, []string, bool) {
+	fields := strings.Split(value, ";")
+	groups := ARC_INSTANCE_PATTERN.FindStringSubmatch(fields[0])
+	if len(groups) != 2 {
+		return 0, nil, false
+	}
+	instance, err := strconv.Atoi(groups[1])
+	if err != nil || instance < 1 {
+		return 0, nil, false
+	}
+	return instance, fields[1:], true
+}
+
+// return the message's ARC set for an instance
+func arcSet(message *Message, instance int) *arcInstance {
+	if message.ARC == nil {
+		message.ARC = make(map[int]*arcInstance)
+	}
+	set, ok := message.ARC[instance]
+	if !ok {
+		set = &arcInstance{}
+		message.ARC[instance] = set
+	}
+	return set
+}
+
+// record the sealing domain and chain validation state of an ARC-Seal header line
+func (f *Filter) parseARCSeal(message *Message, line string) {
+	_, value, _ := strings.Cut(line, ":")
+	instance, fields, ok := arcFields(value)
+	if !ok {
+		return
+	}
+	set := arcSet(message, instance)
+	set.Sealed = true
+	for _, field := range fields {
+		groups := ARC_TAG_PATTERN.FindStringSubmatch(field)
+		if len(groups) != 3 {
+			continue
+		}
+		switch groups[1] {
+		case "d":
+			set.Sealer = strings.ToLower(groups[2])
+		case "cv":
+			set.Chain = strings.ToLower(groups[2])
+		}
+	}
+}
+
+// record the results of an ARC-Authentication-Results header line; the first field after the
+// instance is the authserv-id of the forwarder
+func (f *Filter) parseARCAuthResults(message *Message, line string) {
+	_, value, _ := strings.Cut(line, ":")
+	instance, fields, ok := arcFields(value)
+	if !ok || len(fields) == 0 {
+		return
+	}
+	arcSet(message, instance).Results = authResultKeys(fields[1:])
+}
+
+// return the oldest ARC instance results if the chain is trusted: our authentication results
+// report arc=pass, every instance is sealed without a failed chain, and the latest sealer is
+// an arc_trusted_sealers domain
+func (f *Filter) arcResults(message *Message) ([]string, string, bool) {
+	if !f.authScores.ARCTrust || len(message.ARC) == 0 {
+		return nil, "", false
+	}
+	passed := false
+	for _, key := range message.AuthResults {
+		if key == "arc=pass" {
+			passed = true
+		}
+	}
+	if !passed {
+		return nil, "", false
+	}
+	for instance := 1; instance <= len(message.ARC); instance++ {
+		set, ok := message.ARC[instance]
+		if !ok || !set.Sealed || set.Chain == "fail" {
+			return nil, "", false
+		}
+	}
+	sealer := message.ARC[len(message.ARC)].Sealer
+	if len(f.authScores.ARCSealers) > 0 && !f.authScores.ARCSealers[sealer] {
+		return nil, "", false
+	}
+	return message.ARC[1].Results, sealer, true
+}
+
+// return the authentication results used for scoring, those of the oldest ARC instance for
+// trusted forwarded mail
+func (f *Filter) trustedAuthResults(name string, message *Message) []string {
+	results, sealer, ok := f.arcResults(message)
+	if !ok {
+		return message.AuthResults
+	}
+	log.Printf("%s.%s: using ARC instance 1 authentication results sealed by %s\n", f.Name, name, sealer)
+	return results
+}
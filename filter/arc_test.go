@@ -0,0 +1,63 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func arcInput(oldest, latest string) []string {
+	return []string{
+		"ARC-Seal: i=2; a=rsa-sha256; cv=" + latest + "; d=lists.example.net; s=arc; t=1700000000; b=c2ln",
+		"ARC-Authentication-Results: i=2; mx.lists.example.net; spf=pass smtp.mailfrom=lists.example.net; arc=pass",
+		"ARC-Seal: i=1; a=rsa-sha256; cv=" + oldest + "; d=lists.example.net; s=arc; t=1699999999; b=c2ln",
+		"ARC-Authentication-Results: i=1; mx.lists.example.net;",
+		"\tspf=pass smtp.mailfrom=example.org; dkim=pass header.d=example.org; dmarc=pass header.from=example.org",
+		"Authentication-Results: mx.localdomain.ext; spf=fail smtp.mailfrom=example.org; dmarc=fail header.from=example.org; arc=pass",
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+}
+
+func TestARCTrustForwarded(t *testing.T) {
+	options := map[string]any{
+		"auth_result_scores":  map[string]any{"spf=fail": 2, "dmarc=fail": 3},
+		"arc_trust_forwarded": true,
+		"authserv_id":         "mx.localdomain.ext",
+	}
+	// the broken spf at the forwarder is ignored for the oldest ARC results
+	output := filterMessage(t, options, arcInput("none", "pass"))
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+
+	// a failed chain falls back to our own results
+	output = filterMessage(t, options, arcInput("none", "fail"))
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+
+	// arc=pass from an untrusted authserv-id is ignored
+	forged := arcInput("none", "pass")
+	forged[5] = "Authentication-Results: mx.localdomain.ext; spf=fail smtp.mailfrom=example.org; dmarc=fail header.from=example.org"
+	forged = append([]string{"Authentication-Results: forged.example.com; arc=pass"}, forged...)
+	output = filterMessage(t, options, forged)
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+
+	options["arc_trust_forwarded"] = false
+	output = filterMessage(t, options, arcInput("none", "pass"))
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+}
+
+func TestARCTrustedSealers(t *testing.T) {
+	options := map[string]any{
+		"auth_result_scores":  map[string]any{"spf=fail": 2, "dmarc=fail": 3},
+		"arc_trust_forwarded": true,
+		"arc_trusted_sealers": []string{"forwarder.example.com"},
+		"authserv_id":         "mx.localdomain.ext",
+	}
+	output := filterMessage(t, options, arcInput("none", "pass"))
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+
+	options["arc_trusted_sealers"] = []string{"Lists.Example.Net"}
+	output = filterMessage(t, options, arcInput("none", "pass"))
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+}
@@ -0,0 +1,20 @@
+package filter
+
+// run blocking work such as a scanner request off the protocol loop; the completion it
+// returns is run on the protocol loop, where all session state is changed
+func (f *Filter) async(work func() func()) {
+	f.inflight++
+	go func() {
+		done := work()
+		select {
+		case f.completions <- done:
+		case <-f.stopped:
+		}
+	}()
+}
+
+// run a completion received from async work
+func (f *Filter) complete(done func()) {
+	f.inflight--
+	done()
+}
@@ -0,0 +1,251 @@
+package filter
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rstms/rspamd-classes/classes"
+)
+
+const DEFAULT_AUDIT_SERVER = "localhost:587"
+const DEFAULT_AUDIT_MAX_BYTES = 10 * 1024 * 1024
+const DEFAULT_AUDIT_TIMEOUT = "30s"
+const DEFAULT_AUDIT_MAX_PENDING = 4
+const AUDIT_HEADER = "X-Spam-Audit"
+
+const COUNTER_AUDITED = "audited"
+const COUNTER_AUDIT_FAILED = "audit_failed"
+
+// copies of classified messages submitted to an administrator mailbox
+//
+//	audit_address:   recipient of the copies; auditing is disabled when unset
+//	audit_classes:   classes of the messages copied, default the highest class
+//	audit_server:    SMTP submission endpoint, default DEFAULT_AUDIT_SERVER
+//	audit_username:  optional submission login
+//	audit_password:  password for audit_username
+//	audit_from:      envelope sender of the copies, default the null sender
+//	audit_max_bytes:   messages larger than this are not copied
+//	audit_timeout:     time allowed for each submission, default DEFAULT_AUDIT_TIMEOUT
+//	audit_max_pending: submissions in progress at once, default DEFAULT_AUDIT_MAX_PENDING
+//
+// each copy is prefixed with an AUDIT_HEADER line naming the original envelope; messages
+// addressed to audit_address are never copied, so resubmitted copies do not loop; copies
+// beyond audit_max_pending are dropped and counted as failed
+type Audit struct {
+	Address    string
+	Classes    map[string]bool
+	Server     string
+	Username   string
+	From       string
+	MaxBytes   int
+	MaxPending int
+	password   string
+	timeout    time.Duration
+	send       func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+	pending    chan struct{}
+	wg         sync.WaitGroup
+}
+
+// a message buffered for an audit copy
+type auditCapture struct {
+	Lines []string
+	Size  int
+	Class string
+}
+
+func newAudit() (*Audit, error) {
+	address := ViperGetString("audit_address")
+	if address == "" {
+		return nil, nil
+	}
+	if !EMAIL_ADDRESS_PATTERN.MatchString(address) {
+		return nil, fmt.Errorf("invalid audit_address: '%s'", address)
+	}
+	ViperSetDefault("audit_classes", []string{classes.MAX_NAME})
+	ViperSetDefault("audit_server", DEFAULT_AUDIT_SERVER)
+	ViperSetDefault("audit_max_bytes", DEFAULT_AUDIT_MAX_BYTES)
+	ViperSetDefault("audit_timeout", DEFAULT_AUDIT_TIMEOUT)
+	ViperSetDefault("audit_max_pending", DEFAULT_AUDIT_MAX_PENDING)
+	a := Audit{
+		Address:    strings.ToLower(address),
+		Classes:    make(map[string]bool),
+		Server:     ViperGetString("audit_server"),
+		Username:   ViperGetString("audit_username"),
+		From:       ViperGetString("audit_from"),
+		MaxBytes:   ViperGetInt("audit_max_bytes"),
+		MaxPending: ViperGetInt("audit_max_pending"),
+		password:   ViperGetString("audit_password"),
+	}
+	a.send = a.sendMail
+	for _, class := range ViperGetStringSlice("audit_classes") {
+		a.Classes[class] = true
+	}
+	_, _, err := net.SplitHostPort(a.Server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid audit_server: %v", err)
+	}
+	a.timeout, err = time.ParseDuration(ViperGetString("audit_timeout"))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing audit_timeout: %v", err)
+	}
+	if a.timeout <= 0 {
+		return nil, fmt.Errorf("invalid audit_timeout: %v", a.timeout)
+	}
+	if a.MaxPending < 1 {
+		return nil, fmt.Errorf("invalid audit_max_pending: %d", a.MaxPending)
+	}
+	a.pending = make(chan struct{}, a.MaxPending)
+	return &a, nil
+}
+
+// submit a message like smtp.SendMail, bounding the connection and the whole session by audit_timeout
+func (a *Audit) sendMail(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	deadline := time.Now().Add(a.timeout)
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	host, _, _ := net.SplitHostPort(addr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	ok, _ := client.Extension("STARTTLS")
+	if ok {
+		err = client.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		err = client.Auth(auth)
+		if err != nil {
+			return err
+		}
+	}
+	err = client.Mail(from)
+	if err != nil {
+		return err
+	}
+	for _, address := range to {
+		err = client.Rcpt(address)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// start buffering an audit copy of a classified message
+func (f *Filter) startAudit(message *Message, spamClass string) {
+	if f.audit == nil || !f.audit.Classes[spamClass] {
+		return
+	}
+	for _, address := range message.EnvelopeTo {
+		if strings.EqualFold(address, f.audit.Address) {
+			return
+		}
+	}
+	message.Audit = &auditCapture{Class: spamClass}
+}
+
+func (f *Filter) captureAudit(name string, session *Session, message *Message, lines []string) {
+	capture := message.Audit
+	for _, line := range lines {
+		if line == "." {
+			message.Audit = nil
+			f.sendAudit(name, session, message, capture)
+			return
+		}
+		// data lines are dot-stuffed
+		if strings.HasPrefix(line, "..") {
+			line = line[1:]
+		}
+		capture.Size += len(line) + 2
+		if capture.Size > f.audit.MaxBytes {
+			Warning("%s.%s: message exceeds audit_max_bytes (%d); not copied", f.Name, name, f.audit.MaxBytes)
+			message.Audit = nil
+			return
+		}
+		capture.Lines = append(capture.Lines, line)
+	}
+}
+
+// return an envelope address list as <a>,<b>; an empty list is the null address <>
+func auditAddresses(addresses []string) string {
+	if len(addresses) == 0 {
+		return "<>"
+	}
+	return "<" + strings.Join(addresses, ">,<") + ">"
+}
+
+// submit the audit copy without blocking the filter
+func (f *Filter) sendAudit(name string, session *Session, message *Message, capture *auditCapture) {
+	header := fmt.Sprintf("%s: class=%s session=%s message=%s from=%s to=%s", AUDIT_HEADER, capture.Class, session.Id, message.Id,
+		auditAddresses(message.EnvelopeFrom), auditAddresses(message.EnvelopeTo))
+	data := []byte(header + "\r\n" + strings.Join(capture.Lines, "\r\n") + "\r\n")
+	var auth smtp.Auth
+	if f.audit.Username != "" {
+		host, _, _ := net.SplitHostPort(f.audit.Server)
+		auth = smtp.PlainAuth("", f.audit.Username, f.audit.password, host)
+	}
+	select {
+	case f.audit.pending <- struct{}{}:
+	default:
+		f.count(COUNTER_AUDIT_FAILED)
+		Warning("%s.%s: %d audit copies pending; not copied", f.Name, name, f.audit.MaxPending)
+		return
+	}
+	f.audit.wg.Add(1)
+	go func() {
+		defer f.audit.wg.Done()
+		defer func() { <-f.audit.pending }()
+		err := f.audit.send(f.audit.Server, auth, f.audit.From, []string{f.audit.Address}, data)
+		if err != nil {
+			f.count(COUNTER_AUDIT_FAILED)
+			Warning("%s.%s: audit copy to %s failed: %v", f.Name, name, f.audit.Address, err)
+			return
+		}
+		f.count(COUNTER_AUDITED)
+		log.Printf("%s.%s: audit copy sent to %s\n", f.Name, name, f.audit.Address)
+	}()
+}
+
+// wait up to audit_timeout for pending audit copies when the filter stops
+func (f *Filter) waitAudit() {
+	if f.audit == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		f.audit.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(f.audit.timeout):
+		Warning("%s: abandoned pending audit copies after %v", f.Name, f.audit.timeout)
+	}
+}
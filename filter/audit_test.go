@@ -0,0 +1,186 @@
+package filter
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testSubmission struct {
+	Server string
+	From   string
+	To     []string
+	Data   string
+}
+
+// return a send function recording submissions, failing when fail is set
+func testAuditSender(fail bool) (func(string, smtp.Auth, string, []string, []byte) error, func() []testSubmission) {
+	var lock sync.Mutex
+	sent := []testSubmission{}
+	send := func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if fail {
+			return fmt.Errorf("connection refused")
+		}
+		sent = append(sent, testSubmission{Server: addr, From: from, To: to, Data: string(msg)})
+		return nil
+	}
+	return send, func() []testSubmission {
+		lock.Lock()
+		defer lock.Unlock()
+		return sent
+	}
+}
+
+func TestAuditCopy(t *testing.T) {
+	options := map[string]any{
+		"audit_address": "admin@localdomain.ext",
+		"audit_classes": []string{"spam", "suspected_spam"},
+		"audit_server":  "mail.localdomain.ext:587",
+	}
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"Subject: audit test",
+		"",
+		"..dot stuffed line",
+	}
+	run := func(fail bool) (string, *Filter, []testSubmission) {
+		var output strings.Builder
+		f := newTestFilter(t, options, messageInput(data), &output)
+		send, sent := testAuditSender(fail)
+		f.audit.send = send
+		f.Run()
+		return output.String(), f, sent()
+	}
+	_, f, sent := run(false)
+	require.Empty(t, sent)
+	require.Equal(t, int64(0), f.Counter(COUNTER_AUDITED))
+
+	data[0] = "X-Spam-Score: 7.2 / 100"
+	output, f, sent := run(false)
+	require.Len(t, sent, 1)
+	require.Equal(t, "mail.localdomain.ext:587", sent[0].Server)
+	require.Equal(t, "", sent[0].From)
+	require.Equal(t, []string{"admin@localdomain.ext"}, sent[0].To)
+	require.True(t, strings.HasPrefix(sent[0].Data, "X-Spam-Audit: class=suspected_spam session=deadbeef message=cafebabe from=<fromuser@example.org> to=<touser@localdomain.ext>\r\n"))
+	require.Contains(t, sent[0].Data, "\r\nX-Spam-Class: suspected_spam\r\n")
+	require.Contains(t, sent[0].Data, "\r\nSubject: audit test\r\n")
+	require.True(t, strings.HasSuffix(sent[0].Data, "\r\n.dot stuffed line\r\n"))
+	require.Equal(t, int64(1), f.Counter(COUNTER_AUDITED))
+	// the original message is delivered unchanged
+	require.Contains(t, filteredLines(t, output), "..dot stuffed line")
+
+	_, f, _ = run(true)
+	require.Equal(t, int64(1), f.Counter(COUNTER_AUDIT_FAILED))
+
+	// address lists are formatted alike
+	send, copies := testAuditSender(false)
+	f.audit.send = send
+	message := &Message{Id: "cafebabe", EnvelopeFrom: []string{"a@example.org", "b@example.org"}, EnvelopeTo: []string{"c@localdomain.ext", "d@localdomain.ext"}}
+	f.sendAudit("test", &Session{Id: "deadbeef"}, message, &auditCapture{Class: "spam"})
+	f.waitAudit()
+	require.Len(t, copies(), 1)
+	require.True(t, strings.HasPrefix(copies()[0].Data, "X-Spam-Audit: class=spam session=deadbeef message=cafebabe from=<a@example.org>,<b@example.org> to=<c@localdomain.ext>,<d@localdomain.ext>\r\n"))
+	require.Equal(t, "<>", auditAddresses(nil))
+}
+
+func TestAuditNoLoop(t *testing.T) {
+	data := []string{
+		"X-Spam-Score: 50 / 100",
+		"To: admin@localdomain.ext",
+		"",
+		"body",
+	}
+	var output strings.Builder
+	f := newTestFilter(t, map[string]any{"audit_address": "Admin@localdomain.ext"}, messageInput(data), &output)
+	send, sent := testAuditSender(false)
+	f.audit.send = send
+	f.Run()
+	require.Empty(t, sent())
+}
+
+func TestAuditInvalidServer(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"audit_address": "admin@localdomain.ext", "audit_server": "localhost"})
+	_, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.NotNil(t, err)
+}
+
+func TestAuditStalledServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+	// accept connections but never send the greeting
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	options := map[string]any{
+		"audit_address": "admin@localdomain.ext",
+		"audit_server":  listener.Addr().String(),
+		"audit_timeout": "200ms",
+	}
+	data := []string{
+		"X-Spam-Score: 50 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	f := newTestFilter(t, options, messageInput(data), io.Discard)
+	start := time.Now()
+	f.Run()
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.Eventually(t, func() bool { return f.Counter(COUNTER_AUDIT_FAILED) == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestAuditMaxPending(t *testing.T) {
+	options := map[string]any{
+		"audit_address":     "admin@localdomain.ext",
+		"audit_max_pending": 1,
+		"audit_timeout":     "200ms",
+	}
+	f := newTestFilter(t, options, "", io.Discard)
+	release := make(chan struct{})
+	f.audit.send = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		<-release
+		return nil
+	}
+	session := &Session{Id: "deadbeef"}
+	message := &Message{Id: "cafebabe"}
+	f.sendAudit("test", session, message, &auditCapture{Class: "spam"})
+	f.sendAudit("test", session, message, &auditCapture{Class: "spam"})
+	require.Equal(t, int64(1), f.Counter(COUNTER_AUDIT_FAILED))
+	// the shutdown wait is bounded while a submission is stalled
+	start := time.Now()
+	f.waitAudit()
+	require.Less(t, time.Since(start), 5*time.Second)
+	close(release)
+}
+
+func TestAuditInvalidOptions(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	for _, options := range []map[string]any{
+		{"audit_address": "admin@localdomain.ext", "audit_timeout": "soon"},
+		{"audit_address": "admin@localdomain.ext", "audit_timeout": "0s"},
+		{"audit_address": "admin@localdomain.ext", "audit_timeout": "30s", "audit_max_pending": 0},
+	} {
+		setTestOptions(t, options)
+		_, err := NewFilter(strings.NewReader(""), io.Discard)
+		require.NotNil(t, err)
+	}
+}
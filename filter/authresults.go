@@ -0,0 +1,173 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const COUNTER_AUTH_RESULTS_PENALIZED = "auth_results_penalized"
+
+var AUTH_RESULT_PATTERN = regexp.MustCompile(`^([a-zA-Z0-9_.-]+)(?:/[0-9]+)?\s*=\s*([a-zA-Z0-9_-]+)`)
+var DMARC_POLICY_PATTERN = regexp.MustCompile(`\b(?:policy|p|policy\.dmarc)\s*=\s*([a-zA-Z]+)`)
+
+// score adjustments for upstream SPF, DKIM and DMARC results
+//
+//	auth_result_scores:        map of method=result to the score added, e.g. spf=fail, dkim=fail,
+//	                           dmarc=fail; a failed DMARC check also matches dmarc=<policy>, as in
+//	                           dmarc=quarantine or dmarc=reject
+//	auth_results_authserv_ids: authserv-ids whose Authentication-Results headers are trusted,
+//	                           here and for allowlist address entries, default authserv_id or
+//	                           the host FQDN; arc=pass is only believed from a trusted authserv-id
+//	arc_trust_forwarded:       score forwarded mail by the results of its oldest ARC instance
+//	arc_trusted_sealers:       domains whose ARC seals are trusted; any when unset
+//
+// each method=result adds its score once however many headers or signatures report it
+type authResultScores struct {
+	Scores     map[string]float32
+	ARCTrust   bool
+	ARCSealers map[string]bool
+}
+
+func newAuthResultScores() (*authResultScores, error) {
+	scores := map[string]float64{}
+	err := viper.UnmarshalKey(ViperKey("auth_result_scores"), &scores)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing auth_result_scores: %v", err)
+	}
+	if len(scores) == 0 {
+		return nil, nil
+	}
+	a := authResultScores{
+		Scores:     make(map[string]float32),
+		ARCTrust:   ViperGetBool("arc_trust_forwarded"),
+		ARCSealers: make(map[string]bool),
+	}
+	for _, domain := range ViperGetStringSlice("arc_trusted_sealers") {
+		a.ARCSealers[strings.ToLower(domain)] = true
+	}
+	for key, score := range scores {
+		key = strings.ToLower(strings.ReplaceAll(key, " ", ""))
+		if !AUTH_RESULT_PATTERN.MatchString(key) {
+			return nil, fmt.Errorf("invalid auth_result_scores key: '%s'", key)
+		}
+		a.Scores[key] = float32(score)
+	}
+	return &a, nil
+}
+
+// return the authserv-ids whose Authentication-Results headers are trusted; upstream results
+// are forgeable by any sender, so without auth_results_authserv_ids only our own are trusted
+func (f *Filter) newAuthservIDs() (map[string]bool, error) {
+	authservs := make(map[string]bool)
+	ids := ViperGetStringSlice("auth_results_authserv_ids")
+	if len(ids) == 0 && f.usesAuthResults() {
+		id := f.authservId
+		if id == "" {
+			var err error
+			id, err = HostFQDN()
+			if err != nil {
+				return nil, fmt.Errorf("auth_results_authserv_ids unset and hostname lookup failed: %v", err)
+			}
+		}
+		ids = []string{id}
+	}
+	for _, id := range ids {
+		authservs[strings.ToLower(id)] = true
+	}
+	return authservs, nil
+}
+
+// true if Authentication-Results headers are recorded, for scoring or for the allowlist
+func (f *Filter) usesAuthResults() bool {
+	if f.authScores != nil {
+		return true
+	}
+	for _, list := range f.senderLists {
+		if list.Name == "allowlist" {
+			return true
+		}
+	}
+	return false
+}
+
+// return the method=result keys of an unfolded Authentication-Results header value,
+// or false if its authserv-id is not trusted
+func (f *Filter) parseAuthResultsValue(value string) ([]string, bool) {
+	fields := strings.Split(value, ";")
+	authserv := strings.ToLower(strings.Fields(strings.TrimSpace(fields[0]) + " ")[0])
+	if !f.authservs[authserv] {
+		return nil, false
+	}
+	return authResultKeys(fields[1:]), true
+}
+
+// return the method=result keys of Authentication-Results resinfo fields
+func authResultKeys(fields []string) []string {
+	keys := []string{}
+	for _, field := range fields {
+		groups := AUTH_RESULT_PATTERN.FindStringSubmatch(strings.TrimSpace(field))
+		if len(groups) != 3 {
+			continue
+		}
+		method := strings.ToLower(groups[1])
+		result := strings.ToLower(groups[2])
+		keys = append(keys, method+"="+result)
+		if method == "dmarc" && result == "fail" {
+			policy := DMARC_POLICY_PATTERN.FindStringSubmatch(field)
+			if len(policy) == 2 {
+				keys = append(keys, "dmarc="+strings.ToLower(policy[1]))
+			}
+		}
+	}
+	return keys
+}
+
+// record the results of an Authentication-Results header line
+func (f *Filter) parseAuthResults(name string, message *Message, line string) {
+	_, value, _ := strings.Cut(line, ":")
+	keys, trusted := f.parseAuthResultsValue(value)
+	if !trusted {
+		if f.verbose {
+			log.Printf("%s.%s: ignoring untrusted Authentication-Results: %s\n", f.Name, name, line)
+		}
+		return
+	}
+	for _, key := range keys {
+		found := false
+		for _, existing := range message.AuthResults {
+			if existing == key {
+				found = true
+			}
+		}
+		if !found {
+			message.AuthResults = append(message.AuthResults, key)
+		}
+	}
+}
+
+// return the sum of the configured offsets for a message's authentication results
+func (f *Filter) authResultsScore(name string, message *Message) float32 {
+	if f.authScores == nil {
+		return 0
+	}
+	var score float32
+	matched := []string{}
+	for _, key := range f.trustedAuthResults(name, message) {
+		offset, ok := f.authScores.Scores[key]
+		if ok {
+			score += offset
+			matched = append(matched, key)
+		}
+	}
+	if len(matched) > 0 {
+		sort.Strings(matched)
+		f.count(COUNTER_AUTH_RESULTS_PENALIZED)
+		log.Printf("%s.%s: authentication results %s add %v to score\n", f.Name, name, strings.Join(matched, ","), score)
+	}
+	return score
+}
@@ -0,0 +1,98 @@
+package filter
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthResultScores(t *testing.T) {
+	options := map[string]any{
+		"auth_result_scores": map[string]any{
+			"spf=fail":     1,
+			"dkim=fail":    2,
+			"dmarc=fail":   1,
+			"dmarc=reject": 3,
+		},
+		"authserv_id": "mx.localdomain.ext",
+	}
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	output := filterMessage(t, options, append([]string{"Authentication-Results: mx.localdomain.ext; spf=pass smtp.mailfrom=example.org; dkim=pass header.d=example.org"}, data...))
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+
+	// 1.155 + 2 for dkim=fail, once for both signatures, + 1 for spf=fail
+	output = filterMessage(t, options, append([]string{
+		"Authentication-Results: mx.localdomain.ext;",
+		"\tspf=fail smtp.mailfrom=example.org;",
+		"\tdkim=fail header.d=example.org; dkim=fail header.d=other.example",
+	}, data...))
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+
+	// + 1 for dmarc=fail and + 3 for the reject policy reaches suspected_spam
+	output = filterMessage(t, options, append([]string{
+		"Authentication-Results: mx.localdomain.ext; dmarc=fail reason=\"No valid SPF\" header.from=example.org (policy=reject)",
+	}, data...))
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+}
+
+func TestAuthResultsAuthservIds(t *testing.T) {
+	options := map[string]any{
+		"auth_result_scores":        map[string]any{"dmarc=fail": 5},
+		"auth_results_authserv_ids": []string{"mx.localdomain.ext"},
+	}
+	data := []string{
+		"Authentication-Results: forged.example.com; dmarc=fail header.from=example.org",
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	output := filterMessage(t, options, data)
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+
+	data[0] = "Authentication-Results: MX.localdomain.ext 1; dmarc=fail header.from=example.org"
+	output = filterMessage(t, options, data)
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+}
+
+func TestAuthResultsDefaultAuthserv(t *testing.T) {
+	options := map[string]any{"auth_result_scores": map[string]any{"dmarc=fail": 5}}
+	hostname, err := HostFQDN()
+	if err != nil {
+		// without a host FQDN the authserv-ids must be configured
+		Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+		setTestOptions(t, options)
+		_, err = NewFilter(strings.NewReader(""), io.Discard)
+		require.ErrorContains(t, err, "auth_results_authserv_ids")
+		return
+	}
+	data := []string{
+		"Authentication-Results: mx.localdomain.ext; dmarc=fail header.from=example.org",
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	// only results from this host are trusted when no authserv-ids are configured
+	output := filterMessage(t, options, data)
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+
+	data[0] = "Authentication-Results: " + hostname + "; dmarc=fail header.from=example.org"
+	output = filterMessage(t, options, data)
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+}
+
+func TestAuthResultScoresInvalid(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"auth_result_scores": map[string]any{"spf": 1}})
+	_, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.NotNil(t, err)
+}
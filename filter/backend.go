@@ -0,0 +1,169 @@
+package filter
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rstms/rspamd-classes/classes"
+)
+
+const CLASS_CONFIG_BACKEND_FILE = "file"
+const CLASS_CONFIG_BACKEND_REDIS = "redis"
+const CLASS_CONFIG_BACKEND_SQLITE = "sqlite"
+const CLASS_CONFIG_BACKEND_LDAP = "ldap"
+const DEFAULT_CLASS_BACKEND_CACHE_TTL = "60s"
+const DEFAULT_CLASS_BACKEND_ERROR_TTL = "30s"
+const DEFAULT_CLASS_BACKEND_CACHE_SIZE = 1000
+
+// ClassBackend looks up the class list for a single recipient address,
+// returning false if the backend has no entry for address
+type ClassBackend interface {
+	Lookup(address string) ([]classes.SpamClass, bool, error)
+}
+
+// a backend result remembered until expires
+type backendEntry struct {
+	address string
+	list    []classes.SpamClass
+	found   bool
+	failed  bool
+	expires time.Time
+}
+
+// remember backend lookups, including misses, for class_backend_cache_ttl, and failures
+// for class_backend_error_ttl, evicting the least recently used entry beyond
+// class_backend_cache_size; an unavailable backend is then queried once per error ttl
+// rather than on every lookup of a message
+type backendCache struct {
+	backend  ClassBackend
+	ttl      time.Duration
+	errorTTL time.Duration
+	size     int
+	lock     sync.Mutex
+	entries  map[string]*list.Element
+	recent   *list.List
+}
+
+// return the backend selected by class_config_backend, or nil for the class config file alone
+func newClassBackend() (*backendCache, error) {
+	ViperSetDefault("class_config_backend", CLASS_CONFIG_BACKEND_FILE)
+	ViperSetDefault("class_backend_cache_ttl", DEFAULT_CLASS_BACKEND_CACHE_TTL)
+	ViperSetDefault("class_backend_error_ttl", DEFAULT_CLASS_BACKEND_ERROR_TTL)
+	ViperSetDefault("class_backend_cache_size", DEFAULT_CLASS_BACKEND_CACHE_SIZE)
+	var backend ClassBackend
+	var err error
+	name := strings.ToLower(ViperGetString("class_config_backend"))
+	switch name {
+	case CLASS_CONFIG_BACKEND_FILE:
+		return nil, nil
+	case CLASS_CONFIG_BACKEND_REDIS:
+		backend, err = newRedisBackend()
+	case CLASS_CONFIG_BACKEND_SQLITE:
+		backend, err = newSQLiteBackend()
+	case CLASS_CONFIG_BACKEND_LDAP:
+		backend, err = newLDAPBackend()
+	default:
+		return nil, fmt.Errorf("unknown class_config_backend: %s", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := time.ParseDuration(ViperGetString("class_backend_cache_ttl"))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing class_backend_cache_ttl: %v", err)
+	}
+	errorTTL, err := time.ParseDuration(ViperGetString("class_backend_error_ttl"))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing class_backend_error_ttl: %v", err)
+	}
+	return newBackendCache(backend, ttl, errorTTL, ViperGetInt("class_backend_cache_size")), nil
+}
+
+func newBackendCache(backend ClassBackend, ttl, errorTTL time.Duration, size int) *backendCache {
+	return &backendCache{
+		backend:  backend,
+		ttl:      ttl,
+		errorTTL: errorTTL,
+		size:     size,
+		entries:  make(map[string]*list.Element),
+		recent:   list.New(),
+	}
+}
+
+// return the cached lookup for address, querying the backend when absent or expired;
+// the error of a failed query is returned once, the cached failure then reading as a miss
+func (c *backendCache) lookup(address string, now time.Time) ([]classes.SpamClass, bool, error) {
+	c.lock.Lock()
+	element, ok := c.entries[address]
+	if ok {
+		entry := element.Value.(*backendEntry)
+		if now.Before(entry.expires) {
+			c.recent.MoveToFront(element)
+			c.lock.Unlock()
+			return entry.list, entry.found, nil
+		}
+	}
+	c.lock.Unlock()
+	spamClasses, found, err := c.backend.Lookup(address)
+	if err != nil {
+		c.store(&backendEntry{address: address, failed: true, expires: now.Add(c.errorTTL)})
+		return nil, false, err
+	}
+	if found {
+		spamClasses = normalizeClassList(spamClasses)
+	}
+	c.store(&backendEntry{address: address, list: spamClasses, found: found, expires: now.Add(c.ttl)})
+	return spamClasses, found, nil
+}
+
+// add or replace a cache entry, evicting the least recently used beyond the cache size
+func (c *backendCache) store(entry *backendEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, ok := c.entries[entry.address]
+	if ok {
+		c.recent.Remove(element)
+	}
+	c.entries[entry.address] = c.recent.PushFront(entry)
+	for c.size > 0 && c.recent.Len() > c.size {
+		oldest := c.recent.Back()
+		c.recent.Remove(oldest)
+		delete(c.entries, oldest.Value.(*backendEntry).address)
+	}
+}
+
+// apply the classes library validation to a backend class list
+func normalizeClassList(classList []classes.SpamClass) []classes.SpamClass {
+	spamClasses := classes.SpamClasses{Classes: make(map[string][]classes.SpamClass)}
+	return spamClasses.SetClasses(classes.DEFAULT_NAME, classList)
+}
+
+// query class lists from backend ahead of the class config file
+func (f *Filter) SetClassBackend(backend ClassBackend) {
+	ttl, err := time.ParseDuration(ViperGetString("class_backend_cache_ttl"))
+	if err != nil {
+		Warning("%s: failed parsing class_backend_cache_ttl: %v", f.Name, err)
+	}
+	errorTTL, err := time.ParseDuration(ViperGetString("class_backend_error_ttl"))
+	if err != nil {
+		Warning("%s: failed parsing class_backend_error_ttl: %v", f.Name, err)
+	}
+	f.backend = newBackendCache(backend, ttl, errorTTL, ViperGetInt("class_backend_cache_size"))
+}
+
+// return the class list for address from the class backend;
+// backend failures fall back to the class config file
+func (f *Filter) backendClasses(address string) ([]classes.SpamClass, bool) {
+	if f.backend == nil {
+		return nil, false
+	}
+	classList, found, err := f.backend.lookup(address, f.now())
+	if err != nil {
+		Warning("%s: class backend lookup for %s failed: %v", f.Name, address, err)
+		return nil, false
+	}
+	return classList, found
+}
@@ -0,0 +1,86 @@
+package filter
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rstms/rspamd-classes/classes"
+	"github.com/stretchr/testify/require"
+)
+
+type testBackend struct {
+	entries map[string][]classes.SpamClass
+	err     error
+	lookups int
+}
+
+func (b *testBackend) Lookup(address string) ([]classes.SpamClass, bool, error) {
+	b.lookups++
+	if b.err != nil {
+		return nil, false, b.err
+	}
+	list, ok := b.entries[address]
+	return list, ok, nil
+}
+
+func TestClassBackend(t *testing.T) {
+	f := newTestFilter(t, map[string]any{"class_backend_cache_ttl": "1m"}, "", io.Discard)
+	now := time.Now()
+	f.now = func() time.Time { return now }
+	backend := &testBackend{entries: map[string][]classes.SpamClass{
+		"touser@localdomain.ext": {{Name: "backend", Score: 50}},
+	}}
+	f.SetClassBackend(backend)
+
+	// backend entries take precedence over the class config file, misses fall back to it
+	require.Equal(t, "backend", f.getClass([]string{"touser@localdomain.ext"}, 1.155))
+	require.Equal(t, "spam", f.getClass([]string{"touser@localdomain.ext"}, 50))
+	require.Equal(t, "possible", f.getClass([]string{"username@example.org"}, 1.155))
+	_, configured := f.classKey(f.getClasses(), "touser@localdomain.ext")
+	require.True(t, configured)
+
+	// results, including misses, are cached until the ttl expires
+	require.Equal(t, 2, backend.lookups)
+	backend.entries["touser@localdomain.ext"] = []classes.SpamClass{{Name: "changed", Score: 50}}
+	require.Equal(t, "backend", f.getClass([]string{"touser@localdomain.ext"}, 1.155))
+	now = now.Add(2 * time.Minute)
+	require.Equal(t, "changed", f.getClass([]string{"touser@localdomain.ext"}, 1.155))
+
+	// backend failures fall back to the class config file, and are cached for the error ttl
+	backend.err = errors.New("unavailable")
+	now = now.Add(2 * time.Minute)
+	lookups := backend.lookups
+	require.Equal(t, "applied_class", f.getClass([]string{"touser@localdomain.ext"}, 1.155))
+	require.Equal(t, "suspected_spam", f.getClass([]string{"touser@localdomain.ext"}, 7.2))
+	require.Equal(t, lookups+1, backend.lookups)
+	now = now.Add(time.Minute)
+	require.Equal(t, "applied_class", f.getClass([]string{"touser@localdomain.ext"}, 1.155))
+	require.Equal(t, lookups+2, backend.lookups)
+}
+
+func TestClassBackendUnknown(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"class_config_backend": "carrier_pigeon"})
+	_, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.NotNil(t, err)
+}
+
+func TestClassBackendCacheSize(t *testing.T) {
+	backend := &testBackend{entries: map[string][]classes.SpamClass{}}
+	cache := newBackendCache(backend, time.Minute, time.Second, 2)
+	now := time.Now()
+	for _, address := range []string{"a@example.org", "b@example.org", "a@example.org", "c@example.org"} {
+		_, _, err := cache.lookup(address, now)
+		require.Nil(t, err)
+	}
+	require.Equal(t, 3, backend.lookups)
+
+	// b was least recently used when c was added
+	require.Len(t, cache.entries, 2)
+	require.Contains(t, cache.entries, "a@example.org")
+	require.Contains(t, cache.entries, "c@example.org")
+}
@@ -0,0 +1,186 @@
+package filter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rstms/rspamd-classes/classes"
+)
+
+const CLAMD_ACTION_CLASS = "class"
+const CLAMD_ACTION_REJECT = "reject"
+
+const DEFAULT_CLAMD_TIMEOUT = "30s"
+const DEFAULT_CLAMD_STATUS = "554 5.7.1 Message rejected: virus detected"
+const DEFAULT_VIRUS_HEADER = "X-Virus-Status"
+const CLAMD_CHUNK_SIZE = 64 * 1024
+
+const VIRUS_STATUS_CLEAN = "Clean"
+
+const COUNTER_VIRUS_FOUND = "virus_found"
+const COUNTER_CLAMD_FAILED = "clamd_failed"
+
+// ClamAV virus scanning of buffered messages
+//
+//	clamd_address:   host:port or unix socket path of clamd; scanning is disabled when unset
+//	clamd_timeout:   connection timeout, default DEFAULT_CLAMD_TIMEOUT
+//	clamd_max_bytes: larger messages are passed unscanned; keep within clamd's StreamMaxLength
+//	clamd_action:    class (force clamd_class) or reject (refuse at commit)
+//	clamd_class:     class forced for infected messages, default classes.MAX_NAME
+//	clamd_status:    SMTP status returned for rejected messages
+//	virus_header:    header reporting the result, default DEFAULT_VIRUS_HEADER
+//
+// messages are streamed to clamd with the INSTREAM command off the protocol loop, alongside
+// the score sources; the header value is Clean or Infected (<signature>), and upstream copies
+// of the header are stripped
+type ClamAV struct {
+	Network  string
+	Address  string
+	Action   string
+	Class    string
+	Status   string
+	Header   string
+	MaxBytes int
+	timeout  time.Duration
+}
+
+// return the clamd client, or nil if clamd_address is unset
+func newClamAV() (*ClamAV, error) {
+	address := ViperGetString("clamd_address")
+	if address == "" {
+		return nil, nil
+	}
+	ViperSetDefault("clamd_timeout", DEFAULT_CLAMD_TIMEOUT)
+	ViperSetDefault("clamd_max_bytes", DEFAULT_SCAN_MAX_BYTES)
+	ViperSetDefault("clamd_action", CLAMD_ACTION_CLASS)
+	ViperSetDefault("clamd_class", classes.MAX_NAME)
+	ViperSetDefault("clamd_status", DEFAULT_CLAMD_STATUS)
+	ViperSetDefault("virus_header", DEFAULT_VIRUS_HEADER)
+	c := ClamAV{
+		Network:  "tcp",
+		Address:  address,
+		Action:   strings.ToLower(ViperGetString("clamd_action")),
+		Class:    ViperGetString("clamd_class"),
+		Status:   ViperGetString("clamd_status"),
+		Header:   ViperGetString("virus_header"),
+		MaxBytes: ViperGetInt("clamd_max_bytes"),
+	}
+	if strings.HasPrefix(address, "/") {
+		c.Network = "unix"
+	} else {
+		_, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid clamd_address: %v", err)
+		}
+	}
+	switch c.Action {
+	case CLAMD_ACTION_CLASS, CLAMD_ACTION_REJECT:
+	default:
+		return nil, fmt.Errorf("unknown clamd_action: %s", c.Action)
+	}
+	if !REJECT_STATUS_PATTERN.MatchString(c.Status) {
+		return nil, fmt.Errorf("invalid clamd_status: %q", c.Status)
+	}
+	timeout, err := time.ParseDuration(ViperGetString("clamd_timeout"))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing clamd_timeout: %v", err)
+	}
+	c.timeout = timeout
+	return &c, nil
+}
+
+// stream a message to clamd, returning the signature found or "" if it is clean
+func (c *ClamAV) Scan(data []byte) (string, error) {
+	conn, err := net.DialTimeout(c.Network, c.Address, c.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	_, err = conn.Write([]byte("zINSTREAM\x00"))
+	if err != nil {
+		return "", err
+	}
+	for len(data) > 0 {
+		chunk := data[:min(len(data), CLAMD_CHUNK_SIZE)]
+		data = data[len(chunk):]
+		err = binary.Write(conn, binary.BigEndian, uint32(len(chunk)))
+		if err != nil {
+			return "", err
+		}
+		_, err = conn.Write(chunk)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = binary.Write(conn, binary.BigEndian, uint32(0))
+	if err != nil {
+		return "", err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\x00')
+	if err != nil {
+		return "", fmt.Errorf("failed reading clamd response: %v", err)
+	}
+	return parseClamdResponse(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parse a clamd INSTREAM reply, e.g. "stream: OK" or "stream: Eicar-Signature FOUND"
+func parseClamdResponse(reply string) (string, error) {
+	_, result, found := strings.Cut(reply, ": ")
+	if !found {
+		return "", fmt.Errorf("unexpected clamd response: %q", reply)
+	}
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd error: %s", result)
+}
+
+// the result of a clamd scan of a held message
+type virusScan struct {
+	Signature string
+	Skipped   bool
+	Err       error
+}
+
+// scan a held message, skipping those over clamd_max_bytes; run off the protocol loop
+func (c *ClamAV) check(data []byte) *virusScan {
+	if len(data) > c.MaxBytes {
+		return &virusScan{Skipped: true}
+	}
+	signature, err := c.Scan(data)
+	return &virusScan{Signature: signature, Err: err}
+}
+
+// record a clamd scan result, returning the virus header line, or "" if the message was not scanned
+func (f *Filter) virusHeader(name string, message *Message, scan *virusScan) string {
+	if scan.Skipped {
+		log.Printf("%s.%s: message exceeds clamd_max_bytes (%d); passing unscanned\n", f.Name, name, f.clamav.MaxBytes)
+		return ""
+	}
+	if scan.Err != nil {
+		f.count(COUNTER_CLAMD_FAILED)
+		Warning("%s.%s: clamd scan failed: %v", f.Name, name, scan.Err)
+		return ""
+	}
+	if scan.Signature == "" {
+		return f.formatHeader(f.clamav.Header, VIRUS_STATUS_CLEAN)
+	}
+	f.count(COUNTER_VIRUS_FOUND)
+	log.Printf("%s.%s: clamd found %s\n", f.Name, name, scan.Signature)
+	message.Virus = scan.Signature
+	return f.formatHeader(f.clamav.Header, "Infected ("+scan.Signature+")")
+}
+
+// true if an infected message is refused at commit
+func (f *Filter) virusRejected(message *Message) bool {
+	return message.Virus != "" && f.clamav != nil && f.clamav.Action == CLAMD_ACTION_REJECT
+}
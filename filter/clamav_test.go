@@ -0,0 +1,183 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// return the address of a clamd test server answering with reply, recording the streamed data
+func testClamdServer(t *testing.T, reply string) (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	streams := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			command, _ := reader.ReadString('\x00')
+			stream := command
+			for {
+				var length uint32
+				err := binary.Read(reader, binary.BigEndian, &length)
+				if err != nil || length == 0 {
+					break
+				}
+				chunk := make([]byte, length)
+				io.ReadFull(reader, chunk)
+				stream += string(chunk)
+			}
+			select {
+			case streams <- stream:
+			default:
+			}
+			conn.Write([]byte(reply + "\x00"))
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String(), streams
+}
+
+func TestClamAVClean(t *testing.T) {
+	address, streams := testClamdServer(t, "stream: OK")
+	options := map[string]any{"clamd_address": address}
+	data := []string{
+		"X-Virus-Status: Clean",
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"..body",
+	}
+	var output strings.Builder
+	f := newTestFilter(t, options, messageInput(data), &output)
+	f.Run()
+	require.Equal(t, "zINSTREAM\x00X-Virus-Status: Clean\r\nX-Spam-Score: 1.155 / 100\r\nTo: touser@localdomain.ext\r\n\r\n.body\r\n", <-streams)
+	lines := filteredLines(t, output.String())
+	require.Equal(t, "X-Virus-Status: Clean", lines[0])
+	require.Equal(t, 1, strings.Count(output.String(), "X-Virus-Status"))
+	require.Contains(t, lines, "X-Spam-Class: applied_class")
+	require.Contains(t, lines, "..body")
+}
+
+func TestClamAVInfected(t *testing.T) {
+	address, _ := testClamdServer(t, "stream: Eicar-Test-Signature FOUND")
+	options := map[string]any{"clamd_address": address}
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	var output strings.Builder
+	f := newTestFilter(t, options, commitInput(data), &output)
+	f.Run()
+	lines := filteredLines(t, output.String())
+	require.Contains(t, lines, "X-Virus-Status: Infected (Eicar-Test-Signature)")
+	require.Contains(t, lines, "X-Spam-Class: spam")
+	require.NotContains(t, output.String(), "register|filter|smtp-in|commit\n")
+	require.Equal(t, int64(1), f.Counter(COUNTER_VIRUS_FOUND))
+
+	options["clamd_action"] = "reject"
+	output.Reset()
+	f = newTestFilter(t, options, commitInput(data), &output)
+	f.Run()
+	require.Contains(t, output.String(), "register|filter|smtp-in|commit\n")
+	require.Contains(t, output.String(), "filter-result|deadbeef|c0ffee|reject|"+DEFAULT_CLAMD_STATUS+"\n")
+}
+
+func TestClamAVFailure(t *testing.T) {
+	address, _ := testClamdServer(t, "stream: Size limit exceeded. ERROR")
+	options := map[string]any{"clamd_address": address}
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	var output strings.Builder
+	f := newTestFilter(t, options, messageInput(data), &output)
+	f.Run()
+	require.NotContains(t, output.String(), "X-Virus-Status")
+	require.Contains(t, filteredLines(t, output.String()), "X-Spam-Class: applied_class")
+	require.Equal(t, int64(1), f.Counter(COUNTER_CLAMD_FAILED))
+}
+
+func TestClamAVConfig(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	for _, options := range []map[string]any{
+		{"clamd_address": "localhost"},
+		{"clamd_address": "localhost:3310", "clamd_action": "drop"},
+		{"clamd_address": "localhost:3310", "clamd_status": "250 ok"},
+	} {
+		setTestOptions(t, options)
+		_, err := NewFilter(strings.NewReader(""), io.Discard)
+		require.NotNil(t, err, options)
+	}
+}
+
+func TestClamAVDoesNotBlockSessions(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	fast := make(chan struct{})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// read to the zero length chunk ending the stream
+				stream := []byte{}
+				buf := make([]byte, 512)
+				for !bytes.HasSuffix(stream, []byte{0, 0, 0, 0}) {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					stream = append(stream, buf[:n]...)
+				}
+				if bytes.Contains(stream, []byte("slow")) {
+					select {
+					case <-fast:
+					case <-time.After(5 * time.Second):
+					}
+					// leave time for the other message to be written
+					time.Sleep(500 * time.Millisecond)
+				} else {
+					close(fast)
+				}
+				conn.Write([]byte("stream: OK\x00"))
+			}()
+		}
+	}()
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+	}
+	other := strings.Split(strings.NewReplacer("deadbeef", "00000002", "cafebabe", "cafe0002").Replace(messageInput(append(data, "fast"))), "\n")
+	input := messageInput(append(data, "slow")) + strings.Join(other[len(initLines):], "\n")
+	var output strings.Builder
+	f := newTestFilter(t, map[string]any{"clamd_address": listener.Addr().String()}, input, &output)
+	start := time.Now()
+	f.Run()
+	require.Less(t, time.Since(start), 5*time.Second)
+	slow := strings.Index(output.String(), "filter-dataline|deadbeef|baadf00d|X-Virus-Status: Clean")
+	fastLine := strings.Index(output.String(), "filter-dataline|00000002|baadf00d|X-Virus-Status: Clean")
+	require.True(t, slow > 0 && fastLine > 0)
+	require.Less(t, fastLine, slow)
+}
@@ -0,0 +1,61 @@
+package filter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// a header added to messages of a class
+type classHeader struct {
+	Name  string
+	Value string
+}
+
+// read option class_headers, mapping class names to lists of "Name: value" header lines
+func newClassHeaders() (map[string][]classHeader, error) {
+	config := map[string][]string{}
+	err := viper.UnmarshalKey(ViperKey("class_headers"), &config)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing class_headers: %v", err)
+	}
+	headers := make(map[string][]classHeader)
+	for class, lines := range config {
+		for _, line := range lines {
+			name, ok := headerName(line)
+			if !ok {
+				return nil, fmt.Errorf("invalid class_headers entry for class %s: '%s'", class, line)
+			}
+			_, value, _ := strings.Cut(line, ":")
+			headers[class] = append(headers[class], classHeader{Name: name, Value: strings.TrimSpace(value)})
+		}
+	}
+	return headers, nil
+}
+
+// return the distinct names of the configured class headers
+func (f *Filter) classHeaderNames() []string {
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, headers := range f.classHeaders {
+		for _, header := range headers {
+			if !seen[strings.ToLower(header.Name)] {
+				seen[strings.ToLower(header.Name)] = true
+				names = append(names, header.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// return the header lines configured for spamClass
+func (f *Filter) spamClassHeaders(spamClass string) []string {
+	lines := []string{}
+	for _, header := range f.classHeaders[spamClass] {
+		lines = append(lines, f.formatHeader(header.Name, header.Value))
+	}
+	return lines
+}
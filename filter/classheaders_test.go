@@ -0,0 +1,55 @@
+package filter
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassHeaders(t *testing.T) {
+	options := map[string]any{"class_headers": map[string]any{
+		"suspected_spam": []string{"X-Sieve-Folder: Junk-Suspect"},
+		"spam":           []string{"X-Sieve-Folder: Junk", "X-Spam-Action: discard"},
+	}}
+	data := []string{
+		"X-Spam-Score: 7.2 / 100",
+		"X-Sieve-Folder: INBOX",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	require.Equal(t, []string{
+		"X-Spam-Score: 7.2 / 100",
+		"To: touser@localdomain.ext",
+		"X-Spam: no",
+		"X-Spam-Class: suspected_spam",
+		"X-Sieve-Folder: Junk-Suspect",
+		"",
+		"body",
+		".",
+	}, filterMessage(t, options, data))
+
+	data[0] = "X-Spam-Score: 50 / 100"
+	output := filterMessage(t, options, data)
+	require.Contains(t, output, "X-Sieve-Folder: Junk")
+	require.Contains(t, output, "X-Spam-Action: discard")
+
+	// classes without configured headers get none, and upstream copies are stripped
+	data[0] = "X-Spam-Score: 1.155 / 100"
+	output = filterMessage(t, options, data)
+	require.NotContains(t, strings.Join(output, "\n"), "X-Sieve-Folder")
+}
+
+func TestClassHeadersInvalid(t *testing.T) {
+	for _, headers := range []map[string]any{
+		{"spam": []string{"not a header"}},
+		{"spam": []string{"X-Spam-Class: spam"}},
+	} {
+		Init("smtpd-filter-addheader", Version, "testdata/config.yaml")
+		setTestOptions(t, map[string]any{"class_headers": headers})
+		_, err := NewFilter(strings.NewReader(""), io.Discard)
+		require.NotNil(t, err)
+	}
+}
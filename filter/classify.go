@@ -0,0 +1,243 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/rstms/rspamd-classes/classes"
+)
+
+// Classifier resolves the spam class for a message's recipients and score
+type Classifier interface {
+	GetClass(recipients []string, score float32) string
+}
+
+// the JSON class config backend
+var _ Classifier = (*classes.SpamClasses)(nil)
+
+// the class config file and class backend thresholds, used unless SetClassifier replaces them
+type configClassifier struct {
+	f *Filter
+}
+
+func (c *configClassifier) GetClass(recipients []string, score float32) string {
+	return c.f.scoreClass(c.f.classList(c.f.getClasses(), recipients), score)
+}
+
+// replace the class config file backend with an alternate classifier; sender, user and
+// auth user class tables apply only to the default classifier
+func (f *Filter) SetClassifier(classifier Classifier) {
+	f.classifier = classifier
+}
+
+// return the default classifier, for alternate classifiers delegating to it
+func (f *Filter) DefaultClassifier() Classifier {
+	return &configClassifier{f: f}
+}
+
+// return the class config keys to try for addresses in lookup order: each exact address,
+// then each regex key matching an address in declaration order, then the domain wildcard
+// keys ("*@domain", then "@domain")
+func (f *Filter) classKeys(addresses []string) []string {
+	keys := append([]string{}, addresses...)
+	for _, pattern := range f.getPatterns() {
+		for _, address := range addresses {
+			if pattern.Regexp.MatchString(address) {
+				keys = append(keys, pattern.Key)
+				break
+			}
+		}
+	}
+	for _, address := range addresses {
+		_, domain, found := strings.Cut(address, "@")
+		if found && domain != "" {
+			keys = append(keys, "*@"+domain, "@"+domain)
+		}
+	}
+	return keys
+}
+
+// return the class config key matching address, or false if only the default applies
+func (f *Filter) classKey(spamClasses *classes.SpamClasses, address string) (string, bool) {
+	_, ok := f.backendClasses(address)
+	if ok {
+		return address, true
+	}
+	for _, key := range f.classKeys([]string{address}) {
+		_, ok := spamClasses.Classes[key]
+		if ok {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// return the class list configured for the first matching key, or the default list
+func lookupClasses(spamClasses *classes.SpamClasses, keys []string) []classes.SpamClass {
+	for _, key := range keys {
+		list, ok := spamClasses.Classes[key]
+		if ok && len(list) > 0 {
+			return list
+		}
+	}
+	return spamClasses.GetClasses(classes.DEFAULT_NAME)
+}
+
+// return the class list from the class backend for the first address it knows,
+// otherwise the list from the class config file
+func (f *Filter) classList(spamClasses *classes.SpamClasses, addresses []string) []classes.SpamClass {
+	for _, address := range addresses {
+		list, ok := f.backendClasses(address)
+		if ok {
+			return list
+		}
+	}
+	return lookupClasses(spamClasses, f.classKeys(addresses))
+}
+
+// return the class for score from the class list of addresses, looked up through the
+// class backend, then the class config; a registered classifier decides instead
+func (f *Filter) getClass(addresses []string, score float32) string {
+	if f.classifier != nil {
+		return f.classifier.GetClass(addresses, score)
+	}
+	return f.DefaultClassifier().GetClass(addresses, score)
+}
+
+// return the class in classList for score using the configured threshold boundary semantics
+//
+// inclusive (the default, as implemented by the classes library): a score equal
+// to a threshold selects the upper class
+// exclusive: a score equal to a threshold remains in the lower class
+func (f *Filter) scoreClass(classList []classes.SpamClass, score float32) string {
+	var result string
+	for _, class := range classList {
+		result = class.Name
+		if score < class.Score || (!f.thresholdInclusive && score == class.Score) {
+			break
+		}
+	}
+	return result
+}
+
+// return the lowest class for addresses
+func (f *Filter) lowestClass(addresses []string) string {
+	return f.getClass(addresses, -math.MaxFloat32)
+}
+
+// return the addresses configured with an empty class list in the class config
+func emptyClassTables(config *classConfig) ([]string, error) {
+	empty := []string{}
+	tables := map[string][]classes.SpamClass{}
+	err := json.Unmarshal(config.Recipients, &tables)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing %s: %v", config.Filename, err)
+	}
+	for address, list := range tables {
+		if len(list) == 0 {
+			empty = append(empty, address)
+		}
+	}
+	return empty, nil
+}
+
+// class config key interpreted as a regular expression matched against recipient addresses
+type classPattern struct {
+	Key    string
+	Regexp *regexp.Regexp
+}
+
+// class entry fields marking the key of its list as a regular expression
+type classRegexMarker struct {
+	Regex bool `json:"regex"`
+}
+
+// return the regex keys of the class config in declaration order; keys that do not
+// compile are reported as problems and skipped
+func readClassPatterns(config *classConfig) ([]classPattern, error) {
+	patterns := []classPattern{}
+	keys, err := classRegexKeys(config.Recipients)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing %s: %v", config.Filename, err)
+	}
+	for _, key := range keys {
+		pattern, err := regexp.Compile(key)
+		if err == nil {
+			patterns = append(patterns, classPattern{Key: key, Regexp: pattern})
+		}
+	}
+	return patterns, nil
+}
+
+// return the keys of the recipient class tables marked as regex, in declaration order
+//
+// a key is a regex when any entry in its class list sets "regex": true
+func classRegexKeys(data []byte) ([]string, error) {
+	entries, err := configEntries(data)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, entry := range entries {
+		markers := []classRegexMarker{}
+		err = json.Unmarshal(entry.Value, &markers)
+		if err != nil {
+			return nil, err
+		}
+		for _, marker := range markers {
+			if marker.Regex {
+				keys = append(keys, entry.Key)
+				break
+			}
+		}
+	}
+	return keys, nil
+}
+
+// return the current regex keys
+func (f *Filter) getPatterns() []classPattern {
+	f.classesLock.RLock()
+	defer f.classesLock.RUnlock()
+	return f.patterns
+}
+
+// optional display label for a class in the class config file
+type classLabel struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+}
+
+// return the per-class labels of the class config, as a map of address to class name to label
+func readClassLabels(config *classConfig) (map[string]map[string]string, error) {
+	labels := make(map[string]map[string]string)
+	tables := map[string][]classLabel{}
+	err := json.Unmarshal(config.Recipients, &tables)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing %s: %v", config.Filename, err)
+	}
+	for address, list := range tables {
+		for _, class := range list {
+			if class.Label != "" {
+				if labels[address] == nil {
+					labels[address] = make(map[string]string)
+				}
+				labels[address][class.Name] = class.Label
+			}
+		}
+	}
+	return labels, nil
+}
+
+// return the label for a class from the class table used for address
+func (f *Filter) classLabel(address, class string) string {
+	key, configured := f.classKey(f.getClasses(), address)
+	if !configured {
+		key = classes.DEFAULT_NAME
+	}
+	f.classesLock.RLock()
+	defer f.classesLock.RUnlock()
+	return f.labels[key][class]
+}
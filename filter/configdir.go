@@ -0,0 +1,69 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+)
+
+// read the *.json fragments in dir in filename order, merging them so that the last
+// fragment defining an address, or a key within a section, wins
+//
+// merged addresses keep the position of their first definition
+func readClassConfigDir(dir string) ([]byte, map[string]json.RawMessage, error) {
+	filenames, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed listing %s: %v", dir, err)
+	}
+	recipients := []configEntry{}
+	index := make(map[string]int)
+	sections := make(map[string][]configEntry)
+	sectionIndex := make(map[string]map[string]int)
+	for _, filename := range filenames {
+		data, fragmentSections, err := readClassConfigFile(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		entries, err := configEntries(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed parsing %s: %v", filename, err)
+		}
+		recipients = mergeConfigEntries(recipients, index, entries)
+		for name, data := range fragmentSections {
+			entries, err := configEntries(data)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed parsing %s: %s: %v", filename, name, err)
+			}
+			if sectionIndex[name] == nil {
+				sectionIndex[name] = make(map[string]int)
+			}
+			sections[name] = mergeConfigEntries(sections[name], sectionIndex[name], entries)
+		}
+	}
+	merged, err := encodeConfigEntries(recipients)
+	if err != nil {
+		return nil, nil, err
+	}
+	mergedSections := make(map[string]json.RawMessage)
+	for name, entries := range sections {
+		mergedSections[name], err = encodeConfigEntries(entries)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return merged, mergedSections, nil
+}
+
+// add entries to merged, replacing the value of keys already present
+func mergeConfigEntries(merged []configEntry, index map[string]int, entries []configEntry) []configEntry {
+	for _, entry := range entries {
+		i, ok := index[entry.Key]
+		if ok {
+			merged[i].Value = entry.Value
+			continue
+		}
+		index[entry.Key] = len(merged)
+		merged = append(merged, entry)
+	}
+	return merged
+}
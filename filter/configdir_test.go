@@ -0,0 +1,61 @@
+package filter
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassConfigDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "classes.d")
+	require.Nil(t, os.Mkdir(dir, 0700))
+	writeTestClasses(t, filepath.Join(dir, "10-base.json"), `{
+    "touser@localdomain.ext": [{"name": "base", "score": 50}],
+    "username@example.org": [{"name": "base", "score": 50}],
+    "senders": {"fromuser@example.org": [{"name": "base_sender", "score": 50}]}
+}`)
+	writeTestClasses(t, filepath.Join(dir, "20-override.json"), `{
+    "touser@localdomain.ext": [{"name": "override", "score": 50}],
+    "senders": {"other@example.org": [{"name": "other_sender", "score": 50}]}
+}`)
+	writeTestClasses(t, filepath.Join(dir, "30-ignored.txt"), `not json`)
+	f := newTestFilter(t, map[string]any{"class_config_dir": dir}, "", io.Discard)
+	require.Nil(t, validateClassConfig(dir))
+	require.Equal(t, "override", f.getClass([]string{"touser@localdomain.ext"}, 1.155))
+	require.Equal(t, "base", f.getClass([]string{"username@example.org"}, 1.155))
+	require.Equal(t, "ham", f.getClass([]string{"nobody@example.com"}, 1.155))
+	senders := f.getSection(SENDERS_KEY)
+	require.Contains(t, senders.Classes, "fromuser@example.org")
+	require.Contains(t, senders.Classes, "other@example.org")
+
+	// new fragments are picked up on reload
+	writeTestClasses(t, filepath.Join(dir, "15-new.json"), `{"nobody@example.com": [{"name": "new", "score": 50}]}`)
+	require.Nil(t, f.ReloadClasses())
+	require.Equal(t, "new", f.getClass([]string{"nobody@example.com"}, 1.155))
+
+	// a bad fragment fails the whole load
+	writeTestClasses(t, filepath.Join(dir, "40-bad.json"), `{"touser@localdomain.ext": `)
+	require.NotNil(t, f.ReloadClasses())
+	require.Equal(t, "override", f.getClass([]string{"touser@localdomain.ext"}, 1.155))
+
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"class_config_dir": filepath.Join(dir, "missing")})
+	_, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.NotNil(t, err)
+}
+
+func TestWatchClassConfigDir(t *testing.T) {
+	dir := t.TempDir()
+	writeTestClasses(t, filepath.Join(dir, "10-base.json"), testReloadClasses)
+	f := newTestFilter(t, map[string]any{"class_config_dir": dir, "reload_debounce": "10ms", "reload_watch": true}, "", io.Discard)
+	stop := f.watchClassConfig()
+	defer stop()
+
+	writeTestClasses(t, filepath.Join(dir, "20-new.json"), `{"touser@localdomain.ext": [{"name": "fragment", "score": 1}]}`)
+	require.Eventually(t, func() bool { return f.getClass([]string{"touser@localdomain.ext"}, 0) == "fragment" }, 2*time.Second, time.Millisecond)
+}
@@ -0,0 +1,32 @@
+package filter
+
+const COUNTER_RELOADED = "reloaded"
+const COUNTER_RELOAD_FAILED = "reload_failed"
+const COUNTER_ABORTED_BEFORE_DATA = "aborted_before_data"
+const COUNTER_SESSIONS_REFUSED = "sessions_refused"
+const COUNTER_OUT_OF_ORDER = "out_of_order"
+
+// increment a named event counter
+func (f *Filter) count(name string) {
+	f.countersLock.Lock()
+	defer f.countersLock.Unlock()
+	f.counters[name]++
+}
+
+// return the value of a named event counter
+func (f *Filter) Counter(name string) int64 {
+	f.countersLock.Lock()
+	defer f.countersLock.Unlock()
+	return f.counters[name]
+}
+
+// return a copy of all event counters
+func (f *Filter) Counters() map[string]int64 {
+	f.countersLock.Lock()
+	defer f.countersLock.Unlock()
+	ret := make(map[string]int64, len(f.counters))
+	for name, value := range f.counters {
+		ret[name] = value
+	}
+	return ret
+}
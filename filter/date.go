@@ -0,0 +1,94 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const DATE_ACTION_NONE = "none"
+const DATE_ACTION_SCORE = "score"
+const DATE_ACTION_HEADER = "header"
+const DEFAULT_DATE_ANOMALY_HEADER = "X-Spam-Date-Anomaly"
+const DEFAULT_DATE_MAX_AGE = "720h"
+const DEFAULT_DATE_MAX_SKEW = "24h"
+const DEFAULT_DATE_ANOMALY_SCORE = 3.0
+
+// Date header plausibility check
+//
+//	date_anomaly_action: none, score (add date_anomaly_score), or header (add date_anomaly_header)
+//	date_max_age:        dates older than this are anomalous
+//	date_max_skew:       dates further than this in the future are anomalous
+type dateCheck struct {
+	Action string
+	Header string
+	MaxAge time.Duration
+	Skew   time.Duration
+	Score  float32
+}
+
+func newDateCheck() (*dateCheck, error) {
+	ViperSetDefault("date_anomaly_action", DATE_ACTION_NONE)
+	action := ViperGetString("date_anomaly_action")
+	switch action {
+	case DATE_ACTION_NONE:
+		return nil, nil
+	case DATE_ACTION_SCORE, DATE_ACTION_HEADER:
+	default:
+		return nil, fmt.Errorf("unknown date_anomaly_action: %s", action)
+	}
+	ViperSetDefault("date_anomaly_header", DEFAULT_DATE_ANOMALY_HEADER)
+	ViperSetDefault("date_max_age", DEFAULT_DATE_MAX_AGE)
+	ViperSetDefault("date_max_skew", DEFAULT_DATE_MAX_SKEW)
+	ViperSetDefault("date_anomaly_score", DEFAULT_DATE_ANOMALY_SCORE)
+	maxAge, err := time.ParseDuration(ViperGetString("date_max_age"))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing date_max_age: %v", err)
+	}
+	skew, err := time.ParseDuration(ViperGetString("date_max_skew"))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing date_max_skew: %v", err)
+	}
+	check := dateCheck{
+		Action: action,
+		MaxAge: maxAge,
+		Skew:   skew,
+		Score:  float32(viper.GetFloat64(ViperKey("date_anomaly_score"))),
+	}
+	if action == DATE_ACTION_HEADER {
+		check.Header = ViperGetString("date_anomaly_header")
+	}
+	return &check, nil
+}
+
+// parse the Date header value, leaving the message date unset if it is invalid
+func (f *Filter) parseDate(name string, message *Message, line string) {
+	_, value, _ := strings.Cut(line, ":")
+	date, err := mail.ParseDate(strings.TrimSpace(value))
+	if err != nil {
+		if f.verbose {
+			log.Printf("%s.%s: failed parsing Date header: %v\n", f.Name, name, err)
+		}
+		return
+	}
+	message.Date = date
+}
+
+// return a description of an implausible message date
+func (f *Filter) dateAnomaly(message *Message) (string, bool) {
+	if f.dates == nil || message.Date.IsZero() {
+		return "", false
+	}
+	now := f.now()
+	switch {
+	case message.Date.After(now.Add(f.dates.Skew)):
+		return "future", true
+	case message.Date.Before(now.Add(-f.dates.MaxAge)):
+		return "old", true
+	}
+	return "", false
+}
@@ -0,0 +1,47 @@
+package filter
+
+import (
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDateAnomaly(t *testing.T) {
+	now := time.Date(2026, 1, 5, 12, 0, 0, 0, time.UTC)
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"Date: Fri, 01 Jan 2038 00:00:00 +0000",
+		"X-Spam-Date-Anomaly: forged",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	classify := func(options map[string]any) []string {
+		var output strings.Builder
+		f := newTestFilter(t, options, messageInput(data), &output)
+		f.now = func() time.Time { return now }
+		f.Run()
+		return filteredLines(t, output.String())
+	}
+
+	output := classify(map[string]any{"date_anomaly_action": "header"})
+	require.Contains(t, output, "X-Spam-Date-Anomaly: future Fri, 01 Jan 2038 00:00:00 +0000")
+	require.NotContains(t, output, "X-Spam-Date-Anomaly: forged")
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+
+	output = classify(map[string]any{"date_anomaly_action": "score", "date_anomaly_score": 5})
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+
+	// dates within the allowed skew and age are not anomalous
+	data[1] = "Date: Mon, 05 Jan 2026 11:30:00 +0000"
+	output = classify(map[string]any{"date_anomaly_action": "header"})
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+	for _, line := range output {
+		require.False(t, strings.HasPrefix(line, "X-Spam-Date-Anomaly:"))
+	}
+
+	data[1] = "Date: Mon, 05 Jan 2015 11:30:00 +0000"
+	output = classify(map[string]any{"date_anomaly_action": "header"})
+	require.Contains(t, output, "X-Spam-Date-Anomaly: old Mon, 05 Jan 2015 11:30:00 +0000")
+}
@@ -0,0 +1,69 @@
+package filter
+
+import (
+	"sync"
+	"time"
+)
+
+const DEFAULT_RECENT_DECISIONS_SIZE = 100
+
+// a classification result retained for live debugging
+type Decision struct {
+	Time      time.Time
+	Recipient string
+	Score     float32
+	Class     string
+}
+
+// fixed size ring buffer of the most recent decisions
+type decisionRing struct {
+	lock    sync.Mutex
+	records []Decision
+	next    int
+	full    bool
+}
+
+func newDecisionRing(size int) *decisionRing {
+	if size < 1 {
+		return nil
+	}
+	return &decisionRing{records: make([]Decision, size)}
+}
+
+func (r *decisionRing) add(decision Decision) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.records[r.next] = decision
+	r.next = (r.next + 1) % len(r.records)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+func (r *decisionRing) list() []Decision {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.full {
+		return append([]Decision{}, r.records[:r.next]...)
+	}
+	return append(append([]Decision{}, r.records[r.next:]...), r.records[:r.next]...)
+}
+
+// record a classification result
+func (f *Filter) recordDecision(recipient string, score float32, class string) {
+	decision := Decision{Time: f.now(), Recipient: recipient, Score: score, Class: class}
+	if f.decisions != nil {
+		f.decisions.add(decision)
+	}
+	if f.decisionSocket != nil {
+		f.decisionSocket.Publish(decision)
+	}
+}
+
+// return the most recent decisions, oldest first
+func (f *Filter) RecentDecisions() []Decision {
+	if f.decisions == nil {
+		return []Decision{}
+	}
+	return f.decisions.list()
+}
@@ -0,0 +1,38 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRecentDecisions(t *testing.T) {
+	f := newTestFilter(t, map[string]any{"recent_decisions_size": 3}, "", io.Discard)
+	require.Empty(t, f.RecentDecisions())
+	for i := 1; i <= 5; i++ {
+		f.recordDecision(fmt.Sprintf("user%d@example.org", i), float32(i), "ham")
+	}
+	decisions := f.RecentDecisions()
+	require.Len(t, decisions, 3)
+	for i, decision := range decisions {
+		require.Equal(t, fmt.Sprintf("user%d@example.org", i+3), decision.Recipient)
+		require.Equal(t, float32(i+3), decision.Score)
+	}
+
+	// classified messages are recorded
+	var output strings.Builder
+	f = newTestFilter(t, map[string]any{"recent_decisions_size": 3}, messageInput([]string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: username@example.org",
+		"",
+		"body",
+	}), &output)
+	f.Run()
+	decisions = f.RecentDecisions()
+	require.Len(t, decisions, 1)
+	require.Equal(t, "username@example.org", decisions[0].Recipient)
+	require.Equal(t, float32(1.155), decisions[0].Score)
+	require.Equal(t, "possible", decisions[0].Class)
+}
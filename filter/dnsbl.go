@@ -0,0 +1,188 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const DNSBL_ACTION_SCORE = "score"
+const DNSBL_ACTION_REJECT = "reject"
+
+const DEFAULT_DNSBL_SCORE = 5.0
+const DEFAULT_DNSBL_TIMEOUT = "2s"
+const DEFAULT_DNSBL_STATUS = "554 5.7.1 Client host listed in DNSBL"
+
+const COUNTER_DNSBL_LISTED = "dnsbl_listed"
+const COUNTER_DNSBL_REJECTED = "dnsbl_rejected"
+
+// a DNS blocklist queried for the connecting client address
+//
+//	dnsbl_zones:   list of {zone, score} entries; score defaults to dnsbl_score
+//	dnsbl_score:   score offset added for a listing, default DEFAULT_DNSBL_SCORE
+//	dnsbl_action:  score (add listing offsets to the message score) or reject (refuse at connect)
+//	dnsbl_status:  SMTP status returned for rejected connections
+//	dnsbl_timeout: time allowed for all zone queries, default DEFAULT_DNSBL_TIMEOUT
+type dnsblZone struct {
+	Zone  string   `mapstructure:"zone"`
+	Score *float64 `mapstructure:"score"`
+}
+
+type DNSBL struct {
+	Zones   []dnsblZone
+	Action  string
+	Status  string
+	Timeout time.Duration
+	lookup  func(ctx context.Context, host string) ([]string, error)
+}
+
+func newDNSBL() (*DNSBL, error) {
+	zones := []dnsblZone{}
+	err := viper.UnmarshalKey(ViperKey("dnsbl_zones"), &zones)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing dnsbl_zones: %v", err)
+	}
+	if len(zones) == 0 {
+		return nil, nil
+	}
+	ViperSetDefault("dnsbl_score", DEFAULT_DNSBL_SCORE)
+	ViperSetDefault("dnsbl_action", DNSBL_ACTION_SCORE)
+	ViperSetDefault("dnsbl_status", DEFAULT_DNSBL_STATUS)
+	ViperSetDefault("dnsbl_timeout", DEFAULT_DNSBL_TIMEOUT)
+	score := viper.GetFloat64(ViperKey("dnsbl_score"))
+	for i, zone := range zones {
+		zones[i].Zone = strings.Trim(strings.ToLower(zone.Zone), ".")
+		if zones[i].Zone == "" {
+			return nil, fmt.Errorf("dnsbl_zones entry %d has no zone", i)
+		}
+		if zone.Score == nil {
+			zones[i].Score = &score
+		}
+	}
+	timeout, err := time.ParseDuration(ViperGetString("dnsbl_timeout"))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing dnsbl_timeout: %v", err)
+	}
+	d := DNSBL{
+		Zones:   zones,
+		Action:  strings.ToLower(ViperGetString("dnsbl_action")),
+		Status:  ViperGetString("dnsbl_status"),
+		Timeout: timeout,
+		lookup:  net.DefaultResolver.LookupHost,
+	}
+	switch d.Action {
+	case DNSBL_ACTION_SCORE, DNSBL_ACTION_REJECT:
+	default:
+		return nil, fmt.Errorf("unknown dnsbl_action: %s", d.Action)
+	}
+	if !REJECT_STATUS_PATTERN.MatchString(d.Status) {
+		return nil, fmt.Errorf("invalid dnsbl_status: %q", d.Status)
+	}
+	return &d, nil
+}
+
+// return the reversed address labels used to query a DNSBL zone
+func dnsblQuery(ip net.IP) (string, bool) {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", v4[3], v4[2], v4[1], v4[0]), true
+	}
+	v6 := ip.To16()
+	if v6 == nil {
+		return "", false
+	}
+	labels := make([]string, 0, 32)
+	for i := len(v6) - 1; i >= 0; i-- {
+		labels = append(labels, fmt.Sprintf("%x", v6[i]&0x0f), fmt.Sprintf("%x", v6[i]>>4))
+	}
+	return strings.Join(labels, "."), true
+}
+
+// true if a DNSBL answer is a listing; 127.255.255.0/24 answers report query errors
+func dnsblListed(addrs []string) bool {
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr).To4()
+		if ip != nil && ip[0] == 127 && !(ip[1] == 255 && ip[2] == 255) {
+			return true
+		}
+	}
+	return false
+}
+
+// query all zones concurrently, returning the listing zones and their summed score
+func (d *DNSBL) Check(address string) ([]string, float32) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() {
+		return []string{}, 0
+	}
+	query, ok := dnsblQuery(ip)
+	if !ok {
+		return []string{}, 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout)
+	defer cancel()
+	listed := make([]bool, len(d.Zones))
+	var wg sync.WaitGroup
+	for i, zone := range d.Zones {
+		wg.Add(1)
+		go func(i int, zone string) {
+			defer wg.Done()
+			addrs, err := d.lookup(ctx, query+"."+zone)
+			if err == nil {
+				listed[i] = dnsblListed(addrs)
+			}
+		}(i, zone.Zone)
+	}
+	wg.Wait()
+	zones := []string{}
+	var score float32
+	for i, zone := range d.Zones {
+		if listed[i] {
+			zones = append(zones, zone.Zone)
+			score += float32(*zone.Score)
+		}
+	}
+	return zones, score
+}
+
+// respond to a connect filter request, recording DNSBL listings of the client in the session;
+// the zones are queried off the protocol loop and smtpd holds the session until the result
+func (f *Filter) connect(name, sid, token, src string) {
+	session := f.getSession(name, sid)
+	if session == nil || f.isTrusted(session) {
+		f.connectResult(sid, token, "proceed")
+		return
+	}
+	f.async(func() func() {
+		zones, score := f.dnsbl.Check(src)
+		return func() {
+			result := "proceed"
+			session.DNSBLZones, session.DNSBLScore = zones, score
+			if len(zones) > 0 {
+				f.count(COUNTER_DNSBL_LISTED)
+				log.Printf("%s.%s: session=%s client %s listed in %s\n", f.Name, name, sid, src, strings.Join(zones, ","))
+				if f.dnsbl.Action == DNSBL_ACTION_REJECT {
+					result = "reject|" + f.dnsbl.Status
+					f.count(COUNTER_DNSBL_REJECTED)
+				}
+			}
+			f.connectResult(sid, token, result)
+		}
+	})
+}
+
+func (f *Filter) connectResult(sid, token, result string) {
+	err := f.writeLine(fmt.Sprintf("filter-result|%s|%s|%s", sid, token, result))
+	if err != nil {
+		Warning("connect result output failed with: %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testConnectLine = "filter|0.7|0000000000.000000|smtp-in|connect|deadbeef|f00dface|sendhost.example.org|1.2.3.4"
+
+// return filter protocol input for a message with a connect filter request following link-connect
+func connectInput(data []string) string {
+	return strings.Replace(messageInput(data), messageLines[0]+"\n", messageLines[0]+"\n"+testConnectLine+"\n", 1)
+}
+
+// filter output safe to read while the filter runs
+type lockedOutput struct {
+	sync.Mutex
+	builder strings.Builder
+}
+
+func (o *lockedOutput) Write(data []byte) (int, error) {
+	o.Lock()
+	defer o.Unlock()
+	return o.builder.Write(data)
+}
+
+func (o *lockedOutput) String() string {
+	o.Lock()
+	defer o.Unlock()
+	return o.builder.String()
+}
+
+// wait until the filter has written text
+func (o *lockedOutput) wait(text string) {
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(o.String(), text) && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// run a filter on connect input, sending the lines after the connect request only once it
+// is answered, as smtpd does
+func runConnect(t *testing.T, options map[string]any, data []string, lookup func(context.Context, string) ([]string, error)) (string, *Filter) {
+	reader, writer := io.Pipe()
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, options)
+	output := &lockedOutput{}
+	f, err := NewFilter(reader, output)
+	require.Nil(t, err)
+	f.dnsbl.lookup = lookup
+	before, after, _ := strings.Cut(connectInput(data), testConnectLine+"\n")
+	go func() {
+		defer writer.Close()
+		io.WriteString(writer, before+testConnectLine+"\n")
+		output.wait("filter-result|deadbeef|f00dface|")
+		io.WriteString(writer, after)
+	}()
+	f.Run()
+	return output.String(), f
+}
+
+// return a lookup function answering for the listed query names
+func testDNSBLLookup(listed map[string]string) func(context.Context, string) ([]string, error) {
+	return func(ctx context.Context, host string) ([]string, error) {
+		addr, ok := listed[host]
+		if !ok {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return []string{addr}, nil
+	}
+}
+
+func TestDNSBLScore(t *testing.T) {
+	options := map[string]any{
+		"dnsbl_zones": []map[string]any{
+			{"zone": "zen.example.net"},
+			{"zone": "bl.example.com", "score": 1.5},
+			{"zone": "clean.example.org"},
+		},
+	}
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	output, f := runConnect(t, options, data, testDNSBLLookup(map[string]string{
+		"4.3.2.1.zen.example.net": "127.0.0.2",
+		"4.3.2.1.bl.example.com":  "127.0.0.4",
+	}))
+	require.Contains(t, output, "register|filter|smtp-in|connect\n")
+	require.Contains(t, output, "filter-result|deadbeef|f00dface|proceed\n")
+	// 1.155 + 5 + 1.5 is suspected_spam
+	require.Contains(t, filteredLines(t, output), "X-Spam-Class: suspected_spam")
+	require.Equal(t, int64(1), f.Counter(COUNTER_DNSBL_LISTED))
+}
+
+func TestDNSBLReject(t *testing.T) {
+	options := map[string]any{
+		"dnsbl_zones":  []map[string]any{{"zone": "zen.example.net"}},
+		"dnsbl_action": "reject",
+	}
+	run := func(listed map[string]string) (string, *Filter) {
+		return runConnect(t, options, []string{"To: touser@localdomain.ext", ""}, testDNSBLLookup(listed))
+	}
+	// query error answers are not listings
+	output, _ := run(map[string]string{"4.3.2.1.zen.example.net": "127.255.255.254"})
+	require.Contains(t, output, "filter-result|deadbeef|f00dface|proceed\n")
+
+	output, f := run(map[string]string{"4.3.2.1.zen.example.net": "127.0.0.2"})
+	require.Contains(t, output, fmt.Sprintf("filter-result|deadbeef|f00dface|reject|%s\n", DEFAULT_DNSBL_STATUS))
+	require.Equal(t, int64(1), f.Counter(COUNTER_DNSBL_REJECTED))
+}
+
+func TestDNSBLDoesNotBlockSessions(t *testing.T) {
+	options := map[string]any{"dnsbl_zones": []map[string]any{{"zone": "zen.example.net"}}}
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	second := strings.Split(strings.NewReplacer("deadbeef", "00000002", "cafebabe", "cafe0002").Replace(messageInput(data)), "\n")
+	input := strings.Join(append(append([]string{}, initLines...), messageLines[0], testConnectLine), "\n") + "\n" + strings.Join(second[len(initLines):], "\n")
+	output := &lockedOutput{}
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, options)
+	f, err := NewFilter(strings.NewReader(input), output)
+	require.Nil(t, err)
+	otherLine := "filter-dataline|00000002|baadf00d|X-Spam-Class: applied_class"
+	// the lookup answers only once the other session's message has been filtered
+	f.dnsbl.lookup = func(ctx context.Context, host string) ([]string, error) {
+		for !strings.Contains(output.String(), otherLine) && ctx.Err() == nil {
+			time.Sleep(time.Millisecond)
+		}
+		return []string{"127.0.0.2"}, nil
+	}
+	f.Run()
+	result := strings.Index(output.String(), "filter-result|deadbeef|f00dface|proceed")
+	other := strings.Index(output.String(), otherLine)
+	require.True(t, result > 0 && other > 0)
+	require.Less(t, other, result)
+	require.Equal(t, int64(1), f.Counter(COUNTER_DNSBL_LISTED))
+}
+
+func TestDNSBLQuery(t *testing.T) {
+	query, ok := dnsblQuery(net.ParseIP("192.0.2.99"))
+	require.True(t, ok)
+	require.Equal(t, "99.2.0.192", query)
+	query, ok = dnsblQuery(net.ParseIP("2001:db8::1"))
+	require.True(t, ok)
+	require.Equal(t, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2", query)
+}
+
+func TestDNSBLInvalidAction(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"dnsbl_zones": []map[string]any{{"zone": "zen.example.net"}}, "dnsbl_action": "drop"})
+	_, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.NotNil(t, err)
+}
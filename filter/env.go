@@ -0,0 +1,72 @@
+package filter
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rstms/rspamd-classes/classes"
+)
+
+const THRESHOLD_ENV_PREFIX = "SPAMCLASS_"
+const THRESHOLD_ENV_SUFFIX = "_THRESHOLD"
+
+// return the default class thresholds set by SPAMCLASS_<CLASS>_THRESHOLD environment variables
+func thresholdEnv() (map[string]float32, error) {
+	thresholds := make(map[string]float32)
+	for _, variable := range os.Environ() {
+		key, value, _ := strings.Cut(variable, "=")
+		name, found := strings.CutPrefix(key, THRESHOLD_ENV_PREFIX)
+		if !found {
+			continue
+		}
+		name, found = strings.CutSuffix(name, THRESHOLD_ENV_SUFFIX)
+		if !found || name == "" {
+			continue
+		}
+		score, err := strconv.ParseFloat(value, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: '%s'", key, value)
+		}
+		thresholds[strings.ToLower(name)] = float32(score)
+	}
+	return thresholds, nil
+}
+
+// override the default class table with thresholds from the environment; classes not in
+// the default table are added
+func (f *Filter) applyThresholdEnv(spamClasses *classes.SpamClasses) error {
+	thresholds, err := thresholdEnv()
+	if err != nil {
+		return err
+	}
+	_, ok := thresholds[classes.MAX_NAME]
+	if ok {
+		Warning("%s: the %s class threshold is fixed; ignoring %s%s%s", f.Name, classes.MAX_NAME, THRESHOLD_ENV_PREFIX, strings.ToUpper(classes.MAX_NAME), THRESHOLD_ENV_SUFFIX)
+		delete(thresholds, classes.MAX_NAME)
+	}
+	if len(thresholds) == 0 {
+		return nil
+	}
+	classList := []classes.SpamClass{}
+	for _, class := range spamClasses.GetClasses(classes.DEFAULT_NAME) {
+		score, ok := thresholds[class.Name]
+		if ok {
+			class.Score = score
+			delete(thresholds, class.Name)
+		}
+		classList = append(classList, class)
+	}
+	names := []string{}
+	for name := range thresholds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		classList = append(classList, classes.SpamClass{Name: name, Score: thresholds[name]})
+	}
+	spamClasses.SetClasses(classes.DEFAULT_NAME, classList)
+	return nil
+}
@@ -0,0 +1,29 @@
+package filter
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestThresholdEnv(t *testing.T) {
+	t.Setenv("SPAMCLASS_HAM_THRESHOLD", "2")
+	t.Setenv("SPAMCLASS_POSSIBLE_THRESHOLD", "6")
+	t.Setenv("SPAMCLASS_SPAM_THRESHOLD", "20")
+	f := newTestFilter(t, map[string]any{}, "", io.Discard)
+	require.Equal(t, "ham", f.getClass([]string{"nobody@example.com"}, 1.155))
+	require.Equal(t, "possible", f.getClass([]string{"nobody@example.com"}, 4))
+	require.Equal(t, "probable", f.getClass([]string{"nobody@example.com"}, 7.2))
+	require.Equal(t, "spam", f.getClass([]string{"nobody@example.com"}, 20))
+
+	// configured recipients are not affected
+	require.Equal(t, "applied_class", f.getClass([]string{"touser@localdomain.ext"}, 1.155))
+
+	t.Setenv("SPAMCLASS_HAM_THRESHOLD", "low")
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	_, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.NotNil(t, err)
+}
@@ -2,15 +2,21 @@ package filter
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"github.com/rstms/rspamd-classes/classes"
+	"github.com/spf13/viper"
 	"io"
 	"log"
+	"net/textproto"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
 )
 
 /*********************************************************************************************
@@ -52,9 +58,71 @@ const Version = "0.0.6"
 
 const DEFAULT_CLASS_CONFIG_FILE = "/etc/mail/filter_rspamd_classes.json"
 
+const DEFAULT_CLASS_HEADER = "X-Spam-Class"
+const DEFAULT_FLAG_HEADER = "X-Spam"
+const DEFAULT_LABEL_HEADER = "X-Spam-Label"
+const DEFAULT_ORIGINAL_SCORE_HEADER = "X-Spam-Original-Score"
+const DEFAULT_REASON_HEADER = "X-Spam-Class-Reason"
+
 var EMAIL_ADDRESS_BRACKET_PATTERN = regexp.MustCompile(`^.*<([a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,})>.*$`)
 var EMAIL_ADDRESS_PATTERN = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
 
+// class config key matching every address in a domain: "*@example.org" or "@example.org"
+var DOMAIN_KEY_PATTERN = regexp.MustCompile(`^\*?@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
+
+// SpamAssassin before 3.0 reports hits= instead of score=
+var STATUS_SCORE_PATTERN = regexp.MustCompile(`\b(?:score|hits)=(-?[0-9.,]+)`)
+var SCORE_REQUIRED_PATTERN = regexp.MustCompile(`/\s*(-?[0-9.,]+)`)
+var STATUS_REQUIRED_PATTERN = regexp.MustCompile(`\brequired=(-?[0-9.,]+)`)
+
+// SpamAssassin folds unbracketed tests= lists after a comma
+var STATUS_TESTS_PATTERN = regexp.MustCompile(`\btests=(?:\[([^\]]*)|((?:[^\s,]+,\s*)*[^\s,]*))`)
+var SPAMD_REQUIRED_PATTERN = regexp.MustCompile(`\[\s*-?[0-9.,]+\s*/\s*(-?[0-9.,]+)\s*\]`)
+var SPAMD_SYMBOL_PATTERN = regexp.MustCompile(`^\s*([A-Za-z0-9_]+)\(-?[0-9.]+\)`)
+
+var DEFAULT_DANGEROUS_SYMBOLS = []string{
+	"MIME_BAD_EXTENSION",
+	"MIME_DOUBLE_BAD_EXTENSION",
+	"MIME_ARCHIVE_IN_ARCHIVE",
+	"MIME_EXE_IN_GEN_SPLIT_RAR",
+}
+
+const SCORE_SOURCE_SCORE = "score"
+const SCORE_SOURCE_STATUS = "status"
+const SCORE_SOURCE_MAX_OF_BOTH = "max_of_both"
+const SCORE_SOURCE_BOTH = "both"
+
+const CLASS_KEY_SOURCE_RECIPIENT = "recipient"
+const CLASS_KEY_SOURCE_AUTH_USER = "auth_user"
+
+const RECIPIENT_SOURCE_TO = "to"
+const RECIPIENT_SOURCE_ENVELOPE = "envelope"
+const RECIPIENT_SOURCE_ORIGINAL_TO = "x_original_to"
+const RECIPIENT_SOURCE_DELIVERED_TO = "delivered_to"
+const RECIPIENT_SOURCE_AUTH_USER = "auth_user"
+
+const SCORE_COMBINE_LAST = "last"
+const SCORE_COMBINE_FIRST = "first"
+const SCORE_COMBINE_MAX = "max"
+const SCORE_COMBINE_MIN = "min"
+
+const SPOOF_ACTION_NONE = "none"
+const SPOOF_ACTION_SCORE = "score"
+const SPOOF_ACTION_CLASS = "class"
+const DEFAULT_SPOOF_SCORE = 5.0
+
+const MAX_ALIAS_DEPTH = 8
+
+const PLUS_ALIAS_STRIP = "strip"
+const PLUS_ALIAS_KEEP = "keep"
+const PLUS_ALIAS_BOTH = "both"
+
+const DEFAULT_MAX_HEADER_LINES = 1000
+const DEFAULT_MAX_ADDRESSES = 100
+const DEFAULT_MAX_SESSIONS = 10000
+const DEFAULT_MAX_RECIPIENT_HEADERS = 10
+const DEFAULT_OUTPUT_TERMINATOR = "\n"
+
 const FID_NAME = 4
 const FID_SID = 5
 const FID_TOKEN = 6
@@ -62,15 +130,43 @@ const FID_TOKEN = 6
 var Verbose bool
 
 type Message struct {
-	Id           string
-	From         []string
-	To           []string
-	EnvelopeTo   []string
-	EnvelopeFrom []string
-	State        string
-	InHeader     bool
-	SpamScore    float32
-	SpamScoreSet bool
+	Id               string
+	From             []string
+	To               []string
+	EnvelopeTo       []string
+	EnvelopeFrom     []string
+	State            string
+	InHeader         bool
+	SpamScore        float32
+	SpamScoreSet     bool
+	StatusScore      float32
+	StatusScoreSet   bool
+	Required         float32
+	RequiredSet      bool
+	Stripping        bool `json:"-"`
+	HeadersGenerated bool
+	Headers          []string
+	Pending          string   `json:"-"`
+	Raw              []string `json:"-"`
+	Symbols          []string
+	AuthResults      []string
+	Virus            string
+	DisplayNameSpoof bool
+	Date             time.Time
+	OriginalTo       string
+	DeliveredTo      string
+	Action           string
+	Quarantine       *quarantineCapture    `json:"-"`
+	Audit            *auditCapture         `json:"-"`
+	Learn            *learnCapture         `json:"-"`
+	Scan             *scanCapture          `json:"-"`
+	Scanning         bool                  `json:"-"`
+	Hold             *heldOutput           `json:"-"`
+	AfterScan        []func()              `json:"-"`
+	ScoreRank        int                   `json:"-"`
+	ScoreInputs      map[string]scoreInput `json:"-"`
+	ARC              map[int]*arcInstance  `json:"-"`
+	ScoreInputsValue string                `json:"-"`
 }
 
 func NewMessage(mid string) *Message {
@@ -94,35 +190,140 @@ type Session struct {
 	Local          string
 	AuthorizedUser string
 	DataMessage    string
+	Helo           string
+	DNSBLZones     []string
+	DNSBLScore     float32
+	Country        string
 }
 
 func NewSession(sid, rdns string, confirmed bool, remote, local string) *Session {
 	return &Session{
-		Id:        sid,
-		RDNS:      rdns,
-		Confirmed: confirmed,
-		Remote:    remote,
-		Local:     local,
-		Messages:  make(map[string]*Message),
+		Id:         sid,
+		RDNS:       rdns,
+		Confirmed:  confirmed,
+		Remote:     remote,
+		Local:      local,
+		Messages:   make(map[string]*Message),
+		DNSBLZones: []string{},
 	}
 }
 
+// names of the generated headers, configurable globally and per recipient
+type HeaderNames struct {
+	ClassHeader string `mapstructure:"class_header"`
+	FlagHeader  string `mapstructure:"flag_header"`
+}
+
 type Callback struct {
 	Handler func(string, []string)
 	Args    int
 }
 
 type Filter struct {
-	Name      string
-	Sessions  map[string]*Session
-	Protocol  string
-	Classes   *classes.SpamClasses
-	Subsystem string
-	reports   []string
-	filters   []string
-	verbose   bool
-	input     *bufio.Scanner
-	output    io.Writer
+	Name               string
+	Sessions           map[string]*Session
+	Protocol           string
+	Classes            *classes.SpamClasses
+	Subsystem          string
+	StripHeaders       []string
+	preserveHeaders    []string
+	stripPatterns      []*regexp.Regexp
+	Headers            HeaderNames
+	reports            []string
+	filters            []string
+	verbose            bool
+	commaDecimal       bool
+	scoreSource        string
+	scoreCombine       string
+	classKeySource     string
+	localDomain        string
+	rcptHeaders        map[string]HeaderNames
+	aliases            map[string]string
+	thresholdInclusive bool
+	maxHeaderLines     int
+	maxAddresses       int
+	maxSessions        int
+	terminator         string
+	minConfidence      float64
+	dangerousSymbols   map[string]bool
+	ignoreDomains      map[string]bool
+	spamClasses        map[string]bool
+	labels             map[string]map[string]string
+	patterns           []classPattern
+	sections           map[string]*classes.SpamClasses
+	labelHeader        string
+	scoreHeader        string
+	spoofAction        string
+	spoofScore         float32
+	spoofClass         string
+	classifier         Classifier
+	actions            *classActions
+	actionPolicy       ActionPolicy
+	rejectStatus       string
+	quarantine         *Quarantine
+	audit              *Audit
+	learn              *Learn
+	scoreSources       map[string]ScoreSource
+	scoreChain         []string
+	scanMaxBytes       int
+	reputation         *Reputation
+	dnsbl              *DNSBL
+	clamav             *ClamAV
+	geoip              *GeoIP
+	webhook            *PolicyWebhook
+	completions        chan func()
+	stopped            chan struct{}
+	inflight           int
+	helo               *heloChecks
+	rdns               *rdnsChecks
+	authScores         *authResultScores
+	trusted            *trustedNetworks
+	senderLists        []*senderList
+	authservs          map[string]bool
+	listHeaderName     string
+	subjectTags        map[string]string
+	scoreHeaders       []scoreHeader
+	scoreWeighting     string
+	scoreInputsHeader  string
+	classHeaders       map[string][]classHeader
+	backend            *backendCache
+	review             *ReviewCapture
+	receivedTrace      bool
+	traceHost          string
+	hostname           string
+	authResults        bool
+	authservId         string
+	now                func() time.Time
+	reloadPolicy       ReloadPolicy
+	remote             *remoteConfig
+	reloadTimer        *time.Timer
+	reloadLock         sync.Mutex
+	classesLock        sync.RWMutex
+	countersLock       sync.Mutex
+	decisions          *decisionRing
+	decisionSocket     *DecisionSocket
+	strict             *strictMode
+	level              *spamLevel
+	perRcptHeaders     int
+	maxRcptHeaders     int
+	recipientPolicy    string
+	plusAlias          string
+	zeroScoreClass     string
+	preferEnvelope     bool
+	dates              *dateCheck
+	maxClassifyRcpts   int
+	reasonHeader       string
+	reportHeaderName   string
+	resolutionOrder    []string
+	unmatchedPass      bool
+	defaultOnMissing   bool
+	hashHeader         string
+	counters           map[string]int64
+	classConfigFile    string
+	classConfigFiles   map[string]string
+	reader             io.Reader
+	input              *bufio.Scanner
+	output             io.Writer
 }
 
 func NewFilter(reader io.Reader, writer io.Writer) (*Filter, error) {
@@ -132,14 +333,23 @@ func NewFilter(reader io.Reader, writer io.Writer) (*Filter, error) {
 		return nil, Fatal(err)
 	}
 	f := Filter{
-		Name:     filepath.Base(executable),
-		verbose:  ViperGetBool("verbose"),
-		Sessions: make(map[string]*Session),
-		input:    bufio.NewScanner(reader),
-		output:   writer,
+		Name:           filepath.Base(executable),
+		verbose:        ViperGetBool("verbose"),
+		commaDecimal:   ViperGetBool("accept_comma_decimal"),
+		scoreSource:    ViperGetString("score_source"),
+		scoreCombine:   ViperGetString("score_combine"),
+		classKeySource: ViperGetString("class_key_source"),
+		localDomain:    strings.ToLower(ViperGetString("local_default_domain")),
+		Sessions:       make(map[string]*Session),
+		reader:         reader,
+		input:          bufio.NewScanner(reader),
+		completions:    make(chan func()),
+		stopped:        make(chan struct{}),
+		output:         writer,
 		reports: []string{
 			"link-connect",
 			"link-disconnect",
+			"link-identify",
 			"link-auth",
 			"tx-reset",
 			"tx-begin",
@@ -152,8 +362,365 @@ func NewFilter(reader io.Reader, writer io.Writer) (*Filter, error) {
 		filters: []string{
 			"data-line",
 		},
+		Headers: HeaderNames{
+			ClassHeader: ViperGetString("class_header"),
+			FlagHeader:  ViperGetString("flag_header"),
+		},
+		rcptHeaders:     make(map[string]HeaderNames),
+		counters:        make(map[string]int64),
+		aliases:         make(map[string]string),
+		classConfigFile: ViperGetString("class_config_file"),
+	}
+	// class_config_file may map subsystem names to files, selected once the subsystem is known
+	f.classConfigFiles = ViperGetStringMapString("class_config_file")
+	if len(f.classConfigFiles) > 0 {
+		f.classConfigFile = f.classConfigFiles[classes.DEFAULT_NAME]
+	}
+	// a directory of fragments replaces the single class config file
+	classConfigDir := ViperGetString("class_config_dir")
+	if classConfigDir != "" {
+		if !IsDir(classConfigDir) {
+			return nil, Fatalf("class_config_dir is not a directory: %s", classConfigDir)
+		}
+		f.classConfigFile = classConfigDir
+		f.classConfigFiles = nil
+	}
+	if f.Headers.ClassHeader == "" {
+		f.Headers.ClassHeader = DEFAULT_CLASS_HEADER
+	}
+	if f.Headers.FlagHeader == "" {
+		f.Headers.FlagHeader = DEFAULT_FLAG_HEADER
+	}
+	err = viper.UnmarshalKey(ViperKey("recipient_headers"), &f.rcptHeaders)
+	if err != nil {
+		return nil, Fatalf("failed parsing recipient_headers: %v", err)
+	}
+	// an empty flag header name disables the flag header, leaving upstream copies in place
+	ViperSetDefault("emit_flag_header", true)
+	if !ViperGetBool("emit_flag_header") {
+		f.Headers.FlagHeader = ""
+		for address, names := range f.rcptHeaders {
+			names.FlagHeader = ""
+			f.rcptHeaders[address] = names
+		}
+	}
+	for alias, canonical := range ViperGetStringMapString("aliases") {
+		f.aliases[strings.ToLower(alias)] = strings.ToLower(canonical)
+	}
+	switch f.scoreSource {
+	case "":
+		f.scoreSource = SCORE_SOURCE_SCORE
+	case SCORE_SOURCE_SCORE, SCORE_SOURCE_STATUS, SCORE_SOURCE_MAX_OF_BOTH, SCORE_SOURCE_BOTH:
+	default:
+		return nil, Fatalf("unknown score_source: %s", f.scoreSource)
+	}
+	switch f.classKeySource {
+	case "":
+		f.classKeySource = CLASS_KEY_SOURCE_RECIPIENT
+	case CLASS_KEY_SOURCE_RECIPIENT, CLASS_KEY_SOURCE_AUTH_USER:
+	default:
+		return nil, Fatalf("unknown class_key_source: %s", f.classKeySource)
+	}
+	switch f.scoreCombine {
+	case "":
+		f.scoreCombine = SCORE_COMBINE_LAST
+	case SCORE_COMBINE_LAST, SCORE_COMBINE_FIRST, SCORE_COMBINE_MAX, SCORE_COMBINE_MIN:
+	default:
+		return nil, Fatalf("unknown score_combine: %s", f.scoreCombine)
+	}
+	ViperSetDefault("plus_alias", PLUS_ALIAS_STRIP)
+	f.plusAlias = strings.ToLower(ViperGetString("plus_alias"))
+	switch f.plusAlias {
+	case PLUS_ALIAS_STRIP, PLUS_ALIAS_KEEP, PLUS_ALIAS_BOTH:
+	default:
+		return nil, Fatalf("unknown plus_alias: %s", f.plusAlias)
+	}
+	ViperSetDefault("display_name_spoof_action", SPOOF_ACTION_NONE)
+	ViperSetDefault("display_name_spoof_score", DEFAULT_SPOOF_SCORE)
+	ViperSetDefault("display_name_spoof_class", classes.MAX_NAME)
+	f.spoofAction = ViperGetString("display_name_spoof_action")
+	f.spoofScore = float32(viper.GetFloat64(ViperKey("display_name_spoof_score")))
+	f.spoofClass = ViperGetString("display_name_spoof_class")
+	switch f.spoofAction {
+	case SPOOF_ACTION_NONE, SPOOF_ACTION_SCORE, SPOOF_ACTION_CLASS:
+	default:
+		return nil, Fatalf("unknown display_name_spoof_action: %s", f.spoofAction)
+	}
+	ViperSetDefault("threshold_inclusive", true)
+	f.thresholdInclusive = ViperGetBool("threshold_inclusive")
+	ViperSetDefault("max_header_lines", DEFAULT_MAX_HEADER_LINES)
+	f.maxHeaderLines = ViperGetInt("max_header_lines")
+	ViperSetDefault("max_addresses", DEFAULT_MAX_ADDRESSES)
+	f.maxAddresses = ViperGetInt("max_addresses")
+	ViperSetDefault("recent_decisions_size", DEFAULT_RECENT_DECISIONS_SIZE)
+	f.decisions = newDecisionRing(ViperGetInt("recent_decisions_size"))
+	ViperSetDefault("max_sessions", DEFAULT_MAX_SESSIONS)
+	f.maxSessions = ViperGetInt("max_sessions")
+	ViperSetDefault("output_line_terminator", DEFAULT_OUTPUT_TERMINATOR)
+	f.terminator = ViperGetString("output_line_terminator")
+	switch f.terminator {
+	case "\n", "\r\n":
+	default:
+		return nil, Fatalf("invalid output_line_terminator: %q", f.terminator)
+	}
+	f.minConfidence = viper.GetFloat64(ViperKey("min_confidence_ratio"))
+	f.ignoreDomains = make(map[string]bool)
+	for _, domain := range ViperGetStringSlice("ignore_domains") {
+		f.ignoreDomains[strings.ToLower(domain)] = true
+	}
+	ViperSetDefault("spam_classes", []string{classes.MAX_NAME})
+	f.spamClasses = make(map[string]bool)
+	for _, class := range ViperGetStringSlice("spam_classes") {
+		f.spamClasses[class] = true
+	}
+	ViperSetDefault("dangerous_symbols", DEFAULT_DANGEROUS_SYMBOLS)
+	f.dangerousSymbols = make(map[string]bool)
+	for _, symbol := range ViperGetStringSlice("dangerous_symbols") {
+		f.dangerousSymbols[strings.ToUpper(symbol)] = true
+	}
+	f.now = time.Now
+	f.receivedTrace = ViperGetBool("emit_received_trace")
+	f.traceHost = ViperGetString("received_trace_host")
+	if ViperGetBool("emit_label_header") {
+		ViperSetDefault("label_header", DEFAULT_LABEL_HEADER)
+		f.labelHeader = ViperGetString("label_header")
+	}
+	if ViperGetBool("preserve_score_header") {
+		ViperSetDefault("original_score_header", DEFAULT_ORIGINAL_SCORE_HEADER)
+		f.scoreHeader = ViperGetString("original_score_header")
+	}
+	if ViperGetBool("emit_decision_hash") {
+		ViperSetDefault("decision_hash_header", DEFAULT_HASH_HEADER)
+		f.hashHeader = ViperGetString("decision_hash_header")
+	}
+	if ViperGetBool("emit_reason_header") {
+		ViperSetDefault("reason_header", DEFAULT_REASON_HEADER)
+		f.reasonHeader = ViperGetString("reason_header")
+	}
+	if ViperGetBool("emit_report_header") {
+		ViperSetDefault("report_header", DEFAULT_REPORT_HEADER)
+		f.reportHeaderName = ViperGetString("report_header")
+	}
+	f.senderLists, err = newSenderLists()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	if len(f.senderLists) > 0 {
+		ViperSetDefault("list_header", DEFAULT_LIST_HEADER)
+		f.listHeaderName = ViperGetString("list_header")
+	}
+	f.actions, err = newClassActions()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	f.rejectStatus = ViperGetString("reject_status")
+	f.audit, err = newAudit()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	err = f.newScoreSources()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	f.clamav, err = newClamAV()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	if f.clamav != nil {
+		f.scanMaxBytes = max(f.scanMaxBytes, f.clamav.MaxBytes)
+	}
+	f.webhook, err = newPolicyWebhook()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	f.learn, err = newLearn()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	f.quarantine, err = newQuarantine()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	if f.actions.uses(ACTION_QUARANTINE) && f.quarantine == nil {
+		return nil, Fatalf("class_actions quarantine requires quarantine_path")
+	}
+	f.trusted, err = newTrustedNetworks()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	f.helo = newHeloChecks(f.localDomain)
+	f.rdns = newRDNSChecks()
+	f.authScores, err = newAuthResultScores()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	f.dnsbl, err = newDNSBL()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	if f.dnsbl != nil {
+		f.filters = append(f.filters, "connect")
+	}
+	f.geoip, err = newGeoIP()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	f.reputation, err = newReputation()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	if f.reputation != nil {
+		f.filters = append(f.filters, "rcpt-to")
+	}
+	// rejection is decided once the whole message has been seen
+	if f.actions.uses(ACTION_REJECT) || (f.actions.uses(ACTION_QUARANTINE) && !f.quarantine.Deliver) || (f.clamav != nil && f.clamav.Action == CLAMD_ACTION_REJECT) || f.webhook != nil {
+		f.filters = append(f.filters, "commit")
+	}
+	f.scoreHeaders, err = newScoreHeaders()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	f.scoreWeighting, err = newScoreWeighting(f.scoreHeaders)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	if f.scoreWeighting != "" {
+		ViperSetDefault("score_inputs_header", DEFAULT_SCORE_INPUTS_HEADER)
+		f.scoreInputsHeader = ViperGetString("score_inputs_header")
+	}
+	f.subjectTags = newSubjectTags()
+	f.classHeaders, err = newClassHeaders()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	f.review = newReviewCapture()
+	f.strict = newStrictMode()
+	f.zeroScoreClass = ViperGetString("zero_score_class")
+	f.maxClassifyRcpts = ViperGetInt("max_recipients_for_classify")
+	f.unmatchedPass = ViperGetBool("unmatched_passthrough")
+	ViperSetDefault("default_on_missing", true)
+	f.defaultOnMissing = ViperGetBool("default_on_missing")
+	for _, source := range ViperGetStringSlice("recipient_resolution_order") {
+		source = strings.ToLower(source)
+		switch source {
+		case RECIPIENT_SOURCE_TO, RECIPIENT_SOURCE_ENVELOPE, RECIPIENT_SOURCE_ORIGINAL_TO, RECIPIENT_SOURCE_DELIVERED_TO, RECIPIENT_SOURCE_AUTH_USER:
+		default:
+			return nil, Fatalf("unknown recipient_resolution_order source: %s", source)
+		}
+		f.resolutionOrder = append(f.resolutionOrder, source)
+	}
+	f.dates, err = newDateCheck()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	ViperSetDefault("prefer_envelope_recipient", true)
+	f.preferEnvelope = ViperGetBool("prefer_envelope_recipient")
+	ViperSetDefault("max_recipient_headers", DEFAULT_MAX_RECIPIENT_HEADERS)
+	f.maxRcptHeaders = ViperGetInt("max_recipient_headers")
+	if ViperGetBool("per_recipient_headers") {
+		f.perRcptHeaders = f.maxRcptHeaders
+	}
+	f.recipientPolicy, err = newRecipientPolicy()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	f.level, err = newSpamLevel()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	f.authResults = ViperGetBool("emit_auth_results")
+	f.authservId = ViperGetString("authserv_id")
+	f.authservs, err = f.newAuthservIDs()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	if (f.receivedTrace && f.traceHost == "") || (f.authResults && f.authservId == "") {
+		f.hostname, err = HostFQDN()
+		if err != nil {
+			Warning("%s: hostname lookup failed, using session local address: %v", f.Name, err)
+		}
+	}
+	// always strip upstream copies of any header this filter generates
+	f.StripHeaders = []string{f.Headers.ClassHeader, f.Headers.FlagHeader}
+	if f.labelHeader != "" {
+		f.StripHeaders = append(f.StripHeaders, f.labelHeader)
+	}
+	if f.scoreHeader != "" {
+		f.StripHeaders = append(f.StripHeaders, f.scoreHeader)
+	}
+	if f.level != nil {
+		f.StripHeaders = append(f.StripHeaders, f.level.Header)
+	}
+	if f.clamav != nil {
+		f.StripHeaders = append(f.StripHeaders, f.clamav.Header)
+	}
+	if f.geoip != nil && f.geoip.Header != "" {
+		f.StripHeaders = append(f.StripHeaders, f.geoip.Header)
+	}
+	if f.perRcptHeaders > 0 || f.recipientPolicy == RECIPIENT_POLICY_HASHED {
+		f.StripHeaders = append(f.StripHeaders, f.Headers.ClassHeader+"-*")
+	}
+	if f.dates != nil && f.dates.Header != "" {
+		f.StripHeaders = append(f.StripHeaders, f.dates.Header)
+	}
+	if f.reasonHeader != "" {
+		f.StripHeaders = append(f.StripHeaders, f.reasonHeader)
+	}
+	if f.reportHeaderName != "" {
+		f.StripHeaders = append(f.StripHeaders, f.reportHeaderName)
+	}
+	if f.hashHeader != "" {
+		f.StripHeaders = append(f.StripHeaders, f.hashHeader)
+	}
+	if f.listHeaderName != "" {
+		f.StripHeaders = append(f.StripHeaders, f.listHeaderName)
+	}
+	if f.scoreInputsHeader != "" {
+		f.StripHeaders = append(f.StripHeaders, f.scoreInputsHeader)
+	}
+	for _, names := range f.rcptHeaders {
+		f.StripHeaders = append(f.StripHeaders, names.ClassHeader, names.FlagHeader)
 	}
-	f.Classes, err = f.readClasses(ViperGetString("class_config_file"))
+	f.StripHeaders = append(f.StripHeaders, f.classHeaderNames()...)
+	if ViperGetBool("preserve_original") {
+		f.preserveHeaders = append([]string{}, f.StripHeaders...)
+	}
+	f.StripHeaders = append(f.StripHeaders, ViperGetStringSlice("strip_headers")...)
+	for _, expr := range ViperGetStringSlice("strip_header_patterns") {
+		pattern, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			return nil, Fatalf("invalid strip_header_patterns expression '%s': %v", expr, err)
+		}
+		f.stripPatterns = append(f.stripPatterns, pattern)
+	}
+	err = f.validateHeaderNames()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	f.reloadPolicy, err = newReloadPolicy()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	if isRemoteConfig(f.classConfigFile) {
+		f.remote, err = f.initRemoteConfig(f.classConfigFile, "")
+		if err != nil {
+			return nil, Fatal(err)
+		}
+		f.classConfigFile = f.remote.cache
+	}
+	config, err := readClassConfig(f.classConfigFile)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	err = f.applyClassConfig(config)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	f.backend, err = newClassBackend()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	f.decisionSocket, err = newDecisionSocket()
 	if err != nil {
 		return nil, Fatal(err)
 	}
@@ -162,20 +729,7 @@ func NewFilter(reader io.Reader, writer io.Writer) (*Filter, error) {
 
 func (f *Filter) Config() {
 	for f.input.Scan() {
-		line := f.input.Text()
-		if f.verbose {
-			log.Printf("%s config: %s\n", f.Name, line)
-		}
-		fields := strings.Split(line, "|")
-		if len(fields) < 2 {
-			Warning("unexpected config line: %s", line)
-		}
-		switch fields[1] {
-		case "protocol":
-			f.Protocol = fields[2]
-		case "subsystem":
-			f.Subsystem = fields[2]
-		case "ready":
+		if f.configLine(f.input.Text()) {
 			return
 		}
 	}
@@ -186,11 +740,65 @@ func (f *Filter) Config() {
 	Warning("Config: unexpected EOF")
 }
 
+// handle a config phase line, returning true at config ready
+func (f *Filter) configLine(line string) bool {
+	if f.verbose {
+		log.Printf("%s config: %s\n", f.Name, line)
+	}
+	fields := strings.Split(line, "|")
+	if len(fields) < 2 {
+		Warning("unexpected config line: %s", line)
+		return false
+	}
+	switch fields[1] {
+	case "protocol":
+		if len(fields) > 2 {
+			f.Protocol = fields[2]
+		}
+	case "subsystem":
+		if len(fields) > 2 {
+			f.Subsystem = fields[2]
+			f.selectSubsystemClasses()
+		}
+	case "ready":
+		return true
+	}
+	return false
+}
+
+// load the class config file configured for the subsystem
+//
+// this runs in the config phase, before the reload watchers that read the selected file start
+func (f *Filter) selectSubsystemClasses() {
+	filename, ok := f.classConfigFiles[f.Subsystem]
+	if !ok || filename == f.classConfigFile || f.remote != nil && filename == f.remote.url {
+		return
+	}
+	var remote *remoteConfig
+	if isRemoteConfig(filename) {
+		var err error
+		remote, err = f.initRemoteConfig(filename, f.Subsystem)
+		if err != nil {
+			Warning("%s: failed loading class config for subsystem %s: %v", f.Name, f.Subsystem, err)
+			return
+		}
+		filename = remote.cache
+	}
+	err := f.loadClasses(filename)
+	if err != nil {
+		Warning("%s: failed loading class config for subsystem %s: %v", f.Name, f.Subsystem, err)
+		return
+	}
+	f.classConfigFile = filename
+	f.remote = remote
+	log.Printf("%s: using class config %s for subsystem %s\n", f.Name, filename, f.Subsystem)
+}
+
 func (f *Filter) Register() {
 	for _, name := range f.reports {
 		line := fmt.Sprintf("register|report|%s|%s", f.Subsystem, name)
 		log.Printf("%s.Register: %s\n", f.Name, line)
-		_, err := fmt.Fprintf(f.output, "%s\n", line)
+		err := f.writeLine(line)
 		if err != nil {
 			Warning("Register: report output failed with: %v", err)
 		}
@@ -200,7 +808,7 @@ func (f *Filter) Register() {
 		if f.verbose {
 			log.Printf("%s.Register: %s\n", f.Name, line)
 		}
-		_, err := fmt.Fprintf(f.output, "%s\n", line)
+		err := f.writeLine(line)
 		if err != nil {
 			Warning("Register: filter output failed with: %v", err)
 		}
@@ -209,7 +817,7 @@ func (f *Filter) Register() {
 	if f.verbose {
 		log.Printf("%s.Register: %s\n", f.Name, line)
 	}
-	_, err := fmt.Fprintf(f.output, "%s\n", line)
+	err := f.writeLine(line)
 	if err != nil {
 		Warning("Register: ready output failed with: %v", err)
 	}
@@ -224,98 +832,238 @@ func requireArgs(name string, atoms []string, count int) bool {
 	return true
 }
 
-func lastAtom(line string, atoms []string, field int) string {
-	var index int
-	for i := 0; i < field; i++ {
-		index += (len(atoms[i]) + 1)
+// split a protocol line at '|' separators, returning the unescaped atoms and the offset
+// of each atom in line
+//
+// within an atom "\|" is a literal '|' and "\\" a literal backslash; any other
+// backslash is kept as is
+func splitAtoms(line string) ([]string, []int) {
+	atoms := []string{}
+	offsets := []int{0}
+	var atom strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && (line[i+1] == '|' || line[i+1] == '\\'):
+			i++
+			atom.WriteByte(line[i])
+		case line[i] == '|':
+			atoms = append(atoms, atom.String())
+			atom.Reset()
+			offsets = append(offsets, i+1)
+		default:
+			atom.WriteByte(line[i])
+		}
+	}
+	return append(atoms, atom.String()), offsets
+}
+
+// return value with the escape sequences of splitAtoms resolved
+func unescapeAtom(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+	var unescaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) && (value[i+1] == '|' || value[i+1] == '\\') {
+			i++
+		}
+		unescaped.WriteByte(value[i])
 	}
-	ret := line[index:]
-	return ret
+	return unescaped.String()
+}
+
+// return the raw remainder of line starting at atom field
+//
+// smtpd does not always escape '|' within atoms; free-form values such as the data-line
+// payload, auth username, and envelope addresses are always the final field and may
+// contain a bare separator, so they are taken from the unsplit line
+func lastAtom(line string, offsets []int, field int) string {
+	return line[offsets[field]:]
+}
+
+// return the unescaped remainder of line starting at atom field; only the data-line
+// payload, which is message content, is taken raw
+func finalAtom(line string, offsets []int, field int) string {
+	return unescapeAtom(lastAtom(line, offsets, field))
+}
+
+// run the filter until input EOF, returning an error if it cannot start
+func (f *Filter) Run() error {
+	return f.RunContext(context.Background())
 }
 
-func (f *Filter) Run() {
+// run the filter until input EOF or ctx is cancelled
+func (f *Filter) RunContext(ctx context.Context) error {
 	log.Printf("Starting %s v%s\n", f.Name, Version)
+	err := f.checkScoreChain()
+	if err != nil {
+		return Fatal(err)
+	}
 	if f.verbose {
 		log.Printf("%s: pid=%d uid=%d gid=%d\n", f.Name, os.Getpid(), os.Getuid(), os.Getgid())
 		log.Printf("%s: %s\n", f.Name, FormatJSON(f))
 	}
-	f.Config()
-	f.Register()
-	for f.input.Scan() {
-		line := f.input.Text()
-		atoms := strings.Split(line, "|")
-		if len(atoms) < 6 {
-			panic("failed parsing: '" + line + "'")
-		}
-		switch atoms[0] {
-		case "report":
-			name := atoms[FID_NAME]
-			sid := atoms[FID_SID]
-			switch name {
-			case "link-connect":
-				if requireArgs(name, atoms, 10) {
-					f.linkConnect(name, sid, atoms[6], atoms[7], atoms[8], atoms[9])
-				}
-			case "link-disconnect":
-				f.linkDisconnect(name, sid)
-			case "link-auth":
-				if requireArgs(name, atoms, 8) {
-					f.linkAuth(name, sid, atoms[6], atoms[7])
-				}
-			case "tx-reset":
-				if requireArgs(name, atoms, 7) {
-					f.txReset(name, sid, atoms[6])
-				}
-			case "tx-begin":
-				if requireArgs(name, atoms, 7) {
-					f.txBegin(name, sid, atoms[6])
-				}
-			case "tx-mail":
-				if requireArgs(name, atoms, 9) {
-					f.txMail(name, sid, atoms[6], atoms[7], atoms[8])
-				}
-			case "tx-rcpt":
-				if requireArgs(name, atoms, 9) {
-					f.txRcpt(name, sid, atoms[6], atoms[7], atoms[8])
+	if f.decisionSocket != nil {
+		defer f.decisionSocket.Close()
+	}
+	defer f.watchStrictSignal()()
+	defer f.saveReputation()
+	defer f.waitAudit()
+	defer f.waitLearn()
+	defer close(f.stopped)
+
+	// scan input in a separate goroutine so cancellation need not wait for a line
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		for f.input.Scan() {
+			select {
+			case lines <- f.input.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	configured := false
+	for {
+		select {
+		case <-ctx.Done():
+			closer, ok := f.reader.(io.Closer)
+			if ok {
+				closer.Close()
+			}
+			return ctx.Err()
+		case done := <-f.completions:
+			f.complete(done)
+		case line, ok := <-lines:
+			if !ok {
+				err := f.input.Err()
+				if err != nil {
+					Warning("input failed with %v", err)
 				}
-			case "tx-data":
-				if requireArgs(name, atoms, 8) {
-					f.txData(name, sid, atoms[6], atoms[7])
+				if !configured {
+					Warning("Config: unexpected EOF")
 				}
-			case "tx-commit":
-				if requireArgs(name, atoms, 8) {
-					f.txCommit(name, sid, atoms[6], atoms[7])
+				Warning("unexpected EOF")
+				// finish messages still being scanned
+				for f.inflight > 0 {
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					case done := <-f.completions:
+						f.complete(done)
+					}
 				}
-			case "tx-rollback":
-				if requireArgs(name, atoms, 7) {
-					f.txRollback(name, sid, atoms[6])
+				return nil
+			}
+			if !configured {
+				configured = f.configLine(line)
+				if configured {
+					// the subsystem's class config is selected; reloads may now read it
+					f.Register()
+					defer f.watchReloadSignal()()
+					defer f.watchRemoteConfig()()
+					defer f.watchClassConfig()()
 				}
+				continue
 			}
-		case "filter":
-			phase := atoms[FID_NAME]
-			sid := atoms[FID_SID]
-			token := atoms[FID_TOKEN]
-			switch phase {
-			case "data-line":
-				if requireArgs(phase, atoms, 8) {
-					f.dataLine(phase, sid, token, lastAtom(line, atoms, 7))
-				} else {
-					_, err := fmt.Fprintln(f.output, line)
-					if err != nil {
-						Warning("data line output failed with: %v", err)
-					}
+			// a malformed line is dropped; the rest of the stream is still served
+			err := f.ProcessLine(line)
+			if err != nil {
+				Warning("%s: %v", f.Name, err)
+			}
+		}
+	}
+}
 
+// parse and dispatch a single filter protocol line
+func (f *Filter) ProcessLine(line string) error {
+	atoms, offsets := splitAtoms(line)
+	if len(atoms) < 6 {
+		return fmt.Errorf("failed parsing: '%s'", line)
+	}
+	switch atoms[0] {
+	case "report":
+		name := atoms[FID_NAME]
+		sid := atoms[FID_SID]
+		switch name {
+		case "link-connect":
+			if requireArgs(name, atoms, 10) {
+				f.linkConnect(name, sid, atoms[6], atoms[7], atoms[8], atoms[9])
+			}
+		case "link-disconnect":
+			f.linkDisconnect(name, sid)
+		case "link-identify":
+			if requireArgs(name, atoms, 8) {
+				f.linkIdentify(name, sid, atoms[6], finalAtom(line, offsets, 7))
+			}
+		case "link-auth":
+			if requireArgs(name, atoms, 8) {
+				f.linkAuth(name, sid, atoms[6], finalAtom(line, offsets, 7))
+			}
+		case "tx-reset":
+			if requireArgs(name, atoms, 7) {
+				f.txReset(name, sid, atoms[6])
+			}
+		case "tx-begin":
+			if requireArgs(name, atoms, 7) {
+				f.txBegin(name, sid, atoms[6])
+			}
+		case "tx-mail":
+			if requireArgs(name, atoms, 9) {
+				f.txMail(name, sid, atoms[6], atoms[7], finalAtom(line, offsets, 8))
+			}
+		case "tx-rcpt":
+			if requireArgs(name, atoms, 9) {
+				f.txRcpt(name, sid, atoms[6], atoms[7], finalAtom(line, offsets, 8))
+			}
+		case "tx-data":
+			if requireArgs(name, atoms, 8) {
+				f.txData(name, sid, atoms[6], atoms[7])
+			}
+		case "tx-commit":
+			if requireArgs(name, atoms, 8) {
+				f.txCommit(name, sid, atoms[6], atoms[7])
+			}
+		case "tx-rollback":
+			if requireArgs(name, atoms, 7) {
+				f.txRollback(name, sid, atoms[6])
+			}
+		}
+	case "filter":
+		if len(atoms) <= FID_TOKEN {
+			return fmt.Errorf("missing filter token: '%s'", line)
+		}
+		phase := atoms[FID_NAME]
+		sid := atoms[FID_SID]
+		token := atoms[FID_TOKEN]
+		switch phase {
+		case "data-line":
+			if requireArgs(phase, atoms, 8) {
+				f.dataLine(phase, sid, token, lastAtom(line, offsets, 7))
+			} else {
+				err := f.writeLine(line)
+				if err != nil {
+					Warning("data line output failed with: %v", err)
 				}
+
 			}
-		default:
-			Warning("unexpected input: %v", line)
+		case "connect":
+			if requireArgs(phase, atoms, 9) {
+				f.connect(phase, sid, token, atoms[8])
+			}
+		case "rcpt-to":
+			if requireArgs(phase, atoms, 8) {
+				f.rcptTo(phase, sid, token, finalAtom(line, offsets, 7))
+			}
+		case "commit":
+			f.commit(phase, sid, token)
 		}
+	default:
+		Warning("unexpected input: %v", line)
 	}
-	err := f.input.Err()
-	if err != nil {
-		Warning("input failed with %v", err)
-	}
-	Warning("unexpected EOF")
+	return nil
 }
 
 func (f *Filter) getSession(name, sid string) *Session {
@@ -356,17 +1104,43 @@ func (f *Filter) linkConnect(name, sid, rdns, confirmed, src, dst string) {
 		Warning("%s.%s: existing session: %s", f.Name, name, sid)
 		return
 	}
-	f.Sessions[sid] = NewSession(sid, rdns, confirmed == "pass", src, dst)
+	// refuse to track new sessions beyond max_sessions; their data lines pass through unfiltered
+	if f.maxSessions > 0 && len(f.Sessions) >= f.maxSessions {
+		Warning("%s.%s: session limit (%d) reached; not tracking session %s", f.Name, name, f.maxSessions, sid)
+		f.count(COUNTER_SESSIONS_REFUSED)
+		return
+	}
+	session := NewSession(sid, rdns, confirmed == "pass", src, dst)
+	if f.geoip != nil {
+		f.locateSession(name, session)
+	}
+	f.Sessions[sid] = session
 }
 
 func (f *Filter) linkDisconnect(name, sid string) {
 	if f.verbose {
 		log.Printf("%s.%s: session=%s\n", f.Name, name, sid)
 	}
-	f.getSession(name, sid)
+	session := f.getSession(name, sid)
+	if session != nil {
+		for _, message := range session.Messages {
+			f.countAborted(name, session, message)
+		}
+	}
 	delete(f.Sessions, sid)
 }
 
+// count a transaction that ended before reaching the data phase
+func (f *Filter) countAborted(name string, session *Session, message *Message) {
+	switch message.State {
+	case "mail", "rcpt":
+		if f.verbose {
+			log.Printf("%s.%s: session=%s message=%s aborted before data\n", f.Name, name, session.Id, message.Id)
+		}
+		f.count(COUNTER_ABORTED_BEFORE_DATA)
+	}
+}
+
 func (f *Filter) linkAuth(name, sid, result, username string) {
 	if f.verbose {
 		log.Printf("%s.%s: session=%s result=%s username=%s\n", f.Name, name, sid, result, username)
@@ -378,18 +1152,26 @@ func (f *Filter) linkAuth(name, sid, result, username string) {
 }
 
 func (f *Filter) txReset(name, sid, mid string) {
+	name = txLogName(name, sid, mid)
 	if f.verbose {
 		log.Printf("%s.%s: session=%s message=%s\n", f.Name, name, sid, mid)
 	}
-	session, _ := f.getSessionMessage(name, sid, mid)
-	if session != nil {
+	session := f.getSession(name, sid)
+	if session == nil {
+		return
+	}
+	// committed and rolled back messages have already been released
+	message, ok := session.Messages[mid]
+	if ok {
+		f.countAborted(name, session, message)
 		session.Messages[mid] = NewMessage(mid)
 	}
 }
 
 func (f *Filter) txBegin(name, sid, mid string) {
+	name = txLogName(name, sid, mid)
 	if f.verbose {
-		log.Printf("%s %s: session=%s message=%s\n", f.Name, name, sid, mid)
+		log.Printf("%s.%s: session=%s message=%s\n", f.Name, name, sid, mid)
 	}
 	session := f.getSession(name, sid)
 	if session == nil {
@@ -397,21 +1179,23 @@ func (f *Filter) txBegin(name, sid, mid string) {
 	}
 	_, ok := session.Messages[mid]
 	if ok {
-		log.Fatal(Fatalf("%s: in session %s for existing message %s", name, sid, mid))
+		Warning("%s.%s: in session %s for existing message %s", f.Name, name, sid, mid)
 		return
 	}
 	session.Messages[mid] = NewMessage(mid)
 }
 
 func (f *Filter) txMail(name, sid, mid, result, address string) {
+	name = txLogName(name, sid, mid)
 	if f.verbose {
 		log.Printf("%s.%s: session=%s message=%s\n", f.Name, name, sid, mid)
 	}
-	_, message := f.getSessionMessage(name, sid, mid)
+	_, message := f.txMessage(name, sid, mid)
 	if message != nil && result == "ok" {
+		message.State = "mail"
 		address, ok := f.parseEmailAddress(address)
 		if ok {
-			message.EnvelopeFrom = append(message.EnvelopeFrom, address)
+			message.EnvelopeFrom = f.appendAddress(name, message.EnvelopeFrom, address)
 		} else {
 			Warning("%s.%s: WARNING failed parsing envelopeFrom: %s", f.Name, name, address)
 		}
@@ -419,14 +1203,20 @@ func (f *Filter) txMail(name, sid, mid, result, address string) {
 }
 
 func (f *Filter) txRcpt(name, sid, mid, result, address string) {
+	name = txLogName(name, sid, mid)
 	if f.verbose {
 		log.Printf("%s.%s: session=%s message=%s result=%s address=%s\n", f.Name, name, sid, mid, result, address)
 	}
-	_, message := f.getSessionMessage(name, sid, mid)
+	_, message := f.txMessage(name, sid, mid)
 	if message != nil && result == "ok" {
+		message.State = "rcpt"
 		address, ok := f.parseEmailAddress(address)
 		if ok {
-			message.EnvelopeTo = append(message.EnvelopeTo, address)
+			if f.hasRecipient(message, address) {
+				log.Printf("%s.%s: ignoring duplicate recipient: %s\n", f.Name, name, address)
+				return
+			}
+			message.EnvelopeTo = f.appendAddress(name, message.EnvelopeTo, address)
 		} else {
 			Warning("%s.%s: WARNING failed parsing envelopeTo: %s", f.Name, name, address)
 		}
@@ -435,10 +1225,11 @@ func (f *Filter) txRcpt(name, sid, mid, result, address string) {
 }
 
 func (f *Filter) txData(name, sid, mid, result string) {
+	name = txLogName(name, sid, mid)
 	if f.verbose {
 		log.Printf("%s.%s: session=%s message=%s\n", f.Name, name, sid, mid)
 	}
-	session, message := f.getSessionMessage(name, sid, mid)
+	session, message := f.txMessage(name, sid, mid)
 	if session != nil && message != nil && result == "ok" {
 		session.DataMessage = mid
 		message.State = "data"
@@ -447,26 +1238,93 @@ func (f *Filter) txData(name, sid, mid, result string) {
 }
 
 func (f *Filter) txCommit(name, sid, mid, size string) {
+	name = txLogName(name, sid, mid)
 	if f.verbose {
 		log.Printf("%s.%s: session=%s message=%s size=%s\n", f.Name, name, sid, mid, size)
 	}
-	_, message := f.getSessionMessage(name, sid, mid)
+	session, message := f.getSessionMessage(name, sid, mid)
 	if message != nil {
 		message.State = "commit"
+		session.releaseMessage(mid)
 	}
 }
 
 func (f *Filter) txRollback(name, sid, mid string) {
+	name = txLogName(name, sid, mid)
 	if f.verbose {
 		log.Printf("%s.%s: session=%s message=%s\n", f.Name, name, sid, mid)
 	}
-	_, message := f.getSessionMessage(name, sid, mid)
+	session, message := f.getSessionMessage(name, sid, mid)
 	if message != nil {
+		f.countAborted(name, session, message)
 		message.State = "rollback"
+		session.releaseMessage(mid)
 	}
 }
 
-func (f *Filter) sessionTimeout(name, sid string) {
+// return the session and message for a transaction event, creating state missed through out-of-order events
+func (f *Filter) txMessage(name, sid, mid string) (*Session, *Message) {
+	session, ok := f.Sessions[sid]
+	if !ok {
+		Warning("%s.%s: out-of-order event for unknown session %s; creating session", f.Name, name, sid)
+		f.count(COUNTER_OUT_OF_ORDER)
+		if f.maxSessions > 0 && len(f.Sessions) >= f.maxSessions {
+			Warning("%s.%s: session limit (%d) reached; not tracking session %s", f.Name, name, f.maxSessions, sid)
+			f.count(COUNTER_SESSIONS_REFUSED)
+			return nil, nil
+		}
+		session = NewSession(sid, "", false, "", "")
+		f.Sessions[sid] = session
+	}
+	message, ok := session.Messages[mid]
+	if !ok {
+		Warning("%s.%s: out-of-order event for unknown message %s in session %s; creating message", f.Name, name, mid, sid)
+		f.count(COUNTER_OUT_OF_ORDER)
+		message = NewMessage(mid)
+		session.Messages[mid] = message
+	}
+	return session, message
+}
+
+// return an event name tagged with the message correlation id, for log lines about the message
+func logName(name string, session *Session, message *Message) string {
+	return txLogName(name, session.Id, message.Id)
+}
+
+// return an event name tagged with the correlation id of a transaction event's session and message ids
+func txLogName(name, sid, mid string) string {
+	return fmt.Sprintf("%s[%s.%s]", name, sid, mid)
+}
+
+// remove a completed transaction's message from the session
+func (s *Session) releaseMessage(mid string) {
+	delete(s.Messages, mid)
+	if s.DataMessage == mid {
+		s.DataMessage = ""
+	}
+}
+
+// return true if address is already an envelope recipient, ignoring case and aliases
+func (f *Filter) hasRecipient(message *Message, address string) bool {
+	normalized := strings.ToLower(f.resolveAlias(address))
+	for _, recipient := range message.EnvelopeTo {
+		if strings.ToLower(f.resolveAlias(recipient)) == normalized {
+			return true
+		}
+	}
+	return false
+}
+
+// append an address to a message address list, bounded by max_addresses (0 for no limit)
+func (f *Filter) appendAddress(name string, list []string, address string) []string {
+	if f.maxAddresses > 0 && len(list) >= f.maxAddresses {
+		Warning("%s.%s: address limit (%d) reached; ignoring %s", f.Name, name, f.maxAddresses, address)
+		return list
+	}
+	return append(list, address)
+}
+
+func (f *Filter) sessionTimeout(name, sid string) {
 	if f.verbose {
 		log.Printf("%s.%s: session=%s\n", f.Name, name, sid)
 	}
@@ -475,40 +1333,127 @@ func (f *Filter) sessionTimeout(name, sid string) {
 }
 
 func (f *Filter) dataLine(name, sid, token, line string) {
-	if f.verbose {
-		log.Printf("%s.%s: sid=%s token=%s line=%s\n", f.Name, name, sid, token, line)
-	}
 	lines := []string{line}
+	var message *Message
 	session := f.getSession(name, sid)
+	if session != nil && session.DataMessage == "" {
+		// data-line without a preceding tx-data; pass the line through
+		log.Printf("%s.%s: session=%s data-line received before tx-data; passing through\n", f.Name, name, sid)
+		session = nil
+	}
 	if session != nil {
-		_, message := f.getSessionMessage(name, sid, session.DataMessage)
-		if message != nil && message.InHeader {
-			if strings.TrimSpace(line) == "" {
-				message.InHeader = false
-			}
-			lines = f.filterDataLine(name, session, message, line)
-		}
+		_, message = f.getSessionMessage(name, sid, session.DataMessage)
+	}
+	if message != nil {
+		name = logName(name, session, message)
+	}
+	if f.verbose {
+		log.Printf("%s.%s: sid=%s token=%s line=%s\n", f.Name, name, sid, token, line)
+	}
+	if message != nil && message.InHeader && !message.HeadersGenerated {
+		lines = f.filterDataLine(name, session, message, line)
+	}
+	if message != nil && message.Scan != nil {
+		lines = f.captureScan(name, sid, token, session, message, lines)
+	}
+	f.writeDataLines(name, sid, token, session, message, lines)
+}
+
+// write filtered data lines, first capturing them for quarantine, audit and learning
+func (f *Filter) writeDataLines(name, sid, token string, session *Session, message *Message, lines []string) {
+	if message != nil && message.Hold != nil {
+		message.Hold.hold(sid, token, lines)
+		return
+	}
+	if message != nil && message.Quarantine != nil {
+		f.captureQuarantine(name, session, message, lines)
+	}
+	if message != nil && message.Audit != nil {
+		f.captureAudit(name, session, message, lines)
+	}
+	if message != nil && message.Learn != nil {
+		f.captureLearn(name, message, lines)
 	}
 	for _, oline := range lines {
-		_, err := fmt.Fprintf(f.output, "filter-dataline|%s|%s|%s\n", sid, token, oline)
+		err := f.writeDataLine(sid, token, oline)
 		if err != nil {
 			Warning("data line output failed with: %v", err)
 		}
 	}
 }
 
-func (f *Filter) parseSpamScore(line string) float32 {
-	fields := strings.Split(line, " ")
+func (f *Filter) parseSpamScore(line string) (float32, error) {
+	fields := strings.Fields(line)
 	if len(fields) < 2 {
-		Warning("spam score parse failed: %s", line)
-		return float32(0)
+		return float32(0), fmt.Errorf("spam score not found: %s", line)
+	}
+	return f.parseScoreValue(fields[1])
+}
+
+// parse the score= value from a SpamAssassin style X-Spam-Status header
+func (f *Filter) parseStatusScore(line string) (float32, error) {
+	groups := STATUS_SCORE_PATTERN.FindStringSubmatch(line)
+	if len(groups) != 2 {
+		return float32(0), fmt.Errorf("status score not found: %s", line)
+	}
+	return f.parseScoreValue(strings.TrimRight(groups[1], ","))
+}
+
+func (f *Filter) parseScoreValue(value string) (float32, error) {
+	if f.commaDecimal && !strings.Contains(value, ".") && strings.Count(value, ",") == 1 {
+		// some scanners emit the score with a locale comma decimal separator
+		value = strings.Replace(value, ",", ".", 1)
 	}
-	score, err := strconv.ParseFloat(fields[1], 32)
+	score, err := strconv.ParseFloat(value, 32)
 	if err != nil {
-		Warning("ParseFloat failed with: %v", err)
-		return float32(0)
+		return float32(0), fmt.Errorf("spam score parse failed: %v", err)
 	}
-	return float32(score)
+	return float32(score), nil
+}
+
+// remove CR, LF and other control characters from a header value
+func sanitizeHeaderValue(value string) (string, bool) {
+	clean := strings.Map(func(r rune) rune {
+		if r != '\t' && unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, value)
+	return clean, clean != value
+}
+
+// remove control characters from an address header value, warning of possible header injection
+func (f *Filter) sanitizeAddress(name, value string) string {
+	clean, dirty := sanitizeHeaderValue(value)
+	if dirty {
+		Warning("%s.%s: control characters in address header (possible header injection): %q", f.Name, name, value)
+	}
+	return clean
+}
+
+// return a generated header line with a sanitized value
+func (f *Filter) formatHeader(name, value string) string {
+	value, dirty := sanitizeHeaderValue(value)
+	if dirty {
+		Warning("%s: removed control characters in generated %s header", f.Name, name)
+	}
+	return name + ": " + value
+}
+
+// write a protocol line with the configured terminator, rejecting embedded line breaks
+func (f *Filter) writeLine(line string) error {
+	if strings.ContainsAny(line, "\r\n") {
+		return fmt.Errorf("refusing to write line containing line break: %q", line)
+	}
+	_, err := io.WriteString(f.output, line+f.terminator)
+	return err
+}
+
+// write a data line; message lines are copied unchanged, generated headers being sanitized
+// by formatHeader, and the payload is the last protocol field so '|' needs no escaping
+func (f *Filter) writeDataLine(sid, token, line string) error {
+	_, err := io.WriteString(f.output, fmt.Sprintf("filter-dataline|%s|%s|%s", sid, token, line)+f.terminator)
+	return err
 }
 
 func (f *Filter) parseEmailAddress(address string) (string, bool) {
@@ -523,8 +1468,56 @@ func (f *Filter) parseEmailAddress(address string) (string, bool) {
 	return parsed, true
 }
 
-func (f *Filter) readClasses(filename string) (*classes.SpamClasses, error) {
-	spamClasses, err := classes.New(filename)
+// return an email-like token in the display name of a From value differing from the actual address
+func (f *Filter) displayNameAddress(value, address string) (string, bool) {
+	display, _, found := strings.Cut(value, "<")
+	if !found {
+		return "", false
+	}
+	tokens := strings.FieldsFunc(display, func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune("\"'()[],;:", r)
+	})
+	for _, token := range tokens {
+		parsed, ok := f.parseEmailAddress(token)
+		if ok && !strings.EqualFold(parsed, address) {
+			return parsed, true
+		}
+	}
+	return "", false
+}
+
+func (f *Filter) readClasses(config *classConfig) (*classes.SpamClasses, error) {
+	filename := config.Filename
+	if filename != "" && !config.Exists {
+		if !f.defaultOnMissing {
+			return nil, fmt.Errorf("class config file not found: %s", filename)
+		}
+		Warning("%s: class config file %s not found; using the default classes", f.Name, filename)
+	}
+	_, err := classConfigFormat(filename)
+	if err != nil {
+		return nil, err
+	}
+	for _, problem := range config.Problems {
+		// empty lists are reported below
+		if problem.Message != PROBLEM_EMPTY_LIST {
+			Warning("%s: skipping invalid class config entry %s", f.Name, problem.format(filename))
+		}
+	}
+	spamClasses, err := readClassTables(config)
+	if err != nil {
+		return nil, err
+	}
+	empty, err := emptyClassTables(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, address := range empty {
+		// the classes library would reduce an empty list to the spam class alone
+		Warning("%s: empty class list for %s in %s; using the default classes", f.Name, address, filename)
+		delete(spamClasses.Classes, address)
+	}
+	err = f.applyThresholdEnv(spamClasses)
 	if err != nil {
 		return nil, err
 	}
@@ -534,101 +1527,948 @@ func (f *Filter) readClasses(filename string) (*classes.SpamClasses, error) {
 	return spamClasses, nil
 }
 
-func (f *Filter) filterDataLine(name string, session *Session, message *Message, line string) []string {
+// return a header line renamed with the X-Original- prefix: "X-Spam: yes" becomes "X-Original-Spam: yes"
+func originalHeader(line string) string {
+	name, value, _ := strings.Cut(line, ":")
+	if len(name) > 2 && strings.EqualFold(name[:2], "x-") {
+		name = name[2:]
+	}
+	return "X-Original-" + textproto.CanonicalMIMEHeaderKey(name) + ":" + value
+}
 
-	output := []string{line}
-	switch {
+// return true if line is a folded continuation of the previous header line
+func isContinuation(line string) bool {
+	return (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && strings.TrimSpace(line) != ""
+}
+
+// return an unfolded header line with a canonical name and one space after the colon,
+// so "to:\tuser@example.org", as unfolded from a value starting on a continuation line,
+// becomes "To: user@example.org"
+func normalizeHeader(line string) string {
+	header, ok := headerName(line)
+	if !ok {
+		return line
+	}
+	_, value, _ := strings.Cut(line, ":")
+	return textproto.CanonicalMIMEHeaderKey(header) + ": " + strings.TrimLeft(value, " \t")
+}
+
+// return the name of the header on line, or false if line is not a header
+func headerName(line string) (string, bool) {
+	name, _, found := strings.Cut(line, ":")
+	if !found || name == "" || strings.ContainsAny(name, " \t") {
+		return "", false
+	}
+	return name, true
+}
 
+// headers read by the filter which generated headers must not replace
+var SOURCE_HEADERS = []string{"X-Spam-Score", "X-Spam-Status", "To", "From", "Received", "Authentication-Results"}
+
+// check that generated header names are valid and distinct from each other and from source headers
+func (f *Filter) validateHeaderNames() error {
+	roles := make(map[string]string)
+	for _, name := range SOURCE_HEADERS {
+		roles[strings.ToLower(name)] = "source header " + name
+	}
+	for _, header := range f.scoreHeaders {
+		roles[strings.ToLower(header.Name)] = "source header " + header.Name
+	}
+	check := func(role, name string) error {
+		if name == "" {
+			return nil
+		}
+		_, ok := headerName(name + ":")
+		if !ok {
+			return fmt.Errorf("invalid %s: '%s'", role, name)
+		}
+		other, ok := roles[strings.ToLower(name)]
+		if ok && other != role {
+			return fmt.Errorf("%s '%s' collides with %s", role, name, other)
+		}
+		roles[strings.ToLower(name)] = role
+		return nil
+	}
+	generated := [][]string{
+		{"class_header", f.Headers.ClassHeader},
+		{"flag_header", f.Headers.FlagHeader},
+		{"label_header", f.labelHeader},
+		{"original_score_header", f.scoreHeader},
+	}
+	if f.level != nil {
+		generated = append(generated, []string{"level_header", f.level.Header})
+	}
+	if f.dates != nil {
+		generated = append(generated, []string{"date_anomaly_header", f.dates.Header})
+	}
+	generated = append(generated, []string{"reason_header", f.reasonHeader}, []string{"report_header", f.reportHeaderName}, []string{"decision_hash_header", f.hashHeader}, []string{"list_header", f.listHeaderName}, []string{"score_inputs_header", f.scoreInputsHeader})
+	for _, names := range f.rcptHeaders {
+		generated = append(generated, []string{"class_header", names.ClassHeader}, []string{"flag_header", names.FlagHeader})
+	}
+	for _, name := range f.classHeaderNames() {
+		generated = append(generated, []string{"class_headers", name})
+	}
+	for _, header := range generated {
+		err := check(header[0], header[1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// return true if the header on line matches the strip list
+// names are matched case-insensitively; a trailing '*' matches any suffix
+func (f *Filter) isStripped(line string) bool {
+	if matchHeader(line, f.StripHeaders) {
+		return true
+	}
+	// strip_header_patterns are matched against the header name, ignoring case
+	name, ok := headerName(line)
+	if !ok {
+		return false
+	}
+	for _, pattern := range f.stripPatterns {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// return true if the header of line matches a name pattern; a trailing '*' matches any suffix
+func matchHeader(line string, patterns []string) bool {
+	name, ok := headerName(line)
+	if !ok {
+		return false
+	}
+	name = strings.ToLower(name)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		prefix, wildcard := strings.CutSuffix(pattern, "*")
+		if wildcard && strings.HasPrefix(name, prefix) {
+			return true
+		}
+		if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// return the canonical address for an alias, following alias chains up to MAX_ALIAS_DEPTH
+func (f *Filter) resolveAlias(address string) string {
+	resolved := address
+	for depth := 0; depth < MAX_ALIAS_DEPTH; depth++ {
+		canonical, ok := f.aliases[strings.ToLower(resolved)]
+		if !ok {
+			return resolved
+		}
+		resolved = canonical
+	}
+	Warning("%s: alias chain for %s exceeds depth %d; using %s", f.Name, address, MAX_ALIAS_DEPTH, resolved)
+	return resolved
+}
+
+// return the generated header names for address, checking the address,
+// then its domain, falling back to the global header names
+func (f *Filter) headerNames(address string) HeaderNames {
+	names := f.Headers
+	_, domain, _ := strings.Cut(address, "@")
+	for _, key := range []string{strings.ToLower(address), strings.ToLower(domain)} {
+		override, ok := f.rcptHeaders[key]
+		if ok {
+			if override.ClassHeader != "" {
+				names.ClassHeader = override.ClassHeader
+			}
+			if override.FlagHeader != "" {
+				names.FlagHeader = override.FlagHeader
+			}
+			break
+		}
+	}
+	return names
+}
+
+// parse a complete (unfolded) header, including headers that are stripped from the output
+func (f *Filter) parseHeader(name string, message *Message, line string) {
+	f.parseScoreHeader(name, message, line)
+	line = normalizeHeader(line)
+	switch {
 	case strings.HasPrefix(line, "X-Spam-Score: "):
-		message.SpamScore = f.parseSpamScore(line)
-		message.SpamScoreSet = true
+		f.parseRequired(message, SCORE_REQUIRED_PATTERN, line)
 
-	case strings.HasPrefix(line, "X-Spam: "):
-		// remove original 'X-Spam' header
-		return []string{}
+	case strings.HasPrefix(line, "X-Spam-Status: "):
+		message.Symbols = append(message.Symbols, parseStatusSymbols(line)...)
+		f.parseRequired(message, STATUS_REQUIRED_PATTERN, line)
+		score, err := f.parseStatusScore(line)
+		if err != nil {
+			if f.scoreSource != SCORE_SOURCE_SCORE {
+				Warning("%s.%s: %v", f.Name, name, err)
+			}
+			return
+		}
+		message.StatusScore = f.combineScores(message.StatusScore, message.StatusScoreSet, score)
+		message.StatusScoreSet = true
 
-	case strings.HasPrefix(line, "X-Spam-Class: "):
-		// remove original 'X-Spam-Class' header
-		return []string{}
+	case strings.HasPrefix(line, "X-Spamd-Result: "):
+		message.Symbols = append(message.Symbols, parseSpamdSymbols(line)...)
+		f.parseRequired(message, SPAMD_REQUIRED_PATTERN, line)
+
+	case strings.HasPrefix(line, "Authentication-Results: "):
+		if f.usesAuthResults() {
+			f.parseAuthResults(name, message, line)
+		}
+
+	case strings.HasPrefix(line, "Arc-Seal: "):
+		if f.authScores != nil && f.authScores.ARCTrust {
+			f.parseARCSeal(message, line)
+		}
+
+	case strings.HasPrefix(line, "Arc-Authentication-Results: "):
+		if f.authScores != nil && f.authScores.ARCTrust {
+			f.parseARCAuthResults(message, line)
+		}
 
 	case strings.HasPrefix(line, "To: "):
 		_, value, ok := strings.Cut(line, " ")
 		if !ok {
 			log.Printf("%s.%s: missing address in: %s\n", f.Name, name, line)
 		}
+		value = f.sanitizeAddress(name, value)
 		address, ok := f.parseEmailAddress(value)
 		if !ok {
-			log.Printf("%s.%s: failed parsing From address: %s\n", f.Name, name, line)
-			return output
+			log.Printf("%s.%s: failed parsing To address: %s\n", f.Name, name, line)
+			return
 		}
-		message.To = append(message.To, address)
+		message.To = f.appendAddress(name, message.To, address)
+
+	case strings.HasPrefix(line, "X-Original-To: "):
+		address, ok := f.parseEmailAddress(f.sanitizeAddress(name, strings.TrimPrefix(line, "X-Original-To: ")))
+		if ok && message.OriginalTo == "" {
+			message.OriginalTo = address
+		}
+
+	case strings.HasPrefix(line, "Delivered-To: "):
+		address, ok := f.parseEmailAddress(f.sanitizeAddress(name, strings.TrimPrefix(line, "Delivered-To: ")))
+		if ok && message.DeliveredTo == "" {
+			message.DeliveredTo = address
+		}
+
+	case strings.HasPrefix(line, "Date: "):
+		f.parseDate(name, message, line)
 
 	case strings.HasPrefix(line, "From: "):
 		_, value, ok := strings.Cut(line, " ")
 		if !ok {
 			log.Printf("%s.%s: missing address in: %s\n", f.Name, name, line)
 		}
+		value = f.sanitizeAddress(name, value)
 		address, ok := f.parseEmailAddress(value)
 		if !ok {
 			log.Printf("%s.%s: failed parsing From address: %s\n", f.Name, name, line)
-			return output
+			return
 		}
-		message.From = append(message.From, address)
+		spoofed, ok := f.displayNameAddress(value, address)
+		if ok {
+			log.Printf("%s.%s: From display name address %s differs from %s\n", f.Name, name, spoofed, address)
+			message.DisplayNameSpoof = true
+		}
+		message.From = f.appendAddress(name, message.From, address)
+	}
+}
 
-	case strings.TrimSpace(line) == "":
+// parse the required score from a score header, keeping the first value found
+func (f *Filter) parseRequired(message *Message, pattern *regexp.Regexp, line string) {
+	if message.RequiredSet {
+		return
+	}
+	groups := pattern.FindStringSubmatch(line)
+	if len(groups) != 2 {
+		return
+	}
+	required, err := f.parseScoreValue(strings.TrimRight(groups[1], ","))
+	if err != nil {
+		return
+	}
+	message.Required = required
+	message.RequiredSet = true
+}
 
-		if f.verbose {
-			log.Printf("%s.%s: generating headers for message: %s\n", f.Name, name, FormatJSON(message))
+// return true if the score is below min_confidence_ratio of the required score
+func (f *Filter) belowConfidence(message *Message, score float32) bool {
+	if f.minConfidence <= 0 || !message.RequiredSet || message.Required <= 0 {
+		return false
+	}
+	return float64(score/message.Required) < f.minConfidence
+}
+
+// parse the pending header once all of its continuation lines have been read
+func (f *Filter) parsePendingHeader(name string, message *Message) {
+	if message.Pending != "" {
+		f.parseHeader(name, message, message.Pending)
+		message.Pending = ""
+	}
+}
+
+// return the symbol names from the tests= list of an X-Spam-Status header
+func parseStatusSymbols(line string) []string {
+	symbols := []string{}
+	groups := STATUS_TESTS_PATTERN.FindStringSubmatch(line)
+	if len(groups) != 3 {
+		return symbols
+	}
+	for _, field := range strings.Split(groups[1]+groups[2], ",") {
+		symbol, _, _ := strings.Cut(strings.TrimSpace(field), "=")
+		// SpamAssassin reports tests=none when no rule matched
+		if symbol != "" && symbol != "none" {
+			symbols = append(symbols, symbol)
 		}
+	}
+	return symbols
+}
 
-		// end of headers reached, generate X-Spam-Class, X-Spam headers
-		if !message.SpamScoreSet {
-			log.Printf("%s.%s: X-Spam-Score header not found\n", f.Name, name)
-			return output
+// return the symbol names from an unfolded rspamd X-Spamd-Result header:
+// "default: False [1.15 / 15.00]; ARC_NA(0.00)[]; MIME_GOOD(-0.10)[text/plain]"
+func parseSpamdSymbols(line string) []string {
+	symbols := []string{}
+	for _, field := range strings.Split(line, ";") {
+		groups := SPAMD_SYMBOL_PATTERN.FindStringSubmatch(field)
+		if len(groups) == 2 {
+			symbols = append(symbols, groups[1])
 		}
+	}
+	return symbols
+}
 
-		if len(message.To) < 1 {
-			log.Printf("%s.%s: missing To address'\n", f.Name, name)
-			return output
+// return the first message symbol found in the dangerous_symbols list
+func (f *Filter) dangerousSymbol(message *Message) (string, bool) {
+	for _, symbol := range message.Symbols {
+		if f.dangerousSymbols[strings.ToUpper(symbol)] {
+			return symbol, true
 		}
+	}
+	return "", false
+}
 
-		if len(message.EnvelopeTo) < 1 {
-			log.Printf("%s.%s: missing EnvelopeTo address'\n", f.Name, name)
-			return output
+// combine a score with a previously parsed one according to score_combine
+func (f *Filter) combineScores(current float32, set bool, score float32) float32 {
+	if !set {
+		return score
+	}
+	switch f.scoreCombine {
+	case SCORE_COMBINE_FIRST:
+		return current
+	case SCORE_COMBINE_MAX:
+		return max(current, score)
+	case SCORE_COMBINE_MIN:
+		return min(current, score)
+	}
+	return score
+}
+
+// return the score used for classification as selected by score_source
+func (f *Filter) messageScore(message *Message) (float32, bool) {
+	switch f.scoreSource {
+	case SCORE_SOURCE_STATUS:
+		return message.StatusScore, message.StatusScoreSet
+	case SCORE_SOURCE_MAX_OF_BOTH:
+		switch {
+		case message.SpamScoreSet && message.StatusScoreSet:
+			return max(message.SpamScore, message.StatusScore), true
+		case message.StatusScoreSet:
+			return message.StatusScore, true
+		}
+	case SCORE_SOURCE_BOTH:
+		if message.StatusScoreSet {
+			return f.combineScores(message.SpamScore, message.SpamScoreSet, message.StatusScore), true
 		}
+	}
+	return message.SpamScore, message.SpamScoreSet
+}
 
-		if message.EnvelopeTo[0] != message.To[0] {
-			log.Printf("%s.%s: WARNING envelopeTo (%s) mismatches initial To (%s)\n", f.Name, name, message.EnvelopeTo, message.To[0])
+func (f *Filter) filterDataLine(name string, session *Session, message *Message, line string) []string {
+
+	// end of headers reached, or a message with no body
+	if line == "." || strings.TrimSpace(line) == "" {
+		return append(f.endHeaders(name, session, message), line)
+	}
+
+	// retain the original header lines for messages passed through unmodified
+	message.Raw = append(message.Raw, line)
+
+	// unfold continuation lines, removing those of stripped headers
+	if isContinuation(line) {
+		message.Pending += line
+		if !message.Stripping {
+			message.Headers = append(message.Headers, line)
 		}
+		return []string{}
+	}
+	f.parsePendingHeader(name, message)
+	message.Pending = line
+	message.Stripping = false
+
+	if matchHeader(line, f.preserveHeaders) {
+		// keep upstream copies of generated headers under another name
+		line = originalHeader(line)
+	} else if f.isStripped(line) {
+		// remove original generated headers and configured strip headers
+		message.Stripping = true
+		return []string{}
+	}
+
+	// buffer header lines until the end of headers
+	message.Headers = append(message.Headers, line)
+	if len(message.Headers) > f.maxHeaderLines {
+		Warning("%s.%s: header line limit (%d) exceeded; passing message unclassified", f.Name, name, f.maxHeaderLines)
+		output := message.Headers
+		message.Headers = nil
+		message.Raw = nil
+		message.InHeader = false
+		message.HeadersGenerated = true
+		return output
+	}
+	return []string{}
+}
+
+// return the buffered header lines with the generated headers added
+func (f *Filter) endHeaders(name string, session *Session, message *Message) []string {
+	f.parsePendingHeader(name, message)
+	f.combineScoreInputs(message)
+	headers := message.Headers
+	raw := message.Raw
+	message.Headers = nil
+	message.Raw = nil
+	message.InHeader = false
+
+	// generate headers only once per message; later blank lines are body
+	if message.HeadersGenerated {
+		return headers
+	}
+	message.HeadersGenerated = true
+
+	// messages reaching a buffered score source are held until scored
+	output, scored := f.scoreMessage(name, session, message, headers, raw)
+	if !scored {
+		return []string{}
+	}
+	return output
+}
+
+// return the message header lines with the generated headers added
+func (f *Filter) generateHeaders(name string, session *Session, message *Message, headers, raw []string) []string {
+
+	top := []string{}
+	bottom := []string{}
+
+	if f.verbose {
+		log.Printf("%s.%s: generating headers for message: %s\n", f.Name, name, FormatJSON(message))
+	}
+
+	// broadcast transactions are passed through unclassified, with forged upstream copies of our headers stripped
+	if f.maxClassifyRcpts > 0 && len(message.EnvelopeTo) > f.maxClassifyRcpts {
+		log.Printf("%s.%s: %d recipients exceeds max_recipients_for_classify (%d); passing message unclassified\n", f.Name, name, len(message.EnvelopeTo), f.maxClassifyRcpts)
+		return headers
+	}
+
+	address, ok := f.classKeyAddress(name, session, message)
+	if !ok {
+		return headers
+	}
+
+	// pass messages for ignored domains through untouched
+	_, domain, _ := strings.Cut(address, "@")
+	if f.ignoreDomains[strings.ToLower(domain)] {
+		log.Printf("%s.%s: ignoring message for %s\n", f.Name, name, address)
+		return raw
+	}
+
+	if f.trusted != nil && f.trustedSkip(name, session) {
+		return raw
+	}
+
+	// messages for recipients without a class table are not our mail
+	if f.unmatchedPass && f.classifier == nil {
+		_, configured := f.classKey(f.getClasses(), address)
+		if !configured {
+			log.Printf("%s.%s: no class table for %s; passing message unmodified\n", f.Name, name, address)
+			return raw
+		}
+	}
+
+	// end of headers reached, generate X-Spam-Class, X-Spam headers
+	score, ok := f.messageScore(message)
+	if !ok {
+		log.Printf("%s.%s: spam score header not found\n", f.Name, name)
+		return headers
+	}
+	original := score
+
+	delta := f.strictDelta()
+	if delta != 0 {
+		score += delta
+		log.Printf("%s.%s: strict mode adds %v to score\n", f.Name, name, delta)
+	}
+
+	anomaly, anomalous := f.dateAnomaly(message)
+	if anomalous {
+		log.Printf("%s.%s: %s message date %s\n", f.Name, name, anomaly, message.Date.Format(time.RFC1123Z))
+		if f.dates.Action == DATE_ACTION_SCORE {
+			score += f.dates.Score
+		}
+	}
 
-		name, domain, found := strings.Cut(message.To[0], "@")
-		if !found {
-			log.Printf("%s.%s: '@' not found in To address: %v\n", f.Name, name, message.To)
-			return output
+	if message.DisplayNameSpoof && f.spoofAction == SPOOF_ACTION_SCORE {
+		score += f.spoofScore
+		log.Printf("%s.%s: display name spoof adds %v to score\n", f.Name, name, f.spoofScore)
+	}
+
+	if session.DNSBLScore != 0 {
+		score += session.DNSBLScore
+		log.Printf("%s.%s: DNSBL listing in %s adds %v to score\n", f.Name, name, strings.Join(session.DNSBLZones, ","), session.DNSBLScore)
+	}
+
+	score += f.heloScore(name, session)
+	score += f.rdnsScore(name, session)
+	score += f.authResultsScore(name, message)
+	score += f.geoipScore(name, session)
+
+	names := f.headerNames(address)
+
+	// generate new X-Spam-Class header, recording the input deciding the class
+	spamClass := f.getClass([]string{address}, score)
+	reason := "threshold"
+	if f.classifier != nil {
+		reason = "classifier"
+	}
+	if f.verbose {
+		log.Printf("%s.%s: GetClass(%v, %v) returned %s\n", f.Name, name, []string{address}, score, FormatJSON(spamClass))
+	}
+
+	if f.recipientPolicy == RECIPIENT_POLICY_STRICTEST {
+		strictest := f.strictestClass(name, message, address, spamClass, score)
+		if strictest != spamClass {
+			spamClass = strictest
+			reason = "strictest_recipient"
 		}
+	}
 
-		// strip off possible plus-alias
-		name, _, _ = strings.Cut(name, "+")
-		address := fmt.Sprintf("%s@%s", name, domain)
+	// authenticated user entries, then sender entries, take precedence over the recipient class table
+	if f.classifier == nil {
+		userClass, ok := f.userClass(name, session, score)
+		if ok {
+			spamClass = userClass
+			reason = "auth_user"
+		} else {
+			senderClass, ok := f.senderClass(name, message, score)
+			if ok {
+				spamClass = senderClass
+				reason = "sender"
+			}
+		}
+	}
 
-		// prepend generated X-Spam-Class header line to output
-		spamClass := f.Classes.GetClass([]string{address}, message.SpamScore)
+	// an exact zero score may be labeled specially, e.g. for trusted internal mail
+	if score == 0 && f.zeroScoreClass != "" {
+		spamClass = f.zeroScoreClass
+		reason = "zero_score"
 		if f.verbose {
-			log.Printf("%s.%s: GetClass(%v, %v) returned %s\n", f.Name, name, []string{address}, message.SpamScore, FormatJSON(spamClass))
+			log.Printf("%s.%s: zero score selects class '%s'\n", f.Name, name, spamClass)
 		}
-		if spamClass != "" {
-			output = append([]string{"X-Spam-Class: " + spamClass}, output...)
+	}
+
+	// scores low relative to the required score select the lowest class
+	if f.belowConfidence(message, score) {
+		spamClass = f.lowestClass([]string{address})
+		reason = "confidence"
+		log.Printf("%s.%s: score %v below confidence ratio %v of required %v; using class '%s'\n", f.Name, name, score, f.minConfidence, message.Required, spamClass)
+	}
+
+	// dangerous symbols force the spam class regardless of score
+	symbol, dangerous := f.dangerousSymbol(message)
+	if dangerous {
+		log.Printf("%s.%s: dangerous symbol %s forces class '%s'\n", f.Name, name, symbol, classes.MAX_NAME)
+		spamClass = classes.MAX_NAME
+		reason = "symbol:" + symbol
+	}
+
+	if message.DisplayNameSpoof && f.spoofAction == SPOOF_ACTION_CLASS {
+		log.Printf("%s.%s: display name spoof forces class '%s'\n", f.Name, name, f.spoofClass)
+		spamClass = f.spoofClass
+		reason = "display_name_spoof"
+	}
+
+	countryClass, ok := f.geoipClass(session)
+	if ok {
+		log.Printf("%s.%s: client country %s forces class '%s'\n", f.Name, name, session.Country, countryClass)
+		spamClass = countryClass
+		reason = "country:" + session.Country
+	}
+
+	if f.trusted != nil && f.trusted.Action == TRUSTED_ACTION_CLASS && f.isTrusted(session) {
+		log.Printf("%s.%s: trusted client %s forces class '%s'\n", f.Name, name, session.Remote, f.trusted.Class)
+		f.count(COUNTER_TRUSTED)
+		spamClass = f.trusted.Class
+		reason = "trusted_network"
+	}
+
+	// an allowlist entry never overrides a dangerous symbol or a display name spoof
+	hit, listed := f.senderListHit(name, session, message)
+	if listed && hit.List.Name == "allowlist" && (dangerous || message.DisplayNameSpoof && f.spoofAction != SPOOF_ACTION_NONE) {
+		log.Printf("%s.%s: allowlist %s %s matches %s; not applied to class '%s'\n", f.Name, name, hit.Source, hit.Value, hit.Entry, spamClass)
+		listed = false
+	}
+	if listed {
+		f.recordListHit(name, hit)
+		spamClass = hit.List.Class
+		reason = hit.List.Name
+	}
+
+	if message.Virus != "" && f.clamav.Action == CLAMD_ACTION_CLASS {
+		log.Printf("%s.%s: virus %s forces class '%s'\n", f.Name, name, message.Virus, f.clamav.Class)
+		spamClass = f.clamav.Class
+		reason = "virus"
+	}
+
+	// the rest of the headers follow the policy webhook's decision, which is requested off the
+	// protocol loop with the message held until it arrives
+	finish := func(decision *PolicyResponse) []string {
+		if decision.Class != "" {
+			spamClass = decision.Class
+			reason = "webhook"
+		}
+
+		message.Action = f.classAction(name, session, message, spamClass)
+		if decision.Action != "" {
+			message.Action = f.checkAction(name, strings.ToLower(decision.Action), spamClass)
 		}
+		if message.Action == ACTION_QUARANTINE {
+			message.Quarantine = &quarantineCapture{Score: score, Class: spamClass}
+		}
+		f.startAudit(message, spamClass)
+		f.startLearn(message, spamClass, original)
 
 		// generate new X-Spam header
 		spamState := "no"
-		if spamClass == "spam" {
+		if f.IsSpam(spamClass) || message.Action != ACTION_TAG {
 			spamState = "yes"
 		}
 
-		// prepend generated X-Spam header line to output
-		output = append([]string{"X-Spam: " + spamState}, output...)
-		log.Printf("%s.%s: address=%s score=%v class='%s' spam=%v\n", f.Name, name, address, message.SpamScore, spamClass, spamState)
+		if names.FlagHeader != "" {
+			bottom = append(bottom, f.formatHeader(names.FlagHeader, spamState))
+		}
+		if spamClass != "" {
+			if f.authResults {
+				// carry the class in Authentication-Results instead of the class header
+				var created string
+				headers, created = f.addAuthResults(session, headers, spamClass, score)
+				if created != "" {
+					top = append(top, created)
+				}
+			} else {
+				bottom = append(bottom, f.formatHeader(names.ClassHeader, spamClass))
+			}
+			bottom = append(bottom, f.spamClassHeaders(spamClass)...)
+		}
+
+		headers = f.tagSubject(name, headers, spamClass)
+
+		f.recordDecision(address, score, spamClass)
+		f.recordReputation(session, spamClass)
+		f.captureReview(name, session, message, spamClass, raw)
+
+		if f.labelHeader != "" {
+			label := f.classLabel(address, spamClass)
+			if label != "" {
+				bottom = append(bottom, f.formatHeader(f.labelHeader, `"`+label+`"`))
+			}
+		}
+
+		if f.perRcptHeaders > 0 {
+			bottom = append(bottom, f.recipientClassHeaders(name, message, score)...)
+		}
+
+		if f.recipientPolicy == RECIPIENT_POLICY_HASHED {
+			bottom = append(bottom, f.hashedRecipientHeaders(name, message, score)...)
+		}
+
+		if f.scoreHeader != "" {
+			bottom = append(bottom, f.formatHeader(f.scoreHeader, fmt.Sprintf("%v", score)))
+		}
+
+		if f.reasonHeader != "" {
+			bottom = append(bottom, f.formatHeader(f.reasonHeader, "reason="+reason))
+		}
+
+		if f.scoreInputsHeader != "" && message.ScoreInputsValue != "" {
+			bottom = append(bottom, f.formatHeader(f.scoreInputsHeader, message.ScoreInputsValue))
+		}
+
+		if f.reportHeaderName != "" {
+			bottom = append(bottom, f.reportHeader(session, message, address, score, spamClass, reason))
+		}
+
+		if f.hashHeader != "" {
+			bottom = append(bottom, f.formatHeader(f.hashHeader, f.decisionHash(address, score)))
+		}
+
+		if listed {
+			bottom = append(bottom, f.listHeader(hit))
+		}
+
+		if f.level != nil {
+			bottom = append(bottom, f.levelHeader(message, score))
+		}
+
+		if f.geoip != nil && f.geoip.Header != "" && session.Country != "" {
+			bottom = append(bottom, f.formatHeader(f.geoip.Header, session.Country))
+		}
+
+		if anomalous && f.dates.Header != "" {
+			bottom = append(bottom, f.formatHeader(f.dates.Header, anomaly+" "+message.Date.Format(time.RFC1123Z)))
+		}
+
+		if f.receivedTrace {
+			top = append([]string{f.receivedHeader(session, spamClass, score)}, top...)
+		}
+
+		log.Printf("%s.%s: address=%s score=%v class='%s' spam=%v action=%s\n", f.Name, name, address, score, spamClass, spamState, message.Action)
+		output := append(top, headers...)
+		return append(output, bottom...)
 	}
-	return output
+	if f.webhook != nil && f.requestPolicy(name, session, message, f.policyRequest(session, message, headers, address, score, original, spamClass, reason), finish) {
+		return []string{}
+	}
+	return finish(&PolicyResponse{})
+}
+
+// return the recipient address used for class lookup
+//
+// the To: header is sender controlled and absent or different for Bcc and list mail, so with
+// prefer_envelope_recipient (the default) the envelope recipient is used, with the first To:
+// address only as a fallback; otherwise the To: address is used, falling back to the envelope
+func (f *Filter) recipientAddress(name string, message *Message) (string, bool) {
+	var recipient string
+	switch {
+	case len(message.To) < 1 && len(message.EnvelopeTo) < 1:
+		log.Printf("%s.%s: missing To and EnvelopeTo address'\n", f.Name, name)
+		return "", false
+	case len(message.EnvelopeTo) < 1:
+		log.Printf("%s.%s: missing EnvelopeTo address; using To (%s)\n", f.Name, name, message.To[0])
+		recipient = message.To[0]
+	case len(message.To) < 1:
+		if f.verbose {
+			log.Printf("%s.%s: missing To address; using EnvelopeTo (%s)\n", f.Name, name, message.EnvelopeTo[0])
+		}
+		recipient = message.EnvelopeTo[0]
+	default:
+		recipient = message.To[0]
+		if !strings.EqualFold(message.EnvelopeTo[0], recipient) {
+			log.Printf("%s.%s: WARNING envelopeTo (%s) mismatches initial To (%s)\n", f.Name, name, message.EnvelopeTo, message.To[0])
+			// the envelope recipient is the delivery target, e.g. a list subscriber
+			if f.preferEnvelope {
+				recipient = message.EnvelopeTo[0]
+			}
+		}
+	}
+
+	local, domain, found := strings.Cut(recipient, "@")
+	if !found {
+		log.Printf("%s.%s: '@' not found in To address: %v\n", f.Name, name, recipient)
+		return "", false
+	}
+
+	return f.resolveAlias(f.plusAddress(fmt.Sprintf("%s@%s", local, domain))), true
+}
+
+// return true if class is one of the configured spam_classes
+func (f *Filter) IsSpam(class string) bool {
+	return f.spamClasses[class]
+}
+
+// return a class header for each distinct envelope recipient with a configured class table
+func (f *Filter) recipientClassHeaders(name string, message *Message, score float32) []string {
+	headers := []string{}
+	seen := make(map[string]bool)
+	spamClasses := f.getClasses()
+	for _, recipient := range message.EnvelopeTo {
+		address := f.normalizeRecipient(recipient)
+		_, configured := f.classKey(spamClasses, address)
+		if !configured || seen[address] {
+			continue
+		}
+		seen[address] = true
+		if len(headers) >= f.perRcptHeaders {
+			Warning("%s.%s: recipient header limit (%d) reached; omitting %s", f.Name, name, f.perRcptHeaders, address)
+			continue
+		}
+		headers = append(headers, f.formatHeader(f.Headers.ClassHeader+"-"+address, f.getClass([]string{address}, score)))
+	}
+	return headers
+}
+
+// return the address used for class lookup as selected by recipient_resolution_order or class_key_source
+func (f *Filter) classKeyAddress(name string, session *Session, message *Message) (string, bool) {
+	if len(f.resolutionOrder) > 0 {
+		return f.resolveRecipient(name, session, message)
+	}
+	if f.classKeySource != CLASS_KEY_SOURCE_AUTH_USER || session.AuthorizedUser == "" {
+		return f.recipientAddress(name, message)
+	}
+	address := f.authUserAddress(session)
+	if address == "" {
+		log.Printf("%s.%s: auth user '%s' has no domain and local_default_domain is unset; using recipient\n", f.Name, name, session.AuthorizedUser)
+		return f.recipientAddress(name, message)
+	}
+	if f.verbose {
+		log.Printf("%s.%s: using auth user address %s for class lookup\n", f.Name, name, address)
+	}
+	return address, true
+}
+
+// return the authenticated user as an address, combined with local_default_domain if needed
+func (f *Filter) authUserAddress(session *Session) string {
+	if session.AuthorizedUser == "" {
+		return ""
+	}
+	local, domain, found := strings.Cut(session.AuthorizedUser, "@")
+	if !found {
+		if f.localDomain == "" {
+			return ""
+		}
+		domain = f.localDomain
+	}
+	return f.normalizeRecipient(fmt.Sprintf("%s@%s", local, domain))
+}
+
+// return a recipient address with any plus-alias removed and aliases resolved
+func (f *Filter) normalizeRecipient(address string) string {
+	return f.resolveAlias(f.plusAddress(strings.ToLower(address)))
+}
+
+// return address with its plus-alias tag handled as selected by option plus_alias
+//
+//	strip: user+tag@example.org is looked up as user@example.org (the default)
+//	keep:  the tagged address is looked up unchanged
+//	both:  the tagged address is used if it has its own class table entry (a backend,
+//	       exact or regex match; a domain entry also covers the untagged address),
+//	       otherwise the address without the tag
+func (f *Filter) plusAddress(address string) string {
+	local, domain, found := strings.Cut(address, "@")
+	if !found {
+		return address
+	}
+	base, _, tagged := strings.Cut(local, "+")
+	if !tagged || f.plusAlias == PLUS_ALIAS_KEEP {
+		return address
+	}
+	if f.plusAlias == PLUS_ALIAS_BOTH {
+		key, configured := f.classKey(f.getClasses(), strings.ToLower(f.resolveAlias(address)))
+		if configured && key != "*@"+domain && key != "@"+domain {
+			return address
+		}
+	}
+	return base + "@" + domain
+}
+
+// return the recipient address from a recipient_resolution_order source
+func (f *Filter) sourceAddress(source string, session *Session, message *Message) string {
+	switch source {
+	case RECIPIENT_SOURCE_TO:
+		if len(message.To) > 0 {
+			return f.normalizeRecipient(message.To[0])
+		}
+	case RECIPIENT_SOURCE_ENVELOPE:
+		if len(message.EnvelopeTo) > 0 {
+			return f.normalizeRecipient(message.EnvelopeTo[0])
+		}
+	case RECIPIENT_SOURCE_ORIGINAL_TO:
+		if message.OriginalTo != "" {
+			return f.normalizeRecipient(message.OriginalTo)
+		}
+	case RECIPIENT_SOURCE_DELIVERED_TO:
+		if message.DeliveredTo != "" {
+			return f.normalizeRecipient(message.DeliveredTo)
+		}
+	case RECIPIENT_SOURCE_AUTH_USER:
+		return f.authUserAddress(session)
+	}
+	return ""
+}
+
+// walk recipient_resolution_order, returning the first address with a configured class table,
+// or the first available address when none is configured
+func (f *Filter) resolveRecipient(name string, session *Session, message *Message) (string, bool) {
+	spamClasses := f.getClasses()
+	fallback := ""
+	for _, source := range f.resolutionOrder {
+		address := f.sourceAddress(source, session, message)
+		if address == "" {
+			continue
+		}
+		_, configured := f.classKey(spamClasses, address)
+		if configured {
+			if f.verbose {
+				log.Printf("%s.%s: using %s address %s for class lookup\n", f.Name, name, source, address)
+			}
+			return address, true
+		}
+		if fallback == "" {
+			fallback = address
+		}
+	}
+	if fallback == "" {
+		log.Printf("%s.%s: no recipient found from sources %v\n", f.Name, name, f.resolutionOrder)
+		return "", false
+	}
+	return fallback, true
+}
+
+// return the local host name for generated trace headers
+func (f *Filter) localHostname(session *Session) string {
+	if f.hostname != "" {
+		return f.hostname
+	}
+	host, _, _ := strings.Cut(session.Local, ":")
+	return host
+}
+
+// append the class verdict to the topmost Authentication-Results header, or
+// return a new Authentication-Results header line if none is present
+func (f *Filter) addAuthResults(session *Session, headers []string, spamClass string, score float32) ([]string, string) {
+	verdict, _ := sanitizeHeaderValue(fmt.Sprintf("x-spam-class=%s (score=%v)", spamClass, score))
+	for i, line := range headers {
+		header, ok := headerName(line)
+		if !ok || !strings.EqualFold(header, "Authentication-Results") {
+			continue
+		}
+		// find the last continuation line of the header
+		last := i
+		for last+1 < len(headers) && isContinuation(headers[last+1]) {
+			last++
+		}
+		value := strings.TrimRight(headers[last], " \t;")
+		trimmed, none := strings.CutSuffix(value, "; none")
+		if none {
+			value = trimmed
+		}
+		headers[last] = value + "; " + verdict
+		return headers, ""
+	}
+	authservId := f.authservId
+	if authservId == "" {
+		authservId = f.localHostname(session)
+	}
+	return headers, f.formatHeader("Authentication-Results", authservId+"; "+verdict)
+}
+
+// return a Received header documenting this filter's action
+func (f *Filter) receivedHeader(session *Session, spamClass string, score float32) string {
+	host := f.traceHost
+	if host == "" {
+		host = f.localHostname(session)
+	}
+	value := fmt.Sprintf("by %s with %s (%s) class=%s score=%v; %s", host, ProgramName(), Version, spamClass, score, f.now().Format(time.RFC1123Z))
+	return f.formatHeader("Received", value)
 }
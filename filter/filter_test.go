@@ -2,12 +2,17 @@ package filter
 
 import (
 	"bufio"
+	"context"
+	"flag"
+	"fmt"
 	"github.com/stretchr/testify/require"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestFilter(t *testing.T) {
@@ -101,3 +106,1393 @@ var messageLines []string = []string{
 	"report|0.7|0000000000.000000|smtp-in|tx-commit|deadbeef|cafebabe|1234",
 	"report|0.7|0000000000.000000|smtp-in|link-disconnect|deadbeef",
 }
+
+const testPrefix = "filter|0.7|0000000000.000000|smtp-in|data-line|deadbeef|baadf00d|"
+const testOutputPrefix = "filter-dataline|deadbeef|baadf00d|"
+
+// set viper options for the duration of the test
+func setTestOptions(t *testing.T, options map[string]any) {
+	for key, value := range options {
+		ViperSet(key, value)
+	}
+	t.Cleanup(func() {
+		for key := range options {
+			ViperSet(key, nil)
+		}
+	})
+}
+
+// return a filter configured with options reading from input
+func newTestFilter(t *testing.T, options map[string]any, input string, output io.Writer) *Filter {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, options)
+	f, err := NewFilter(strings.NewReader(input), output)
+	require.Nil(t, err)
+	return f
+}
+
+// return filter protocol input lines for a message with data lines
+// the envelope recipient follows the first To header address in data
+func messageInput(data []string) string {
+	lines := append([]string{}, initLines...)
+	lines = append(lines, messageLines[:6]...)
+	for _, line := range data {
+		address, found := strings.CutPrefix(line, "To: ")
+		if found && EMAIL_ADDRESS_PATTERN.MatchString(address) {
+			lines[len(initLines)+4] = strings.Replace(lines[len(initLines)+4], "touser@localdomain.ext", address, 1)
+			break
+		}
+	}
+	for _, line := range data {
+		lines = append(lines, testPrefix+line)
+	}
+	lines = append(lines, testPrefix+".")
+	lines = append(lines, messageLines[len(messageLines)-2:]...)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// return the data lines from filter protocol output
+func filteredLines(t *testing.T, output string) []string {
+	filtered := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, testOutputPrefix) {
+			filtered = append(filtered, strings.TrimPrefix(line, testOutputPrefix))
+		}
+	}
+	require.NotEmpty(t, filtered)
+	require.Equal(t, ".", filtered[len(filtered)-1])
+	return filtered
+}
+
+// capture log output for the duration of the test
+func captureLog(t *testing.T) *strings.Builder {
+	var buf strings.Builder
+	log.SetOutput(io.MultiWriter(&buf, os.Stderr))
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+	return &buf
+}
+
+// run a message through a filter, returning the filtered data lines
+func filterMessage(t *testing.T, options map[string]any, data []string) []string {
+	var output strings.Builder
+	f := newTestFilter(t, options, messageInput(data), &output)
+	f.Run()
+	return filteredLines(t, output.String())
+}
+
+func TestPreserveOriginal(t *testing.T) {
+	output := filterMessage(t, map[string]any{
+		"preserve_original": true,
+		"strip_headers":     []string{"X-Rspamd-*"},
+	}, []string{
+		"X-Spam-Score: 1.155 / 100",
+		"X-Spam: yes",
+		"X-Spam-Class: upstream",
+		"  folded",
+		"X-Rspamd-Server: mx.example.org",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	})
+	require.Equal(t, []string{
+		"X-Spam-Score: 1.155 / 100",
+		"X-Original-Spam: yes",
+		"X-Original-Spam-Class: upstream",
+		"  folded",
+		"To: touser@localdomain.ext",
+		"X-Spam: no",
+		"X-Spam-Class: applied_class",
+		"",
+		"body",
+		".",
+	}, output)
+	require.Equal(t, "X-Original-Spam-Class: x", originalHeader("x-spam-class: x"))
+	require.Equal(t, "X-Original-Spamclass: x", originalHeader("Spamclass: x"))
+}
+
+func TestStripHeaderPatterns(t *testing.T) {
+	options := map[string]any{"strip_header_patterns": []string{`^x-(vade|barracuda)-`, `^X-Spam-Flag$`}}
+	output := filterMessage(t, options, []string{
+		"X-Spam-Score: 1.155 / 100",
+		"X-Vade-Verdict: clean",
+		"X-Barracuda-Spam-Score: 0.00",
+		"  folded",
+		"X-Spam-Flag: NO",
+		"X-Spam-Flagged: kept",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	})
+	require.Equal(t, []string{
+		"X-Spam-Score: 1.155 / 100",
+		"X-Spam-Flagged: kept",
+		"To: touser@localdomain.ext",
+		"X-Spam: no",
+		"X-Spam-Class: applied_class",
+		"",
+		"body",
+		".",
+	}, output)
+
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"strip_header_patterns": []string{"("}})
+	_, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.NotNil(t, err)
+}
+
+func TestFoldedHeaders(t *testing.T) {
+	output := filterMessage(t, map[string]any{"dangerous_symbols": []string{}}, []string{
+		"X-Spamd-Result:",
+		"\tdefault: False [7.20 / 15.00];",
+		"\tARC_NA(0.00)[]",
+		"to:",
+		"\tTouser",
+		"\t<username@example.org>",
+		"From:",
+		" fromuser@example.org",
+		"",
+		"body",
+	})
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+
+	message := NewMessage("cafebabe")
+	f := newTestFilter(t, nil, "", nil)
+	f.parseHeader("test", message, "X-Spamd-Result:\tdefault: False [7.20 / 15.00];\tARC_NA(0.00)[]")
+	f.parseHeader("test", message, "to:\tTouser\t<username@example.org>")
+	require.Equal(t, float32(7.2), message.SpamScore)
+	require.Equal(t, float32(15), message.Required)
+	require.Equal(t, []string{"ARC_NA"}, message.Symbols)
+	require.Equal(t, []string{"username@example.org"}, message.To)
+	require.Equal(t, "To: user@example.org", normalizeHeader("to:\t user@example.org"))
+}
+
+func TestStripHeaders(t *testing.T) {
+	output := filterMessage(t, map[string]any{
+		"strip_headers": []string{"x-spam-status", "X-SPAM-LEVEL", "X-Spam-Flag", "X-Rspamd-*"},
+	}, []string{
+		"Received: from localhost",
+		"X-Spam-Score: 1.155 / 100",
+		"X-Spam-Status: Yes, score=1.155 required=100.000",
+		"    tests=[ARC_NA=0.000, ASN=0.000]",
+		"X-Spam-Level: *",
+		"x-spam-flag: NO",
+		"X-Rspamd-Queue-Id: 12345",
+		"X-Rspamd-Server: mx.example.org",
+		"X-Spam-Report: kept",
+		"To: touser@localdomain.ext",
+		"From: fromuser@example.org",
+		"",
+		"body",
+	})
+	require.Equal(t, []string{
+		"Received: from localhost",
+		"X-Spam-Score: 1.155 / 100",
+		"X-Spam-Report: kept",
+		"To: touser@localdomain.ext",
+		"From: fromuser@example.org",
+		"X-Spam: no",
+		"X-Spam-Class: applied_class",
+		"",
+		"body",
+		".",
+	}, output)
+}
+
+func TestCommaDecimalScore(t *testing.T) {
+	f := newTestFilter(t, map[string]any{"accept_comma_decimal": true}, "", io.Discard)
+	score, err := f.parseSpamScore("X-Spam-Score: 1,155 / 100")
+	require.Nil(t, err)
+	require.Equal(t, float32(1.155), score)
+
+	f = newTestFilter(t, map[string]any{"accept_comma_decimal": false}, "", io.Discard)
+	_, err = f.parseSpamScore("X-Spam-Score: 1,155 / 100")
+	require.NotNil(t, err)
+
+	// an unparsable score leaves the message unclassified
+	output := filterMessage(t, nil, []string{
+		"X-Spam: yes",
+		"X-Spam-Score: 1,155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	})
+	require.Equal(t, []string{"X-Spam-Score: 1,155 / 100", "To: touser@localdomain.ext", "", "body", "."}, output)
+
+	output = filterMessage(t, map[string]any{"accept_comma_decimal": true}, []string{
+		"X-Spam-Score: 7,5 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	})
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+}
+
+func TestHeadersGeneratedOnce(t *testing.T) {
+	lines := append([]string{}, initLines...)
+	lines = append(lines, messageLines[:6]...)
+	for _, line := range []string{"X-Spam-Score: 1.155 / 100", "To: touser@localdomain.ext", "", "X-Spam: yes", ""} {
+		lines = append(lines, testPrefix+line)
+	}
+	// a repeated tx-data must not re-enable header processing
+	lines = append(lines, "report|0.7|0000000000.000000|smtp-in|tx-data|deadbeef|cafebabe|ok")
+	for _, line := range []string{"X-Spam-Class: fake", "", "body", "."} {
+		lines = append(lines, testPrefix+line)
+	}
+	var output strings.Builder
+	f := newTestFilter(t, nil, strings.Join(lines, "\n")+"\n", &output)
+	f.Run()
+	require.Equal(t, 1, strings.Count(output.String(), "|X-Spam-Class: applied_class"))
+	require.Equal(t, 1, strings.Count(output.String(), "|X-Spam: no"))
+	require.Contains(t, output.String(), testOutputPrefix+"X-Spam: yes\n")
+	require.Contains(t, output.String(), testOutputPrefix+"X-Spam-Class: fake\n")
+}
+
+func TestScoreSourceMaxOfBoth(t *testing.T) {
+	headers := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"X-Spam-Status: Yes, score=7.500 required=100.000",
+		"    tests=[ARC_NA=0.000, ASN=0.000]",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	output := filterMessage(t, nil, headers)
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+
+	output = filterMessage(t, map[string]any{"score_source": "max_of_both"}, headers)
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+
+	// the lower status score does not reduce the header score
+	headers[0] = "X-Spam-Score: 12.0 / 100"
+	output = filterMessage(t, map[string]any{"score_source": "max_of_both"}, headers)
+	require.Contains(t, output, "X-Spam-Class: spam")
+}
+
+func TestRecipientHeaderNames(t *testing.T) {
+	options := map[string]any{
+		"recipient_headers": map[string]any{
+			"localdomain.ext": map[string]any{
+				"class_header": "X-Local-Class",
+			},
+			"username@example.org": map[string]any{
+				"class_header": "X-Example-Class",
+				"flag_header":  "X-Example-Spam",
+			},
+		},
+	}
+	output := filterMessage(t, options, []string{
+		"X-Spam-Score: 1.155 / 100",
+		"X-Example-Class: forged",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	})
+	require.Equal(t, []string{"X-Spam-Score: 1.155 / 100", "To: touser@localdomain.ext", "X-Spam: no", "X-Local-Class: applied_class", "", "body", "."}, output)
+
+	output = filterMessage(t, options, []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: username@example.org",
+		"",
+		"body",
+	})
+	require.Equal(t, []string{"X-Spam-Score: 1.155 / 100", "To: username@example.org", "X-Example-Spam: no", "X-Example-Class: possible", "", "body", "."}, output)
+}
+
+func TestDisableFlagHeader(t *testing.T) {
+	options := map[string]any{
+		"emit_flag_header": false,
+		"class_header":     "X-Rspamd-Class",
+		"recipient_headers": map[string]any{
+			"username@example.org": map[string]any{"flag_header": "X-Example-Spam"},
+		},
+	}
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"X-Spam: upstream",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	// the upstream flag header is left in place
+	require.Equal(t, []string{"X-Spam-Score: 1.155 / 100", "X-Spam: upstream", "To: touser@localdomain.ext", "X-Rspamd-Class: applied_class", "", "body", "."}, filterMessage(t, options, data))
+
+	data[2] = "To: username@example.org"
+	output := filterMessage(t, options, data)
+	require.NotContains(t, output, "X-Example-Spam: no")
+	require.Contains(t, output, "X-Rspamd-Class: possible")
+}
+
+func TestHeaderInjection(t *testing.T) {
+	var output strings.Builder
+	f := newTestFilter(t, nil, messageInput([]string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: Touser <touser@localdomain.ext>\rBcc: evil@example.org\x1b",
+		"",
+		"body",
+	}), &output)
+	logs := captureLog(t)
+	f.Run()
+	lines := filteredLines(t, output.String())
+	require.Contains(t, lines, "X-Spam-Class: applied_class")
+	require.Contains(t, logs.String(), "WARNING: ")
+	require.Contains(t, logs.String(), "control characters")
+
+	require.Equal(t, "X-Test: value", f.formatHeader("X-Test", "val\r\nue\x00"))
+}
+
+func TestScoreCombineMin(t *testing.T) {
+	// duplicate same-name score headers
+	output := filterMessage(t, map[string]any{"score_combine": "min"}, []string{
+		"X-Spam-Score: 12.0 / 100",
+		"X-Spam-Score: 7.5 / 100",
+		"X-Spam-Score: 9.0 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	})
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+
+	// distinct score headers
+	output = filterMessage(t, map[string]any{"score_source": "both", "score_combine": "min"}, []string{
+		"X-Spam-Score: 12.0 / 100",
+		"X-Spam-Status: Yes, score=1.155 required=100.000",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	})
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+}
+
+func TestAliases(t *testing.T) {
+	options := map[string]any{
+		"aliases": map[string]any{
+			"alias@localdomain.ext":  "middle@localdomain.ext",
+			"middle@localdomain.ext": "username@example.org",
+			"loop1@localdomain.ext":  "loop2@localdomain.ext",
+			"loop2@localdomain.ext":  "loop1@localdomain.ext",
+		},
+	}
+	output := filterMessage(t, options, []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: alias@localdomain.ext",
+		"",
+		"body",
+	})
+	require.Contains(t, output, "X-Spam-Class: possible")
+
+	f := newTestFilter(t, options, "", io.Discard)
+	require.Equal(t, "username@example.org", f.resolveAlias("Alias@localdomain.ext"))
+	require.Equal(t, "other@localdomain.ext", f.resolveAlias("other@localdomain.ext"))
+	require.Contains(t, []string{"loop1@localdomain.ext", "loop2@localdomain.ext"}, f.resolveAlias("loop1@localdomain.ext"))
+}
+
+func TestThresholdInclusive(t *testing.T) {
+	headers := []string{
+		"X-Spam-Score: 5.0 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	output := filterMessage(t, nil, headers)
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+
+	output = filterMessage(t, map[string]any{"threshold_inclusive": false}, headers)
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+
+	headers[0] = "X-Spam-Score: 5.01 / 100"
+	output = filterMessage(t, map[string]any{"threshold_inclusive": false}, headers)
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+}
+
+func TestReceivedTrace(t *testing.T) {
+	var output strings.Builder
+	f := newTestFilter(t, map[string]any{
+		"emit_received_trace": true,
+		"received_trace_host": "mx.localdomain.ext",
+	}, messageInput([]string{
+		"Received: from localhost",
+		"X-Spam-Score: 7.2 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}), &output)
+	f.now = func() time.Time {
+		return time.Date(2026, time.January, 5, 12, 49, 41, 0, time.UTC)
+	}
+	f.Run()
+	lines := filteredLines(t, output.String())
+	require.Equal(t, "Received: by mx.localdomain.ext with smtpd-filter-addheader (0.0.6) class=suspected_spam score=7.2; Mon, 05 Jan 2026 12:49:41 +0000", lines[0])
+	require.Equal(t, "Received: from localhost", lines[1])
+}
+
+func TestHeadersOnlyMessage(t *testing.T) {
+	output := filterMessage(t, nil, []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+	})
+	require.Equal(t, []string{"X-Spam-Score: 1.155 / 100", "To: touser@localdomain.ext", "X-Spam: no", "X-Spam-Class: applied_class", "."}, output)
+}
+
+func TestCommittedMessageReleased(t *testing.T) {
+	input := messageInput([]string{"X-Spam-Score: 1.155 / 100", "To: touser@localdomain.ext", "", "body"})
+	// remove the trailing link-disconnect so the session is retained
+	input = strings.TrimSuffix(input, messageLines[len(messageLines)-1]+"\n")
+	f := newTestFilter(t, nil, input, io.Discard)
+	f.Run()
+	session, ok := f.Sessions["deadbeef"]
+	require.True(t, ok)
+	require.Empty(t, session.Messages)
+	require.Empty(t, session.DataMessage)
+}
+
+func TestAddressLimit(t *testing.T) {
+	f := newTestFilter(t, map[string]any{"max_addresses": 2}, "", io.Discard)
+	list := []string{}
+	for _, address := range []string{"a@example.org", "b@example.org", "c@example.org"} {
+		list = f.appendAddress("test", list, address)
+	}
+	require.Equal(t, []string{"a@example.org", "b@example.org"}, list)
+
+	// 0 disables the limit
+	f = newTestFilter(t, map[string]any{"max_addresses": 0}, "", io.Discard)
+	list = f.appendAddress("test", []string{}, "a@example.org")
+	require.Equal(t, []string{"a@example.org"}, list)
+}
+
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+func TestMessageJSONGolden(t *testing.T) {
+	message := NewMessage("cafebabe")
+	message.To = append(message.To, "touser@localdomain.ext")
+	message.From = append(message.From, "fromuser@example.org")
+	message.EnvelopeTo = append(message.EnvelopeTo, "touser@localdomain.ext", "other@localdomain.ext")
+	message.EnvelopeFrom = append(message.EnvelopeFrom, "fromuser@example.org")
+	message.State = "data"
+	message.SpamScore = 1.155
+	message.SpamScoreSet = true
+	message.Headers = []string{"X-Spam-Score: 1.155 / 100", "To: touser@localdomain.ext"}
+
+	filename := filepath.Join("testdata", "message.json")
+	formatted := FormatJSON(message)
+	// output must be stable across runs for golden comparison
+	for i := 0; i < 10; i++ {
+		require.Equal(t, formatted, FormatJSON(message))
+	}
+	if *updateGolden {
+		err := os.WriteFile(filename, []byte(formatted+"\n"), 0644)
+		require.Nil(t, err)
+	}
+	golden, err := os.ReadFile(filename)
+	require.Nil(t, err)
+	require.Equal(t, string(golden), formatted+"\n")
+}
+
+func TestDangerousSymbols(t *testing.T) {
+	headers := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"X-Spam-Status: No, score=1.155 required=100.000",
+		"    tests=[ARC_NA=0.000, ASN=0.000,",
+		"    MIME_BAD_EXTENSION=0.500, ZERO_FONT=0.300]",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	output := filterMessage(t, nil, headers)
+	require.Contains(t, output, "X-Spam-Class: spam")
+	require.Contains(t, output, "X-Spam: yes")
+
+	output = filterMessage(t, map[string]any{"dangerous_symbols": []string{"OTHER_SYMBOL"}}, headers)
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+
+	require.Equal(t, []string{"ARC_NA", "ASN", "MIME_BAD_EXTENSION", "ZERO_FONT"},
+		parseStatusSymbols("X-Spam-Status: No, score=1.155 required=100.000    tests=[ARC_NA=0.000, ASN=0.000,    MIME_BAD_EXTENSION=0.500, ZERO_FONT=0.300]"))
+	require.Equal(t, []string{"BAYES_00", "HTML_MESSAGE"}, parseStatusSymbols("X-Spam-Status: No, score=-1.9 required=5.0 tests=BAYES_00,HTML_MESSAGE autolearn=ham"))
+	require.Equal(t, []string{"BAYES_00", "DKIM_SIGNED", "DKIM_VALID", "HTML_MESSAGE"},
+		parseStatusSymbols("X-Spam-Status: No, score=-1.9 required=5.0 tests=BAYES_00,DKIM_SIGNED,\tDKIM_VALID,HTML_MESSAGE autolearn=ham"))
+	require.Equal(t, []string{}, parseStatusSymbols("X-Spam-Status: No, score=0.0 required=5.0 tests=none autolearn=no"))
+}
+
+func TestSpamAssassinStatus(t *testing.T) {
+	options := map[string]any{"score_source": "status"}
+	headers := []string{
+		"X-Spam-Status: Yes, score=7.2 required=5.0 tests=BAYES_99,DKIM_SIGNED,",
+		"\tMIME_BAD_EXTENSION autolearn=no autolearn_force=no version=3.4.6",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	output := filterMessage(t, options, headers)
+	require.Contains(t, output, "X-Spam-Class: spam")
+
+	// symbols on the folded continuation are found; pre-3.0 hits= scores are accepted
+	options["dangerous_symbols"] = []string{"OTHER_SYMBOL"}
+	output = filterMessage(t, options, headers)
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+	headers[0] = "X-Spam-Status: Yes, hits=1.155 required=5.0 tests=BAYES_99,DKIM_SIGNED,"
+	output = filterMessage(t, options, headers)
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+}
+
+func TestSpamdResult(t *testing.T) {
+	headers := []string{
+		"X-Spamd-Result: default: False [7.20 / 15.00];",
+		"\tARC_NA(0.00)[];",
+		"\tMIME_GOOD(-0.10)[text/plain];",
+		"\tR_SPF_ALLOW(-0.20)[+ip4:1.2.3.4/24:c];",
+		"\tMIME_BAD_EXTENSION(0.50)[exe]",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	// the score is used without X-Spam-Score and the symbols are checked
+	output := filterMessage(t, nil, headers)
+	require.Contains(t, output, "X-Spam-Class: spam")
+	output = filterMessage(t, map[string]any{"dangerous_symbols": []string{"OTHER_SYMBOL"}}, headers)
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+
+	// X-Spam-Score is preferred when both are present
+	output = filterMessage(t, map[string]any{"dangerous_symbols": []string{"OTHER_SYMBOL"}}, append([]string{"X-Spam-Score: 1.155 / 100"}, headers...))
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+
+	require.Equal(t, []string{"ARC_NA", "MIME_GOOD", "R_SPF_ALLOW", "MIME_BAD_EXTENSION"},
+		parseSpamdSymbols("X-Spamd-Result: default: False [7.20 / 15.00];\tARC_NA(0.00)[];\tMIME_GOOD(-0.10)[text/plain];\tR_SPF_ALLOW(-0.20)[+ip4:1.2.3.4/24:c];\tMIME_BAD_EXTENSION(0.50)[exe]"))
+
+	message := NewMessage("cafebabe")
+	f := newTestFilter(t, nil, "", nil)
+	f.parseHeader("test", message, "X-Spamd-Result: default: True [16.50 / 15.00]; BAYES_SPAM(5.10)[99.99%]")
+	require.Equal(t, float32(16.5), message.SpamScore)
+	require.Equal(t, float32(15), message.Required)
+	require.Equal(t, []string{"BAYES_SPAM"}, message.Symbols)
+}
+
+func TestAuthResults(t *testing.T) {
+	options := map[string]any{"emit_auth_results": true, "authserv_id": "mx.localdomain.ext"}
+	output := filterMessage(t, options, []string{
+		"Received: from localhost",
+		"Authentication-Results: mx.localdomain.ext;",
+		"    dkim=pass header.d=example.org;",
+		"    spf=pass smtp.mailfrom=example.org",
+		"Authentication-Results: relay.example.org; none",
+		"X-Spam-Score: 7.2 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	})
+	require.Equal(t, []string{
+		"Received: from localhost",
+		"Authentication-Results: mx.localdomain.ext;",
+		"    dkim=pass header.d=example.org;",
+		"    spf=pass smtp.mailfrom=example.org; x-spam-class=suspected_spam (score=7.2)",
+		"Authentication-Results: relay.example.org; none",
+		"X-Spam-Score: 7.2 / 100",
+		"To: touser@localdomain.ext",
+		"X-Spam: no",
+		"",
+		"body",
+		".",
+	}, output)
+
+	output = filterMessage(t, options, []string{
+		"Authentication-Results: relay.example.org; none",
+		"X-Spam-Score: 7.2 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	})
+	require.Equal(t, "Authentication-Results: relay.example.org; x-spam-class=suspected_spam (score=7.2)", output[0])
+
+	output = filterMessage(t, options, []string{
+		"X-Spam-Score: 7.2 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	})
+	require.Equal(t, "Authentication-Results: mx.localdomain.ext; x-spam-class=suspected_spam (score=7.2)", output[0])
+}
+
+func TestIgnoreDomains(t *testing.T) {
+	headers := []string{
+		"X-Spam: yes",
+		"X-Spam-Score: 7.2 / 100",
+		"X-Spam-Class: upstream",
+		"X-Spam-Status: Yes, score=7.2",
+		"    tests=[ZERO_FONT=0.300]",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	output := filterMessage(t, map[string]any{"ignore_domains": []string{"LocalDomain.ext"}, "strip_headers": []string{"X-Spam-Status"}}, headers)
+	require.Equal(t, append(headers, "."), output)
+
+	output = filterMessage(t, map[string]any{"ignore_domains": []string{"example.org"}}, headers)
+	require.NotContains(t, output, "X-Spam-Class: upstream")
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+}
+
+func TestLabelHeader(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "classes.json")
+	err := os.WriteFile(filename, []byte(`{
+    "touser@localdomain.ext": [
+	{ "name": "ham", "score": 3, "label": "Not Spam" },
+	{ "name": "probable", "score": 10, "label": "Probably Spam" },
+	{ "name": "spam", "score": 999 }
+    ]
+}`), 0600)
+	require.Nil(t, err)
+	options := map[string]any{"class_config_file": filename, "emit_label_header": true}
+	output := filterMessage(t, options, []string{
+		"X-Spam-Label: forged",
+		"X-Spam-Score: 7.2 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	})
+	require.Equal(t, []string{"X-Spam-Score: 7.2 / 100", "To: touser@localdomain.ext", "X-Spam: no", "X-Spam-Class: probable", `X-Spam-Label: "Probably Spam"`, "", "body", "."}, output)
+
+	// unlabeled classes emit no label header
+	output = filterMessage(t, options, []string{
+		"X-Spam-Score: 12 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	})
+	require.Equal(t, []string{"X-Spam-Score: 12 / 100", "To: touser@localdomain.ext", "X-Spam: yes", "X-Spam-Class: spam", "", "body", "."}, output)
+}
+
+func TestDuplicateRecipients(t *testing.T) {
+	f := newTestFilter(t, map[string]any{"aliases": map[string]any{"alias@localdomain.ext": "touser@localdomain.ext"}}, "", io.Discard)
+	f.linkConnect("link-connect", "deadbeef", "sendhost.example.org", "pass", "1.2.3.4:11223", "5.6.7.8:25")
+	f.txBegin("tx-begin", "deadbeef", "cafebabe")
+	f.txRcpt("tx-rcpt", "deadbeef", "cafebabe", "ok", "touser@localdomain.ext")
+	f.txRcpt("tx-rcpt", "deadbeef", "cafebabe", "ok", "<TOUSER@localdomain.ext>")
+	f.txRcpt("tx-rcpt", "deadbeef", "cafebabe", "ok", "alias@localdomain.ext")
+	f.txRcpt("tx-rcpt", "deadbeef", "cafebabe", "ok", "other@localdomain.ext")
+	message := f.Sessions["deadbeef"].Messages["cafebabe"]
+	require.Equal(t, []string{"touser@localdomain.ext", "other@localdomain.ext"}, message.EnvelopeTo)
+}
+
+func TestMinConfidenceRatio(t *testing.T) {
+	headers := []string{
+		"X-Spam-Score: 12.0 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	output := filterMessage(t, nil, headers)
+	require.Contains(t, output, "X-Spam-Class: spam")
+
+	output = filterMessage(t, map[string]any{"min_confidence_ratio": 0.2}, headers)
+	require.Contains(t, output, "X-Spam-Class: not_spam")
+	require.Contains(t, output, "X-Spam: no")
+
+	headers[0] = "X-Spam-Score: 12.0 / 15"
+	output = filterMessage(t, map[string]any{"min_confidence_ratio": 0.2}, headers)
+	require.Contains(t, output, "X-Spam-Class: spam")
+}
+
+func TestAbortedBeforeData(t *testing.T) {
+	lines := append([]string{}, initLines...)
+	lines = append(lines, messageLines[:5]...)
+	lines = append(lines, messageLines[len(messageLines)-1])
+	f := newTestFilter(t, nil, strings.Join(lines, "\n")+"\n", io.Discard)
+	f.Run()
+	require.Equal(t, int64(1), f.Counter(COUNTER_ABORTED_BEFORE_DATA))
+
+	// a completed transaction is not counted
+	f = newTestFilter(t, nil, messageInput([]string{"X-Spam-Score: 1.155 / 100", "To: touser@localdomain.ext"}), io.Discard)
+	f.Run()
+	require.Equal(t, int64(0), f.Counter(COUNTER_ABORTED_BEFORE_DATA))
+}
+
+// in-memory classifier returning a class per recipient
+type testClassifier struct {
+	classes map[string]string
+	calls   int
+}
+
+func (c *testClassifier) GetClass(recipients []string, score float32) string {
+	c.calls++
+	for _, recipient := range recipients {
+		class, ok := c.classes[recipient]
+		if ok {
+			return fmt.Sprintf("%s-%v", class, score)
+		}
+	}
+	return "unknown"
+}
+
+func TestClassifierInterface(t *testing.T) {
+	var output strings.Builder
+	f := newTestFilter(t, nil, messageInput([]string{
+		"X-Spam-Score: 7.2 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}), &output)
+	classifier := &testClassifier{classes: map[string]string{"touser@localdomain.ext": "fake"}}
+	f.SetClassifier(classifier)
+	f.Run()
+	lines := filteredLines(t, output.String())
+	require.Contains(t, lines, "X-Spam-Class: fake-7.2")
+	require.Equal(t, 1, classifier.calls)
+}
+
+// classifier raising the class of one domain, delegating to the default classifier
+type testDomainClassifier struct {
+	inner Classifier
+}
+
+func (c *testDomainClassifier) GetClass(recipients []string, score float32) string {
+	if strings.HasSuffix(recipients[0], "@localdomain.ext") {
+		score += 5
+	}
+	return c.inner.GetClass(recipients, score)
+}
+
+func TestDefaultClassifier(t *testing.T) {
+	var output strings.Builder
+	f := newTestFilter(t, nil, messageInput([]string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}), &output)
+	f.SetClassifier(&testDomainClassifier{inner: f.DefaultClassifier()})
+	f.Run()
+	require.Contains(t, filteredLines(t, output.String()), "X-Spam-Class: suspected_spam")
+}
+
+func TestClassKeyAuthUser(t *testing.T) {
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	options := map[string]any{
+		"class_key_source":     "auth_user",
+		"local_default_domain": "example.org",
+	}
+	classify := func(username string) []string {
+		input := strings.Replace(messageInput(data), "|link-auth|deadbeef|pass|authuser", "|link-auth|deadbeef|pass|"+username, 1)
+		var output strings.Builder
+		f := newTestFilter(t, options, input, &output)
+		f.Run()
+		return filteredLines(t, output.String())
+	}
+
+	// bare username is combined with local_default_domain
+	require.Contains(t, classify("username"), "X-Spam-Class: possible")
+
+	// full address auth user is used as-is
+	require.Contains(t, classify("username@example.org"), "X-Spam-Class: possible")
+
+	// the recipient table is used when not configured
+	options["class_key_source"] = "recipient"
+	require.Contains(t, classify("username"), "X-Spam-Class: applied_class")
+}
+
+func TestMaxSessions(t *testing.T) {
+	connect := "report|0.7|0000000000.000000|smtp-in|link-connect|%s|sendhost.example.org|pass|1.2.3.4:11223|5.6.7.8:25"
+	lines := append([]string{}, initLines...)
+	for _, sid := range []string{"00000001", "00000002", "00000003"} {
+		lines = append(lines, fmt.Sprintf(connect, sid))
+	}
+	var output strings.Builder
+	f := newTestFilter(t, map[string]any{"max_sessions": 2}, strings.Join(lines, "\n")+"\n", &output)
+	captureLog(t)
+	f.Run()
+	require.Len(t, f.Sessions, 2)
+	require.Contains(t, f.Sessions, "00000001")
+	require.Contains(t, f.Sessions, "00000002")
+	require.Equal(t, int64(1), f.Counter(COUNTER_SESSIONS_REFUSED))
+}
+
+func TestProtocolSafeOutput(t *testing.T) {
+	var output strings.Builder
+	f := newTestFilter(t, map[string]any{"output_line_terminator": "\r\n"}, messageInput([]string{
+		"X-Spam-Score: 7.2 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}), &output)
+	f.SetClassifier(&testClassifier{classes: map[string]string{"touser@localdomain.ext": "debug|value"}})
+	log := captureLog(t)
+	f.Run()
+	require.Contains(t, output.String(), testOutputPrefix+"X-Spam-Class: debug|value-7.2\r\n")
+	require.NotContains(t, strings.ReplaceAll(output.String(), "\r\n", ""), "\n")
+	require.NotContains(t, log.String(), "generated X-Spam-Class header")
+
+	// embedded line breaks are refused
+	require.NotNil(t, f.writeLine("filter-dataline|deadbeef|baadf00d|X-Spam-Class: a\nX-Injected: b"))
+
+	// message data lines are copied unchanged
+	output.Reset()
+	f = newTestFilter(t, nil, messageInput([]string{
+		"X-Spam-Score: 7.2 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"bare\rcarriage | return",
+	}), &output)
+	f.Run()
+	require.Contains(t, output.String(), testOutputPrefix+"bare\rcarriage | return"+f.terminator)
+
+	// only protocol line terminators are accepted
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"output_line_terminator": ";"})
+	_, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.NotNil(t, err)
+}
+
+func TestIsSpam(t *testing.T) {
+	f := newTestFilter(t, nil, "", io.Discard)
+	require.True(t, f.IsSpam("spam"))
+	require.False(t, f.IsSpam("probable"))
+	require.False(t, f.IsSpam(""))
+
+	f = newTestFilter(t, map[string]any{"spam_classes": []string{"probable", "junk"}}, "", io.Discard)
+	require.True(t, f.IsSpam("probable"))
+	require.True(t, f.IsSpam("junk"))
+	require.False(t, f.IsSpam("spam"))
+
+	output := filterMessage(t, map[string]any{"spam_classes": []string{"possible"}}, []string{
+		"X-Spam-Score: 2 / 100",
+		"To: username@example.org",
+		"",
+		"body",
+	})
+	require.Contains(t, output, "X-Spam: yes")
+	require.Contains(t, output, "X-Spam-Class: possible")
+}
+
+func TestDataLineWithoutTxData(t *testing.T) {
+	lines := append([]string{}, initLines...)
+	lines = append(lines, messageLines[:5]...)
+	lines = append(lines, testPrefix+"X-Spam-Score: 1.155 / 100", testPrefix+"To: touser@localdomain.ext", testPrefix+"", testPrefix+".")
+	lines = append(lines, messageLines[len(messageLines)-1])
+	var output strings.Builder
+	f := newTestFilter(t, nil, strings.Join(lines, "\n")+"\n", &output)
+	log := captureLog(t)
+	f.Run()
+	require.Equal(t, []string{"X-Spam-Score: 1.155 / 100", "To: touser@localdomain.ext", "", "."}, filteredLines(t, output.String()))
+	require.Contains(t, log.String(), "data-line received before tx-data")
+}
+
+func TestPreserveScoreHeader(t *testing.T) {
+	output := filterMessage(t, map[string]any{"preserve_score_header": true}, []string{
+		"X-Spam-Score: 7.25 / 100",
+		"X-Spam-Original-Score: 99",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	})
+	require.Equal(t, []string{
+		"X-Spam-Score: 7.25 / 100",
+		"To: touser@localdomain.ext",
+		"X-Spam: no",
+		"X-Spam-Class: suspected_spam",
+		"X-Spam-Original-Score: 7.25",
+		"",
+		"body",
+		".",
+	}, output)
+}
+
+func TestDisplayNameSpoof(t *testing.T) {
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		`From: "ceo@example.org" <fromuser@attacker.example.com>`,
+		"",
+		"body",
+	}
+	output := filterMessage(t, map[string]any{"display_name_spoof_action": "class"}, data)
+	require.Contains(t, output, "X-Spam-Class: spam")
+	require.Contains(t, output, "X-Spam: yes")
+
+	output = filterMessage(t, map[string]any{"display_name_spoof_action": "score", "display_name_spoof_score": 5}, data)
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+
+	output = filterMessage(t, map[string]any{"display_name_spoof_action": "none"}, data)
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+
+	// a display name repeating the actual address is not a spoof
+	data[2] = "From: Some User fromuser@example.org <FromUser@example.org>"
+	output = filterMessage(t, map[string]any{"display_name_spoof_action": "class"}, data)
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+}
+
+func TestHeaderNameCollisions(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	tests := []struct {
+		options map[string]any
+		message string
+	}{
+		{map[string]any{"class_header": "X-Spam"}, "flag_header 'X-Spam' collides with class_header"},
+		{map[string]any{"flag_header": "x-spam-score"}, "flag_header 'x-spam-score' collides with source header X-Spam-Score"},
+		{map[string]any{"emit_label_header": true, "label_header": "X-Spam-Class"}, "label_header 'X-Spam-Class' collides with class_header"},
+		{map[string]any{"preserve_score_header": true, "original_score_header": "X-Spam-Status"}, "original_score_header 'X-Spam-Status' collides with source header X-Spam-Status"},
+		{map[string]any{"recipient_headers": map[string]any{"example.org": map[string]any{"class_header": "X-Spam"}}}, "class_header 'X-Spam' collides with flag_header"},
+		{map[string]any{"class_header": "Bad Header"}, "invalid class_header: 'Bad Header'"},
+	}
+	for _, test := range tests {
+		setTestOptions(t, test.options)
+		_, err := NewFilter(strings.NewReader(""), io.Discard)
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), test.message)
+		for key := range test.options {
+			ViperSet(key, nil)
+		}
+	}
+
+	// per-recipient names may repeat the global name for the same role
+	setTestOptions(t, map[string]any{"recipient_headers": map[string]any{"example.org": map[string]any{"class_header": "X-Spam-Class"}}})
+	_, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.Nil(t, err)
+}
+
+func TestOutOfOrderEvents(t *testing.T) {
+	lines := append([]string{}, initLines...)
+	// tx-mail arrives before tx-begin
+	lines = append(lines, messageLines[0], messageLines[1], messageLines[3], messageLines[2], messageLines[4], messageLines[5])
+	lines = append(lines, testPrefix+"X-Spam-Score: 1.155 / 100", testPrefix+"To: touser@localdomain.ext", testPrefix+"", testPrefix+".")
+	lines = append(lines, messageLines[len(messageLines)-2:]...)
+	var output strings.Builder
+	f := newTestFilter(t, nil, strings.Join(lines, "\n")+"\n", &output)
+	log := captureLog(t)
+	f.Run()
+	require.Contains(t, log.String(), "out-of-order event for unknown message cafebabe")
+	require.Equal(t, int64(1), f.Counter(COUNTER_OUT_OF_ORDER))
+	require.Contains(t, filteredLines(t, output.String()), "X-Spam-Class: applied_class")
+
+	// a transaction for a session missing its link-connect
+	lines = append([]string{}, initLines...)
+	lines = append(lines, messageLines[3:6]...)
+	lines = append(lines, testPrefix+"X-Spam-Score: 1.155 / 100", testPrefix+"To: touser@localdomain.ext", testPrefix+"", testPrefix+".")
+	output.Reset()
+	f = newTestFilter(t, nil, strings.Join(lines, "\n")+"\n", &output)
+	f.Run()
+	require.Equal(t, int64(2), f.Counter(COUNTER_OUT_OF_ORDER))
+	require.Contains(t, filteredLines(t, output.String()), "X-Spam-Class: applied_class")
+}
+
+func TestEmptyClassTable(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "classes.json")
+	err := os.WriteFile(filename, []byte(`{"touser@localdomain.ext": [], "username@example.org": [{"name": "low", "score": 5}]}`), 0600)
+	require.Nil(t, err)
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"class_config_file": filename})
+	log := captureLog(t)
+	var output strings.Builder
+	f, err := NewFilter(strings.NewReader(messageInput([]string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	})), &output)
+	require.Nil(t, err)
+	require.Contains(t, log.String(), "empty class list for touser@localdomain.ext")
+	f.Run()
+	require.Contains(t, filteredLines(t, output.String()), "X-Spam-Class: ham")
+}
+
+func TestPerRecipientHeaders(t *testing.T) {
+	rcpt := "report|0.7|0000000000.000000|smtp-in|tx-rcpt|deadbeef|cafebabe|ok|"
+	input := strings.Replace(messageInput([]string{
+		"X-Spam-Score: 4 / 100",
+		"X-Spam-Class-username@example.org: forged",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}), rcpt+"touser@localdomain.ext", rcpt+"touser@localdomain.ext\n"+rcpt+"Username+tag@example.org\n"+rcpt+"other@localdomain.ext", 1)
+	var output strings.Builder
+	f := newTestFilter(t, map[string]any{"per_recipient_headers": true}, input, &output)
+	f.Run()
+	require.Equal(t, []string{
+		"X-Spam-Score: 4 / 100",
+		"To: touser@localdomain.ext",
+		"X-Spam: no",
+		"X-Spam-Class: applied_class",
+		"X-Spam-Class-touser@localdomain.ext: applied_class",
+		"X-Spam-Class-username@example.org: probable",
+		"",
+		"body",
+		".",
+	}, filteredLines(t, output.String()))
+
+	// the number of recipient headers is bounded
+	output.Reset()
+	f = newTestFilter(t, map[string]any{"per_recipient_headers": true, "max_recipient_headers": 1}, input, &output)
+	f.Run()
+	lines := filteredLines(t, output.String())
+	require.Contains(t, lines, "X-Spam-Class-touser@localdomain.ext: applied_class")
+	require.NotContains(t, lines, "X-Spam-Class-username@example.org: probable")
+}
+
+func TestZeroScore(t *testing.T) {
+	data := []string{
+		"X-Spam-Score: 0.00 / 100",
+		"To: nobody@example.com",
+		"",
+		"body",
+	}
+	// zero falls below the lowest default threshold
+	require.Contains(t, filterMessage(t, nil, data), "X-Spam-Class: ham")
+	data[0] = "X-Spam-Score: -0.0 / 100"
+	require.Contains(t, filterMessage(t, nil, data), "X-Spam-Class: ham")
+
+	// a table with a zero threshold places zero in the class above it, per the inclusive boundary
+	data[1] = "To: touser@localdomain.ext"
+	require.Contains(t, filterMessage(t, nil, data), "X-Spam-Class: applied_class")
+
+	output := filterMessage(t, map[string]any{"zero_score_class": "internal"}, data)
+	require.Contains(t, output, "X-Spam-Class: internal")
+	data[0] = "X-Spam-Score: 0.01 / 100"
+	require.Contains(t, filterMessage(t, map[string]any{"zero_score_class": "internal"}, data), "X-Spam-Class: applied_class")
+}
+
+func TestPreferEnvelopeRecipient(t *testing.T) {
+	input := strings.Replace(messageInput([]string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: list@lists.example.net",
+		"",
+		"body",
+	}), "|tx-rcpt|deadbeef|cafebabe|ok|list@lists.example.net", "|tx-rcpt|deadbeef|cafebabe|ok|username@example.org", 1)
+	classify := func(options map[string]any) []string {
+		var output strings.Builder
+		f := newTestFilter(t, options, input, &output)
+		f.Run()
+		return filteredLines(t, output.String())
+	}
+	// the subscriber's table is used by default
+	require.Contains(t, classify(nil), "X-Spam-Class: possible")
+
+	// the list address selects the default table when disabled
+	require.Contains(t, classify(map[string]any{"prefer_envelope_recipient": false}), "X-Spam-Class: ham")
+}
+
+func TestRecipientFallback(t *testing.T) {
+	// a Bcc recipient has no To header; the envelope recipient is used
+	output := filterMessage(t, nil, []string{
+		"X-Spam-Score: 1.155 / 100",
+		"From: fromuser@example.org",
+		"",
+		"body",
+	})
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+
+	f := newTestFilter(t, map[string]any{"prefer_envelope_recipient": false}, "", nil)
+	message := NewMessage("cafebabe")
+	_, ok := f.recipientAddress("test", message)
+	require.False(t, ok)
+	message.EnvelopeTo = []string{"username+tag@example.org"}
+	address, ok := f.recipientAddress("test", message)
+	require.True(t, ok)
+	require.Equal(t, "username@example.org", address)
+	message.EnvelopeTo = nil
+	message.To = []string{"touser@localdomain.ext"}
+	address, ok = f.recipientAddress("test", message)
+	require.True(t, ok)
+	require.Equal(t, "touser@localdomain.ext", address)
+}
+
+func TestPlusAlias(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "classes.json")
+	writeTestClasses(t, filename, `{
+    "username@example.org": [{"name": "ham", "score": 0}, {"name": "possible", "score": 3}, {"name": "probable", "score": 10}],
+    "username+lists@example.org": [{"name": "list", "score": 20}],
+    "^username\\+alerts-.*@example\\.org$": [{"name": "alerts", "score": 30, "regex": true}]
+}`)
+	classify := func(plusAlias, address string) []string {
+		return filterMessage(t, map[string]any{"class_config_file": filename, "plus_alias": plusAlias}, []string{
+			"X-Spam-Score: 1.155 / 100",
+			"To: " + address,
+			"",
+			"body",
+		})
+	}
+	require.Contains(t, classify("strip", "username+lists@example.org"), "X-Spam-Class: possible")
+	require.Contains(t, classify("keep", "username+lists@example.org"), "X-Spam-Class: list")
+	require.Contains(t, classify("keep", "username+other@example.org"), "X-Spam-Class: ham")
+	require.Contains(t, classify("both", "username+lists@example.org"), "X-Spam-Class: list")
+	require.Contains(t, classify("both", "username+other@example.org"), "X-Spam-Class: possible")
+	require.Contains(t, classify("both", "username+alerts-disk@example.org"), "X-Spam-Class: alerts")
+
+	// a domain entry matches the untagged address too, so it does not keep the tag
+	writeTestClasses(t, filename, `{
+    "username@example.org": [{"name": "ham", "score": 0}, {"name": "possible", "score": 3}],
+    "@example.org": [{"name": "domain", "score": 40}]
+}`)
+	require.Contains(t, classify("both", "username+other@example.org"), "X-Spam-Class: possible")
+
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"plus_alias": "drop"})
+	_, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.NotNil(t, err)
+}
+
+func TestRunContextCancel(t *testing.T) {
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	f, err := NewFilter(reader, io.Discard)
+	require.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		result <- f.RunContext(ctx)
+	}()
+	_, err = writer.Write([]byte(strings.Join(initLines, "\n") + "\n"))
+	require.Nil(t, err)
+	cancel()
+	select {
+	case err := <-result:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("RunContext did not return after cancel")
+	}
+}
+
+func TestRunMalformedLine(t *testing.T) {
+	var output strings.Builder
+	input := messageInput([]string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	})
+	input = strings.Replace(input, messageLines[0]+"\n", messageLines[0]+"\nreport|0.7\n", 1)
+	f := newTestFilter(t, nil, input, &output)
+	log := captureLog(t)
+	require.Nil(t, f.Run())
+	require.Contains(t, log.String(), "failed parsing: 'report|0.7'")
+	require.Contains(t, filteredLines(t, output.String()), "X-Spam-Class: applied_class")
+}
+
+func TestLogCorrelationId(t *testing.T) {
+	var output strings.Builder
+	f := newTestFilter(t, nil, messageInput([]string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}), &output)
+	log := captureLog(t)
+	f.Run()
+	var summary, debug string
+	for _, line := range strings.Split(log.String(), "\n") {
+		switch {
+		case strings.Contains(line, "class='applied_class'"):
+			summary = line
+		case strings.Contains(line, "line=X-Spam-Score: 1.155 / 100"):
+			debug = line
+		}
+	}
+	require.Contains(t, summary, "data-line[deadbeef.cafebabe]: address=touser@localdomain.ext")
+	require.Contains(t, debug, "data-line[deadbeef.cafebabe]: sid=deadbeef")
+	// transaction events are tagged the same way
+	require.Contains(t, log.String(), "tx-rcpt[deadbeef.cafebabe]: session=deadbeef message=cafebabe result=ok address=touser@localdomain.ext")
+}
+
+func TestMaxRecipientsForClassify(t *testing.T) {
+	rcpt := "report|0.7|0000000000.000000|smtp-in|tx-rcpt|deadbeef|cafebabe|ok|"
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"X-Spam-Class: upstream",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	input := strings.Replace(messageInput(data), rcpt+"touser@localdomain.ext", rcpt+"touser@localdomain.ext\n"+rcpt+"a@localdomain.ext\n"+rcpt+"b@localdomain.ext", 1)
+	var output strings.Builder
+	f := newTestFilter(t, map[string]any{"max_recipients_for_classify": 2}, input, &output)
+	f.Run()
+	// unclassified, but an upstream class header is still stripped
+	require.Equal(t, []string{"X-Spam-Score: 1.155 / 100", "To: touser@localdomain.ext", "", "body", "."}, filteredLines(t, output.String()))
+
+	// at the cap, the message is classified
+	output.Reset()
+	f = newTestFilter(t, map[string]any{"max_recipients_for_classify": 3}, input, &output)
+	f.Run()
+	require.Contains(t, filteredLines(t, output.String()), "X-Spam-Class: applied_class")
+}
+
+func TestReasonHeader(t *testing.T) {
+	headers := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"X-Spam-Status: No, score=1.155 required=100.000",
+		"    tests=[ARC_NA=0.000, ZERO_FONT=0.300]",
+		"X-Spam-Class-Reason: reason=forged",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	output := filterMessage(t, map[string]any{"emit_reason_header": true, "dangerous_symbols": []string{"ZERO_FONT"}}, headers)
+	require.Contains(t, output, "X-Spam-Class: spam")
+	require.Contains(t, output, "X-Spam-Class-Reason: reason=symbol:ZERO_FONT")
+	require.NotContains(t, output, "X-Spam-Class-Reason: reason=forged")
+
+	output = filterMessage(t, map[string]any{"emit_reason_header": true, "dangerous_symbols": []string{}}, headers)
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+	require.Contains(t, output, "X-Spam-Class-Reason: reason=threshold")
+}
+
+func TestRecipientResolutionOrder(t *testing.T) {
+	input := strings.Replace(messageInput([]string{
+		"X-Spam-Score: 1.155 / 100",
+		"Delivered-To: Username+lists@example.org",
+		"X-Original-To: list@lists.example.net",
+		"To: list@lists.example.net",
+		"",
+		"body",
+	}), "|tx-rcpt|deadbeef|cafebabe|ok|list@lists.example.net", "|tx-rcpt|deadbeef|cafebabe|ok|touser@localdomain.ext", 1)
+	classify := func(order []string) []string {
+		var output strings.Builder
+		f := newTestFilter(t, map[string]any{"recipient_resolution_order": order}, input, &output)
+		f.Run()
+		return filteredLines(t, output.String())
+	}
+	// unconfigured sources are skipped until a configured table matches
+	require.Contains(t, classify([]string{"to", "x_original_to", "delivered_to", "envelope"}), "X-Spam-Class: possible")
+	require.Contains(t, classify([]string{"envelope", "delivered_to"}), "X-Spam-Class: applied_class")
+
+	// the first available address is used when no table matches
+	require.Contains(t, classify([]string{"to", "auth_user"}), "X-Spam-Class: ham")
+
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"recipient_resolution_order": []string{"to", "srs"}})
+	_, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.NotNil(t, err)
+}
+
+func TestSubsystemClassConfig(t *testing.T) {
+	outbound := filepath.Join(t.TempDir(), "outbound.json")
+	err := os.WriteFile(outbound, []byte(`{"touser@localdomain.ext": [{"name": "outbound", "score": 50}]}`), 0600)
+	require.Nil(t, err)
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	var output strings.Builder
+	f := newTestFilter(t, map[string]any{"class_config_file": map[string]any{
+		"smtp-in":  filepath.Join("testdata", "classes.json"),
+		"smtp-out": outbound,
+	}}, messageInput(data), &output)
+	require.Empty(t, f.classConfigFile)
+	f.Run()
+	require.Equal(t, filepath.Join("testdata", "classes.json"), f.classConfigFile)
+	require.Contains(t, filteredLines(t, output.String()), "X-Spam-Class: applied_class")
+
+	// the subsystem absent from the map uses the default entry
+	output.Reset()
+	f = newTestFilter(t, map[string]any{"class_config_file": map[string]any{
+		"default":  outbound,
+		"smtp-out": filepath.Join("testdata", "classes.json"),
+	}}, messageInput(data), &output)
+	f.Run()
+	require.Equal(t, outbound, f.classConfigFile)
+	require.Contains(t, filteredLines(t, output.String()), "X-Spam-Class: outbound")
+}
+
+func TestUnmatchedPassthrough(t *testing.T) {
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"X-Spam: yes",
+		"X-Spam-Class: upstream",
+		"To: nobody@example.com",
+		"",
+		"body",
+	}
+	output := filterMessage(t, map[string]any{"unmatched_passthrough": true}, data)
+	require.Equal(t, append(append([]string{}, data...), "."), output)
+
+	// configured recipients are classified as usual
+	data[3] = "To: touser@localdomain.ext"
+	output = filterMessage(t, map[string]any{"unmatched_passthrough": true}, data)
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+	require.NotContains(t, output, "X-Spam-Class: upstream")
+}
+
+func TestDomainClassEntries(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "classes.json")
+	writeTestClasses(t, filename, `{
+    "boss@corp.example.org": [{"name": "exact", "score": 50}],
+    "*@corp.example.org": [{"name": "wildcard", "score": 50}],
+    "@other.example.org": [{"name": "domain", "score": 50}]
+}`)
+	require.Nil(t, validateClassConfig(filename))
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: boss@corp.example.org",
+		"",
+		"body",
+	}
+	cases := map[string]string{
+		"boss@corp.example.org":    "exact",
+		"staff@corp.example.org":   "wildcard",
+		"anyone@other.example.org": "domain",
+		"nobody@example.com":       "ham",
+	}
+	for address, class := range cases {
+		data[1] = "To: " + address
+		output := filterMessage(t, map[string]any{"class_config_file": filename}, data)
+		require.Contains(t, output, "X-Spam-Class: "+class, address)
+	}
+}
+
+func TestRegexClassEntries(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "classes.json")
+	writeTestClasses(t, filename, `{
+    "sales-boss@example.org": [{"name": "exact", "score": 50}],
+    "^sales-.*@example\\.org$": [{"name": "sales", "score": 50, "regex": true}],
+    "^.*-.*@example\\.org$": [{"name": "hyphen", "score": 50, "regex": true}],
+    "*@example.org": [{"name": "wildcard", "score": 50}]
+}`)
+	require.Nil(t, validateClassConfig(filename))
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: sales-boss@example.org",
+		"",
+		"body",
+	}
+	cases := map[string]string{
+		"sales-boss@example.org": "exact",
+		"sales-east@example.org": "sales",
+		"tech-east@example.org":  "hyphen",
+		"tech@example.org":       "wildcard",
+		"sales-east@example.com": "ham",
+	}
+	for address, class := range cases {
+		data[1] = "To: " + address
+		output := filterMessage(t, map[string]any{"class_config_file": filename}, data)
+		require.Contains(t, output, "X-Spam-Class: "+class, address)
+	}
+
+	// an invalid regex key is reported and skipped
+	writeTestClasses(t, filename, `{"^sales-(@example\\.org$": [{"name": "sales", "score": 50, "regex": true}]}`)
+	f := newTestFilter(t, map[string]any{"class_config_file": filename}, "", io.Discard)
+	require.Empty(t, f.getPatterns())
+	require.Equal(t, "ham", f.getClass([]string{"sales-east@example.org"}, 1.155))
+	require.NotNil(t, validateClassConfig(filename))
+}
+
+func TestDefaultOnMissing(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "missing.json")
+	data := []string{
+		"X-Spam-Score: 7.2 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	output := filterMessage(t, map[string]any{"class_config_file": filename}, data)
+	require.Contains(t, output, "X-Spam-Class: probable")
+
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"class_config_file": filename, "default_on_missing": false})
+	_, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,271 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/rstms/rspamd-classes/classes"
+	"go.yaml.in/yaml/v3"
+)
+
+const CLASS_CONFIG_FORMAT_JSON = "json"
+const CLASS_CONFIG_FORMAT_YAML = "yaml"
+const CLASS_CONFIG_FORMAT_TOML = "toml"
+
+// return the class config file format from class_config_format, or from the filename extension
+func classConfigFormat(filename string) (string, error) {
+	format := strings.ToLower(ViperGetString("class_config_format"))
+	if format == "" && !IsDir(filename) {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+	}
+	switch format {
+	case "", CLASS_CONFIG_FORMAT_JSON:
+		return CLASS_CONFIG_FORMAT_JSON, nil
+	case CLASS_CONFIG_FORMAT_YAML, "yml":
+		return CLASS_CONFIG_FORMAT_YAML, nil
+	case CLASS_CONFIG_FORMAT_TOML:
+		return CLASS_CONFIG_FORMAT_TOML, nil
+	}
+	return "", fmt.Errorf("unknown class config format: %s", format)
+}
+
+// a class config file or directory, read and parsed once; the class tables, labels, regex
+// keys and sections in use are all derived from it
+type classConfig struct {
+	Filename   string
+	Exists     bool
+	Recipients []byte
+	Sections   map[string]json.RawMessage
+	Problems   []configProblem
+}
+
+// read a class config file or directory, with profile references expanded; a missing
+// file yields an empty config
+func readClassConfig(filename string) (*classConfig, error) {
+	config := classConfig{
+		Filename:   filename,
+		Recipients: []byte("{}"),
+		Sections:   make(map[string]json.RawMessage),
+		Problems:   []configProblem{},
+	}
+	if !classConfigExists(filename) {
+		return &config, nil
+	}
+	config.Exists = true
+	lines := map[string]int{}
+	var err error
+	if IsDir(filename) {
+		config.Recipients, config.Sections, err = readClassConfigDir(filename)
+	} else {
+		var data []byte
+		data, err = os.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading %s: %v", filename, err)
+		}
+		config.Recipients, config.Sections, err = parseClassConfigFile(filename, data)
+		format, _ := classConfigFormat(filename)
+		if err == nil && format == CLASS_CONFIG_FORMAT_JSON {
+			lines = jsonLines(data)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	config.Recipients, config.Sections, err = expandProfiles(config.Recipients, config.Sections)
+	if err != nil {
+		return nil, fmt.Errorf("failed expanding profiles in %s: %v", filename, err)
+	}
+	config.Problems, err = configProblems(filename, config.Recipients, config.Sections, lines)
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// return true if filename names an existing class config file or directory
+func classConfigExists(filename string) bool {
+	return filename != "" && (IsFile(filename) || IsDir(filename))
+}
+
+// read a class config file, returning the recipient class tables and a map of the other
+// sections, as JSON
+//
+// YAML files keep the declaration order of their keys; TOML tables are decoded in sorted key order
+func readClassConfigFile(filename string) ([]byte, map[string]json.RawMessage, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed reading %s: %v", filename, err)
+	}
+	return parseClassConfigFile(filename, data)
+}
+
+// parse the contents of a class config file in the format named by filename
+func parseClassConfigFile(filename string, data []byte) ([]byte, map[string]json.RawMessage, error) {
+	format, err := classConfigFormat(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch format {
+	case CLASS_CONFIG_FORMAT_YAML:
+		data, err = yamlClassConfig(data)
+	case CLASS_CONFIG_FORMAT_TOML:
+		config := map[string]any{}
+		err = toml.Unmarshal(data, &config)
+		if err == nil {
+			data, err = json.Marshal(config)
+		}
+	}
+	var recipients []byte
+	var sections map[string]json.RawMessage
+	if err == nil {
+		recipients, sections, err = splitClassConfig(data)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed parsing %s: %v", filename, err)
+	}
+	return recipients, sections, nil
+}
+
+// a top level class config key and its value
+type configEntry struct {
+	Key   string
+	Value json.RawMessage
+}
+
+// return the top level entries of a JSON object in declaration order
+func configEntries(data []byte) ([]configEntry, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token != json.Delim('{') {
+		return nil, fmt.Errorf("expected an object of addresses to class lists")
+	}
+	entries := []configEntry{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := token.(string)
+		var value json.RawMessage
+		err = decoder.Decode(&value)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, configEntry{Key: key, Value: value})
+	}
+	return entries, nil
+}
+
+// return entries as a JSON object in order
+func encodeConfigEntries(entries []configEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	for i, entry := range entries {
+		key, err := json.Marshal(entry.Key)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		buf.Write(key)
+		buf.WriteString(":")
+		buf.Write(entry.Value)
+	}
+	buf.WriteString("}")
+	return buf.Bytes(), nil
+}
+
+// separate the named sections from the recipient class tables, preserving key order
+func splitClassConfig(data []byte) ([]byte, map[string]json.RawMessage, error) {
+	entries, err := configEntries(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	recipients := []configEntry{}
+	sections := make(map[string]json.RawMessage)
+	for _, entry := range entries {
+		if slices.Contains(CLASS_CONFIG_SECTIONS, entry.Key) {
+			sections[entry.Key] = entry.Value
+		} else {
+			recipients = append(recipients, entry)
+		}
+	}
+	encoded, err := encodeConfigEntries(recipients)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encoded, sections, nil
+}
+
+// convert a YAML class config to JSON, preserving the order of the top level keys
+func yamlClassConfig(data []byte) ([]byte, error) {
+	var document yaml.Node
+	err := yaml.Unmarshal(data, &document)
+	if err != nil {
+		return nil, err
+	}
+	if len(document.Content) == 0 {
+		return []byte("{}"), nil
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: expected a mapping of addresses to class lists", root.Line)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		var list any
+		err := root.Content[i+1].Decode(&list)
+		if err != nil {
+			return nil, err
+		}
+		key, err := json.Marshal(root.Content[i].Value)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(list)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		buf.Write(key)
+		buf.WriteString(":")
+		buf.Write(value)
+	}
+	buf.WriteString("}")
+	return buf.Bytes(), nil
+}
+
+// return the recipient class tables of a class config the way the classes library reads JSON,
+// skipping the entries named by its problems
+func readClassTables(config *classConfig) (*classes.SpamClasses, error) {
+	spamClasses, err := classes.New("")
+	if err != nil {
+		return nil, err
+	}
+	tables := map[string][]classes.SpamClass{}
+	err = json.Unmarshal(config.Recipients, &tables)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing %s: %v", config.Filename, err)
+	}
+	skipInvalid("", tables, config.Problems)
+	for address, list := range tables {
+		// like classes.New, the built-in default table replaces a configured default
+		if address != classes.DEFAULT_NAME {
+			spamClasses.SetClasses(address, list)
+		}
+	}
+	return spamClasses, nil
+}
@@ -0,0 +1,72 @@
+package filter
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testYAMLClasses = `
+touser@localdomain.ext:
+  - name: low
+    score: 1
+    label: Low
+  - name: spam
+    score: 999
+"^z.*@example\\.org$":
+  - name: zed
+    score: 50
+    regex: true
+"^.*@example\\.org$":
+  - name: any
+    score: 50
+    regex: true
+`
+
+const testTOMLClasses = `
+[["touser@localdomain.ext"]]
+name = "low"
+score = 1
+label = "Low"
+
+[["touser@localdomain.ext"]]
+name = "spam"
+score = 999
+`
+
+func TestClassConfigFormats(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{"classes.yaml": testYAMLClasses, "classes.yml": testYAMLClasses, "classes.toml": testTOMLClasses} {
+		filename := filepath.Join(dir, name)
+		writeTestClasses(t, filename, data)
+		require.Nil(t, validateClassConfig(filename), name)
+		f := newTestFilter(t, map[string]any{"class_config_file": filename}, "", io.Discard)
+		require.Equal(t, "low", f.getClass([]string{"touser@localdomain.ext"}, 0), name)
+		require.Equal(t, "spam", f.getClass([]string{"touser@localdomain.ext"}, 1), name)
+		require.Equal(t, "Low", f.classLabel("touser@localdomain.ext", "low"), name)
+		require.Equal(t, "ham", f.getClass([]string{"nobody@example.com"}, 0), name)
+	}
+}
+
+func TestClassConfigYAMLKeyOrder(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "classes.yaml")
+	writeTestClasses(t, filename, testYAMLClasses)
+	f := newTestFilter(t, map[string]any{"class_config_file": filename}, "", io.Discard)
+	require.Equal(t, "zed", f.getClass([]string{"zoe@example.org"}, 0))
+	require.Equal(t, "any", f.getClass([]string{"amy@example.org"}, 0))
+}
+
+func TestClassConfigFormatOption(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "classes.conf")
+	writeTestClasses(t, filename, testYAMLClasses)
+	f := newTestFilter(t, map[string]any{"class_config_file": filename, "class_config_format": "yaml"}, "", io.Discard)
+	require.Equal(t, "low", f.getClass([]string{"touser@localdomain.ext"}, 0))
+
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"class_config_file": filename, "class_config_format": "xml"})
+	_, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,149 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+	"github.com/spf13/viper"
+)
+
+const DEFAULT_GEOIP_HEADER = "X-Connect-Country"
+
+const COUNTER_GEOIP_SCORED = "geoip_scored"
+
+var COUNTRY_CODE_PATTERN = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// score adjustments and forced classes by the country of the connecting client address
+//
+//	geoip_database:        MaxMind GeoLite2 or GeoIP2 Country or City database file; disabled when unset
+//	geoip_country_scores:  map of ISO 3166 country code to the score added
+//	geoip_country_classes: map of ISO 3166 country code to the class forced
+//	geoip_header:          header reporting the client country, default DEFAULT_GEOIP_HEADER;
+//	                       set empty to omit it
+//
+// a network without a location uses its registered country; authenticated sessions are
+// reported but neither scored nor classed by country
+type GeoIP struct {
+	Scores  map[string]float32
+	Classes map[string]string
+	Header  string
+	reader  *maxminddb.Reader
+}
+
+// the country fields of a Country or City database record
+type geoipRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+func newGeoIP() (*GeoIP, error) {
+	database := ViperGetString("geoip_database")
+	if database == "" {
+		return nil, nil
+	}
+	// the database is held in memory for the life of the filter
+	buf, err := os.ReadFile(database)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening geoip_database: %v", err)
+	}
+	reader, err := maxminddb.OpenBytes(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening geoip_database: %v", err)
+	}
+	scores := map[string]float64{}
+	err = viper.UnmarshalKey(ViperKey("geoip_country_scores"), &scores)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing geoip_country_scores: %v", err)
+	}
+	ViperSetDefault("geoip_header", DEFAULT_GEOIP_HEADER)
+	g := GeoIP{
+		Scores:  make(map[string]float32),
+		Classes: make(map[string]string),
+		Header:  ViperGetString("geoip_header"),
+		reader:  reader,
+	}
+	for country, score := range scores {
+		country = strings.ToUpper(country)
+		if !COUNTRY_CODE_PATTERN.MatchString(country) {
+			return nil, fmt.Errorf("invalid geoip_country_scores country: '%s'", country)
+		}
+		g.Scores[country] = float32(score)
+	}
+	for country, class := range ViperGetStringMapString("geoip_country_classes") {
+		country = strings.ToUpper(country)
+		if !COUNTRY_CODE_PATTERN.MatchString(country) {
+			return nil, fmt.Errorf("invalid geoip_country_classes country: '%s'", country)
+		}
+		g.Classes[country] = class
+	}
+	return &g, nil
+}
+
+// return the ISO country code of a client address, or "" if it is not located
+func (g *GeoIP) Country(remote string) (string, error) {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil || ip.IsLoopback() || ip.IsPrivate() {
+		return "", nil
+	}
+	ip = ip.Unmap()
+	// IPv4-only databases locate no IPv6 clients
+	if ip.Is6() && g.reader.Metadata.IPVersion == 4 {
+		return "", nil
+	}
+	var record geoipRecord
+	err = g.reader.Lookup(ip).Decode(&record)
+	if err != nil {
+		return "", err
+	}
+	code := record.Country.ISOCode
+	if code == "" {
+		code = record.RegisteredCountry.ISOCode
+	}
+	return strings.ToUpper(code), nil
+}
+
+// record the country of a new session's client address
+func (f *Filter) locateSession(name string, session *Session) {
+	country, err := f.geoip.Country(session.Remote)
+	if err != nil {
+		Warning("%s.%s: geoip lookup of %s failed: %v", f.Name, name, session.Remote, err)
+		return
+	}
+	session.Country = country
+}
+
+// return the country score adjustment for a message's session
+func (f *Filter) geoipScore(name string, session *Session) float32 {
+	if f.geoip == nil || session.AuthorizedUser != "" {
+		return 0
+	}
+	score := f.geoip.Scores[session.Country]
+	if score != 0 {
+		f.count(COUNTER_GEOIP_SCORED)
+		log.Printf("%s.%s: client country %s adds %v to score\n", f.Name, name, session.Country, score)
+	}
+	return score
+}
+
+// return the class forced for a message's session country
+func (f *Filter) geoipClass(session *Session) (string, bool) {
+	if f.geoip == nil || session.AuthorizedUser != "" || session.Country == "" {
+		return "", false
+	}
+	class, ok := f.geoip.Classes[session.Country]
+	return class, ok
+}
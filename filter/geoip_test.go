@@ -0,0 +1,176 @@
+package filter
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// the marker preceding the metadata section at the end of a MaxMind DB file
+var testMMDBMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const testMMDBDataSeparator = 16
+
+// encode a MaxMind DB data section string
+func mmdbString(value string) []byte {
+	return append([]byte{2<<5 | byte(len(value))}, value...)
+}
+
+// encode a MaxMind DB data section map header for count pairs
+func mmdbMap(count int) []byte {
+	return []byte{7<<5 | byte(count)}
+}
+
+// encode a MaxMind DB data section uint32
+func mmdbUint32(value uint32) []byte {
+	return binary.BigEndian.AppendUint32([]byte{6<<5 | 4}, value)
+}
+
+// write an IPv4 MaxMind DB with 24 bit records mapping each network to its data section offset
+func testMMDB(t *testing.T, data []byte, networks map[string]int) string {
+	// search tree records are node indexes, -1 for no data, or -2-offset for a data offset
+	nodes := [][2]int{{-1, -1}}
+	for network, offset := range networks {
+		_, ipnet, err := net.ParseCIDR(network)
+		require.Nil(t, err)
+		ones, _ := ipnet.Mask.Size()
+		ip := ipnet.IP.To4()
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-i%8)) & 1
+			if i == ones-1 {
+				nodes[node][bit] = -2 - offset
+				break
+			}
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+	count := len(nodes)
+	buf := []byte{}
+	for _, node := range nodes {
+		for _, record := range node {
+			value := record
+			switch {
+			case record == -1:
+				value = count
+			case record < -1:
+				value = count + testMMDBDataSeparator + (-2 - record)
+			}
+			buf = append(buf, byte(value>>16), byte(value>>8), byte(value))
+		}
+	}
+	buf = append(buf, make([]byte, testMMDBDataSeparator)...)
+	buf = append(buf, data...)
+	buf = append(buf, testMMDBMetadataMarker...)
+	buf = append(buf, mmdbMap(3)...)
+	buf = append(append(buf, mmdbString("node_count")...), mmdbUint32(uint32(count))...)
+	buf = append(append(buf, mmdbString("record_size")...), mmdbUint32(24)...)
+	buf = append(append(buf, mmdbString("ip_version")...), mmdbUint32(4)...)
+	filename := filepath.Join(t.TempDir(), "country.mmdb")
+	require.Nil(t, os.WriteFile(filename, buf, 0600))
+	return filename
+}
+
+// return a database locating 1.2.3.0/24 in RU and 9.0.0.0/8 by its registered country DE
+func testCountryDatabase(t *testing.T) string {
+	data := append(mmdbMap(1), mmdbString("country")...)
+	key := len(data) + 1
+	data = append(append(append(data, mmdbMap(1)...), mmdbString("iso_code")...), mmdbString("RU")...)
+	registered := len(data)
+	data = append(append(data, mmdbMap(1)...), mmdbString("registered_country")...)
+	// the iso_code key is a pointer to the first record's key
+	data = append(append(data, mmdbMap(1)...), 1<<5, byte(key))
+	data = append(data, mmdbString("de")...)
+	return testMMDB(t, data, map[string]int{"1.2.3.0/24": 0, "9.0.0.0/8": registered})
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"geoip_database": testCountryDatabase(t)})
+	geoip, err := newGeoIP()
+	require.Nil(t, err)
+	for remote, country := range map[string]string{
+		"1.2.3.200:25":     "RU",
+		"9.8.7.6":          "DE",
+		"1.2.4.1:25":       "",
+		"[2001:db8::1]:25": "",
+		"10.0.0.1:25":      "",
+		"unknown":          "",
+	} {
+		code, err := geoip.Country(remote)
+		require.Nil(t, err, remote)
+		require.Equal(t, country, code, remote)
+	}
+
+	// unreadable databases are refused
+	filename := filepath.Join(t.TempDir(), "corrupt.mmdb")
+	require.Nil(t, os.WriteFile(filename, []byte("not a database"), 0600))
+	setTestOptions(t, map[string]any{"geoip_database": filename})
+	_, err = newGeoIP()
+	require.NotNil(t, err)
+}
+
+func TestGeoIPCountry(t *testing.T) {
+	options := map[string]any{
+		"geoip_database":        testCountryDatabase(t),
+		"geoip_country_scores":  map[string]any{"ru": 5},
+		"geoip_country_classes": map[string]string{"DE": "not_spam"},
+	}
+	data := []string{
+		"X-Connect-Country: US",
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	run := func(input string) ([]string, *Filter) {
+		var output strings.Builder
+		f := newTestFilter(t, options, input, &output)
+		f.Run()
+		return filteredLines(t, output.String()), f
+	}
+	input := rdnsInput(data, "sendhost.example.org", "pass")
+	lines, f := run(input)
+	require.Contains(t, lines, "X-Connect-Country: RU")
+	require.NotContains(t, lines, "X-Connect-Country: US")
+	require.Contains(t, lines, "X-Spam-Class: suspected_spam")
+	require.Equal(t, int64(1), f.Counter(COUNTER_GEOIP_SCORED))
+
+	lines, _ = run(strings.Replace(input, "1.2.3.4:11223", "9.9.9.9:11223", 1))
+	require.Contains(t, lines, "X-Connect-Country: DE")
+	require.Contains(t, lines, "X-Spam-Class: not_spam")
+
+	// unlocated clients get no country header
+	lines, _ = run(strings.Replace(input, "1.2.3.4:11223", "10.0.0.1:11223", 1))
+	require.NotContains(t, strings.Join(lines, "\n"), "X-Connect-Country")
+	require.Contains(t, lines, "X-Spam-Class: applied_class")
+
+	// authenticated sessions are reported but not scored
+	lines, _ = run(messageInput(data))
+	require.Contains(t, lines, "X-Connect-Country: RU")
+	require.Contains(t, lines, "X-Spam-Class: applied_class")
+}
+
+func TestGeoIPConfig(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	database := testCountryDatabase(t)
+	for _, options := range []map[string]any{
+		{"geoip_database": filepath.Join(t.TempDir(), "missing.mmdb")},
+		{"geoip_database": database, "geoip_country_scores": map[string]any{"russia": 5}},
+		{"geoip_database": database, "geoip_country_classes": map[string]string{"x1": "spam"}},
+	} {
+		setTestOptions(t, options)
+		_, err := NewFilter(strings.NewReader(""), io.Discard)
+		require.NotNil(t, err, options)
+	}
+}
@@ -0,0 +1,28 @@
+package filter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const DEFAULT_HASH_HEADER = "X-Spam-Class-Hash"
+const DECISION_HASH_LENGTH = 16
+
+// return a stable hash of the classification inputs
+//
+// the hash is the first 16 hex digits of the SHA-256 of the lines:
+//
+//	<recipient>
+//	<score>
+//	<class>=<threshold> for each class in the resolved table, in table order
+func (f *Filter) decisionHash(address string, score float32) string {
+	spamClasses := f.getClasses()
+	lines := []string{address, fmt.Sprintf("%v", score)}
+	for _, class := range f.classList(spamClasses, []string{address}) {
+		lines = append(lines, fmt.Sprintf("%s=%v", class.Name, class.Score))
+	}
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])[:DECISION_HASH_LENGTH]
+}
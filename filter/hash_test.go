@@ -0,0 +1,39 @@
+package filter
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecisionHash(t *testing.T) {
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	hashHeader := func(options map[string]any) string {
+		options["emit_decision_hash"] = true
+		for _, line := range filterMessage(t, options, data) {
+			value, found := strings.CutPrefix(line, "X-Spam-Class-Hash: ")
+			if found {
+				return value
+			}
+		}
+		t.Fatal("hash header not found")
+		return ""
+	}
+	first := hashHeader(map[string]any{})
+	require.Len(t, first, DECISION_HASH_LENGTH)
+	require.Equal(t, first, hashHeader(map[string]any{}))
+
+	// a changed threshold changes the hash
+	filename := filepath.Join(t.TempDir(), "classes.json")
+	err := os.WriteFile(filename, []byte(`{"touser@localdomain.ext": [{"name": "not_spam", "score": 0}, {"name": "applied_class", "score": 6}, {"name": "suspected_spam", "score": 10}]}`), 0600)
+	require.Nil(t, err)
+	changed := hashHeader(map[string]any{"class_config_file": filename})
+	require.NotEqual(t, first, changed)
+}
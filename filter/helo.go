@@ -0,0 +1,103 @@
+package filter
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const COUNTER_HELO_FORGED = "helo_forged"
+
+// score adjustments for forged HELO/EHLO names of unauthenticated sessions
+//
+//	helo_bare_ip_score:       added when the HELO name is an IP address or address literal
+//	helo_rdns_mismatch_score: added when the HELO name differs from the client's reverse DNS name
+//	helo_own_domain_score:    added when the HELO name claims one of helo_own_domains
+//	helo_own_domains:         domains of this host, default local_default_domain
+type heloChecks struct {
+	BareIPScore       float32
+	RDNSMismatchScore float32
+	OwnDomainScore    float32
+	OwnDomains        []string
+}
+
+func newHeloChecks(localDomain string) *heloChecks {
+	h := heloChecks{
+		BareIPScore:       float32(viper.GetFloat64(ViperKey("helo_bare_ip_score"))),
+		RDNSMismatchScore: float32(viper.GetFloat64(ViperKey("helo_rdns_mismatch_score"))),
+		OwnDomainScore:    float32(viper.GetFloat64(ViperKey("helo_own_domain_score"))),
+		OwnDomains:        []string{},
+	}
+	if h.BareIPScore == 0 && h.RDNSMismatchScore == 0 && h.OwnDomainScore == 0 {
+		return nil
+	}
+	domains := ViperGetStringSlice("helo_own_domains")
+	if len(domains) == 0 && localDomain != "" {
+		domains = []string{localDomain}
+	}
+	for _, domain := range domains {
+		h.OwnDomains = append(h.OwnDomains, strings.Trim(strings.ToLower(domain), "."))
+	}
+	return &h
+}
+
+// true if the HELO name is a bare IP address or [address] literal
+func heloIsAddress(helo string) bool {
+	literal := strings.TrimSuffix(strings.TrimPrefix(helo, "["), "]")
+	literal = strings.TrimPrefix(strings.ToLower(literal), "ipv6:")
+	return net.ParseIP(literal) != nil
+}
+
+// return the score adjustment and reasons for a session's HELO name
+func (h *heloChecks) check(session *Session) (float32, []string) {
+	reasons := []string{}
+	var score float32
+	helo := strings.TrimSuffix(strings.ToLower(session.Helo), ".")
+	if helo == "" || session.AuthorizedUser != "" {
+		return 0, reasons
+	}
+	if heloIsAddress(helo) {
+		score += h.BareIPScore
+		reasons = append(reasons, "bare_ip")
+		// an address literal has no name to compare
+		return score, reasons
+	}
+	rdns := strings.TrimSuffix(strings.ToLower(session.RDNS), ".")
+	if rdns != "" && rdns != helo {
+		score += h.RDNSMismatchScore
+		reasons = append(reasons, "rdns_mismatch")
+	}
+	for _, domain := range h.OwnDomains {
+		if helo == domain || strings.HasSuffix(helo, "."+domain) {
+			score += h.OwnDomainScore
+			reasons = append(reasons, "own_domain")
+			break
+		}
+	}
+	return score, reasons
+}
+
+func (f *Filter) linkIdentify(name, sid, method, identity string) {
+	if f.verbose {
+		log.Printf("%s.%s: session=%s method=%s identity=%s\n", f.Name, name, sid, method, identity)
+	}
+	session := f.getSession(name, sid)
+	if session != nil {
+		session.Helo = identity
+	}
+}
+
+// return the HELO score adjustment for a message's session
+func (f *Filter) heloScore(name string, session *Session) float32 {
+	if f.helo == nil {
+		return 0
+	}
+	score, reasons := f.helo.check(session)
+	if len(reasons) > 0 {
+		f.count(COUNTER_HELO_FORGED)
+		log.Printf("%s.%s: HELO %s (%s) adds %v to score\n", f.Name, name, session.Helo, strings.Join(reasons, ","), score)
+	}
+	return score
+}
@@ -0,0 +1,73 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// return filter protocol input for an unauthenticated message from a client identifying as helo
+func heloInput(data []string, helo string) string {
+	identify := "report|0.7|0000000000.000000|smtp-in|link-identify|deadbeef|EHLO|" + helo
+	return strings.Replace(messageInput(data), messageLines[1], identify, 1)
+}
+
+func TestHeloScore(t *testing.T) {
+	options := map[string]any{
+		"helo_bare_ip_score":       6,
+		"helo_rdns_mismatch_score": 1,
+		"helo_own_domain_score":    5,
+		"helo_own_domains":         []string{"localdomain.ext"},
+	}
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	run := func(helo string) (string, *Filter) {
+		var output strings.Builder
+		f := newTestFilter(t, options, heloInput(data, helo), &output)
+		f.Run()
+		return output.String(), f
+	}
+	output, f := run("sendhost.example.org")
+	require.Contains(t, output, "register|report|smtp-in|link-identify\n")
+	require.Contains(t, filteredLines(t, output), "X-Spam-Class: applied_class")
+	require.Equal(t, int64(0), f.Counter(COUNTER_HELO_FORGED))
+
+	// 1.155 + 1 remains applied_class
+	output, f = run("other.example.org")
+	require.Contains(t, filteredLines(t, output), "X-Spam-Class: applied_class")
+	require.Equal(t, int64(1), f.Counter(COUNTER_HELO_FORGED))
+
+	output, _ = run("[1.2.3.4]")
+	require.Contains(t, filteredLines(t, output), "X-Spam-Class: suspected_spam")
+
+	// 1.155 + 1 + 5 for a mismatched name in our own domain
+	output, _ = run("mx.localdomain.ext")
+	require.Contains(t, filteredLines(t, output), "X-Spam-Class: suspected_spam")
+}
+
+func TestHeloAuthenticated(t *testing.T) {
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	identify := "report|0.7|0000000000.000000|smtp-in|link-identify|deadbeef|HELO|1.2.3.4"
+	input := strings.Replace(messageInput(data), messageLines[1], identify+"\n"+messageLines[1], 1)
+	var output strings.Builder
+	f := newTestFilter(t, map[string]any{"helo_bare_ip_score": 6}, input, &output)
+	f.Run()
+	require.Contains(t, filteredLines(t, output.String()), "X-Spam-Class: applied_class")
+}
+
+func TestHeloIsAddress(t *testing.T) {
+	require.True(t, heloIsAddress("1.2.3.4"))
+	require.True(t, heloIsAddress("[1.2.3.4]"))
+	require.True(t, heloIsAddress("[IPv6:2001:db8::1]"))
+	require.False(t, heloIsAddress("mail.example.org"))
+}
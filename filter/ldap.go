@@ -0,0 +1,152 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/rstms/rspamd-classes/classes"
+)
+
+const DEFAULT_LDAP_ADDRESS = "127.0.0.1:389"
+const DEFAULT_LDAP_MAIL_ATTRIBUTE = "mail"
+const DEFAULT_LDAP_CLASS_ATTRIBUTE = "spamClassThresholds"
+const DEFAULT_LDAP_TIMEOUT = "5s"
+const DEFAULT_LDAP_MAX_BYTES = 1024 * 1024
+
+// class lists read from an attribute of the recipient's directory entry
+//
+//	ldap_address:         host:port of the directory server
+//	ldap_tls:             connect with TLS (ldaps)
+//	ldap_bind_dn:         DN for simple bind; anonymous when empty
+//	ldap_bind_password:   password for simple bind
+//	ldap_base_dn:         search base
+//	ldap_mail_attribute:  attribute matched against the recipient address
+//	ldap_class_attribute: attribute holding the class thresholds
+//	ldap_timeout:         connect and request timeout
+//	ldap_max_bytes:       largest directory response accepted
+//
+// class attribute values hold comma separated name=score pairs, e.g. "ham=3,probable=10";
+// multiple values are combined; lookups run on the protocol loop, each taking up to
+// ldap_timeout, so class_backend_cache_ttl bounds how often a recipient's lookup may stall it
+type ldapBackend struct {
+	address       string
+	useTLS        bool
+	bindDN        string
+	bindPassword  string
+	baseDN        string
+	mailAttribute string
+	attribute     string
+	timeout       time.Duration
+}
+
+func newLDAPBackend() (*ldapBackend, error) {
+	ViperSetDefault("ldap_address", DEFAULT_LDAP_ADDRESS)
+	ViperSetDefault("ldap_mail_attribute", DEFAULT_LDAP_MAIL_ATTRIBUTE)
+	ViperSetDefault("ldap_class_attribute", DEFAULT_LDAP_CLASS_ATTRIBUTE)
+	ViperSetDefault("ldap_timeout", DEFAULT_LDAP_TIMEOUT)
+	ViperSetDefault("ldap_max_bytes", DEFAULT_LDAP_MAX_BYTES)
+	timeout, err := time.ParseDuration(ViperGetString("ldap_timeout"))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing ldap_timeout: %v", err)
+	}
+	maxBytes := ViperGetInt("ldap_max_bytes")
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("invalid ldap_max_bytes: %d", maxBytes)
+	}
+	// the BER packet limit is process wide; the directory is its only user
+	ber.MaxPacketLengthBytes = int64(maxBytes)
+	l := ldapBackend{
+		address:       ViperGetString("ldap_address"),
+		useTLS:        ViperGetBool("ldap_tls"),
+		bindDN:        ViperGetString("ldap_bind_dn"),
+		bindPassword:  ViperGetString("ldap_bind_password"),
+		baseDN:        ViperGetString("ldap_base_dn"),
+		mailAttribute: ViperGetString("ldap_mail_attribute"),
+		attribute:     ViperGetString("ldap_class_attribute"),
+		timeout:       timeout,
+	}
+	return &l, nil
+}
+
+func (l *ldapBackend) Lookup(address string) ([]classes.SpamClass, bool, error) {
+	values, err := l.search(address)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(values) == 0 {
+		return nil, false, nil
+	}
+	classList, err := parseClassThresholds(values)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s for %s: %v", l.attribute, address, err)
+	}
+	return classList, len(classList) > 0, nil
+}
+
+// parse name=score pairs into a class list
+func parseClassThresholds(values []string) ([]classes.SpamClass, error) {
+	classList := []classes.SpamClass{}
+	for _, value := range values {
+		for _, pair := range strings.Split(value, ",") {
+			pair = strings.TrimSpace(pair)
+			if pair == "" {
+				continue
+			}
+			name, score, found := strings.Cut(pair, "=")
+			if !found {
+				return nil, fmt.Errorf("expected name=score: '%s'", pair)
+			}
+			threshold, err := strconv.ParseFloat(strings.TrimSpace(score), 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid score: '%s'", pair)
+			}
+			classList = append(classList, classes.SpamClass{Name: strings.TrimSpace(name), Score: float32(threshold)})
+		}
+	}
+	return classList, nil
+}
+
+// return the class attribute values of the first entry whose mail attribute equals address
+func (l *ldapBackend) search(address string) (values []string, err error) {
+	// the client library indexes into response elements without checking their shape
+	defer func() {
+		r := recover()
+		if r != nil {
+			values, err = nil, fmt.Errorf("ldap search failed: malformed response: %v", r)
+		}
+	}()
+	scheme := "ldap://"
+	if l.useTLS {
+		scheme = "ldaps://"
+	}
+	conn, err := ldap.DialURL(scheme+l.address, ldap.DialWithDialer(&net.Dialer{Timeout: l.timeout}))
+	if err != nil {
+		return nil, fmt.Errorf("ldap connect failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetTimeout(l.timeout)
+	if l.bindDN == "" {
+		err = conn.UnauthenticatedBind("")
+	} else {
+		err = conn.Bind(l.bindDN, l.bindPassword)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ldap bind failed: %v", err)
+	}
+	filter := fmt.Sprintf("(%s=%s)", l.mailAttribute, ldap.EscapeFilter(address))
+	request := ldap.NewSearchRequest(l.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 1, int(l.timeout.Seconds()), false, filter, []string{l.attribute}, nil)
+	result, err := conn.Search(request)
+	// the size limit of one is exceeded when several entries match
+	if err != nil && !(ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) && len(result.Entries) > 0) {
+		return nil, fmt.Errorf("ldap search failed: %v", err)
+	}
+	if len(result.Entries) == 0 {
+		return []string{}, nil
+	}
+	return result.Entries[0].GetEqualFoldAttributeValues(l.attribute), nil
+}
@@ -0,0 +1,173 @@
+package filter
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/rstms/rspamd-classes/classes"
+	"github.com/stretchr/testify/require"
+)
+
+// minimal directory server answering simple binds and equality searches
+type testLDAP struct {
+	sync.Mutex
+	entries map[string][]string
+	binds   []string
+	raw     []byte
+}
+
+func (l *testLDAP) serve(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go l.handle(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// return an LDAP response message for request id
+func ldapResponse(id int64, op *ber.Packet) []byte {
+	message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "message")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "id"))
+	message.AppendChild(op)
+	return message.Bytes()
+}
+
+// return an LDAP result operation
+func ldapResultOp(tag ber.Tag, code int64) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matched"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "message"))
+	return op
+}
+
+func (l *testLDAP) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			l.Lock()
+			l.binds = append(l.binds, op.Children[1].Data.String()+":"+op.Children[2].Data.String())
+			l.Unlock()
+			conn.Write(ldapResponse(id, ldapResultOp(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess)))
+		case ldap.ApplicationSearchRequest:
+			if l.raw != nil {
+				conn.Write(l.raw)
+				return
+			}
+			address := op.Children[6].Children[1].Data.String()
+			l.Lock()
+			values, ok := l.entries[address]
+			l.Unlock()
+			if ok {
+				set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "values")
+				for _, value := range values {
+					set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "value"))
+				}
+				attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+				attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, DEFAULT_LDAP_CLASS_ATTRIBUTE, "type"))
+				attribute.AppendChild(set)
+				attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+				attributes.AppendChild(attribute)
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "entry")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "uid=test,"+op.Children[0].Data.String(), "dn"))
+				entry.AppendChild(attributes)
+				conn.Write(ldapResponse(id, entry))
+			}
+			conn.Write(ldapResponse(id, ldapResultOp(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)))
+		default:
+			return
+		}
+	}
+}
+
+func TestLDAPBackend(t *testing.T) {
+	server := &testLDAP{entries: map[string][]string{
+		"touser@localdomain.ext": {"ldap_ham=4, ldap_probable=8"},
+		"bad@localdomain.ext":    {"ldap_ham"},
+	}}
+	address := server.serve(t)
+	options := map[string]any{
+		"class_config_backend": "ldap",
+		"ldap_address":         address,
+		"ldap_bind_dn":         "cn=filter,dc=example,dc=org",
+		"ldap_bind_password":   "secret",
+		"ldap_base_dn":         "dc=example,dc=org",
+	}
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	output := filterMessage(t, options, data)
+	require.Contains(t, output, "X-Spam-Class: ldap_ham")
+
+	// recipients without the attribute use the class config file
+	data[1] = "To: username@example.org"
+	output = filterMessage(t, options, data)
+	require.Contains(t, output, "X-Spam-Class: possible")
+
+	// unparseable attributes fall back to the default classes
+	data[1] = "To: bad@localdomain.ext"
+	output = filterMessage(t, options, data)
+	require.Contains(t, output, "X-Spam-Class: ham")
+
+	server.Lock()
+	defer server.Unlock()
+	require.Equal(t, "cn=filter,dc=example,dc=org:secret", server.binds[0])
+}
+
+func TestParseClassThresholds(t *testing.T) {
+	classList, err := parseClassThresholds([]string{"ham=3, possible=6.5", "probable=10"})
+	require.Nil(t, err)
+	require.Equal(t, []classes.SpamClass{{Name: "ham", Score: 3}, {Name: "possible", Score: 6.5}, {Name: "probable", Score: 10}}, classList)
+	_, err = parseClassThresholds([]string{"ham=high"})
+	require.NotNil(t, err)
+}
+
+func TestLDAPMalformedResponse(t *testing.T) {
+	lookup := func(options map[string]any, server *testLDAP) error {
+		options["ldap_address"] = server.serve(t)
+		options["ldap_timeout"] = "1s"
+		Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+		setTestOptions(t, options)
+		backend, err := newLDAPBackend()
+		require.Nil(t, err)
+		_, _, err = backend.Lookup("touser@localdomain.ext")
+		return err
+	}
+	// a response larger than ldap_max_bytes is refused before it is read
+	large := &testLDAP{entries: map[string][]string{"touser@localdomain.ext": {"ldap_ham=4," + strings.Repeat(" ", 2048)}}}
+	require.Nil(t, lookup(map[string]any{"ldap_max_bytes": DEFAULT_LDAP_MAX_BYTES}, large))
+	require.NotNil(t, lookup(map[string]any{"ldap_max_bytes": 1024}, large))
+	require.NotNil(t, lookup(map[string]any{}, &testLDAP{raw: []byte{0x30, 0x84, 0x7f, 0xff, 0xff, 0xff}}))
+	// truncated and malformed messages fail the lookup
+	require.NotNil(t, lookup(map[string]any{"ldap_max_bytes": DEFAULT_LDAP_MAX_BYTES}, &testLDAP{raw: []byte{0x30, 0x05, 0x02, 0x01}}))
+	require.NotNil(t, lookup(map[string]any{}, &testLDAP{raw: []byte{0x30, 0x03, 0x02, 0x01, 0x02}}))
+	require.NotNil(t, lookup(map[string]any{}, &testLDAP{raw: ldapResponse(2, ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "x", "value"))}))
+
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"ldap_max_bytes": 0})
+	_, err := newLDAPBackend()
+	require.NotNil(t, err)
+}
@@ -0,0 +1,217 @@
+package filter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const DEFAULT_LEARN_TIMEOUT = "10s"
+const DEFAULT_LEARN_MAX_BYTES = 10 * 1024 * 1024
+const DEFAULT_LEARN_MAX_PENDING = 4
+
+const LEARN_SPAM = "learnspam"
+const LEARN_HAM = "learnham"
+
+const COUNTER_LEARNED_SPAM = "learned_spam"
+const COUNTER_LEARNED_HAM = "learned_ham"
+const COUNTER_LEARN_FAILED = "learn_failed"
+
+// Bayes training of rspamd with confidently classified messages
+//
+//	rspamd_controller_url:      base URL of the rspamd controller, e.g. http://localhost:11334
+//	rspamd_controller_password: controller password, sent in the Password header
+//	learn_spam_score:           spam class messages scoring at least this are posted to /learnspam
+//	learn_ham_score:            non-spam class messages scoring at most this are posted to /learnham
+//	learn_timeout:              HTTP request timeout, default DEFAULT_LEARN_TIMEOUT
+//	learn_max_bytes:            messages larger than this are not posted
+//	learn_max_pending:          requests in progress at once, default DEFAULT_LEARN_MAX_PENDING
+//
+// the rspamd score is compared, before any offsets applied by this filter; messages beyond
+// learn_max_pending are dropped and counted as failed
+type Learn struct {
+	URL        string
+	SpamScore  *float32
+	HamScore   *float32
+	MaxBytes   int
+	MaxPending int
+	password   string
+	timeout    time.Duration
+	client     *http.Client
+	send       func(endpoint string, data []byte) error
+	pending    chan struct{}
+	wg         sync.WaitGroup
+}
+
+// a message buffered for a learn request
+type learnCapture struct {
+	Lines    []string
+	Size     int
+	Endpoint string
+}
+
+func newLearn() (*Learn, error) {
+	baseURL := ViperGetString("rspamd_controller_url")
+	spamSet := viper.IsSet(ViperKey("learn_spam_score"))
+	hamSet := viper.IsSet(ViperKey("learn_ham_score"))
+	if !spamSet && !hamSet {
+		return nil, nil
+	}
+	if baseURL == "" {
+		return nil, fmt.Errorf("learn_spam_score and learn_ham_score require rspamd_controller_url")
+	}
+	parsed, err := url.Parse(baseURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return nil, fmt.Errorf("invalid rspamd_controller_url: '%s'", baseURL)
+	}
+	ViperSetDefault("learn_timeout", DEFAULT_LEARN_TIMEOUT)
+	ViperSetDefault("learn_max_bytes", DEFAULT_LEARN_MAX_BYTES)
+	ViperSetDefault("learn_max_pending", DEFAULT_LEARN_MAX_PENDING)
+	timeout, err := time.ParseDuration(ViperGetString("learn_timeout"))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing learn_timeout: %v", err)
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("invalid learn_timeout: %v", timeout)
+	}
+	l := Learn{
+		URL:        strings.TrimSuffix(baseURL, "/"),
+		MaxBytes:   ViperGetInt("learn_max_bytes"),
+		MaxPending: ViperGetInt("learn_max_pending"),
+		password:   ViperGetString("rspamd_controller_password"),
+		timeout:    timeout,
+		client:     &http.Client{Timeout: timeout},
+	}
+	if l.MaxPending < 1 {
+		return nil, fmt.Errorf("invalid learn_max_pending: %d", l.MaxPending)
+	}
+	l.send = l.post
+	l.pending = make(chan struct{}, l.MaxPending)
+	if spamSet {
+		score := float32(viper.GetFloat64(ViperKey("learn_spam_score")))
+		l.SpamScore = &score
+	}
+	if hamSet {
+		score := float32(viper.GetFloat64(ViperKey("learn_ham_score")))
+		l.HamScore = &score
+	}
+	return &l, nil
+}
+
+// return the learn endpoint for a classified message, if any
+func (l *Learn) endpoint(spam bool, score float32) (string, bool) {
+	if spam && l.SpamScore != nil && score >= *l.SpamScore {
+		return LEARN_SPAM, true
+	}
+	if !spam && l.HamScore != nil && score <= *l.HamScore {
+		return LEARN_HAM, true
+	}
+	return "", false
+}
+
+// start buffering a message for a learn request
+func (f *Filter) startLearn(message *Message, spamClass string, score float32) {
+	if f.learn == nil {
+		return
+	}
+	endpoint, ok := f.learn.endpoint(f.IsSpam(spamClass), score)
+	if ok {
+		message.Learn = &learnCapture{Endpoint: endpoint}
+	}
+}
+
+func (f *Filter) captureLearn(name string, message *Message, lines []string) {
+	capture := message.Learn
+	for _, line := range lines {
+		if line == "." {
+			message.Learn = nil
+			f.postLearn(name, capture)
+			return
+		}
+		// data lines are dot-stuffed
+		if strings.HasPrefix(line, "..") {
+			line = line[1:]
+		}
+		capture.Size += len(line) + 2
+		if capture.Size > f.learn.MaxBytes {
+			log.Printf("%s.%s: message exceeds learn_max_bytes (%d); not learned\n", f.Name, name, f.learn.MaxBytes)
+			message.Learn = nil
+			return
+		}
+		capture.Lines = append(capture.Lines, line)
+	}
+}
+
+// post the message to the rspamd controller without blocking the filter
+func (f *Filter) postLearn(name string, capture *learnCapture) {
+	select {
+	case f.learn.pending <- struct{}{}:
+	default:
+		f.count(COUNTER_LEARN_FAILED)
+		Warning("%s.%s: %d rspamd learn requests pending; not learned", f.Name, name, f.learn.MaxPending)
+		return
+	}
+	data := []byte(strings.Join(capture.Lines, "\r\n") + "\r\n")
+	f.learn.wg.Add(1)
+	go func() {
+		defer f.learn.wg.Done()
+		defer func() { <-f.learn.pending }()
+		err := f.learn.send(capture.Endpoint, data)
+		if err != nil {
+			f.count(COUNTER_LEARN_FAILED)
+			Warning("%s.%s: rspamd %s failed: %v", f.Name, name, capture.Endpoint, err)
+			return
+		}
+		if capture.Endpoint == LEARN_SPAM {
+			f.count(COUNTER_LEARNED_SPAM)
+		} else {
+			f.count(COUNTER_LEARNED_HAM)
+		}
+		log.Printf("%s.%s: posted message to rspamd %s\n", f.Name, name, capture.Endpoint)
+	}()
+}
+
+func (l *Learn) post(endpoint string, data []byte) error {
+	request, err := http.NewRequest("POST", l.URL+"/"+endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if l.password != "" {
+		request.Header.Set("Password", l.password)
+	}
+	response, err := l.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// wait up to learn_timeout for pending learn requests when the filter stops
+func (f *Filter) waitLearn() {
+	if f.learn == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		f.learn.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(f.learn.timeout):
+		Warning("%s: abandoned pending learn requests after %v", f.Name, f.learn.timeout)
+	}
+}
@@ -0,0 +1,135 @@
+package filter
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testLearnRequest struct {
+	Path     string
+	Password string
+	Body     string
+}
+
+// return an rspamd controller test server recording learn requests
+func testLearnServer(t *testing.T, status int) (*httptest.Server, func() []testLearnRequest) {
+	var lock sync.Mutex
+	requests := []testLearnRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		requests = append(requests, testLearnRequest{Path: r.URL.Path, Password: r.Header.Get("Password"), Body: string(body)})
+		lock.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []testLearnRequest {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]testLearnRequest{}, requests...)
+	}
+}
+
+func TestLearn(t *testing.T) {
+	server, requests := testLearnServer(t, http.StatusOK)
+	options := map[string]any{
+		"rspamd_controller_url":      server.URL + "/",
+		"rspamd_controller_password": "secret",
+		"learn_spam_score":           40,
+		"learn_ham_score":            0.5,
+	}
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	run := func() *Filter {
+		var output strings.Builder
+		f := newTestFilter(t, options, messageInput(data), &output)
+		f.Run()
+		return f
+	}
+	run()
+	require.Empty(t, requests())
+
+	data[0] = "X-Spam-Score: 50 / 100"
+	f := run()
+	require.Len(t, requests(), 1)
+	request := requests()[0]
+	require.Equal(t, "/learnspam", request.Path)
+	require.Equal(t, "secret", request.Password)
+	require.Contains(t, request.Body, "X-Spam-Score: 50 / 100\r\n")
+	require.True(t, strings.HasSuffix(request.Body, "\r\nbody\r\n"))
+	require.Equal(t, int64(1), f.Counter(COUNTER_LEARNED_SPAM))
+
+	data[0] = "X-Spam-Score: 0.1 / 100"
+	f = run()
+	require.Len(t, requests(), 2)
+	require.Equal(t, "/learnham", requests()[1].Path)
+	require.Equal(t, int64(1), f.Counter(COUNTER_LEARNED_HAM))
+}
+
+func TestLearnFailed(t *testing.T) {
+	server, _ := testLearnServer(t, http.StatusForbidden)
+	data := []string{
+		"X-Spam-Score: 50 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	var output strings.Builder
+	f := newTestFilter(t, map[string]any{"rspamd_controller_url": server.URL, "learn_spam_score": 40}, messageInput(data), &output)
+	f.Run()
+	require.Equal(t, int64(1), f.Counter(COUNTER_LEARN_FAILED))
+}
+
+func TestLearnRequiresURL(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"learn_spam_score": 40})
+	_, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.NotNil(t, err)
+}
+
+func TestLearnMaxPending(t *testing.T) {
+	options := map[string]any{
+		"rspamd_controller_url": "http://localhost:11334",
+		"learn_spam_score":      40,
+		"learn_max_pending":     1,
+		"learn_timeout":         "200ms",
+	}
+	f := newTestFilter(t, options, "", io.Discard)
+	release := make(chan struct{})
+	f.learn.send = func(endpoint string, data []byte) error {
+		<-release
+		return nil
+	}
+	f.postLearn("test", &learnCapture{Endpoint: LEARN_SPAM})
+	f.postLearn("test", &learnCapture{Endpoint: LEARN_SPAM})
+	require.Equal(t, int64(1), f.Counter(COUNTER_LEARN_FAILED))
+	// the shutdown wait is bounded while a request is stalled
+	start := time.Now()
+	f.waitLearn()
+	require.Less(t, time.Since(start), 5*time.Second)
+	close(release)
+}
+
+func TestLearnInvalidOptions(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	for _, options := range []map[string]any{
+		{"rspamd_controller_url": "http://localhost:11334", "learn_spam_score": 40, "learn_timeout": "0s"},
+		{"rspamd_controller_url": "http://localhost:11334", "learn_spam_score": 40, "learn_timeout": "10s", "learn_max_pending": 0},
+	} {
+		setTestOptions(t, options)
+		_, err := NewFilter(strings.NewReader(""), io.Discard)
+		require.NotNil(t, err, options)
+	}
+}
@@ -0,0 +1,82 @@
+package filter
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const DEFAULT_LEVEL_HEADER = "X-Spam-Level"
+const LEVEL_MODE_ABSOLUTE = "absolute"
+const LEVEL_MODE_RELATIVE = "relative"
+const DEFAULT_LEVEL_SCALE = 10
+const DEFAULT_LEVEL_REQUIRED = 15.0
+const DEFAULT_LEVEL_MAX = 50
+
+// X-Spam-Level asterisk header
+//
+//	emit_level_header:      enable the header
+//	level_header:           header name
+//	level_mode:             absolute: one asterisk per whole point of score
+//	                        relative: score/required * level_scale asterisks
+//	level_scale:            asterisks at the required score in relative mode
+//	level_default_required: required score used when the message has none
+//	level_max:              maximum number of asterisks
+type spamLevel struct {
+	Header   string
+	Mode     string
+	Scale    int
+	Required float32
+	Max      int
+}
+
+func newSpamLevel() (*spamLevel, error) {
+	if !ViperGetBool("emit_level_header") {
+		return nil, nil
+	}
+	ViperSetDefault("level_header", DEFAULT_LEVEL_HEADER)
+	ViperSetDefault("level_mode", LEVEL_MODE_ABSOLUTE)
+	ViperSetDefault("level_scale", DEFAULT_LEVEL_SCALE)
+	ViperSetDefault("level_default_required", DEFAULT_LEVEL_REQUIRED)
+	ViperSetDefault("level_max", DEFAULT_LEVEL_MAX)
+	level := spamLevel{
+		Header:   ViperGetString("level_header"),
+		Mode:     ViperGetString("level_mode"),
+		Scale:    ViperGetInt("level_scale"),
+		Required: float32(viper.GetFloat64(ViperKey("level_default_required"))),
+		Max:      ViperGetInt("level_max"),
+	}
+	switch level.Mode {
+	case LEVEL_MODE_ABSOLUTE, LEVEL_MODE_RELATIVE:
+	default:
+		return nil, fmt.Errorf("unknown level_mode: %s", level.Mode)
+	}
+	if level.Required <= 0 {
+		return nil, fmt.Errorf("invalid level_default_required: %v", level.Required)
+	}
+	if level.Max < 1 {
+		return nil, fmt.Errorf("invalid level_max: %d", level.Max)
+	}
+	return &level, nil
+}
+
+// return the number of asterisks for a message score
+func (l *spamLevel) count(message *Message, score float32) int {
+	value := float64(score)
+	if l.Mode == LEVEL_MODE_RELATIVE {
+		required := l.Required
+		if message.RequiredSet && message.Required > 0 {
+			required = message.Required
+		}
+		value = value / float64(required) * float64(l.Scale)
+	}
+	count := int(math.Floor(value))
+	return max(0, min(count, l.Max))
+}
+
+// return the formatted level header
+func (f *Filter) levelHeader(message *Message, score float32) string {
+	return f.formatHeader(f.level.Header, strings.Repeat("*", f.level.count(message, score)))
+}
@@ -0,0 +1,45 @@
+package filter
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSpamLevel(t *testing.T) {
+	data := []string{
+		"X-Spam-Score: 7.5 / 15",
+		"X-Spam-Level: ***************",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	output := filterMessage(t, map[string]any{"emit_level_header": true, "level_mode": "absolute"}, data)
+	require.Contains(t, output, "X-Spam-Level: *******")
+	require.NotContains(t, output, "X-Spam-Level: ***************")
+
+	// relative to the required score: 7.5/15 * 10
+	output = filterMessage(t, map[string]any{"emit_level_header": true, "level_mode": "relative"}, data)
+	require.Contains(t, output, "X-Spam-Level: *****")
+
+	// the default required is used when the message has none
+	data[0] = "X-Spam-Score: 7.5"
+	output = filterMessage(t, map[string]any{"emit_level_header": true, "level_mode": "relative", "level_default_required": 5}, data)
+	require.Contains(t, output, "X-Spam-Level: ***************")
+
+	// level_max caps the bar
+	output = filterMessage(t, map[string]any{"emit_level_header": true, "level_max": 5}, data)
+	require.Contains(t, output, "X-Spam-Level: *****")
+	require.NotContains(t, output, "X-Spam-Level: ******")
+}
+
+func TestSpamLevelCount(t *testing.T) {
+	level := spamLevel{Mode: LEVEL_MODE_ABSOLUTE, Scale: 10, Required: 15, Max: DEFAULT_LEVEL_MAX}
+	message := NewMessage("m1")
+	require.Equal(t, 0, level.count(message, -3))
+	require.Equal(t, 3, level.count(message, 3.9))
+	require.Equal(t, DEFAULT_LEVEL_MAX, level.count(message, 999))
+	level.Mode = LEVEL_MODE_RELATIVE
+	message.Required = 4
+	message.RequiredSet = true
+	require.Equal(t, 20, level.count(message, 8))
+}
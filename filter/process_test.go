@@ -0,0 +1,78 @@
+package filter
+
+import (
+	"github.com/stretchr/testify/require"
+	"io"
+	"strings"
+	"testing"
+)
+
+func FuzzProcessLine(f *testing.F) {
+	for _, line := range messageLines {
+		f.Add(line)
+	}
+	f.Add("filter|0.7|0000000000.000000|smtp-in|data-line|deadbeef")
+	f.Add("report|0.7|0000000000.000000|smtp-in|tx-rcpt|deadbeef|cafebabe|ok")
+	f.Fuzz(func(t *testing.T, line string) {
+		Init("smtpd-filter-addheader", Version, "testdata/config.yaml")
+		filter, err := NewFilter(strings.NewReader(""), io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// establish a session in the data phase so data-line input reaches the header parser
+		for _, setup := range messageLines[:6] {
+			err := filter.ProcessLine(setup)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		filter.ProcessLine(line)
+	})
+}
+
+func TestProcessLineErrors(t *testing.T) {
+	f := newTestFilter(t, nil, "", io.Discard)
+	require.NotNil(t, f.ProcessLine("report|0.7"))
+	require.NotNil(t, f.ProcessLine("filter|0.7|0000000000.000000|smtp-in|data-line|deadbeef"))
+	require.Nil(t, f.ProcessLine(messageLines[0]))
+	require.Contains(t, f.Sessions, "deadbeef")
+}
+
+func TestProcessLineSeparatorInFinalAtom(t *testing.T) {
+	var output strings.Builder
+	f := newTestFilter(t, nil, "", &output)
+	require.Nil(t, f.ProcessLine(messageLines[0]))
+	require.Nil(t, f.ProcessLine("report|0.7|0000000000.000000|smtp-in|link-auth|deadbeef|pass|user|name"))
+	require.Equal(t, "user|name", f.Sessions["deadbeef"].AuthorizedUser)
+
+	require.Nil(t, f.ProcessLine(messageLines[2]))
+	require.Nil(t, f.ProcessLine("report|0.7|0000000000.000000|smtp-in|tx-rcpt|deadbeef|cafebabe|ok|touser@localdomain.ext|extra"))
+	require.Empty(t, f.Sessions["deadbeef"].Messages["cafebabe"].EnvelopeTo)
+	require.Nil(t, f.ProcessLine(messageLines[4]))
+	require.Equal(t, []string{"touser@localdomain.ext"}, f.Sessions["deadbeef"].Messages["cafebabe"].EnvelopeTo)
+
+	// the data-line payload keeps embedded separators
+	require.Nil(t, f.ProcessLine("filter|0.7|0000000000.000000|smtp-in|data-line|deadbeef|baadf00d|a|b||c"))
+	require.Equal(t, "filter-dataline|deadbeef|baadf00d|a|b||c\n", output.String())
+}
+
+func TestProcessLineEscapedAtoms(t *testing.T) {
+	var output strings.Builder
+	f := newTestFilter(t, nil, "", &output)
+	// an escaped separator does not shift the following atoms
+	require.Nil(t, f.ProcessLine(`report|0.7|0000000000.000000|smtp-in|link-connect|deadbeef|mail\|host|pass|1.2.3.4:11223|5.6.7.8:25`))
+	require.Equal(t, "mail|host", f.Sessions["deadbeef"].RDNS)
+	require.Equal(t, "1.2.3.4:11223", f.Sessions["deadbeef"].Remote)
+
+	require.Nil(t, f.ProcessLine(`report|0.7|0000000000.000000|smtp-in|link-auth|deadbeef|pass|domain\\user\|name`))
+	require.Equal(t, `domain\user|name`, f.Sessions["deadbeef"].AuthorizedUser)
+
+	// other backslashes are kept
+	atoms, _ := splitAtoms(`a\b|c\\|d\|e\`)
+	require.Equal(t, []string{`a\b`, `c\`, `d|e\`}, atoms)
+
+	// the data-line payload is message content and is copied unchanged
+	output.Reset()
+	require.Nil(t, f.ProcessLine(`filter|0.7|0000000000.000000|smtp-in|data-line|deadbeef|baadf00d|a\|b\\c`))
+	require.Equal(t, `filter-dataline|deadbeef|baadf00d|a\|b\\c`+"\n", output.String())
+}
@@ -0,0 +1,160 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// class config section holding named class lists referenced by other entries
+const PROFILES_KEY = "profiles"
+
+// a class list item; items naming a profile are replaced by the profile's classes
+type profileItem struct {
+	Name    string `json:"name"`
+	Profile string `json:"profile"`
+}
+
+// expands profile references in class lists
+//
+// an item {"profile": "strict"} is replaced by the classes of the strict profile; items
+// following it with the same class name override the profile's class, other items are
+// added.  Profiles may reference other profiles.
+type profileExpander struct {
+	profiles map[string][]json.RawMessage
+	resolved map[string][]json.RawMessage
+	active   map[string]bool
+}
+
+// replace profile references in the recipient class tables and sections
+func expandProfiles(recipients []byte, sections map[string]json.RawMessage) ([]byte, map[string]json.RawMessage, error) {
+	e := profileExpander{
+		profiles: make(map[string][]json.RawMessage),
+		resolved: make(map[string][]json.RawMessage),
+		active:   make(map[string]bool),
+	}
+	data, ok := sections[PROFILES_KEY]
+	if ok {
+		entries, err := configEntries(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", PROFILES_KEY, err)
+		}
+		for _, entry := range entries {
+			items := []json.RawMessage{}
+			err := json.Unmarshal(entry.Value, &items)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s.%s: %v", PROFILES_KEY, entry.Key, err)
+			}
+			e.profiles[entry.Key] = items
+		}
+	}
+	recipients, err := e.expandObject("", recipients)
+	if err != nil {
+		return nil, nil, err
+	}
+	expanded := make(map[string]json.RawMessage)
+	for name, data := range sections {
+		expanded[name], err = e.expandObject(name+".", data)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return recipients, expanded, nil
+}
+
+// expand each class list in a JSON object of class lists, leaving unreferencing lists unchanged
+func (e *profileExpander) expandObject(prefix string, data []byte) ([]byte, error) {
+	entries, err := configEntries(data)
+	if err != nil {
+		return nil, err
+	}
+	changed := false
+	for i, entry := range entries {
+		items := []json.RawMessage{}
+		if json.Unmarshal(entry.Value, &items) != nil || !hasProfileItem(items) {
+			// not a class list, or nothing to expand; left for the validator
+			continue
+		}
+		list, err := e.expand(prefix+entry.Key, items)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].Value, err = json.Marshal(list)
+		if err != nil {
+			return nil, err
+		}
+		changed = true
+	}
+	if !changed {
+		return data, nil
+	}
+	return encodeConfigEntries(entries)
+}
+
+func hasProfileItem(items []json.RawMessage) bool {
+	for _, raw := range items {
+		var item profileItem
+		if json.Unmarshal(raw, &item) == nil && item.Profile != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// return items with profile references replaced
+func (e *profileExpander) expand(path string, items []json.RawMessage) ([]json.RawMessage, error) {
+	list := []json.RawMessage{}
+	index := make(map[string]int)
+	add := func(raw json.RawMessage, name string) {
+		i, ok := index[name]
+		if ok && name != "" {
+			list[i] = raw
+			return
+		}
+		index[name] = len(list)
+		list = append(list, raw)
+	}
+	for _, raw := range items {
+		var item profileItem
+		err := json.Unmarshal(raw, &item)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if item.Profile == "" {
+			add(raw, item.Name)
+			continue
+		}
+		classList, err := e.resolve(path, item.Profile)
+		if err != nil {
+			return nil, err
+		}
+		for _, class := range classList {
+			var profileClass profileItem
+			json.Unmarshal(class, &profileClass)
+			add(class, profileClass.Name)
+		}
+	}
+	return list, nil
+}
+
+// return the expanded classes of a profile
+func (e *profileExpander) resolve(path, name string) ([]json.RawMessage, error) {
+	list, ok := e.resolved[name]
+	if ok {
+		return list, nil
+	}
+	items, ok := e.profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown profile '%s'", path, name)
+	}
+	if e.active[name] {
+		return nil, fmt.Errorf("%s: profile '%s' references itself", path, name)
+	}
+	e.active[name] = true
+	defer delete(e.active, name)
+	list, err := e.expand(PROFILES_KEY+"."+name, items)
+	if err != nil {
+		return nil, err
+	}
+	e.resolved[name] = list
+	return list, nil
+}
@@ -0,0 +1,66 @@
+package filter
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfileClasses(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	filename := filepath.Join(t.TempDir(), "classes.json")
+	writeTestClasses(t, filename, `{
+    "profiles": {
+	"strict": [{"name": "ham", "score": 2}, {"name": "probable", "score": 6}, {"name": "spam", "score": 999}],
+	"stricter": [{"profile": "strict"}, {"name": "ham", "score": 1}]
+    },
+    "touser@localdomain.ext": [{"profile": "strict"}, {"name": "possible", "score": 4}],
+    "senders": {
+	"other@example.org": [{"profile": "stricter"}]
+    }
+}`)
+	require.Nil(t, validateClassConfig(filename))
+	data := []string{
+		"X-Spam-Score: 3 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	options := map[string]any{"class_config_file": filename}
+	output := filterMessage(t, options, data)
+	require.Contains(t, output, "X-Spam-Class: possible")
+
+	data[0] = "X-Spam-Score: 1.155 / 100"
+	output = filterMessage(t, options, data)
+	require.Contains(t, output, "X-Spam-Class: ham")
+
+	data[0] = "X-Spam-Score: 5 / 100"
+	output = filterMessage(t, options, data)
+	require.Contains(t, output, "X-Spam-Class: probable")
+
+	// the sender profile overrides the inherited ham threshold
+	config, err := readClassConfig(filename)
+	require.Nil(t, err)
+	sections, err := readSectionClasses(config)
+	require.Nil(t, err)
+	require.Equal(t, "probable", sections[SENDERS_KEY].GetClass([]string{"other@example.org"}, 1.5))
+	require.Equal(t, "ham", sections[SENDERS_KEY].GetClass([]string{"other@example.org"}, 0.5))
+}
+
+func TestProfileErrors(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	filename := filepath.Join(t.TempDir(), "classes.json")
+	writeTestClasses(t, filename, `{"touser@localdomain.ext": [{"profile": "missing"}]}`)
+	_, err := readClassConfig(filename)
+	require.ErrorContains(t, err, "unknown profile 'missing'")
+
+	writeTestClasses(t, filename, `{
+    "profiles": {
+	"a": [{"profile": "b"}],
+	"b": [{"profile": "a"}]
+    }
+}`)
+	_, err = readClassConfig(filename)
+	require.ErrorContains(t, err, "references itself")
+}
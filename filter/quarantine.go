@@ -0,0 +1,229 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const QUARANTINE_FORMAT_MAILDIR = "maildir"
+const QUARANTINE_FORMAT_MBOX = "mbox"
+
+const DEFAULT_QUARANTINE_MAX_BYTES = 10485760
+
+const COUNTER_QUARANTINED = "quarantined"
+
+// storage of messages with the quarantine class action
+//
+//	quarantine_path:      Maildir directory or mbox file receiving quarantined messages
+//	quarantine_format:    maildir or mbox
+//	quarantine_deliver:   deliver quarantined messages as junk instead of rejecting them
+//	quarantine_max_bytes: messages larger than this are delivered as junk, not quarantined
+//
+// each message is accompanied by a JSON metadata record: a file in the meta subdirectory of
+// a Maildir, or a line appended to <quarantine_path>.meta for an mbox
+type Quarantine struct {
+	Path     string
+	Format   string
+	Deliver  bool
+	MaxBytes int
+}
+
+// metadata written alongside a quarantined message
+type QuarantineRecord struct {
+	Time         time.Time
+	Session      string
+	Message      string
+	Remote       string
+	RDNS         string
+	AuthUser     string
+	EnvelopeFrom []string
+	EnvelopeTo   []string
+	Score        float32
+	Class        string
+	File         string
+}
+
+// a message buffered for quarantine
+type quarantineCapture struct {
+	Lines []string
+	Size  int
+	Score float32
+	Class string
+}
+
+func newQuarantine() (*Quarantine, error) {
+	path := ViperGetString("quarantine_path")
+	if path == "" {
+		return nil, nil
+	}
+	ViperSetDefault("quarantine_format", QUARANTINE_FORMAT_MAILDIR)
+	ViperSetDefault("quarantine_max_bytes", DEFAULT_QUARANTINE_MAX_BYTES)
+	q := Quarantine{
+		Path:     path,
+		Format:   strings.ToLower(ViperGetString("quarantine_format")),
+		Deliver:  ViperGetBool("quarantine_deliver"),
+		MaxBytes: ViperGetInt("quarantine_max_bytes"),
+	}
+	switch q.Format {
+	case QUARANTINE_FORMAT_MAILDIR:
+		for _, dir := range []string{"tmp", "new", "cur", "meta"} {
+			err := os.MkdirAll(filepath.Join(q.Path, dir), 0700)
+			if err != nil {
+				return nil, fmt.Errorf("failed creating quarantine maildir: %v", err)
+			}
+		}
+	case QUARANTINE_FORMAT_MBOX:
+	default:
+		return nil, fmt.Errorf("unknown quarantine_format: %s", q.Format)
+	}
+	return &q, nil
+}
+
+// write a message and its metadata record, returning the message filename
+func (q *Quarantine) Store(record QuarantineRecord, lines []string) (string, error) {
+	if q.Format == QUARANTINE_FORMAT_MBOX {
+		return q.storeMbox(record, lines)
+	}
+	return q.storeMaildir(record, lines)
+}
+
+func (q *Quarantine) storeMaildir(record QuarantineRecord, lines []string) (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	unique := fmt.Sprintf("%d.%s_%s.%s", record.Time.Unix(), record.Session, record.Message, strings.ReplaceAll(hostname, "/", "_"))
+	tmp := filepath.Join(q.Path, "tmp", unique)
+	data := strings.Join(lines, "\r\n") + "\r\n"
+	err = os.WriteFile(tmp, []byte(data), 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed writing quarantine message: %v", err)
+	}
+	filename := filepath.Join(q.Path, "new", unique)
+	err = os.Rename(tmp, filename)
+	if err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed writing quarantine message: %v", err)
+	}
+	record.File = filename
+	meta, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	err = os.WriteFile(filepath.Join(q.Path, "meta", unique+".json"), append(meta, '\n'), 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed writing quarantine metadata: %v", err)
+	}
+	return filename, nil
+}
+
+func (q *Quarantine) storeMbox(record QuarantineRecord, lines []string) (string, error) {
+	sender := "MAILER-DAEMON"
+	if len(record.EnvelopeFrom) > 0 && record.EnvelopeFrom[0] != "" {
+		sender = record.EnvelopeFrom[0]
+	}
+	var data strings.Builder
+	data.WriteString(fmt.Sprintf("From %s %s\n", sender, record.Time.UTC().Format(time.ANSIC)))
+	for _, line := range lines {
+		// mboxrd quoting of From_ lines
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			line = ">" + line
+		}
+		data.WriteString(line + "\n")
+	}
+	data.WriteString("\n")
+	err := appendFile(q.Path, data.String())
+	if err != nil {
+		return "", fmt.Errorf("failed writing quarantine message: %v", err)
+	}
+	record.File = q.Path
+	meta, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	err = appendFile(q.Path+".meta", string(meta)+"\n")
+	if err != nil {
+		return "", fmt.Errorf("failed writing quarantine metadata: %v", err)
+	}
+	return q.Path, nil
+}
+
+func appendFile(filename, data string) error {
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(data)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// buffer the filtered data lines of a quarantined message, storing it at the final line
+func (f *Filter) captureQuarantine(name string, session *Session, message *Message, lines []string) {
+	capture := message.Quarantine
+	for _, line := range lines {
+		if line == "." {
+			message.Quarantine = nil
+			f.storeQuarantine(name, session, message, capture)
+			return
+		}
+		// data lines are dot-stuffed
+		if strings.HasPrefix(line, "..") {
+			line = line[1:]
+		}
+		capture.Size += len(line) + 2
+		if capture.Size > f.quarantine.MaxBytes {
+			Warning("%s.%s: message exceeds quarantine_max_bytes (%d); delivering as junk", f.Name, name, f.quarantine.MaxBytes)
+			message.Quarantine = nil
+			message.Action = ACTION_JUNK
+			return
+		}
+		capture.Lines = append(capture.Lines, line)
+	}
+}
+
+func (f *Filter) storeQuarantine(name string, session *Session, message *Message, capture *quarantineCapture) {
+	record := QuarantineRecord{
+		Time:         f.now(),
+		Session:      session.Id,
+		Message:      message.Id,
+		Remote:       session.Remote,
+		RDNS:         session.RDNS,
+		AuthUser:     session.AuthorizedUser,
+		EnvelopeFrom: message.EnvelopeFrom,
+		EnvelopeTo:   message.EnvelopeTo,
+		Score:        capture.Score,
+		Class:        capture.Class,
+	}
+	filename, err := f.quarantine.Store(record, capture.Lines)
+	if err != nil {
+		// never reject a message that could not be kept
+		Warning("%s.%s: quarantine failed, delivering as junk: %v", f.Name, name, err)
+		message.Action = ACTION_JUNK
+		return
+	}
+	f.count(COUNTER_QUARANTINED)
+	log.Printf("%s.%s: quarantined message to %s\n", f.Name, name, filename)
+}
+
+// return true if the message is refused at commit
+func (f *Filter) rejected(message *Message) bool {
+	if f.virusRejected(message) {
+		return true
+	}
+	switch message.Action {
+	case ACTION_REJECT:
+		return true
+	case ACTION_QUARANTINE:
+		return !f.quarantine.Deliver
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package filter
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var quarantineData = []string{
+	"X-Spam-Score: 50 / 100",
+	"To: touser@localdomain.ext",
+	"",
+	"From the body",
+	"..dot stuffed",
+}
+
+func TestQuarantineMaildir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "quarantine")
+	options := map[string]any{
+		"class_actions":   map[string]string{"spam": "quarantine"},
+		"quarantine_path": dir,
+	}
+	var output strings.Builder
+	f := newTestFilter(t, options, commitInput(quarantineData), &output)
+	f.Run()
+	require.Contains(t, output.String(), "filter-result|deadbeef|c0ffee|reject|"+DEFAULT_REJECT_STATUS+"\n")
+	require.Equal(t, int64(1), f.Counter(COUNTER_QUARANTINED))
+
+	files, err := filepath.Glob(filepath.Join(dir, "new", "*"))
+	require.Nil(t, err)
+	require.Len(t, files, 1)
+	data, err := os.ReadFile(files[0])
+	require.Nil(t, err)
+	require.Contains(t, string(data), "X-Spam-Class: spam\r\n")
+	require.True(t, strings.HasSuffix(string(data), "\r\nFrom the body\r\n.dot stuffed\r\n"))
+
+	meta, err := os.ReadFile(filepath.Join(dir, "meta", filepath.Base(files[0])+".json"))
+	require.Nil(t, err)
+	var record QuarantineRecord
+	require.Nil(t, json.Unmarshal(meta, &record))
+	require.Equal(t, "deadbeef", record.Session)
+	require.Equal(t, "cafebabe", record.Message)
+	require.Equal(t, "spam", record.Class)
+	require.Equal(t, float32(50), record.Score)
+	require.Equal(t, []string{"touser@localdomain.ext"}, record.EnvelopeTo)
+	require.Equal(t, files[0], record.File)
+}
+
+func TestQuarantineMboxDeliver(t *testing.T) {
+	mbox := filepath.Join(t.TempDir(), "quarantine.mbox")
+	options := map[string]any{
+		"class_actions":      map[string]string{"spam": "quarantine"},
+		"quarantine_path":    mbox,
+		"quarantine_format":  "mbox",
+		"quarantine_deliver": true,
+	}
+	var output strings.Builder
+	f := newTestFilter(t, options, messageInput(quarantineData), &output)
+	f.Run()
+	require.NotContains(t, output.String(), "|commit")
+	require.Contains(t, filteredLines(t, output.String()), "X-Spam: yes")
+
+	data, err := os.ReadFile(mbox)
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(string(data), "From fromuser@example.org "))
+	require.Contains(t, string(data), "\n>From the body\n.dot stuffed\n")
+	meta, err := os.ReadFile(mbox + ".meta")
+	require.Nil(t, err)
+	var record QuarantineRecord
+	require.Nil(t, json.Unmarshal(meta, &record))
+	require.Equal(t, mbox, record.File)
+}
+
+func TestQuarantineFailureDelivers(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "quarantine")
+	options := map[string]any{
+		"class_actions":   map[string]string{"spam": "quarantine"},
+		"quarantine_path": dir,
+	}
+	var output strings.Builder
+	f := newTestFilter(t, options, commitInput(quarantineData), &output)
+	require.Nil(t, os.RemoveAll(dir))
+	f.Run()
+	require.Contains(t, output.String(), "filter-result|deadbeef|c0ffee|proceed\n")
+	require.Equal(t, int64(0), f.Counter(COUNTER_QUARANTINED))
+}
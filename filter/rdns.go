@@ -0,0 +1,69 @@
+package filter
+
+import (
+	"log"
+	"net"
+
+	"github.com/spf13/viper"
+)
+
+const COUNTER_RDNS_PENALIZED = "rdns_penalized"
+
+// smtpd reports this name for clients without reverse DNS
+const RDNS_UNKNOWN = "<unknown>"
+
+// score adjustments for unauthenticated clients with poor reverse DNS
+//
+//	rdns_missing_score: added when the client address has no reverse DNS name
+//	fcrdns_fail_score:  added when the reverse DNS name does not resolve back to the client address
+type rdnsChecks struct {
+	MissingScore float32
+	FCrDNSScore  float32
+}
+
+func newRDNSChecks() *rdnsChecks {
+	r := rdnsChecks{
+		MissingScore: float32(viper.GetFloat64(ViperKey("rdns_missing_score"))),
+		FCrDNSScore:  float32(viper.GetFloat64(ViperKey("fcrdns_fail_score"))),
+	}
+	if r.MissingScore == 0 && r.FCrDNSScore == 0 {
+		return nil
+	}
+	return &r
+}
+
+// return the score adjustment and reason for a session's connection
+func (r *rdnsChecks) check(session *Session) (float32, string) {
+	if session.AuthorizedUser != "" {
+		return 0, ""
+	}
+	host, _, err := net.SplitHostPort(session.Remote)
+	if err != nil {
+		host = session.Remote
+	}
+	// local socket and loopback clients are not looked up
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() {
+		return 0, ""
+	}
+	if session.RDNS == "" || session.RDNS == RDNS_UNKNOWN {
+		return r.MissingScore, "missing"
+	}
+	if !session.Confirmed {
+		return r.FCrDNSScore, "fcrdns_fail"
+	}
+	return 0, ""
+}
+
+// return the reverse DNS score adjustment for a message's session
+func (f *Filter) rdnsScore(name string, session *Session) float32 {
+	if f.rdns == nil {
+		return 0
+	}
+	score, reason := f.rdns.check(session)
+	if score != 0 {
+		f.count(COUNTER_RDNS_PENALIZED)
+		log.Printf("%s.%s: rDNS %s for %s adds %v to score\n", f.Name, name, reason, session.Remote, score)
+	}
+	return score
+}
@@ -0,0 +1,52 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// return filter protocol input for an unauthenticated message from a client with the given rdns and fcrdns result
+func rdnsInput(data []string, rdns, confirmed string) string {
+	connect := "report|0.7|0000000000.000000|smtp-in|link-connect|deadbeef|" + rdns + "|" + confirmed + "|1.2.3.4:11223|5.6.7.8:25"
+	input := strings.Replace(messageInput(data), messageLines[1]+"\n", "", 1)
+	return strings.Replace(input, messageLines[0], connect, 1)
+}
+
+func TestRDNSScore(t *testing.T) {
+	options := map[string]any{
+		"rdns_missing_score": 6,
+		"fcrdns_fail_score":  1,
+	}
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	run := func(rdns, confirmed string) (string, *Filter) {
+		var output strings.Builder
+		f := newTestFilter(t, options, rdnsInput(data, rdns, confirmed), &output)
+		f.Run()
+		return output.String(), f
+	}
+	output, f := run("sendhost.example.org", "pass")
+	require.Contains(t, filteredLines(t, output), "X-Spam-Class: applied_class")
+	require.Equal(t, int64(0), f.Counter(COUNTER_RDNS_PENALIZED))
+
+	// 1.155 + 1 remains applied_class
+	output, f = run("sendhost.example.org", "fail")
+	require.Contains(t, filteredLines(t, output), "X-Spam-Class: applied_class")
+	require.Equal(t, int64(1), f.Counter(COUNTER_RDNS_PENALIZED))
+
+	output, _ = run(RDNS_UNKNOWN, "error")
+	require.Contains(t, filteredLines(t, output), "X-Spam-Class: suspected_spam")
+
+	// authenticated sessions are not penalized
+	var authOutput strings.Builder
+	input := strings.Replace(messageInput(data), messageLines[0], "report|0.7|0000000000.000000|smtp-in|link-connect|deadbeef||error|1.2.3.4:11223|5.6.7.8:25", 1)
+	f = newTestFilter(t, options, input, &authOutput)
+	f.Run()
+	require.Contains(t, filteredLines(t, authOutput.String()), "X-Spam-Class: applied_class")
+}
@@ -0,0 +1,103 @@
+package filter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+)
+
+const RECIPIENT_POLICY_FIRST = "first"
+const RECIPIENT_POLICY_STRICTEST = "strictest"
+const RECIPIENT_POLICY_HASHED = "hashed"
+
+const RECIPIENT_HASH_LENGTH = 12
+
+// classification of messages with several envelope recipients, from option recipient_class_policy
+//
+//	first:     the class header is computed for the class lookup address alone (the default)
+//	strictest: the class header carries the strictest class of any distinct envelope recipient,
+//	           the class nearest the top of its own class table
+//	hashed:    the class header is computed as for first, and a class header is added for each
+//	           envelope recipient, named with a hash of the address: X-Spam-Class-<hash>
+//
+// hashed headers are limited by max_recipient_headers
+func newRecipientPolicy() (string, error) {
+	policy := strings.ToLower(ViperGetString("recipient_class_policy"))
+	switch policy {
+	case "":
+		return RECIPIENT_POLICY_FIRST, nil
+	case RECIPIENT_POLICY_FIRST, RECIPIENT_POLICY_STRICTEST, RECIPIENT_POLICY_HASHED:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown recipient_class_policy: %s", policy)
+}
+
+// return the distinct normalized envelope recipients of a message
+func (f *Filter) envelopeRecipients(message *Message) []string {
+	recipients := []string{}
+	seen := make(map[string]bool)
+	for _, recipient := range message.EnvelopeTo {
+		address := f.normalizeRecipient(recipient)
+		if !seen[address] {
+			seen[address] = true
+			recipients = append(recipients, address)
+		}
+	}
+	return recipients
+}
+
+// return how far the class for score is from the top of the recipient's class table
+func (f *Filter) classDistance(address, spamClass string) int {
+	if f.classifier != nil {
+		if f.IsSpam(spamClass) {
+			return 0
+		}
+		return 1
+	}
+	classList := f.classList(f.getClasses(), []string{address})
+	for i, class := range classList {
+		if class.Name == spamClass {
+			return len(classList) - 1 - i
+		}
+	}
+	return len(classList)
+}
+
+// return the strictest class of the message's envelope recipients, starting from the class
+// of the lookup address
+func (f *Filter) strictestClass(name string, message *Message, address, spamClass string, score float32) string {
+	distance := f.classDistance(address, spamClass)
+	for _, recipient := range f.envelopeRecipients(message) {
+		class := f.getClass([]string{recipient}, score)
+		recipientDistance := f.classDistance(recipient, class)
+		if recipientDistance < distance {
+			if f.verbose {
+				log.Printf("%s.%s: recipient %s selects stricter class '%s'\n", f.Name, name, recipient, class)
+			}
+			spamClass = class
+			distance = recipientDistance
+		}
+	}
+	return spamClass
+}
+
+// return the recipient hash used in hashed per-recipient class header names
+func recipientHash(address string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(address)))
+	return hex.EncodeToString(sum[:])[:RECIPIENT_HASH_LENGTH]
+}
+
+// return a class header named by recipient hash for each distinct envelope recipient
+func (f *Filter) hashedRecipientHeaders(name string, message *Message, score float32) []string {
+	headers := []string{}
+	for _, address := range f.envelopeRecipients(message) {
+		if len(headers) >= f.maxRcptHeaders {
+			Warning("%s.%s: recipient header limit (%d) reached; omitting %s", f.Name, name, f.maxRcptHeaders, address)
+			continue
+		}
+		headers = append(headers, f.formatHeader(f.Headers.ClassHeader+"-"+recipientHash(address), f.getClass([]string{address}, score)))
+	}
+	return headers
+}
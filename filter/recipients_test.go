@@ -0,0 +1,74 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// return filter protocol input for a message with additional envelope recipients
+func recipientsInput(data []string, recipients ...string) string {
+	rcpt := "report|0.7|0000000000.000000|smtp-in|tx-rcpt|deadbeef|cafebabe|ok|"
+	lines := []string{}
+	for _, recipient := range recipients {
+		lines = append(lines, rcpt+recipient)
+	}
+	txData := "report|0.7|0000000000.000000|smtp-in|tx-data|"
+	return strings.Replace(messageInput(data), txData, strings.Join(lines, "\n")+"\n"+txData, 1)
+}
+
+func filterRecipients(t *testing.T, options map[string]any, data []string, recipients ...string) []string {
+	var output strings.Builder
+	f := newTestFilter(t, options, recipientsInput(data, recipients...), &output)
+	f.Run()
+	return filteredLines(t, output.String())
+}
+
+func TestRecipientPolicyStrictest(t *testing.T) {
+	data := []string{
+		"X-Spam-Score: 4 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	output := filterRecipients(t, nil, data, "username@example.org")
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+
+	options := map[string]any{"recipient_class_policy": "strictest", "emit_reason_header": true}
+	output = filterRecipients(t, options, data, "other@example.com", "USERNAME@example.org")
+	require.Contains(t, output, "X-Spam-Class: probable")
+	require.Contains(t, output, "X-Spam-Class-Reason: reason=strictest_recipient")
+
+	// the class of the lookup address is kept when no recipient is stricter
+	data[0] = "X-Spam-Score: 9 / 100"
+	output = filterRecipients(t, options, data, "username@example.org")
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+	require.Contains(t, output, "X-Spam-Class-Reason: reason=threshold")
+}
+
+func TestRecipientPolicyHashed(t *testing.T) {
+	data := []string{
+		"X-Spam-Score: 4 / 100",
+		"X-Spam-Class-0123456789ab: forged",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	output := filterRecipients(t, map[string]any{"recipient_class_policy": "hashed"}, data, "other@example.com", "Other@Example.com")
+	require.Equal(t, []string{
+		"X-Spam-Score: 4 / 100",
+		"To: touser@localdomain.ext",
+		"X-Spam: no",
+		"X-Spam-Class: applied_class",
+		"X-Spam-Class-" + recipientHash("touser@localdomain.ext") + ": applied_class",
+		"X-Spam-Class-" + recipientHash("other@example.com") + ": ham",
+		"",
+		"body",
+		".",
+	}, output)
+	require.Len(t, recipientHash("other@example.com"), RECIPIENT_HASH_LENGTH)
+
+	output = filterRecipients(t, map[string]any{"recipient_class_policy": "hashed", "max_recipient_headers": 1}, data, "other@example.com")
+	require.NotContains(t, output, "X-Spam-Class-"+recipientHash("other@example.com")+": ham")
+}
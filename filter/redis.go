@@ -0,0 +1,163 @@
+package filter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rstms/rspamd-classes/classes"
+)
+
+const DEFAULT_REDIS_ADDRESS = "127.0.0.1:6379"
+const DEFAULT_REDIS_KEY_PREFIX = "spamclass:"
+const DEFAULT_REDIS_TIMEOUT = "2s"
+
+// class lists stored in redis as JSON under <redis_key_prefix><address>
+//
+//	redis_address:    host:port of the redis server
+//	redis_password:   AUTH password, if required
+//	redis_database:   database number selected after connecting
+//	redis_key_prefix: prefix prepended to the recipient address
+//	redis_timeout:    connect and command timeout
+type redisBackend struct {
+	address  string
+	password string
+	database int
+	prefix   string
+	timeout  time.Duration
+	lock     sync.Mutex
+	conn     net.Conn
+	reader   *bufio.Reader
+}
+
+func newRedisBackend() (*redisBackend, error) {
+	ViperSetDefault("redis_address", DEFAULT_REDIS_ADDRESS)
+	ViperSetDefault("redis_key_prefix", DEFAULT_REDIS_KEY_PREFIX)
+	ViperSetDefault("redis_timeout", DEFAULT_REDIS_TIMEOUT)
+	timeout, err := time.ParseDuration(ViperGetString("redis_timeout"))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing redis_timeout: %v", err)
+	}
+	r := redisBackend{
+		address:  ViperGetString("redis_address"),
+		password: ViperGetString("redis_password"),
+		database: ViperGetInt("redis_database"),
+		prefix:   ViperGetString("redis_key_prefix"),
+		timeout:  timeout,
+	}
+	return &r, nil
+}
+
+func (r *redisBackend) Lookup(address string) ([]classes.SpamClass, bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	value, found, err := r.get(r.prefix + address)
+	if err != nil {
+		// drop the connection so the next lookup reconnects
+		r.close()
+		return nil, false, err
+	}
+	if !found {
+		return nil, false, nil
+	}
+	list := []classes.SpamClass{}
+	err = json.Unmarshal([]byte(value), &list)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed parsing redis key %s%s: %v", r.prefix, address, err)
+	}
+	return list, true, nil
+}
+
+func (r *redisBackend) connect() error {
+	if r.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", r.address, r.timeout)
+	if err != nil {
+		return fmt.Errorf("redis connect failed: %v", err)
+	}
+	r.conn = conn
+	r.reader = bufio.NewReader(conn)
+	if r.password != "" {
+		_, _, err = r.command("AUTH", r.password)
+		if err != nil {
+			return err
+		}
+	}
+	if r.database != 0 {
+		_, _, err = r.command("SELECT", strconv.Itoa(r.database))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *redisBackend) close() {
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+		r.reader = nil
+	}
+}
+
+// return the value of key, or false if the key does not exist
+func (r *redisBackend) get(key string) (string, bool, error) {
+	err := r.connect()
+	if err != nil {
+		return "", false, err
+	}
+	return r.command("GET", key)
+}
+
+// send a command, returning a string reply or false for a nil reply
+func (r *redisBackend) command(args ...string) (string, bool, error) {
+	err := r.conn.SetDeadline(time.Now().Add(r.timeout))
+	if err != nil {
+		return "", false, err
+	}
+	var request strings.Builder
+	fmt.Fprintf(&request, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&request, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err = r.conn.Write([]byte(request.String()))
+	if err != nil {
+		return "", false, fmt.Errorf("redis %s failed: %v", args[0], err)
+	}
+	line, err := r.reader.ReadString('\n')
+	if err != nil {
+		return "", false, fmt.Errorf("redis %s failed: %v", args[0], err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return "", false, fmt.Errorf("redis %s: empty reply", args[0])
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], true, nil
+	case '-':
+		return "", false, fmt.Errorf("redis %s: %s", args[0], line[1:])
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", false, fmt.Errorf("redis %s: invalid reply: %s", args[0], line)
+		}
+		if size < 0 {
+			return "", false, nil
+		}
+		data := make([]byte, size+2)
+		_, err = io.ReadFull(r.reader, data)
+		if err != nil {
+			return "", false, fmt.Errorf("redis %s failed: %v", args[0], err)
+		}
+		return string(data[:size]), true, nil
+	}
+	return "", false, fmt.Errorf("redis %s: unexpected reply: %s", args[0], line)
+}
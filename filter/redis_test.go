@@ -0,0 +1,122 @@
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// minimal redis server answering AUTH, SELECT and GET
+type testRedis struct {
+	sync.Mutex
+	values   map[string]string
+	commands []string
+}
+
+func (r *testRedis) serve(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.handle(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func (r *testRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := []string{}
+		for i := 0; i < count; i++ {
+			line, err = reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			data := make([]byte, size+2)
+			_, err = io.ReadFull(reader, data)
+			if err != nil {
+				return
+			}
+			args = append(args, string(data[:size]))
+		}
+		r.Lock()
+		r.commands = append(r.commands, strings.Join(args, " "))
+		value, ok := r.values[args[len(args)-1]]
+		r.Unlock()
+		switch {
+		case args[0] != "GET":
+			io.WriteString(conn, "+OK\r\n")
+		case ok:
+			fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+		default:
+			io.WriteString(conn, "$-1\r\n")
+		}
+	}
+}
+
+func TestRedisBackend(t *testing.T) {
+	server := &testRedis{values: map[string]string{
+		"spamclass:touser@localdomain.ext": `[{"name": "redis_ham", "score": 4}, {"name": "redis_probable", "score": 8}]`,
+	}}
+	address := server.serve(t)
+	options := map[string]any{
+		"class_config_backend": "redis",
+		"redis_address":        address,
+		"redis_password":       "secret",
+		"redis_database":       2,
+	}
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	output := filterMessage(t, options, data)
+	require.Contains(t, output, "X-Spam-Class: redis_ham")
+
+	// recipients without a redis key use the class config file
+	data[1] = "To: username@example.org"
+	output = filterMessage(t, options, data)
+	require.Contains(t, output, "X-Spam-Class: possible")
+
+	server.Lock()
+	defer server.Unlock()
+	require.Equal(t, "AUTH secret", server.commands[0])
+	require.Equal(t, "SELECT 2", server.commands[1])
+	require.Contains(t, server.commands, "GET spamclass:touser@localdomain.ext")
+}
+
+func TestRedisBackendDown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	output := filterMessage(t, map[string]any{"class_config_backend": "redis", "redis_address": address}, data)
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+}
@@ -0,0 +1,163 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rstms/rspamd-classes/classes"
+)
+
+const DEFAULT_RELOAD_DEBOUNCE = "2s"
+
+// class config reload behavior
+//
+//	reload_debounce: delay coalescing reload requests
+//	reload_validate: run semantic validation before swapping in a new config
+//	reload_alert:    log failed reloads as warnings
+//	reload_watch:    reload automatically when the class config file changes
+type ReloadPolicy struct {
+	Debounce time.Duration
+	Validate bool
+	Alert    bool
+	Watch    bool
+}
+
+func newReloadPolicy() (ReloadPolicy, error) {
+	ViperSetDefault("reload_debounce", DEFAULT_RELOAD_DEBOUNCE)
+	ViperSetDefault("reload_validate", true)
+	ViperSetDefault("reload_alert", true)
+	debounce, err := time.ParseDuration(ViperGetString("reload_debounce"))
+	if err != nil {
+		return ReloadPolicy{}, fmt.Errorf("failed parsing reload_debounce: %v", err)
+	}
+	policy := ReloadPolicy{
+		Debounce: debounce,
+		Validate: ViperGetBool("reload_validate"),
+		Alert:    ViperGetBool("reload_alert"),
+		Watch:    ViperGetBool("reload_watch"),
+	}
+	return policy, nil
+}
+
+// return the current class config
+func (f *Filter) getClasses() *classes.SpamClasses {
+	f.classesLock.RLock()
+	defer f.classesLock.RUnlock()
+	return f.Classes
+}
+
+func (f *Filter) setClasses(spamClasses *classes.SpamClasses, labels map[string]map[string]string, patterns []classPattern, sections map[string]*classes.SpamClasses) {
+	f.classesLock.Lock()
+	defer f.classesLock.Unlock()
+	f.Classes = spamClasses
+	f.labels = labels
+	f.patterns = patterns
+	f.sections = sections
+}
+
+// re-read the class config file, replacing the current config only if the new one is valid
+func (f *Filter) ReloadClasses() error {
+	filename := f.classConfigFile
+	err := f.loadClasses(filename)
+	if err != nil {
+		f.count(COUNTER_RELOAD_FAILED)
+		if f.reloadPolicy.Alert {
+			Warning("%s: class config reload failed, retaining previous config: %v", f.Name, err)
+		} else {
+			log.Printf("%s: class config reload failed, retaining previous config: %v\n", f.Name, err)
+		}
+		return err
+	}
+	f.count(COUNTER_RELOADED)
+	log.Printf("%s: reloaded class config from %s\n", f.Name, filename)
+	return nil
+}
+
+// a class config file missing at reload is a failure, not a fallback to the default classes:
+// editors and deploy tools briefly remove the file while replacing it
+func (f *Filter) loadClasses(filename string) error {
+	config, err := readClassConfig(filename)
+	if err != nil {
+		return err
+	}
+	if filename != "" && !config.Exists {
+		return fmt.Errorf("class config file not found: %s", filename)
+	}
+	if f.reloadPolicy.Validate {
+		err = joinProblems(filename, config.Problems)
+		if err != nil {
+			return err
+		}
+	}
+	return f.applyClassConfig(config)
+}
+
+// derive the class tables, labels, regex keys and sections from a class config and swap them in
+func (f *Filter) applyClassConfig(config *classConfig) error {
+	spamClasses, err := f.readClasses(config)
+	if err != nil {
+		return err
+	}
+	labels, err := readClassLabels(config)
+	if err != nil {
+		return err
+	}
+	patterns, err := readClassPatterns(config)
+	if err != nil {
+		return err
+	}
+	sections, err := readSectionClasses(config)
+	if err != nil {
+		return err
+	}
+	f.setClasses(spamClasses, labels, patterns, sections)
+	return nil
+}
+
+// schedule a class config reload, coalescing requests within the debounce interval
+func (f *Filter) RequestReload() {
+	f.reloadLock.Lock()
+	defer f.reloadLock.Unlock()
+	if f.reloadTimer != nil {
+		f.reloadTimer.Stop()
+	}
+	f.reloadTimer = time.AfterFunc(f.reloadPolicy.Debounce, func() {
+		f.ReloadClasses()
+	})
+}
+
+// request a class config reload on SIGHUP until the returned stop function is called
+func (f *Filter) watchReloadSignal() func() {
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-signals:
+				log.Printf("%s: SIGHUP received, reloading class config\n", f.Name)
+				f.RequestReload()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// check a class config file for entries the classes library would silently repair or drop,
+// returning an error reporting every invalid entry
+func validateClassConfig(filename string) error {
+	config, err := readClassConfig(filename)
+	if err != nil {
+		return err
+	}
+	return joinProblems(filename, config.Problems)
+}
@@ -0,0 +1,93 @@
+package filter
+
+import (
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const testReloadClasses = `{
+    "touser@localdomain.ext": [
+	{ "name": "low", "score": 1 },
+	{ "name": "spam", "score": 999 }
+    ]
+}`
+
+// duplicate class names parse, but would be silently dropped by the classes library
+const testReloadBadClasses = `{
+    "touser@localdomain.ext": [
+	{ "name": "low", "score": 1 },
+	{ "name": "low", "score": 2 },
+	{ "name": "spam", "score": 999 }
+    ]
+}`
+
+func writeTestClasses(t *testing.T, filename, data string) {
+	err := os.WriteFile(filename, []byte(data), 0600)
+	require.Nil(t, err)
+}
+
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "classes.json")
+	writeTestClasses(t, filename, testReloadClasses)
+	f := newTestFilter(t, map[string]any{"class_config_file": filename}, "", io.Discard)
+	original := f.getClasses()
+	require.Equal(t, "low", original.GetClass([]string{"touser@localdomain.ext"}, 0))
+
+	writeTestClasses(t, filename, testReloadBadClasses)
+	err := f.ReloadClasses()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "duplicate class name")
+	require.Same(t, original, f.getClasses())
+	require.Equal(t, int64(1), f.Counter(COUNTER_RELOAD_FAILED))
+
+	writeTestClasses(t, filename, `{"touser@localdomain.ext": []}`)
+	require.NotNil(t, f.ReloadClasses())
+	require.Same(t, original, f.getClasses())
+	require.Equal(t, int64(2), f.Counter(COUNTER_RELOAD_FAILED))
+
+	// a removed file keeps the current config rather than reverting to the default classes
+	require.Nil(t, os.Remove(filename))
+	err = f.ReloadClasses()
+	require.ErrorContains(t, err, "not found")
+	require.Same(t, original, f.getClasses())
+	require.Equal(t, int64(3), f.Counter(COUNTER_RELOAD_FAILED))
+
+	// without validation the repaired config is accepted
+	f.reloadPolicy.Validate = false
+	writeTestClasses(t, filename, testReloadBadClasses)
+	require.Nil(t, f.ReloadClasses())
+	require.NotSame(t, original, f.getClasses())
+	require.Equal(t, int64(1), f.Counter(COUNTER_RELOADED))
+}
+
+func TestReloadDebounce(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "classes.json")
+	writeTestClasses(t, filename, testReloadClasses)
+	f := newTestFilter(t, map[string]any{"class_config_file": filename, "reload_debounce": "20ms"}, "", io.Discard)
+	for i := 0; i < 5; i++ {
+		f.RequestReload()
+	}
+	require.Eventually(t, func() bool { return f.Counter(COUNTER_RELOADED) == 1 }, time.Second, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int64(1), f.Counter(COUNTER_RELOADED))
+}
+
+func TestReloadSignal(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "classes.json")
+	writeTestClasses(t, filename, testReloadClasses)
+	f := newTestFilter(t, map[string]any{"class_config_file": filename, "reload_debounce": "1ms"}, "", io.Discard)
+	stop := f.watchReloadSignal()
+	defer stop()
+	original := f.getClasses()
+
+	writeTestClasses(t, filename, `{"touser@localdomain.ext": [{"name": "reloaded", "score": 1}]}`)
+	require.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	require.Eventually(t, func() bool { return f.Counter(COUNTER_RELOADED) == 1 }, time.Second, time.Millisecond)
+	require.NotSame(t, original, f.getClasses())
+	require.Equal(t, "reloaded", f.getClasses().GetClass([]string{"touser@localdomain.ext"}, 0))
+}
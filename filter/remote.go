@@ -0,0 +1,215 @@
+package filter
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const DEFAULT_CLASS_CONFIG_CACHE_DIR = "/var/db/smtpd-filter-spamclass"
+const DEFAULT_CLASS_CONFIG_REFRESH = "5m"
+const DEFAULT_CLASS_CONFIG_TIMEOUT = "10s"
+const DEFAULT_CLASS_CONFIG_MAX_BYTES = 4 * 1024 * 1024
+
+// class config fetched from an https:// class_config_file
+//
+//	class_config_cache:     local copy of the last valid remote config; a remote config mapped
+//	                        to a subsystem is cached beside it as classes-<subsystem>
+//	class_config_refresh:   interval between fetches, 0 to fetch only at startup
+//	class_config_timeout:   HTTP request timeout
+//	class_config_ca:        PEM CA certificates trusted in addition to the system roots
+//	class_config_max_bytes: a larger response is rejected
+type remoteConfig struct {
+	url      string
+	cache    string
+	refresh  time.Duration
+	maxBytes int64
+	client   *http.Client
+}
+
+// return true if class_config_file names a remote config
+func isRemoteConfig(filename string) bool {
+	return strings.HasPrefix(strings.ToLower(filename), "https://")
+}
+
+func newRemoteConfig(configURL, subsystem string) (*remoteConfig, error) {
+	parsed, err := url.Parse(configURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid class_config_file URL: %v", err)
+	}
+	ext := path.Ext(parsed.Path)
+	if ext == "" {
+		ext = "." + CLASS_CONFIG_FORMAT_JSON
+	}
+	ViperSetDefault("class_config_cache", filepath.Join(DEFAULT_CLASS_CONFIG_CACHE_DIR, "classes"+ext))
+	ViperSetDefault("class_config_refresh", DEFAULT_CLASS_CONFIG_REFRESH)
+	ViperSetDefault("class_config_timeout", DEFAULT_CLASS_CONFIG_TIMEOUT)
+	ViperSetDefault("class_config_max_bytes", DEFAULT_CLASS_CONFIG_MAX_BYTES)
+	refresh, err := time.ParseDuration(ViperGetString("class_config_refresh"))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing class_config_refresh: %v", err)
+	}
+	if refresh < 0 {
+		return nil, fmt.Errorf("invalid class_config_refresh: %v", refresh)
+	}
+	maxBytes := int64(ViperGetInt("class_config_max_bytes"))
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("invalid class_config_max_bytes: %v", maxBytes)
+	}
+	timeout, err := time.ParseDuration(ViperGetString("class_config_timeout"))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing class_config_timeout: %v", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	caFile := ViperGetString("class_config_ca")
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading class_config_ca: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	r := remoteConfig{
+		url:      configURL,
+		cache:    ViperGetString("class_config_cache"),
+		refresh:  refresh,
+		maxBytes: maxBytes,
+		client:   &http.Client{Timeout: timeout, Transport: transport},
+	}
+	if subsystem != "" {
+		r.cache = filepath.Join(filepath.Dir(r.cache), "classes-"+subsystem+ext)
+	}
+	return &r, nil
+}
+
+// return the body of the remote config
+func (r *remoteConfig) fetch() ([]byte, error) {
+	response, err := r.client.Get(r.url)
+	if err != nil {
+		return nil, fmt.Errorf("failed fetching %s: %v", r.url, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed fetching %s: %s", r.url, response.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(response.Body, r.maxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading %s: %v", r.url, err)
+	}
+	if int64(len(data)) > r.maxBytes {
+		return nil, fmt.Errorf("failed reading %s: response exceeds class_config_max_bytes (%d)", r.url, r.maxBytes)
+	}
+	return data, nil
+}
+
+// fetch the remote config, replacing the cached copy if it changed and is valid;
+// returns true if the cache was updated
+func (f *Filter) updateRemoteConfig(remote *remoteConfig) (bool, error) {
+	data, err := remote.fetch()
+	if err != nil {
+		return false, err
+	}
+	cached, err := os.ReadFile(remote.cache)
+	if err == nil && bytes.Equal(cached, data) {
+		return false, nil
+	}
+	dir := filepath.Dir(remote.cache)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return false, fmt.Errorf("failed creating %s: %v", dir, err)
+	}
+	// check the download in a temporary file so an invalid config never replaces a valid cache
+	temp, err := os.CreateTemp(dir, ".classes-*"+filepath.Ext(remote.cache))
+	if err != nil {
+		return false, fmt.Errorf("failed creating cache file: %v", err)
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(data)
+	if err == nil {
+		err = temp.Close()
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed writing %s: %v", temp.Name(), err)
+	}
+	config, err := readClassConfig(temp.Name())
+	if err != nil {
+		return false, err
+	}
+	if f.reloadPolicy.Validate {
+		err = joinProblems(temp.Name(), config.Problems)
+		if err != nil {
+			return false, err
+		}
+	}
+	_, err = f.readClasses(config)
+	if err != nil {
+		return false, err
+	}
+	err = os.Rename(temp.Name(), remote.cache)
+	if err != nil {
+		return false, fmt.Errorf("failed updating %s: %v", remote.cache, err)
+	}
+	log.Printf("%s: cached class config from %s in %s\n", f.Name, remote.url, remote.cache)
+	return true, nil
+}
+
+// fetch a remote class config, for subsystem if set, falling back to the cached copy
+func (f *Filter) initRemoteConfig(configURL, subsystem string) (*remoteConfig, error) {
+	remote, err := newRemoteConfig(configURL, subsystem)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.updateRemoteConfig(remote)
+	if err != nil {
+		if !IsFile(remote.cache) {
+			return nil, err
+		}
+		Warning("%s: %v; using cached class config %s", f.Name, err, remote.cache)
+	}
+	return remote, nil
+}
+
+// refetch the remote class config every class_config_refresh until the returned stop function is called
+func (f *Filter) watchRemoteConfig() func() {
+	if f.remote == nil || f.remote.refresh == 0 {
+		return func() {}
+	}
+	ticker := time.NewTicker(f.remote.refresh)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				changed, err := f.updateRemoteConfig(f.remote)
+				if err != nil {
+					Warning("%s: %v; retaining cached class config", f.Name, err)
+				} else if changed {
+					f.ReloadClasses()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
@@ -0,0 +1,155 @@
+package filter
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testConfigServer struct {
+	sync.Mutex
+	body   string
+	status int
+}
+
+func (s *testConfigServer) set(status int, body string) {
+	s.Lock()
+	defer s.Unlock()
+	s.status = status
+	s.body = body
+}
+
+func (s *testConfigServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	w.WriteHeader(s.status)
+	io.WriteString(w, s.body)
+}
+
+func remoteTestOptions(t *testing.T, server *httptest.Server, cache string) map[string]any {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.Nil(t, os.WriteFile(caFile, data, 0600))
+	return map[string]any{
+		"class_config_file":    server.URL + "/classes.json",
+		"class_config_cache":   cache,
+		"class_config_ca":      caFile,
+		"class_config_refresh": "10ms",
+		"reload_debounce":      "1ms",
+	}
+}
+
+func TestRemoteClassConfig(t *testing.T) {
+	handler := &testConfigServer{}
+	handler.set(http.StatusOK, testReloadClasses)
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+	cache := filepath.Join(t.TempDir(), "cache", "classes.json")
+
+	f := newTestFilter(t, remoteTestOptions(t, server, cache), "", io.Discard)
+	require.Equal(t, cache, f.classConfigFile)
+	require.Equal(t, "low", f.getClass([]string{"touser@localdomain.ext"}, 0))
+	data, err := os.ReadFile(cache)
+	require.Nil(t, err)
+	require.Equal(t, testReloadClasses, string(data))
+
+	stop := f.watchRemoteConfig()
+	defer stop()
+
+	// an invalid remote config leaves the cache and current config in place
+	handler.set(http.StatusOK, testReloadBadClasses)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, "low", f.getClass([]string{"touser@localdomain.ext"}, 0))
+	data, err = os.ReadFile(cache)
+	require.Nil(t, err)
+	require.Equal(t, testReloadClasses, string(data))
+
+	updated := `{"touser@localdomain.ext": [{"name": "remote", "score": 1}]}`
+	handler.set(http.StatusOK, updated)
+	require.Eventually(t, func() bool { return f.getClass([]string{"touser@localdomain.ext"}, 0) == "remote" }, 2*time.Second, time.Millisecond)
+
+	// a failing remote keeps serving the cached config
+	handler.set(http.StatusInternalServerError, "")
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, "remote", f.getClass([]string{"touser@localdomain.ext"}, 0))
+}
+
+func TestRemoteClassConfigUnavailable(t *testing.T) {
+	handler := &testConfigServer{}
+	handler.set(http.StatusServiceUnavailable, "")
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+	cache := filepath.Join(t.TempDir(), "classes.json")
+	options := remoteTestOptions(t, server, cache)
+
+	// no cached copy to fall back on
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, options)
+	_, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.NotNil(t, err)
+
+	writeTestClasses(t, cache, testReloadClasses)
+	f := newTestFilter(t, options, "", io.Discard)
+	require.Equal(t, "low", f.getClass([]string{"touser@localdomain.ext"}, 0))
+}
+
+func TestRemoteSubsystemClassConfig(t *testing.T) {
+	handler := &testConfigServer{}
+	handler.set(http.StatusOK, testReloadClasses)
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+	cache := filepath.Join(t.TempDir(), "cache", "classes.json")
+	options := remoteTestOptions(t, server, cache)
+	options["class_config_file"] = map[string]any{
+		"default": filepath.Join("testdata", "classes.json"),
+		"smtp-in": server.URL + "/classes.json",
+	}
+	f := newTestFilter(t, options, strings.Join(initLines, "\n")+"\n", io.Discard)
+	require.Nil(t, f.remote)
+	f.Run()
+	// the mapped URL is fetched and cached beside class_config_cache
+	subsystemCache := filepath.Join(filepath.Dir(cache), "classes-smtp-in.json")
+	require.Equal(t, subsystemCache, f.classConfigFile)
+	require.Equal(t, server.URL+"/classes.json", f.remote.url)
+	require.Equal(t, "low", f.getClass([]string{"touser@localdomain.ext"}, 0))
+	data, err := os.ReadFile(subsystemCache)
+	require.Nil(t, err)
+	require.Equal(t, testReloadClasses, string(data))
+}
+
+func TestRemoteClassConfigLimits(t *testing.T) {
+	handler := &testConfigServer{}
+	handler.set(http.StatusOK, testReloadClasses)
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+	cache := filepath.Join(t.TempDir(), "classes.json")
+
+	// a response larger than class_config_max_bytes is rejected
+	options := remoteTestOptions(t, server, cache)
+	options["class_config_max_bytes"] = len(testReloadClasses) - 1
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, options)
+	_, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.NotNil(t, err)
+	_, err = os.Stat(cache)
+	require.True(t, os.IsNotExist(err))
+
+	options["class_config_max_bytes"] = len(testReloadClasses)
+	f := newTestFilter(t, options, "", io.Discard)
+	require.Equal(t, "low", f.getClass([]string{"touser@localdomain.ext"}, 0))
+
+	options["class_config_refresh"] = "-1m"
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, options)
+	_, err = NewFilter(strings.NewReader(""), io.Discard)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,55 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rstms/rspamd-classes/classes"
+)
+
+const DEFAULT_REPORT_HEADER = "X-Spam-Class-Report"
+
+// return the class table line for the report header: "ham<0, possible<3, probable<10, spam"
+func (f *Filter) formatThresholds(classList []classes.SpamClass) string {
+	operator := "<"
+	if !f.thresholdInclusive {
+		operator = "<="
+	}
+	fields := []string{}
+	for i, class := range classList {
+		if i == len(classList)-1 {
+			fields = append(fields, class.Name)
+		} else {
+			fields = append(fields, fmt.Sprintf("%s%s%v", class.Name, operator, class.Score))
+		}
+	}
+	return strings.Join(fields, ", ")
+}
+
+// return the class config entry and class table deciding the class of a message
+func (f *Filter) reportTable(session *Session, message *Message, address, reason string) (string, []classes.SpamClass) {
+	switch reason {
+	case "auth_user":
+		user := strings.ToLower(session.AuthorizedUser)
+		return USERS_KEY + "." + user, f.getSection(USERS_KEY).Classes[user]
+	case "sender":
+		key, list, _ := f.senderClassList(message)
+		return SENDERS_KEY + "." + key, list
+	}
+	spamClasses := f.getClasses()
+	key, ok := f.classKey(spamClasses, address)
+	if !ok {
+		key = classes.DEFAULT_NAME
+	}
+	return key, f.classList(spamClasses, []string{address})
+}
+
+// return the diagnostic report header showing how the class was chosen
+func (f *Filter) reportHeader(session *Session, message *Message, address string, score float32, spamClass, reason string) string {
+	value := fmt.Sprintf("address=%s score=%v class=%s reason=%s", address, score, spamClass, reason)
+	if f.classifier == nil {
+		key, classList := f.reportTable(session, message, address, reason)
+		value += fmt.Sprintf(" entry=%s thresholds=\"%s\"", key, f.formatThresholds(classList))
+	}
+	return f.formatHeader(f.reportHeaderName, value)
+}
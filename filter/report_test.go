@@ -0,0 +1,52 @@
+package filter
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/rstms/rspamd-classes/classes"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportHeader(t *testing.T) {
+	data := []string{
+		"X-Spam-Score: 7.2 / 100",
+		"X-Spam-Class-Report: forged",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	options := map[string]any{"emit_report_header": true}
+	require.Equal(t, []string{
+		"X-Spam-Score: 7.2 / 100",
+		"To: touser@localdomain.ext",
+		"X-Spam: no",
+		"X-Spam-Class: suspected_spam",
+		`X-Spam-Class-Report: address=touser@localdomain.ext score=7.2 class=suspected_spam reason=threshold entry=touser@localdomain.ext thresholds="not_spam<0, applied_class<5, suspected_spam<10, spam"`,
+		"",
+		"body",
+		".",
+	}, filterMessage(t, options, data))
+
+	// unconfigured recipients report the default table
+	data[2] = "To: nobody@example.com"
+	output := filterMessage(t, options, data)
+	require.Contains(t, output, `X-Spam-Class-Report: address=nobody@example.com score=7.2 class=probable reason=threshold entry=default thresholds="ham<5, probable<10, spam"`)
+}
+
+func TestReportHeaderSection(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "classes.json")
+	writeTestClasses(t, filename, `{"senders": {"@example.org": [{"name": "trusted", "score": 20}, {"name": "spam", "score": 999}]}}`)
+	output := filterMessage(t, map[string]any{"class_config_file": filename, "emit_report_header": true}, []string{
+		"X-Spam-Score: 7.2 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	})
+	require.Contains(t, output, `X-Spam-Class-Report: address=touser@localdomain.ext score=7.2 class=trusted reason=sender entry=senders.@example.org thresholds="trusted<20, spam"`)
+}
+
+func TestFormatThresholds(t *testing.T) {
+	f := newTestFilter(t, map[string]any{"threshold_inclusive": false}, "", nil)
+	require.Equal(t, "ham<=0, possible<=3.5, spam", f.formatThresholds([]classes.SpamClass{{Name: "ham", Score: 0}, {Name: "possible", Score: 3.5}, {Name: "spam", Score: 999}}))
+}
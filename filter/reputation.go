@@ -0,0 +1,229 @@
+package filter
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const DEFAULT_REPUTATION_REJECT_RATIO = 0.8
+const DEFAULT_REPUTATION_MIN_MESSAGES = 5
+const DEFAULT_REPUTATION_MAX_ENTRIES = 10000
+const DEFAULT_REPUTATION_TTL = "24h"
+const DEFAULT_REPUTATION_STATUS = "550 5.7.1 Sender reputation too low"
+
+const COUNTER_REPUTATION_REJECTED = "reputation_rejected"
+
+// spam ratio of unauthenticated senders from past classifications, used to reject repeat
+// spam sources at RCPT TO before the message is transferred
+//
+//	reputation_reject:       register the rcpt-to filter phase and reject poor reputation senders
+//	reputation_reject_ratio: spam fraction of past messages at which a sender is rejected
+//	reputation_min_messages: messages needed before a sender may be rejected
+//	reputation_max_entries:  size of the store; the least recently updated entry is evicted
+//	reputation_ttl:          entries not updated within this interval are reset
+//	reputation_status:       SMTP status returned for rejected recipients
+//	reputation_file:         optional JSON file the store is loaded from and saved to
+//
+// senders are tracked by client IP only: an unauthenticated envelope sender is trivially
+// forged, and keying on it would let anyone poison the reputation of a third party's address
+type Reputation struct {
+	RejectRatio float64
+	MinMessages int
+	MaxEntries  int
+	TTL         time.Duration
+	Status      string
+	File        string
+	entries     map[string]*ReputationEntry
+	recent      *list.List
+	elements    map[string]*list.Element
+	lock        sync.Mutex
+}
+
+// classification history of a client IP
+type ReputationEntry struct {
+	Messages int
+	Spam     int
+	Updated  time.Time
+}
+
+func newReputation() (*Reputation, error) {
+	if !ViperGetBool("reputation_reject") {
+		return nil, nil
+	}
+	ViperSetDefault("reputation_reject_ratio", DEFAULT_REPUTATION_REJECT_RATIO)
+	ViperSetDefault("reputation_min_messages", DEFAULT_REPUTATION_MIN_MESSAGES)
+	ViperSetDefault("reputation_max_entries", DEFAULT_REPUTATION_MAX_ENTRIES)
+	ViperSetDefault("reputation_ttl", DEFAULT_REPUTATION_TTL)
+	ViperSetDefault("reputation_status", DEFAULT_REPUTATION_STATUS)
+	ttl, err := time.ParseDuration(ViperGetString("reputation_ttl"))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing reputation_ttl: %v", err)
+	}
+	r := Reputation{
+		RejectRatio: viper.GetFloat64(ViperKey("reputation_reject_ratio")),
+		MinMessages: ViperGetInt("reputation_min_messages"),
+		MaxEntries:  ViperGetInt("reputation_max_entries"),
+		TTL:         ttl,
+		Status:      ViperGetString("reputation_status"),
+		File:        ViperGetString("reputation_file"),
+		entries:     make(map[string]*ReputationEntry),
+		recent:      list.New(),
+		elements:    make(map[string]*list.Element),
+	}
+	if r.RejectRatio <= 0 || r.RejectRatio > 1 {
+		return nil, fmt.Errorf("invalid reputation_reject_ratio: %v", r.RejectRatio)
+	}
+	if r.MaxEntries < 1 {
+		return nil, fmt.Errorf("invalid reputation_max_entries: %d", r.MaxEntries)
+	}
+	if !REJECT_STATUS_PATTERN.MatchString(r.Status) {
+		return nil, fmt.Errorf("invalid reputation_status: %q", r.Status)
+	}
+	if r.File != "" && IsFile(r.File) {
+		data, err := os.ReadFile(r.File)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading reputation_file: %v", err)
+		}
+		err = json.Unmarshal(data, &r.entries)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing reputation_file %s: %v", r.File, err)
+		}
+		keys := []string{}
+		for key := range r.entries {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return r.entries[keys[i]].Updated.Before(r.entries[keys[j]].Updated) })
+		for _, key := range keys {
+			r.elements[key] = r.recent.PushFront(key)
+		}
+	}
+	return &r, nil
+}
+
+// return the reputation keys of an unauthenticated session
+func reputationKeys(session *Session) []string {
+	keys := []string{}
+	if session.AuthorizedUser != "" {
+		return keys
+	}
+	host, _, err := net.SplitHostPort(session.Remote)
+	if err != nil {
+		host = session.Remote
+	}
+	if host != "" {
+		keys = append(keys, "ip:"+host)
+	}
+	return keys
+}
+
+// add a classified message to the history of each key
+func (r *Reputation) Record(keys []string, spam bool, now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, key := range keys {
+		entry, ok := r.entries[key]
+		if !ok || now.Sub(entry.Updated) > r.TTL {
+			if !ok && len(r.entries) >= r.MaxEntries {
+				r.evict()
+			}
+			entry = &ReputationEntry{}
+			r.entries[key] = entry
+		}
+		entry.Messages++
+		if spam {
+			entry.Spam++
+		}
+		entry.Updated = now
+		element, ok := r.elements[key]
+		if ok {
+			r.recent.MoveToFront(element)
+		} else {
+			r.elements[key] = r.recent.PushFront(key)
+		}
+	}
+}
+
+// remove the least recently updated entry
+func (r *Reputation) evict() {
+	oldest := r.recent.Back()
+	if oldest == nil {
+		return
+	}
+	key := r.recent.Remove(oldest).(string)
+	delete(r.elements, key)
+	delete(r.entries, key)
+}
+
+// return the first key whose spam ratio reaches the reject ratio
+func (r *Reputation) Check(keys []string, now time.Time) (string, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, key := range keys {
+		entry, ok := r.entries[key]
+		if !ok || now.Sub(entry.Updated) > r.TTL || entry.Messages < r.MinMessages {
+			continue
+		}
+		if float64(entry.Spam)/float64(entry.Messages) >= r.RejectRatio {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// write the store to reputation_file
+func (r *Reputation) Save() error {
+	if r.File == "" {
+		return nil
+	}
+	r.lock.Lock()
+	data, err := json.Marshal(r.entries)
+	r.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.File, data, 0600)
+}
+
+func (f *Filter) recordReputation(session *Session, spamClass string) {
+	if f.reputation != nil {
+		f.reputation.Record(reputationKeys(session), f.IsSpam(spamClass), f.now())
+	}
+}
+
+// respond to an rcpt-to filter request, rejecting senders with a poor reputation
+func (f *Filter) rcptTo(name, sid, token, address string) {
+	result := "proceed"
+	session := f.getSession(name, sid)
+	if session != nil && !f.isTrusted(session) {
+		key, reject := f.reputation.Check(reputationKeys(session), f.now())
+		if reject {
+			result = "reject|" + f.reputation.Status
+			f.count(COUNTER_REPUTATION_REJECTED)
+			log.Printf("%s.%s: session=%s rejecting recipient %s for %s reputation\n", f.Name, name, sid, address, key)
+		}
+	}
+	err := f.writeLine(fmt.Sprintf("filter-result|%s|%s|%s", sid, token, result))
+	if err != nil {
+		Warning("rcpt-to result output failed with: %v", err)
+	}
+}
+
+// save the reputation store when the filter stops
+func (f *Filter) saveReputation() {
+	if f.reputation == nil {
+		return
+	}
+	err := f.reputation.Save()
+	if err != nil {
+		Warning("%s: failed saving reputation_file: %v", f.Name, err)
+	}
+}
@@ -0,0 +1,125 @@
+package filter
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testRcptToLine = "filter|0.7|0000000000.000000|smtp-in|rcpt-to|deadbeef|f00dface|touser@localdomain.ext"
+
+// return filter protocol input for unauthenticated messages followed by a new transaction's rcpt-to request
+func reputationInput(data []string, count int) string {
+	message := strings.TrimPrefix(messageInput(data), strings.Join(initLines, "\n")+"\n")
+	message = strings.Replace(message, messageLines[1]+"\n", "", 1)
+	lines := append([]string{}, initLines...)
+	for i := 0; i < count; i++ {
+		lines = append(lines, strings.TrimSuffix(message, "\n"))
+	}
+	lines = append(lines, messageLines[0], messageLines[2], messageLines[3], testRcptToLine)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestReputationReject(t *testing.T) {
+	options := map[string]any{
+		"reputation_reject":       true,
+		"reputation_min_messages": 3,
+		"reputation_status":       "550 5.7.1 not today",
+	}
+	data := []string{
+		"X-Spam-Score: 50 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	run := func(count int) (string, *Filter) {
+		var output strings.Builder
+		f := newTestFilter(t, options, reputationInput(data, count), &output)
+		f.Run()
+		return output.String(), f
+	}
+	output, _ := run(2)
+	require.Contains(t, output, "register|filter|smtp-in|rcpt-to\n")
+	require.Contains(t, output, "filter-result|deadbeef|f00dface|proceed\n")
+
+	output, f := run(3)
+	require.Contains(t, output, "filter-result|deadbeef|f00dface|reject|550 5.7.1 not today\n")
+	require.Equal(t, int64(1), f.Counter(COUNTER_REPUTATION_REJECTED))
+
+	// ham lowers the spam ratio below the reject ratio
+	data[0] = "X-Spam-Score: 1.155 / 100"
+	output, _ = run(3)
+	require.Contains(t, output, "filter-result|deadbeef|f00dface|proceed\n")
+}
+
+func TestReputationKeys(t *testing.T) {
+	session := &Session{Remote: "1.2.3.4:25"}
+	require.Equal(t, []string{"ip:1.2.3.4"}, reputationKeys(session))
+	session.AuthorizedUser = "username"
+	require.Empty(t, reputationKeys(session))
+}
+
+func TestReputationNotRegistered(t *testing.T) {
+	var output strings.Builder
+	f := newTestFilter(t, map[string]any{}, messageInput([]string{"To: touser@localdomain.ext", ""}), &output)
+	f.Run()
+	require.NotContains(t, output.String(), "|rcpt-to")
+}
+
+func TestReputationStore(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	file := filepath.Join(t.TempDir(), "reputation.json")
+	setTestOptions(t, map[string]any{
+		"reputation_reject":       true,
+		"reputation_min_messages": 2,
+		"reputation_max_entries":  2,
+		"reputation_ttl":          "1h",
+		"reputation_file":         file,
+	})
+	r, err := newReputation()
+	require.Nil(t, err)
+	now := time.Now()
+	r.Record([]string{"ip:1.2.3.4"}, true, now)
+	_, reject := r.Check([]string{"ip:1.2.3.4"}, now)
+	require.False(t, reject)
+	r.Record([]string{"ip:1.2.3.4"}, true, now)
+	key, reject := r.Check([]string{"ip:5.6.7.8", "ip:1.2.3.4"}, now)
+	require.True(t, reject)
+	require.Equal(t, "ip:1.2.3.4", key)
+
+	// expired entries are ignored and reset
+	_, reject = r.Check([]string{"ip:1.2.3.4"}, now.Add(2*time.Hour))
+	require.False(t, reject)
+
+	// the least recently updated entry is evicted
+	r.Record([]string{"ip:5.6.7.8"}, false, now.Add(time.Minute))
+	r.Record([]string{"ip:9.9.9.9"}, false, now.Add(2*time.Minute))
+	require.Len(t, r.entries, 2)
+	require.NotContains(t, r.entries, "ip:1.2.3.4")
+
+	// an updated entry is no longer the least recent
+	r.Record([]string{"ip:5.6.7.8"}, false, now.Add(3*time.Minute))
+	r.Record([]string{"ip:1.2.3.4"}, false, now.Add(4*time.Minute))
+	require.Contains(t, r.entries, "ip:5.6.7.8")
+	require.NotContains(t, r.entries, "ip:9.9.9.9")
+
+	require.Nil(t, r.Save())
+	loaded, err := newReputation()
+	require.Nil(t, err)
+	require.Equal(t, 3, loaded.entries["ip:5.6.7.8"].Messages+loaded.entries["ip:1.2.3.4"].Messages)
+	// the loaded store keeps the update order
+	loaded.Record([]string{"ip:9.9.9.9"}, false, now.Add(5*time.Minute))
+	require.NotContains(t, loaded.entries, "ip:5.6.7.8")
+	require.Equal(t, "ip:9.9.9.9", loaded.recent.Front().Value)
+}
+
+func TestReputationInvalidOptions(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"reputation_reject": true, "reputation_status": "250 ok"})
+	_, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.NotNil(t, err)
+}
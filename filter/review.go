@@ -0,0 +1,76 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const DEFAULT_REVIEW_CAPTURE_MAX_BYTES = 65536
+const DEFAULT_REVIEW_CAPTURE_MAX_FILES = 1000
+
+// header capture of messages in a selected class for later human review
+//
+//	review_capture_class:     class name to capture
+//	review_capture_dir:       output directory, one file per message
+//	review_capture_max_bytes: size limit of each capture file
+//	review_capture_max_files: capture stops when the directory holds this many files
+type ReviewCapture struct {
+	Class    string
+	Dir      string
+	MaxBytes int
+	MaxFiles int
+}
+
+func newReviewCapture() *ReviewCapture {
+	class := ViperGetString("review_capture_class")
+	dir := ViperGetString("review_capture_dir")
+	if class == "" || dir == "" {
+		return nil
+	}
+	ViperSetDefault("review_capture_max_bytes", DEFAULT_REVIEW_CAPTURE_MAX_BYTES)
+	ViperSetDefault("review_capture_max_files", DEFAULT_REVIEW_CAPTURE_MAX_FILES)
+	return &ReviewCapture{
+		Class:    class,
+		Dir:      dir,
+		MaxBytes: ViperGetInt("review_capture_max_bytes"),
+		MaxFiles: ViperGetInt("review_capture_max_files"),
+	}
+}
+
+// write the original header block of a message to the capture directory
+func (r *ReviewCapture) Capture(session *Session, message *Message, headers []string) (string, error) {
+	entries, err := os.ReadDir(r.Dir)
+	if err != nil {
+		return "", fmt.Errorf("failed reading review capture dir: %v", err)
+	}
+	if len(entries) >= r.MaxFiles {
+		return "", fmt.Errorf("review capture file limit (%d) reached", r.MaxFiles)
+	}
+	data := strings.Join(headers, "\n") + "\n"
+	if len(data) > r.MaxBytes {
+		data = data[:r.MaxBytes]
+	}
+	filename := filepath.Join(r.Dir, fmt.Sprintf("%s.%s.headers", session.Id, message.Id))
+	err = os.WriteFile(filename, []byte(data), 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed writing review capture: %v", err)
+	}
+	return filename, nil
+}
+
+func (f *Filter) captureReview(name string, session *Session, message *Message, spamClass string, headers []string) {
+	if f.review == nil || spamClass != f.review.Class {
+		return
+	}
+	filename, err := f.review.Capture(session, message, headers)
+	if err != nil {
+		Warning("%s.%s: %v", f.Name, name, err)
+		return
+	}
+	if f.verbose {
+		log.Printf("%s.%s: captured headers to %s\n", f.Name, name, filename)
+	}
+}
@@ -0,0 +1,48 @@
+package filter
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReviewCapture(t *testing.T) {
+	dir := t.TempDir()
+	headers := []string{
+		"Received: from localhost",
+		"X-Spam-Score: 7.2 / 100",
+		"X-Spam-Class: upstream",
+		"To: username@example.org",
+	}
+	options := map[string]any{
+		"review_capture_class":     "probable",
+		"review_capture_dir":       dir,
+		"review_capture_max_files": 1,
+	}
+	filterMessage(t, options, append(headers, "", "body"))
+	data, err := os.ReadFile(filepath.Join(dir, "deadbeef.cafebabe.headers"))
+	require.Nil(t, err)
+	require.Equal(t, "Received: from localhost\nX-Spam-Score: 7.2 / 100\nX-Spam-Class: upstream\nTo: username@example.org\n", string(data))
+
+	// other classes are not captured
+	dir = t.TempDir()
+	options["review_capture_dir"] = dir
+	filterMessage(t, options, []string{"X-Spam-Score: 1.155 / 100", "To: username@example.org", "", "body"})
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	require.Empty(t, entries)
+}
+
+func TestReviewCaptureLimits(t *testing.T) {
+	dir := t.TempDir()
+	r := &ReviewCapture{Class: "probable", Dir: dir, MaxBytes: 10, MaxFiles: 1}
+	session := NewSession("s1", "", false, "", "")
+	filename, err := r.Capture(session, NewMessage("m1"), []string{"Subject: a long header line"})
+	require.Nil(t, err)
+	data, err := os.ReadFile(filename)
+	require.Nil(t, err)
+	require.Equal(t, "Subject: a", string(data))
+	_, err = r.Capture(session, NewMessage("m2"), []string{"Subject: second"})
+	require.NotNil(t, err)
+}
@@ -0,0 +1,213 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const SCORER_RSPAMD = "rspamd"
+const SCORER_SPAMASSASSIN = "spamassassin"
+
+const DEFAULT_SCAN_TIMEOUT = "30s"
+const DEFAULT_SPAMD_ADDRESS = "localhost:783"
+const DEFAULT_SCAN_MAX_BYTES = 10 * 1024 * 1024
+
+// score sources scanning the whole message with rspamd or SpamAssassin
+//
+//	rspamd_scan_url:       base URL of the rspamd normal worker, e.g. http://localhost:11333
+//	rspamd_scan_timeout:   HTTP request timeout, default DEFAULT_SCAN_TIMEOUT
+//	rspamd_scan_max_bytes: larger messages are passed through unscanned
+//	spamd_address:         host:port of SpamAssassin's spamd, default DEFAULT_SPAMD_ADDRESS
+//	spamd_user:            optional user whose spamd preferences apply
+//	spamd_timeout:         spamd connection timeout, default DEFAULT_SCAN_TIMEOUT
+//	spamd_max_bytes:       larger messages are passed through unscanned
+//
+// messages are posted to rspamd's /checkv2 or sent to spamd with the spamc protocol; the
+// scanner's usual headers are added with the returned score: X-Spam-Score and X-Spamd-Result
+// as rspamd's proxy would, or X-Spam-Score and X-Spam-Status for SpamAssassin; requests run
+// off the protocol loop, so a slow scanner delays only the message being scanned
+type Scanner struct {
+	Scorer   string
+	URL      string
+	Address  string
+	User     string
+	MaxBytes int
+	timeout  time.Duration
+	client   *http.Client
+}
+
+// the fields used from a /checkv2 response
+type scanResult struct {
+	Scorer        string                    `json:"-"`
+	Score         float32                   `json:"score"`
+	RequiredScore float32                   `json:"required_score"`
+	Action        string                    `json:"action"`
+	Symbols       map[string]scanResultItem `json:"symbols"`
+}
+
+type scanResultItem struct {
+	Name  string  `json:"name"`
+	Score float32 `json:"score"`
+}
+
+// return the scanner for scorer, or nil if rspamd has no rspamd_scan_url
+func newScanner(scorer string) (*Scanner, error) {
+	s := Scanner{Scorer: scorer}
+	prefix := "rspamd_scan"
+	switch s.Scorer {
+	case SCORER_RSPAMD:
+		baseURL := ViperGetString("rspamd_scan_url")
+		if baseURL == "" {
+			return nil, nil
+		}
+		parsed, err := url.Parse(baseURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return nil, fmt.Errorf("invalid rspamd_scan_url: '%s'", baseURL)
+		}
+		s.URL = strings.TrimSuffix(baseURL, "/")
+	case SCORER_SPAMASSASSIN:
+		prefix = "spamd"
+		ViperSetDefault("spamd_address", DEFAULT_SPAMD_ADDRESS)
+		s.Address = ViperGetString("spamd_address")
+		s.User = ViperGetString("spamd_user")
+		_, _, err := net.SplitHostPort(s.Address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spamd_address: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown scorer: %s", s.Scorer)
+	}
+	ViperSetDefault(prefix+"_timeout", DEFAULT_SCAN_TIMEOUT)
+	ViperSetDefault(prefix+"_max_bytes", DEFAULT_SCAN_MAX_BYTES)
+	timeout, err := time.ParseDuration(ViperGetString(prefix + "_timeout"))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing %s_timeout: %v", prefix, err)
+	}
+	s.timeout = timeout
+	s.MaxBytes = ViperGetInt(prefix + "_max_bytes")
+	s.client = &http.Client{Timeout: timeout}
+	return &s, nil
+}
+
+func (s *Scanner) Name() string {
+	return s.Scorer
+}
+
+func (s *Scanner) Buffered() bool {
+	return true
+}
+
+// scan a message with the scanner's scorer; messages over its size limit are not scanned
+func (s *Scanner) Score(session *Session, message *Message, data []byte) (*ScoreResult, bool, error) {
+	if len(data) > s.MaxBytes {
+		return nil, false, nil
+	}
+	var result *scanResult
+	var err error
+	if s.Scorer == SCORER_SPAMASSASSIN {
+		result, err = s.checkSpamd(data)
+	} else {
+		result, err = s.checkRspamd(session, message, data)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	symbols := make([]string, 0, len(result.Symbols))
+	for symbol := range result.Symbols {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	score := ScoreResult{
+		Score:       result.Score,
+		Required:    result.RequiredScore,
+		RequiredSet: true,
+		Symbols:     symbols,
+		Headers:     result.headers(),
+	}
+	return &score, true, nil
+}
+
+// post a message to /checkv2 with the session's envelope as request headers
+func (s *Scanner) checkRspamd(session *Session, message *Message, data []byte) (*scanResult, error) {
+	request, err := http.NewRequest("POST", s.URL+"/checkv2", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(session.Remote)
+	if err == nil {
+		request.Header.Set("IP", host)
+	}
+	if session.Helo != "" {
+		request.Header.Set("Helo", session.Helo)
+	}
+	if session.RDNS != "" && session.RDNS != RDNS_UNKNOWN {
+		request.Header.Set("Hostname", session.RDNS)
+	}
+	if session.AuthorizedUser != "" {
+		request.Header.Set("User", session.AuthorizedUser)
+	}
+	if len(message.EnvelopeFrom) > 0 {
+		request.Header.Set("From", message.EnvelopeFrom[0])
+	}
+	for _, address := range message.EnvelopeTo {
+		request.Header.Add("Rcpt", address)
+	}
+	request.Header.Set("Queue-Id", message.Id)
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	var result scanResult
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing checkv2 response: %v", err)
+	}
+	result.Scorer = SCORER_RSPAMD
+	return &result, nil
+}
+
+// return the result headers for a scan result in the style of its scorer
+func (r *scanResult) headers() []string {
+	if r.Scorer == SCORER_SPAMASSASSIN {
+		return r.spamassassinHeaders()
+	}
+	return r.rspamdHeaders()
+}
+
+// return the rspamd result headers, the symbol list folded one per line
+func (r *scanResult) rspamdHeaders() []string {
+	names := make([]string, 0, len(r.Symbols))
+	for name := range r.Symbols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	spam := "False"
+	if r.Action == "reject" {
+		spam = "True"
+	}
+	lines := []string{
+		fmt.Sprintf("X-Spam-Score: %.2f / %.2f", r.Score, r.RequiredScore),
+		fmt.Sprintf("X-Spamd-Result: default: %s [%.2f / %.2f]", spam, r.Score, r.RequiredScore),
+	}
+	for _, name := range names {
+		lines[len(lines)-1] += ";"
+		lines = append(lines, fmt.Sprintf("\t%s(%.2f)", name, r.Symbols[name].Score))
+	}
+	return lines
+}
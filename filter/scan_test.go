@@ -0,0 +1,79 @@
+package filter
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// return an rspamd test server answering checkv2 requests with response, recording the last request
+func testScanServer(t *testing.T, status int, response string) (*httptest.Server, *http.Request, *string) {
+	var request http.Request
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		request = *r
+		body = string(data)
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(server.Close)
+	return server, &request, &body
+}
+
+func TestScanFallback(t *testing.T) {
+	response := `{"score": 7.25, "required_score": 15, "action": "add header", "symbols": {"R_SPF_FAIL": {"name": "R_SPF_FAIL", "score": 1}, "BAYES_SPAM": {"name": "BAYES_SPAM", "score": 6.25}}}`
+	server, request, body := testScanServer(t, http.StatusOK, response)
+	data := []string{
+		"To: touser@localdomain.ext",
+		"Subject: unscanned",
+		"",
+		"..dot stuffed",
+	}
+	var output strings.Builder
+	f := newTestFilter(t, map[string]any{"rspamd_scan_url": server.URL}, messageInput(data), &output)
+	f.Run()
+	lines := filteredLines(t, output.String())
+	require.Equal(t, "/checkv2", request.URL.Path)
+	require.Equal(t, "1.2.3.4", request.Header.Get("IP"))
+	require.Equal(t, "fromuser@example.org", request.Header.Get("From"))
+	require.Equal(t, []string{"touser@localdomain.ext"}, request.Header.Values("Rcpt"))
+	require.Equal(t, "authuser", request.Header.Get("User"))
+	require.Equal(t, "To: touser@localdomain.ext\r\nSubject: unscanned\r\n\r\n.dot stuffed\r\n", *body)
+	require.Contains(t, lines, "X-Spam-Score: 7.25 / 15.00")
+	require.Contains(t, lines, "X-Spamd-Result: default: False [7.25 / 15.00];")
+	require.Contains(t, lines, "\tBAYES_SPAM(6.25);")
+	require.Contains(t, lines, "\tR_SPF_FAIL(1.00)")
+	require.Contains(t, lines, "X-Spam-Class: suspected_spam")
+	require.Equal(t, []string{"", "..dot stuffed", "."}, lines[len(lines)-3:])
+	require.Equal(t, int64(1), f.Counter(COUNTER_SCANNED))
+}
+
+func TestScanSkippedWithScore(t *testing.T) {
+	server, request, _ := testScanServer(t, http.StatusOK, `{}`)
+	output := filterMessage(t, map[string]any{"rspamd_scan_url": server.URL}, []string{"X-Spam-Score: 1.155 / 100", "To: touser@localdomain.ext", "", "body"})
+	require.Nil(t, request.URL)
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+}
+
+func TestScanFailed(t *testing.T) {
+	server, _, _ := testScanServer(t, http.StatusInternalServerError, "oops")
+	var output strings.Builder
+	f := newTestFilter(t, map[string]any{"rspamd_scan_url": server.URL}, messageInput([]string{"To: touser@localdomain.ext", "", "body"}), &output)
+	f.Run()
+	lines := filteredLines(t, output.String())
+	require.Equal(t, []string{"To: touser@localdomain.ext", "", "body", "."}, lines)
+	require.Equal(t, int64(1), f.Counter(COUNTER_SCAN_FAILED))
+}
+
+func TestScanInvalidURL(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"rspamd_scan_url": "localhost:11333"})
+	_, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,195 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// score parse expressions for known scanner headers, applied to the header value
+var DEFAULT_SCORE_HEADER_PATTERNS = map[string]string{
+	"x-spam-score":         `^(-?[0-9.,]+)`,
+	"x-spamd-result":       `\[\s*(-?[0-9.,]+)\s*/`,
+	"x-spam-status":        `\b(?:score|hits)=(-?[0-9.,]+)`,
+	"x-spamassassin-score": `^(-?[0-9.,]+)`,
+}
+
+// rspamd's proxy adds X-Spamd-Result; the mda wrapper adds X-Spam-Score
+var DEFAULT_SCORE_HEADERS = []string{"X-Spam-Score", "X-Spamd-Result"}
+
+const SCORE_WEIGHTING_AVERAGE = "average"
+const SCORE_WEIGHTING_SUM = "sum"
+
+const DEFAULT_SCORE_INPUTS_HEADER = "X-Spam-Score-Inputs"
+
+// a header the spam score may be read from
+//
+//	score_headers:       list of {name, pattern, weight} entries in order of preference; pattern
+//	                     is a regular expression with one group capturing the score from the header
+//	                     value, optional for the headers named in DEFAULT_SCORE_HEADER_PATTERNS,
+//	                     default DEFAULT_SCORE_HEADERS
+//	score_weighting:     average or sum, combining weighted scores when any entry has a weight
+//	score_inputs_header: header recording the weighted inputs, default DEFAULT_SCORE_INPUTS_HEADER
+//
+// the score is taken from the first listed header present in the message; when weights are
+// configured the scores of all listed headers present are combined instead, entries without
+// a weight counting once
+type scoreHeader struct {
+	Name    string   `mapstructure:"name"`
+	Pattern string   `mapstructure:"pattern"`
+	Weight  *float64 `mapstructure:"weight"`
+	regexp  *regexp.Regexp
+}
+
+// a score header value recorded for weighted combination
+type scoreInput struct {
+	Score  float32
+	Weight float32
+}
+
+func newScoreHeaders() ([]scoreHeader, error) {
+	headers := []scoreHeader{}
+	err := viper.UnmarshalKey(ViperKey("score_headers"), &headers)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing score_headers: %v", err)
+	}
+	if len(headers) == 0 {
+		for _, name := range DEFAULT_SCORE_HEADERS {
+			headers = append(headers, scoreHeader{Name: name})
+		}
+	}
+	for i, header := range headers {
+		_, ok := headerName(header.Name + ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid score_headers name: '%s'", header.Name)
+		}
+		if header.Pattern == "" {
+			header.Pattern, ok = DEFAULT_SCORE_HEADER_PATTERNS[strings.ToLower(header.Name)]
+			if !ok {
+				return nil, fmt.Errorf("score_headers %s requires a pattern", header.Name)
+			}
+		}
+		headers[i].regexp, err = regexp.Compile(header.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid score_headers pattern for %s: %v", header.Name, err)
+		}
+		if headers[i].regexp.NumSubexp() != 1 {
+			return nil, fmt.Errorf("score_headers pattern for %s must have one capture group", header.Name)
+		}
+	}
+	return headers, nil
+}
+
+// set the message spam score from a configured score header line, preferring headers listed earlier
+func (f *Filter) parseScoreHeader(name string, message *Message, line string) {
+	header, ok := headerName(line)
+	if !ok {
+		return
+	}
+	for i, candidate := range f.scoreHeaders {
+		if !strings.EqualFold(header, candidate.Name) {
+			continue
+		}
+		_, value, _ := strings.Cut(line, ":")
+		if f.scoreWeighting != "" {
+			f.recordScoreInput(message, candidate, value)
+		}
+		rank := i + 1
+		if message.SpamScoreSet && rank > message.ScoreRank {
+			return
+		}
+		groups := candidate.regexp.FindStringSubmatch(strings.TrimSpace(value))
+		if len(groups) != 2 {
+			Warning("%s.%s: spam score not found: %s", f.Name, name, line)
+			return
+		}
+		score, err := f.parseScoreValue(strings.TrimRight(groups[1], ","))
+		if err != nil {
+			Warning("%s.%s: %v", f.Name, name, err)
+			return
+		}
+		if rank < message.ScoreRank {
+			message.SpamScoreSet = false
+		}
+		message.SpamScore = f.combineScores(message.SpamScore, message.SpamScoreSet, score)
+		message.SpamScoreSet = true
+		message.ScoreRank = rank
+		return
+	}
+}
+
+// return score_weighting if any score_headers entry is weighted
+func newScoreWeighting(headers []scoreHeader) (string, error) {
+	weighted := false
+	for _, header := range headers {
+		if header.Weight != nil {
+			weighted = true
+		}
+	}
+	if !weighted {
+		return "", nil
+	}
+	ViperSetDefault("score_weighting", SCORE_WEIGHTING_AVERAGE)
+	weighting := strings.ToLower(ViperGetString("score_weighting"))
+	switch weighting {
+	case SCORE_WEIGHTING_AVERAGE, SCORE_WEIGHTING_SUM:
+	default:
+		return "", fmt.Errorf("unknown score_weighting: %s", weighting)
+	}
+	return weighting, nil
+}
+
+// record the first score of each weighted score header
+func (f *Filter) recordScoreInput(message *Message, header scoreHeader, value string) {
+	_, seen := message.ScoreInputs[header.Name]
+	if seen {
+		return
+	}
+	groups := header.regexp.FindStringSubmatch(strings.TrimSpace(value))
+	if len(groups) != 2 {
+		return
+	}
+	score, err := f.parseScoreValue(strings.TrimRight(groups[1], ","))
+	if err != nil {
+		return
+	}
+	weight := float32(1)
+	if header.Weight != nil {
+		weight = float32(*header.Weight)
+	}
+	if message.ScoreInputs == nil {
+		message.ScoreInputs = make(map[string]scoreInput)
+	}
+	message.ScoreInputs[header.Name] = scoreInput{Score: score, Weight: weight}
+}
+
+// replace the message spam score with the weighted combination of its score headers,
+// recording the inputs for the score inputs header
+func (f *Filter) combineScoreInputs(message *Message) {
+	if f.scoreWeighting == "" || len(message.ScoreInputs) == 0 {
+		return
+	}
+	var total, weights float32
+	inputs := []string{}
+	for _, header := range f.scoreHeaders {
+		input, ok := message.ScoreInputs[header.Name]
+		if !ok {
+			continue
+		}
+		total += input.Score * input.Weight
+		weights += input.Weight
+		inputs = append(inputs, fmt.Sprintf("%s=%v*%v", header.Name, input.Score, input.Weight))
+	}
+	score := total
+	if f.scoreWeighting == SCORE_WEIGHTING_AVERAGE {
+		if weights == 0 {
+			return
+		}
+		score = total / weights
+	}
+	message.SpamScore = score
+	message.SpamScoreSet = true
+	message.ScoreInputsValue = fmt.Sprintf("%s; %s=%v", strings.Join(inputs, ", "), f.scoreWeighting, score)
+}
@@ -0,0 +1,77 @@
+package filter
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScoreHeaders(t *testing.T) {
+	options := map[string]any{"score_headers": []map[string]any{
+		{"name": "X-Spamd-Result"},
+		{"name": "X-SpamAssassin-Score"},
+		{"name": "X-Scanner", "pattern": `total=(-?[0-9.]+)`},
+	}}
+	spamd := "X-Spamd-Result: default: False [7.20 / 15.00];"
+	output := filterMessage(t, options, []string{spamd, "To: touser@localdomain.ext", "", "body"})
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+
+	// earlier listed headers are preferred regardless of header order
+	output = filterMessage(t, options, []string{"X-SpamAssassin-Score: 50", spamd, "To: touser@localdomain.ext", "", "body"})
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+	output = filterMessage(t, options, []string{"X-SpamAssassin-Score: 50", "X-Scanner: total=1", "To: touser@localdomain.ext", "", "body"})
+	require.Contains(t, output, "X-Spam-Class: spam")
+
+	output = filterMessage(t, options, []string{"X-Scanner: verdict=ok total=1.155", "To: touser@localdomain.ext", "", "body"})
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+
+	// X-Spam-Score is not read unless listed
+	output = filterMessage(t, options, []string{"X-Spam-Score: 50 / 100", "To: touser@localdomain.ext", "", "body"})
+	require.NotContains(t, strings.Join(output, "\n"), "X-Spam-Class")
+}
+
+func TestScoreHeadersInvalid(t *testing.T) {
+	for _, headers := range [][]map[string]any{
+		{{"name": "X-Unknown-Score"}},
+		{{"name": "X-Scanner", "pattern": `total=[0-9.]+`}},
+		{{"name": "X-Scanner", "pattern": `(`}},
+		{{"name": "Bad Header", "pattern": `(.*)`}},
+	} {
+		Init("smtpd-filter-addheader", Version, "testdata/config.yaml")
+		setTestOptions(t, map[string]any{"score_headers": headers})
+		_, err := NewFilter(strings.NewReader(""), io.Discard)
+		require.NotNil(t, err)
+	}
+}
+
+func TestWeightedScoreHeaders(t *testing.T) {
+	options := map[string]any{"score_headers": []map[string]any{
+		{"name": "X-Spam-Score", "weight": 3},
+		{"name": "X-Spam-Status", "weight": 1},
+	}}
+	data := []string{
+		"X-Spam-Score: 10 / 100",
+		"X-Spam-Status: Yes, score=2 required=5",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	// (10*3 + 2*1) / 4 = 8
+	output := filterMessage(t, options, data)
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+	require.Contains(t, output, "X-Spam-Score-Inputs: X-Spam-Score=10*3, X-Spam-Status=2*1; average=8")
+
+	// a missing input does not count against the average
+	output = filterMessage(t, options, data[1:])
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+	require.Contains(t, output, "X-Spam-Score-Inputs: X-Spam-Status=2*1; average=2")
+
+	// upstream copies of the inputs header are removed
+	options["score_weighting"] = "sum"
+	output = filterMessage(t, options, append([]string{"X-Spam-Score-Inputs: forged"}, data...))
+	require.Contains(t, output, "X-Spam-Class: spam")
+	require.Contains(t, output, "X-Spam-Score-Inputs: X-Spam-Score=10*3, X-Spam-Status=2*1; sum=32")
+	require.NotContains(t, output, "X-Spam-Score-Inputs: forged")
+}
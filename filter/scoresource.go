@@ -0,0 +1,326 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const SCORE_SOURCE_HEADER = "header"
+const SCORE_SOURCE_STATIC = "static"
+
+const COUNTER_SCANNED = "scanned"
+const COUNTER_SCAN_FAILED = "scan_failed"
+
+// ScoreSource provides the spam score of a message
+type ScoreSource interface {
+	// Name identifies the source in score_chain and logs
+	Name() string
+	// Buffered reports whether the source needs the whole message; unbuffered sources are
+	// asked at the end of the headers with nil data
+	Buffered() bool
+	// Score returns the message score, or false if the source has none for the message
+	Score(session *Session, message *Message, data []byte) (*ScoreResult, bool, error)
+}
+
+// a score returned by a ScoreSource, with result headers to add to the message
+type ScoreResult struct {
+	Score       float32
+	Required    float32
+	RequiredSet bool
+	Symbols     []string
+	Headers     []string
+}
+
+// the score parsed from the message's score headers
+type headerScore struct {
+	f *Filter
+}
+
+func (s *headerScore) Name() string {
+	return SCORE_SOURCE_HEADER
+}
+
+func (s *headerScore) Buffered() bool {
+	return false
+}
+
+func (s *headerScore) Score(session *Session, message *Message, data []byte) (*ScoreResult, bool, error) {
+	score, ok := s.f.messageScore(message)
+	if !ok {
+		return nil, false, nil
+	}
+	return &ScoreResult{Score: score}, true, nil
+}
+
+// a fixed score for messages no other source scored
+type staticScore struct {
+	score float32
+}
+
+func (s *staticScore) Name() string {
+	return SCORE_SOURCE_STATIC
+}
+
+func (s *staticScore) Buffered() bool {
+	return false
+}
+
+func (s *staticScore) Score(session *Session, message *Message, data []byte) (*ScoreResult, bool, error) {
+	return &ScoreResult{Score: s.score}, true, nil
+}
+
+// a message held while it is buffered for a score source
+type scanCapture struct {
+	Headers []string
+	Raw     []string
+	Body    []string
+	Size    int
+	Next    int
+	Result  *ScoreResult
+}
+
+// the ordered chain of score sources; the first to return a score decides
+//
+//	score_chain:  list of source names: header, rspamd, spamassassin, static or a source added
+//	              with RegisterScoreSource; default header followed by the scorer when configured
+//	scorer:       rspamd or spamassassin, the scanner of the default chain, default rspamd
+//	static_score: score returned by the static source
+//
+// messages reaching a buffered source are held whole until it has scored them
+func (f *Filter) newScoreSources() error {
+	f.scoreSources = make(map[string]ScoreSource)
+	f.RegisterScoreSource(&headerScore{f: f})
+	ViperSetDefault("scorer", SCORER_RSPAMD)
+	scorer := strings.ToLower(ViperGetString("scorer"))
+	switch scorer {
+	case SCORER_RSPAMD, SCORER_SPAMASSASSIN:
+	default:
+		return fmt.Errorf("unknown scorer: %s", scorer)
+	}
+	chain := []string{}
+	for _, name := range ViperGetStringSlice("score_chain") {
+		chain = append(chain, strings.ToLower(name))
+	}
+	if len(chain) == 0 {
+		chain = []string{SCORE_SOURCE_HEADER, scorer}
+	}
+	f.scoreChain = chain
+	f.scanMaxBytes = DEFAULT_SCAN_MAX_BYTES
+	for _, name := range chain {
+		switch name {
+		case SCORER_RSPAMD, SCORER_SPAMASSASSIN:
+			scanner, err := newScanner(name)
+			if err != nil {
+				return err
+			}
+			if scanner == nil {
+				// rspamd scanning is optional in the default chain
+				if len(ViperGetStringSlice("score_chain")) == 0 {
+					f.scoreChain = []string{SCORE_SOURCE_HEADER}
+					continue
+				}
+				return fmt.Errorf("score_chain %s requires rspamd_scan_url", name)
+			}
+			f.scanMaxBytes = max(f.scanMaxBytes, scanner.MaxBytes)
+			f.RegisterScoreSource(scanner)
+		case SCORE_SOURCE_STATIC:
+			if !viper.IsSet(ViperKey("static_score")) {
+				return fmt.Errorf("score_chain static requires static_score")
+			}
+			f.RegisterScoreSource(&staticScore{score: float32(viper.GetFloat64(ViperKey("static_score")))})
+		}
+	}
+	return nil
+}
+
+// add a score source, replacing any of the same name; sources not named in score_chain
+// are appended to it
+func (f *Filter) RegisterScoreSource(source ScoreSource) {
+	name := source.Name()
+	f.scoreSources[name] = source
+	for _, chained := range f.scoreChain {
+		if chained == name {
+			return
+		}
+	}
+	f.scoreChain = append(f.scoreChain, name)
+}
+
+// return an error if score_chain names a source that was never registered
+func (f *Filter) checkScoreChain() error {
+	for _, name := range f.scoreChain {
+		_, ok := f.scoreSources[name]
+		if !ok {
+			return fmt.Errorf("unknown score_chain source: %s", name)
+		}
+	}
+	return nil
+}
+
+// a score source's answer for a message
+type scoreAttempt struct {
+	source ScoreSource
+	result *ScoreResult
+	ok     bool
+	err    error
+}
+
+// ask the score sources from index start for a score, changing no filter state so held
+// messages may be scored off the protocol loop; without data, stop at the first buffered
+// source, returning its index
+func (f *Filter) tryScoreSources(session *Session, message *Message, start int, data []byte) ([]scoreAttempt, int, bool) {
+	attempts := []scoreAttempt{}
+	for i := start; i < len(f.scoreChain); i++ {
+		source := f.scoreSources[f.scoreChain[i]]
+		if source.Buffered() && data == nil {
+			return attempts, i, false
+		}
+		result, ok, err := source.Score(session, message, data)
+		attempts = append(attempts, scoreAttempt{source: source, result: result, ok: ok, err: err})
+		if err == nil && ok {
+			break
+		}
+	}
+	return attempts, len(f.scoreChain), true
+}
+
+// count and report score attempts, returning the first score found
+func (f *Filter) useScoreAttempts(name string, message *Message, attempts []scoreAttempt) *ScoreResult {
+	for _, attempt := range attempts {
+		if attempt.err != nil {
+			f.count(COUNTER_SCAN_FAILED)
+			Warning("%s.%s: %s score failed: %v", f.Name, name, attempt.source.Name(), attempt.err)
+			continue
+		}
+		if !attempt.ok {
+			continue
+		}
+		if attempt.source.Buffered() {
+			f.count(COUNTER_SCANNED)
+		}
+		if attempt.source.Name() != SCORE_SOURCE_HEADER {
+			log.Printf("%s.%s: %s score source returned %.2f\n", f.Name, name, attempt.source.Name(), attempt.result.Score)
+			f.applyScore(message, attempt.result)
+		}
+		return attempt.result
+	}
+	return nil
+}
+
+// score a message with the sources from index start, returning the index of a buffered
+// source reached without data
+func (f *Filter) runScoreChain(name string, session *Session, message *Message, start int, data []byte) (*ScoreResult, int, bool) {
+	attempts, next, done := f.tryScoreSources(session, message, start, data)
+	return f.useScoreAttempts(name, message, attempts), next, done
+}
+
+// use a score source result as the message score
+func (f *Filter) applyScore(message *Message, result *ScoreResult) {
+	message.SpamScore, message.SpamScoreSet = result.Score, true
+	message.StatusScore, message.StatusScoreSet = result.Score, true
+	if result.RequiredSet {
+		message.Required, message.RequiredSet = result.Required, true
+	}
+	message.Symbols = append(message.Symbols, result.Symbols...)
+}
+
+// return the header lines with a score result's headers added
+func scoredHeaders(lines []string, result *ScoreResult) []string {
+	if result == nil || len(result.Headers) == 0 {
+		return lines
+	}
+	return append(append([]string{}, lines...), result.Headers...)
+}
+
+// score a message at the end of its headers, returning false if it is held for a buffered source
+func (f *Filter) scoreMessage(name string, session *Session, message *Message, headers, raw []string) ([]string, bool) {
+	result, next, done := f.runScoreChain(name, session, message, 0, nil)
+	if !done || f.clamav != nil {
+		message.Scan = &scanCapture{Headers: headers, Raw: raw, Next: next, Result: result}
+		for _, line := range raw {
+			message.Scan.Size += len(line) + 2
+		}
+		return nil, false
+	}
+	return f.generateHeaders(name, session, message, scoredHeaders(headers, result), scoredHeaders(raw, result)), true
+}
+
+// buffer data lines of a held message, starting its scan at the end of data; the output
+// lines are returned only if the message is passed unscanned
+func (f *Filter) captureScan(name, sid, token string, session *Session, message *Message, lines []string) []string {
+	capture := message.Scan
+	for i, line := range lines {
+		capture.Body = append(capture.Body, line)
+		if line == "." {
+			message.Scan = nil
+			f.scanMessage(name, sid, token, session, message, capture)
+			return lines[i+1:]
+		}
+		capture.Size += len(line) + 2
+		if capture.Size > f.scanMaxBytes {
+			log.Printf("%s.%s: message exceeds scan size limit (%d); passing unscanned\n", f.Name, name, f.scanMaxBytes)
+			message.Scan = nil
+			output := f.generateHeaders(name, session, message, capture.Headers, capture.Raw)
+			return append(append(output, capture.Body...), lines[i+1:]...)
+		}
+	}
+	return []string{}
+}
+
+// scan a held message off the protocol loop with clamd and the remaining score sources; the
+// message is written with the generated headers added when the scans finish, and commit
+// decisions wait for it
+func (f *Filter) scanMessage(name, sid, token string, session *Session, message *Message, capture *scanCapture) {
+	data := []string{}
+	for _, line := range append(append([]string{}, capture.Raw...), capture.Body[:len(capture.Body)-1]...) {
+		// data lines are dot-stuffed
+		if strings.HasPrefix(line, "..") {
+			line = line[1:]
+		}
+		data = append(data, line)
+	}
+	buffer := []byte(strings.Join(data, "\r\n") + "\r\n")
+	message.Scanning = true
+	f.async(func() func() {
+		var virus *virusScan
+		if f.clamav != nil {
+			virus = f.clamav.check(buffer)
+		}
+		var attempts []scoreAttempt
+		if capture.Next < len(f.scoreChain) {
+			attempts, _, _ = f.tryScoreSources(session, message, capture.Next, buffer)
+		}
+		return func() {
+			virusHeader := ""
+			if virus != nil {
+				virusHeader = f.virusHeader(name, message, virus)
+			}
+			result := capture.Result
+			if capture.Next < len(f.scoreChain) {
+				result = f.useScoreAttempts(name, message, attempts)
+			}
+			output := f.generateHeaders(name, session, message, scoredHeaders(capture.Headers, result), scoredHeaders(capture.Raw, result))
+			if virusHeader != "" {
+				output = append([]string{virusHeader}, output...)
+			}
+			f.writeDataLines(name, sid, token, session, message, append(output, capture.Body...))
+			f.releaseMessage(message)
+		}
+	})
+}
+
+// run the commit decisions waiting for a scanned message, unless it is still held for the
+// policy webhook
+func (f *Filter) releaseMessage(message *Message) {
+	if message.Hold != nil {
+		return
+	}
+	message.Scanning = false
+	for _, after := range message.AfterScan {
+		after()
+	}
+	message.AfterScan = nil
+}
@@ -0,0 +1,140 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// a buffered score source scoring messages by the length of their body
+type testLengthScore struct {
+	fail bool
+	seen []byte
+}
+
+func (s *testLengthScore) Name() string {
+	return "length"
+}
+
+func (s *testLengthScore) Buffered() bool {
+	return true
+}
+
+func (s *testLengthScore) Score(session *Session, message *Message, data []byte) (*ScoreResult, bool, error) {
+	s.seen = data
+	if s.fail {
+		return nil, false, fmt.Errorf("length unavailable")
+	}
+	return &ScoreResult{Score: float32(len(data)) / 10, Headers: []string{"X-Length-Score: scored"}}, true, nil
+}
+
+func TestScoreChainStatic(t *testing.T) {
+	data := []string{
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	options := map[string]any{"score_chain": []string{"header", "static"}, "static_score": 7.2}
+	output := filterMessage(t, options, data)
+	require.Contains(t, output, "X-Spam-Class: suspected_spam")
+
+	// the header source answers first when the message has a score
+	output = filterMessage(t, options, append([]string{"X-Spam-Score: 1.155 / 100"}, data...))
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+}
+
+func TestRegisterScoreSource(t *testing.T) {
+	data := []string{
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	run := func(options map[string]any, source *testLengthScore) ([]string, *Filter) {
+		var output strings.Builder
+		f := newTestFilter(t, options, messageInput(data), &output)
+		f.RegisterScoreSource(source)
+		f.Run()
+		return filteredLines(t, output.String()), f
+	}
+	// 36 bytes scores 3.6, applied_class
+	source := &testLengthScore{}
+	output, f := run(map[string]any{}, source)
+	require.Equal(t, "To: touser@localdomain.ext\r\n\r\nbody\r\n", string(source.seen))
+	require.Contains(t, output, "X-Length-Score: scored")
+	require.Contains(t, output, "X-Spam-Class: applied_class")
+	require.Equal(t, []string{SCORE_SOURCE_HEADER, "length"}, f.scoreChain)
+
+	// a failed source falls through to the next in the chain
+	output, f = run(map[string]any{"score_chain": []string{"length", "static"}, "static_score": 50}, &testLengthScore{fail: true})
+	require.Contains(t, output, "X-Spam-Class: spam")
+	require.Equal(t, int64(1), f.Counter(COUNTER_SCAN_FAILED))
+}
+
+func TestScoreChainUnknownSource(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"score_chain": []string{"header", "bayes"}})
+	f, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.Nil(t, err)
+	require.NotNil(t, f.RunContext(context.Background()))
+	require.NotNil(t, f.Run())
+
+	setTestOptions(t, map[string]any{"score_chain": []string{"static"}})
+	_, err = NewFilter(strings.NewReader(""), io.Discard)
+	require.NotNil(t, err)
+}
+
+// a buffered score source holding the first session's message until another has been scored
+type testSlowScore struct {
+	scored chan struct{}
+}
+
+func (s *testSlowScore) Name() string {
+	return "slow"
+}
+
+func (s *testSlowScore) Buffered() bool {
+	return true
+}
+
+func (s *testSlowScore) Score(session *Session, message *Message, data []byte) (*ScoreResult, bool, error) {
+	if session.Id == "deadbeef" {
+		select {
+		case <-s.scored:
+		case <-time.After(5 * time.Second):
+		}
+		// leave time for the other message to be written
+		time.Sleep(500 * time.Millisecond)
+	} else {
+		close(s.scored)
+	}
+	return &ScoreResult{Score: 1.155}, true, nil
+}
+
+func TestScanDoesNotBlockSessions(t *testing.T) {
+	data := []string{
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	second := strings.Split(strings.NewReplacer("deadbeef", "00000002", "cafebabe", "cafe0002", "c0ffee", "c0ffee02").Replace(commitInput(data)), "\n")
+	input := commitInput(data) + strings.Join(second[len(initLines):], "\n")
+	var output strings.Builder
+	f := newTestFilter(t, map[string]any{"class_actions": map[string]string{"spam": "reject"}}, input, &output)
+	f.RegisterScoreSource(&testSlowScore{scored: make(chan struct{})})
+	start := time.Now()
+	f.Run()
+	require.Less(t, time.Since(start), 5*time.Second)
+	first := strings.Index(output.String(), "filter-dataline|deadbeef|baadf00d|X-Spam-Class: applied_class")
+	other := strings.Index(output.String(), "filter-dataline|00000002|baadf00d|X-Spam-Class: applied_class")
+	require.True(t, first > 0 && other > 0)
+	require.Less(t, other, first)
+
+	// commit decisions wait for the message scan
+	require.Less(t, first, strings.Index(output.String(), "filter-result|deadbeef|c0ffee|proceed"))
+}
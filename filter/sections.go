@@ -0,0 +1,60 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/rstms/rspamd-classes/classes"
+)
+
+// class config section holding class tables keyed by sender address
+const SENDERS_KEY = "senders"
+
+// class config section holding class tables keyed by authenticated username
+const USERS_KEY = "users"
+
+// class config sections holding class tables not keyed by recipient
+var CLASS_CONFIG_SECTIONS = []string{SENDERS_KEY, USERS_KEY, PROFILES_KEY}
+
+// parse a named section of a class config
+func parseSectionConfig(name string, data []byte) (map[string][]classes.SpamClass, error) {
+	config := map[string][]classes.SpamClass{}
+	if len(data) == 0 {
+		return config, nil
+	}
+	err := json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return config, nil
+}
+
+// return the class tables of each section of a class config, skipping invalid entries;
+// keys are lowercased
+func readSectionClasses(config *classConfig) (map[string]*classes.SpamClasses, error) {
+	sections := make(map[string]*classes.SpamClasses)
+	for _, name := range CLASS_CONFIG_SECTIONS {
+		sections[name] = &classes.SpamClasses{Classes: make(map[string][]classes.SpamClass)}
+	}
+	for _, name := range CLASS_CONFIG_SECTIONS {
+		tables, err := parseSectionConfig(name, config.Sections[name])
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing %s: %v", config.Filename, err)
+		}
+		skipInvalid(name, tables, config.Problems)
+		for key, list := range tables {
+			if len(list) > 0 {
+				sections[name].SetClasses(strings.ToLower(key), list)
+			}
+		}
+	}
+	return sections, nil
+}
+
+// return the current class tables of a section
+func (f *Filter) getSection(name string) *classes.SpamClasses {
+	f.classesLock.RLock()
+	defer f.classesLock.RUnlock()
+	return f.sections[name]
+}
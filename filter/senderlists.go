@@ -0,0 +1,185 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/rstms/rspamd-classes/classes"
+)
+
+const DEFAULT_ALLOWLIST_CLASS = "ham"
+const DEFAULT_LIST_HEADER = "X-Spam-List"
+
+const COUNTER_ALLOWLISTED = "allowlisted"
+const COUNTER_BLOCKLISTED = "blocklisted"
+
+// a list of senders whose messages are forced into a class regardless of score
+//
+//	allowlist:       list of addresses, domains and CIDR ranges whose messages are forced to allowlist_class
+//	allowlist_class: default DEFAULT_ALLOWLIST_CLASS
+//	blocklist:       list of addresses, domains and CIDR ranges whose messages are forced to blocklist_class
+//	blocklist_class: default the highest class
+//	list_header:     header noting the list hit, default DEFAULT_LIST_HEADER
+//
+// entries are matched against the envelope sender, the From: header addresses and the client
+// address; a domain entry also matches its subdomains; the blocklist is checked first
+//
+// sender addresses are trivially forged, so an allowlist address entry matches the envelope
+// sender only with a trusted spf=pass or dmarc=pass result, and the From: header only with
+// dmarc=pass; allowlist network entries need no authentication
+type senderList struct {
+	Name      string
+	Class     string
+	Addresses map[string]bool
+	Domains   []string
+	Networks  []*net.IPNet
+}
+
+// a sender list match, recording which message input matched which entry
+type listHit struct {
+	List   *senderList
+	Source string
+	Value  string
+	Entry  string
+}
+
+func newSenderList(name, defaultClass string) (*senderList, error) {
+	entries := ViperGetStringSlice(name)
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	ViperSetDefault(name+"_class", defaultClass)
+	l := senderList{
+		Name:      name,
+		Class:     ViperGetString(name + "_class"),
+		Addresses: make(map[string]bool),
+		Domains:   []string{},
+		Networks:  []*net.IPNet{},
+	}
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case strings.Contains(entry, "/") || net.ParseIP(entry) != nil:
+			network, err := parseNetwork(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s entry: %v", name, err)
+			}
+			l.Networks = append(l.Networks, network)
+		case strings.HasPrefix(entry, "@"):
+			l.Domains = append(l.Domains, strings.TrimPrefix(entry, "@"))
+		case strings.Contains(entry, "@"):
+			l.Addresses[entry] = true
+		case entry != "":
+			l.Domains = append(l.Domains, strings.Trim(entry, "."))
+		default:
+			return nil, fmt.Errorf("empty %s entry", name)
+		}
+	}
+	return &l, nil
+}
+
+func newSenderLists() ([]*senderList, error) {
+	lists := []*senderList{}
+	for _, spec := range [][]string{{"blocklist", classes.MAX_NAME}, {"allowlist", DEFAULT_ALLOWLIST_CLASS}} {
+		list, err := newSenderList(spec[0], spec[1])
+		if err != nil {
+			return nil, err
+		}
+		if list != nil {
+			lists = append(lists, list)
+		}
+	}
+	return lists, nil
+}
+
+// return the list entry matching an email address
+func (l *senderList) matchAddress(address string) (string, bool) {
+	address = strings.ToLower(address)
+	if l.Addresses[address] {
+		return address, true
+	}
+	_, domain, ok := strings.Cut(address, "@")
+	if !ok {
+		return "", false
+	}
+	for _, entry := range l.Domains {
+		if domain == entry || strings.HasSuffix(domain, "."+entry) {
+			return entry, true
+		}
+	}
+	return "", false
+}
+
+// return the list entry matching a client address
+func (l *senderList) matchRemote(remote string) (string, bool) {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", false
+	}
+	for _, network := range l.Networks {
+		if network.Contains(ip) {
+			return network.String(), true
+		}
+	}
+	return "", false
+}
+
+// return the first sender list hit for a message
+func (f *Filter) senderListHit(name string, session *Session, message *Message) (*listHit, bool) {
+	for _, list := range f.senderLists {
+		for _, address := range message.EnvelopeFrom {
+			entry, ok := list.matchAddress(address)
+			if ok && f.listAuthenticated(name, list, message, "envelope_from", address, "spf=pass", "dmarc=pass") {
+				return &listHit{List: list, Source: "envelope_from", Value: address, Entry: entry}, true
+			}
+		}
+		for _, address := range message.From {
+			entry, ok := list.matchAddress(address)
+			if ok && f.listAuthenticated(name, list, message, "from", address, "dmarc=pass") {
+				return &listHit{List: list, Source: "from", Value: address, Entry: entry}, true
+			}
+		}
+		entry, ok := list.matchRemote(session.Remote)
+		if ok {
+			return &listHit{List: list, Source: "ip", Value: session.Remote, Entry: entry}, true
+		}
+	}
+	return nil, false
+}
+
+// true if a sender address matching list is authenticated by one of the results; blocklist
+// matches need none
+func (f *Filter) listAuthenticated(name string, list *senderList, message *Message, source, address string, results ...string) bool {
+	if list.Name != "allowlist" {
+		return true
+	}
+	for _, result := range results {
+		if slices.Contains(message.AuthResults, result) {
+			return true
+		}
+	}
+	log.Printf("%s.%s: allowlist %s %s is not authenticated by %s; ignored\n", f.Name, name, source, address, strings.Join(results, " or "))
+	return false
+}
+
+// return the header noting a sender list hit
+func (f *Filter) listHeader(hit *listHit) string {
+	return f.formatHeader(f.listHeaderName, fmt.Sprintf("%s %s=%s entry=%s", hit.List.Name, hit.Source, hit.Value, hit.Entry))
+}
+
+// log and count a sender list hit
+func (f *Filter) recordListHit(name string, hit *listHit) {
+	if hit.List.Name == "blocklist" {
+		f.count(COUNTER_BLOCKLISTED)
+	} else {
+		f.count(COUNTER_ALLOWLISTED)
+	}
+	log.Printf("%s.%s: %s %s %s matches %s; forcing class '%s'\n", f.Name, name, hit.List.Name, hit.Source, hit.Value, hit.Entry, hit.List.Class)
+}
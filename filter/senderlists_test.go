@@ -0,0 +1,74 @@
+package filter
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSenderLists(t *testing.T) {
+	data := []string{
+		"X-Spam-Score: 50 / 100",
+		"To: touser@localdomain.ext",
+		"From: Friend <friend@partner.example.com>",
+		"",
+		"body",
+	}
+	output := filterMessage(t, map[string]any{}, data)
+	require.Contains(t, output, "X-Spam-Class: spam")
+	for _, line := range output {
+		require.NotContains(t, line, "X-Spam-List")
+	}
+
+	// an unauthenticated From: header address does not match the allowlist
+	options := map[string]any{"allowlist": []string{"example.com"}, "auth_results_authserv_ids": []string{"mx.localdomain.ext"}}
+	output = filterMessage(t, options, data)
+	require.Contains(t, output, "X-Spam-Class: spam")
+
+	// a From: header domain entry authenticated by dmarc=pass matches subdomains
+	authenticated := append([]string{"Authentication-Results: mx.localdomain.ext; dmarc=pass header.from=example.com"}, data...)
+	output = filterMessage(t, options, authenticated)
+	require.Contains(t, output, "X-Spam-Class: ham")
+	require.Contains(t, output, "X-Spam: no")
+	require.Contains(t, output, "X-Spam-List: allowlist from=friend@partner.example.com entry=example.com")
+
+	// results from an untrusted authserv-id, or an spf=pass for the envelope sender, do not authenticate From:
+	forged := append([]string{"Authentication-Results: attacker.example; dmarc=pass header.from=example.com"}, data...)
+	output = filterMessage(t, options, forged)
+	require.Contains(t, output, "X-Spam-Class: spam")
+	forged[0] = "Authentication-Results: mx.localdomain.ext; spf=pass smtp.mailfrom=example.org"
+	output = filterMessage(t, options, forged)
+	require.Contains(t, output, "X-Spam-Class: spam")
+
+	// spf=pass authenticates the envelope sender
+	output = filterMessage(t, map[string]any{"allowlist": []string{"example.org"}, "auth_results_authserv_ids": []string{"mx.localdomain.ext"}}, forged)
+	require.Contains(t, output, "X-Spam-List: allowlist envelope_from=fromuser@example.org entry=example.org")
+
+	// the allowlist never overrides a dangerous symbol
+	dangerous := append([]string{"X-Spamd-Result: default: False [50.00 / 15.00]; MIME_BAD_EXTENSION(1.00)[exe]"}, authenticated...)
+	output = filterMessage(t, options, dangerous)
+	require.Contains(t, output, "X-Spam-Class: spam")
+	for _, line := range output {
+		require.NotContains(t, line, "X-Spam-List")
+	}
+
+	// the blocklist is checked before the allowlist
+	data[0] = "X-Spam-Score: 1.155 / 100"
+	output = filterMessage(t, map[string]any{"allowlist": []string{"example.com"}, "blocklist": []string{"1.2.3.0/24"}}, data)
+	require.Contains(t, output, "X-Spam-Class: spam")
+	require.Contains(t, output, "X-Spam: yes")
+	require.Contains(t, output, "X-Spam-List: blocklist ip=1.2.3.4:11223 entry=1.2.3.0/24")
+
+	output = filterMessage(t, map[string]any{"blocklist": []string{"FromUser@example.org"}, "allowlist": []string{}}, data)
+	require.Contains(t, output, "X-Spam-List: blocklist envelope_from=fromuser@example.org entry=fromuser@example.org")
+}
+
+func TestSenderListInvalid(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"blocklist": []string{"10.0.0.0/40"}})
+	_, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.NotNil(t, err)
+}
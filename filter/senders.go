@@ -0,0 +1,49 @@
+package filter
+
+import (
+	"log"
+	"strings"
+
+	"github.com/rstms/rspamd-classes/classes"
+)
+
+// return the sender class table matching the message sender, with the matched key
+//
+// sender class tables take precedence over recipient class tables; the envelope sender,
+// then each From: header address, is matched against an exact senders entry, then
+// "*@domain", then "@domain".  Without a match the recipient lookup applies.
+func (f *Filter) senderClassList(message *Message) (string, []classes.SpamClass, bool) {
+	senders := f.getSection(SENDERS_KEY)
+	if senders == nil || len(senders.Classes) == 0 {
+		return "", nil, false
+	}
+	addresses := append(append([]string{}, message.EnvelopeFrom...), message.From...)
+	for _, address := range addresses {
+		address = strings.ToLower(address)
+		keys := []string{address}
+		_, domain, found := strings.Cut(address, "@")
+		if found && domain != "" {
+			keys = append(keys, "*@"+domain, "@"+domain)
+		}
+		for _, key := range keys {
+			list, ok := senders.Classes[key]
+			if ok {
+				return key, list, true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+// return the class selected by a matching sender class table
+func (f *Filter) senderClass(name string, message *Message, score float32) (string, bool) {
+	key, list, ok := f.senderClassList(message)
+	if !ok {
+		return "", false
+	}
+	spamClass := f.scoreClass(list, score)
+	if f.verbose {
+		log.Printf("%s.%s: sender entry %s selects class '%s'\n", f.Name, name, key, spamClass)
+	}
+	return spamClass, true
+}
@@ -0,0 +1,75 @@
+package filter
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSenderClasses(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "classes.json")
+	writeTestClasses(t, filename, `{
+    "touser@localdomain.ext": [{"name": "recipient", "score": 50}],
+    "senders": {
+	"@bulk.example.com": [{"name": "bulk_ham", "score": 1}, {"name": "bulk", "score": 50}]
+    }
+}`)
+	require.Nil(t, validateClassConfig(filename))
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"From: news@bulk.example.com",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	options := map[string]any{"class_config_file": filename, "emit_reason_header": true}
+	output := filterMessage(t, options, data)
+	require.Contains(t, output, "X-Spam-Class: bulk")
+	require.Contains(t, output, "X-Spam-Class-Reason: reason=sender")
+
+	// without a sender match the recipient table applies
+	data[1] = "From: fromuser@example.org"
+	output = filterMessage(t, options, data)
+	require.Contains(t, output, "X-Spam-Class: recipient")
+
+	// the envelope sender is matched before the From: header
+	writeTestClasses(t, filename, `{
+    "senders": {
+	"fromuser@example.org": [{"name": "envelope", "score": 50}],
+	"*@bulk.example.com": [{"name": "header", "score": 50}]
+    }
+}`)
+	data[1] = "From: news@bulk.example.com"
+	output = filterMessage(t, options, data)
+	require.Contains(t, output, "X-Spam-Class: envelope")
+}
+
+func TestSenderClassesInvalid(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "classes.json")
+	writeTestClasses(t, filename, `{"senders": {"not an address": [{"name": "bulk", "score": 5}]}}`)
+	require.NotNil(t, validateClassConfig(filename))
+	writeTestClasses(t, filename, `{"senders": {"@bulk.example.com": [{"name": "bulk", "score": 5}, {"name": "bulk", "score": 6}]}}`)
+	require.NotNil(t, validateClassConfig(filename))
+	writeTestClasses(t, filename, `{"senders": ["bulk"]}`)
+	require.NotNil(t, validateClassConfig(filename))
+}
+
+func TestSenderClassesYAML(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "classes.yaml")
+	writeTestClasses(t, filename, `
+senders:
+  "@bulk.example.com":
+    - name: bulk
+      score: 50
+`)
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"From: news@bulk.example.com",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	output := filterMessage(t, map[string]any{"class_config_file": filename}, data)
+	require.Contains(t, output, "X-Spam-Class: bulk")
+}
@@ -0,0 +1,142 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const DEFAULT_DECISION_SOCKET_BUFFER = 64
+const DEFAULT_DECISION_SOCKET_TIMEOUT = "5s"
+
+// stream of decisions as newline delimited JSON to local readers on a unix socket
+//
+//	decision_socket:         socket path
+//	decision_socket_buffer:  lines buffered per reader; readers falling behind lose decisions
+//	decision_socket_timeout: time allowed for each write; a reader not reading within it is dropped
+type DecisionSocket struct {
+	Path     string
+	listener net.Listener
+	buffer   int
+	timeout  time.Duration
+	lock     sync.Mutex
+	readers  map[net.Conn]chan []byte
+	wg       sync.WaitGroup
+}
+
+func newDecisionSocket() (*DecisionSocket, error) {
+	path := ViperGetString("decision_socket")
+	if path == "" {
+		return nil, nil
+	}
+	ViperSetDefault("decision_socket_buffer", DEFAULT_DECISION_SOCKET_BUFFER)
+	ViperSetDefault("decision_socket_timeout", DEFAULT_DECISION_SOCKET_TIMEOUT)
+	timeout, err := time.ParseDuration(ViperGetString("decision_socket_timeout"))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing decision_socket_timeout: %v", err)
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("invalid decision_socket_timeout: %v", timeout)
+	}
+	// remove a stale socket left by a previous run
+	if _, err := os.Stat(path); err == nil {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed listening on decision_socket: %v", err)
+	}
+	s := &DecisionSocket{
+		Path:     path,
+		listener: listener,
+		buffer:   ViperGetInt("decision_socket_buffer"),
+		timeout:  timeout,
+		readers:  make(map[net.Conn]chan []byte),
+	}
+	go s.accept()
+	return s, nil
+}
+
+func (s *DecisionSocket) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		queue := make(chan []byte, s.buffer)
+		s.lock.Lock()
+		s.readers[conn] = queue
+		s.lock.Unlock()
+		s.wg.Add(1)
+		go s.write(conn, queue)
+	}
+}
+
+func (s *DecisionSocket) write(conn net.Conn, queue chan []byte) {
+	defer s.wg.Done()
+	defer conn.Close()
+	for line := range queue {
+		conn.SetWriteDeadline(time.Now().Add(s.timeout))
+		_, err := conn.Write(line)
+		if err != nil {
+			s.drop(conn)
+			for range queue {
+			}
+			return
+		}
+	}
+}
+
+func (s *DecisionSocket) drop(conn net.Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	queue, ok := s.readers[conn]
+	if ok {
+		delete(s.readers, conn)
+		close(queue)
+	}
+}
+
+// return the number of connected readers
+func (s *DecisionSocket) Readers() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.readers)
+}
+
+// queue a decision to all readers without blocking
+func (s *DecisionSocket) Publish(decision Decision) {
+	data, err := json.Marshal(decision)
+	if err != nil {
+		Warning("decision_socket: failed formatting decision: %v", err)
+		return
+	}
+	line := append(data, '\n')
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, queue := range s.readers {
+		select {
+		case queue <- line:
+		default:
+			log.Printf("decision_socket: reader buffer full; dropping decision\n")
+		}
+	}
+}
+
+// stop accepting readers, flush queued decisions, and remove the socket; the write
+// deadline bounds the wait for a reader that stopped reading
+func (s *DecisionSocket) Close() {
+	s.listener.Close()
+	s.lock.Lock()
+	for conn, queue := range s.readers {
+		delete(s.readers, conn)
+		close(queue)
+	}
+	s.lock.Unlock()
+	s.wg.Wait()
+	os.Remove(s.Path)
+}
@@ -0,0 +1,77 @@
+package filter
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecisionSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.sock")
+	var output strings.Builder
+	f := newTestFilter(t, map[string]any{"decision_socket": path}, messageInput([]string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: username@example.org",
+		"",
+		"body",
+	}), &output)
+	conn, err := net.Dial("unix", path)
+	require.Nil(t, err)
+	defer conn.Close()
+	require.Eventually(t, func() bool { return f.decisionSocket.Readers() == 1 }, time.Second, time.Millisecond)
+
+	f.Run()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.Nil(t, err)
+	var decision Decision
+	err = json.Unmarshal([]byte(line), &decision)
+	require.Nil(t, err)
+	require.Equal(t, "username@example.org", decision.Recipient)
+	require.Equal(t, float32(1.155), decision.Score)
+	require.Equal(t, "possible", decision.Class)
+}
+
+func TestDecisionSocketSlowReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.sock")
+	options := map[string]any{"decision_socket": path, "decision_socket_buffer": 1, "decision_socket_timeout": "200ms"}
+	f := newTestFilter(t, options, "", nil)
+	conn, err := net.Dial("unix", path)
+	require.Nil(t, err)
+	defer conn.Close()
+	require.Eventually(t, func() bool { return f.decisionSocket.Readers() == 1 }, time.Second, time.Millisecond)
+
+	captureLog(t)
+
+	// publishing never blocks on a reader that is not reading
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 10000; i++ {
+			f.recordDecision("username@example.org", 1, "possible")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish blocked on slow reader")
+	}
+
+	// closing does not wait on the reader either
+	closed := make(chan bool)
+	go func() {
+		f.decisionSocket.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close blocked on slow reader")
+	}
+}
@@ -0,0 +1,130 @@
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const SPAMC_PROTOCOL = "SPAMC/1.5"
+
+var SPAMD_STATUS_PATTERN = regexp.MustCompile(`^SPAMD/[0-9.]+\s+([0-9]+)\s+(.*)$`)
+var SPAMD_SPAM_PATTERN = regexp.MustCompile(`^(True|False|Yes|No)\s*;\s*(-?[0-9.]+)\s*/\s*(-?[0-9.]+)`)
+
+// send a message to spamd with the SYMBOLS command, returning its score and matched tests
+func (s *Scanner) checkSpamd(data []byte) (*scanResult, error) {
+	conn, err := net.DialTimeout("tcp", s.Address, s.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.timeout))
+	request := fmt.Sprintf("SYMBOLS %s\r\nContent-length: %d\r\n", SPAMC_PROTOCOL, len(data))
+	if s.User != "" {
+		request += fmt.Sprintf("User: %s\r\n", s.User)
+	}
+	_, err = io.WriteString(conn, request+"\r\n")
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	// spamd reads the message until end of input
+	tcp, ok := conn.(*net.TCPConn)
+	if ok {
+		tcp.CloseWrite()
+	}
+	return parseSpamdResponse(bufio.NewReader(conn))
+}
+
+// parse a spamd SYMBOLS response
+func parseSpamdResponse(reader *bufio.Reader) (*scanResult, error) {
+	status, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed reading spamd response: %v", err)
+	}
+	groups := SPAMD_STATUS_PATTERN.FindStringSubmatch(strings.TrimSpace(status))
+	if len(groups) != 3 {
+		return nil, fmt.Errorf("unexpected spamd response: %q", strings.TrimSpace(status))
+	}
+	if groups[1] != "0" {
+		return nil, fmt.Errorf("spamd error %s: %s", groups[1], groups[2])
+	}
+	result := scanResult{Scorer: SCORER_SPAMASSASSIN, Symbols: make(map[string]scanResultItem)}
+	found := false
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("failed reading spamd response headers: %v", err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		name, value, _ := strings.Cut(line, ":")
+		if !strings.EqualFold(name, "Spam") {
+			continue
+		}
+		fields := SPAMD_SPAM_PATTERN.FindStringSubmatch(strings.TrimSpace(value))
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("unexpected spamd Spam header: %q", value)
+		}
+		score, err := strconv.ParseFloat(fields[2], 32)
+		if err != nil {
+			return nil, err
+		}
+		required, err := strconv.ParseFloat(fields[3], 32)
+		if err != nil {
+			return nil, err
+		}
+		result.Score = float32(score)
+		result.RequiredScore = float32(required)
+		if fields[1] == "True" || fields[1] == "Yes" {
+			result.Action = "reject"
+		}
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("spamd response has no Spam header")
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading spamd symbols: %v", err)
+	}
+	for _, symbol := range strings.Split(strings.TrimSpace(string(body)), ",") {
+		symbol = strings.TrimSpace(symbol)
+		if symbol != "" {
+			result.Symbols[symbol] = scanResultItem{Name: symbol}
+		}
+	}
+	return &result, nil
+}
+
+// return the SpamAssassin result headers
+func (r *scanResult) spamassassinHeaders() []string {
+	names := make([]string, 0, len(r.Symbols))
+	for name := range r.Symbols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tests := "none"
+	if len(names) > 0 {
+		tests = strings.Join(names, ",")
+	}
+	flag := "No"
+	if r.Action == "reject" {
+		flag = "Yes"
+	}
+	return []string{
+		fmt.Sprintf("X-Spam-Score: %.2f / %.2f", r.Score, r.RequiredScore),
+		fmt.Sprintf("X-Spam-Status: %s, score=%.1f required=%.1f tests=%s", flag, r.Score, r.RequiredScore, tests),
+	}
+}
@@ -0,0 +1,96 @@
+package filter
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// return the address of a spamd test server answering with response, recording the last request
+func testSpamdServer(t *testing.T, response string) (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	requests := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			header := ""
+			length := 0
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil || line == "\r\n" {
+					break
+				}
+				header += line
+				value, found := strings.CutPrefix(line, "Content-length: ")
+				if found {
+					length, _ = strconv.Atoi(strings.TrimSpace(value))
+				}
+			}
+			body := make([]byte, length)
+			io.ReadFull(reader, body)
+			requests <- header + "\r\n" + string(body)
+			conn.Write([]byte(response))
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String(), requests
+}
+
+func TestSpamdScorer(t *testing.T) {
+	address, requests := testSpamdServer(t, "SPAMD/1.1 0 EX_OK\r\nContent-length: 22\r\nSpam: False ; 7.2 / 5.0\r\n\r\nBAYES_50,MISSING_DATE\r\n")
+	options := map[string]any{
+		"scorer":        "spamassassin",
+		"spamd_address": address,
+		"spamd_user":    "filter",
+	}
+	data := []string{
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	var output strings.Builder
+	f := newTestFilter(t, options, messageInput(data), &output)
+	f.Run()
+	request := <-requests
+	require.Equal(t, "SYMBOLS SPAMC/1.5\r\nContent-length: 36\r\nUser: filter\r\n\r\nTo: touser@localdomain.ext\r\n\r\nbody\r\n", request)
+	lines := filteredLines(t, output.String())
+	require.Contains(t, lines, "X-Spam-Score: 7.20 / 5.00")
+	require.Contains(t, lines, "X-Spam-Status: No, score=7.2 required=5.0 tests=BAYES_50,MISSING_DATE")
+	require.Contains(t, lines, "X-Spam-Class: suspected_spam")
+	require.Equal(t, int64(1), f.Counter(COUNTER_SCANNED))
+}
+
+func TestSpamdResponseErrors(t *testing.T) {
+	for _, response := range []string{
+		"SPAMD/1.1 76 Bad header line\r\n\r\n",
+		"SPAMD/1.1 0 EX_OK\r\nContent-length: 0\r\n\r\n",
+		"garbage\r\n",
+	} {
+		_, err := parseSpamdResponse(bufio.NewReader(strings.NewReader(response)))
+		require.NotNil(t, err, response)
+	}
+	result, err := parseSpamdResponse(bufio.NewReader(strings.NewReader("SPAMD/1.1 0 EX_OK\r\nSpam: True ; 15.3 / 5.0\r\n\r\n")))
+	require.Nil(t, err)
+	require.Equal(t, float32(15.3), result.Score)
+	require.Equal(t, "reject", result.Action)
+	require.Empty(t, result.Symbols)
+}
+
+func TestUnknownScorer(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"scorer": "bogofilter"})
+	_, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.NotNil(t, err)
+}
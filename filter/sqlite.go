@@ -0,0 +1,77 @@
+package filter
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+
+	"github.com/rstms/rspamd-classes/classes"
+	_ "modernc.org/sqlite"
+)
+
+const DEFAULT_SQLITE_DRIVER = "sqlite"
+const DEFAULT_SQLITE_TABLE = "spam_classes"
+
+var SQL_IDENTIFIER_PATTERN = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// class lists queried from a SQLite table with address, name and score columns
+//
+//	sqlite_database: database file or DSN
+//	sqlite_driver:   database/sql driver name, default the linked pure Go sqlite driver
+//	sqlite_table:    table holding one row per class
+type sqliteBackend struct {
+	db    *sql.DB
+	query *sql.Stmt
+}
+
+func newSQLiteBackend() (*sqliteBackend, error) {
+	ViperSetDefault("sqlite_driver", DEFAULT_SQLITE_DRIVER)
+	ViperSetDefault("sqlite_table", DEFAULT_SQLITE_TABLE)
+	database := ViperGetString("sqlite_database")
+	if database == "" {
+		return nil, fmt.Errorf("sqlite_database is required for the sqlite class backend")
+	}
+	table := ViperGetString("sqlite_table")
+	if !SQL_IDENTIFIER_PATTERN.MatchString(table) {
+		return nil, fmt.Errorf("invalid sqlite_table: '%s'", table)
+	}
+	db, err := sql.Open(ViperGetString("sqlite_driver"), database)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening %s: %v", database, err)
+	}
+	query, err := db.Prepare(fmt.Sprintf("SELECT name, score FROM %s WHERE address = ? ORDER BY score", table))
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed preparing class query on %s: %v", database, err)
+	}
+	// drivers may defer statement errors such as a missing table to the first query
+	rows, err := query.Query("")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed querying %s in %s: %v", table, database, err)
+	}
+	rows.Close()
+	return &sqliteBackend{db: db, query: query}, nil
+}
+
+func (s *sqliteBackend) Lookup(address string) ([]classes.SpamClass, bool, error) {
+	rows, err := s.query.Query(address)
+	if err != nil {
+		return nil, false, fmt.Errorf("class query failed: %v", err)
+	}
+	defer rows.Close()
+	classList := []classes.SpamClass{}
+	for rows.Next() {
+		var class classes.SpamClass
+		err := rows.Scan(&class.Name, &class.Score)
+		if err != nil {
+			return nil, false, fmt.Errorf("class query failed: %v", err)
+		}
+		classList = append(classList, class)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, false, fmt.Errorf("class query failed: %v", err)
+	}
+	return classList, len(classList) > 0, nil
+}
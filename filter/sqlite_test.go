@@ -0,0 +1,62 @@
+package filter
+
+import (
+	"database/sql"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// return the path of a sqlite class database holding rows of address, name and score
+func testSQLiteDatabase(t *testing.T, rows [][]any) (string, *sql.DB) {
+	filename := filepath.Join(t.TempDir(), "classes.db")
+	db, err := sql.Open(DEFAULT_SQLITE_DRIVER, filename)
+	require.Nil(t, err)
+	t.Cleanup(func() { db.Close() })
+	_, err = db.Exec("CREATE TABLE spam_classes (address TEXT, name TEXT, score REAL)")
+	require.Nil(t, err)
+	for _, row := range rows {
+		_, err = db.Exec("INSERT INTO spam_classes (address, name, score) VALUES (?, ?, ?)", row...)
+		require.Nil(t, err)
+	}
+	return filename, db
+}
+
+func TestSQLiteBackend(t *testing.T) {
+	database, db := testSQLiteDatabase(t, [][]any{
+		{"touser@localdomain.ext", "sql_probable", 8.0},
+		{"touser@localdomain.ext", "sql_ham", 4.0},
+	})
+	options := map[string]any{
+		"class_config_backend": "sqlite",
+		"sqlite_database":      database,
+	}
+	f := newTestFilter(t, options, "", io.Discard)
+	require.Equal(t, "sql_ham", f.getClass([]string{"touser@localdomain.ext"}, 1.155))
+	require.Equal(t, "sql_probable", f.getClass([]string{"touser@localdomain.ext"}, 7.2))
+	require.Equal(t, "spam", f.getClass([]string{"touser@localdomain.ext"}, 8))
+	require.Equal(t, "possible", f.getClass([]string{"username@example.org"}, 1.155))
+
+	// lookups are cached
+	_, err := db.Exec("DELETE FROM spam_classes")
+	require.Nil(t, err)
+	require.Equal(t, "sql_ham", f.getClass([]string{"touser@localdomain.ext"}, 1.155))
+}
+
+func TestSQLiteBackendConfig(t *testing.T) {
+	database, _ := testSQLiteDatabase(t, nil)
+	for _, options := range []map[string]any{
+		{"class_config_backend": "sqlite"},
+		{"class_config_backend": "sqlite", "sqlite_database": database, "sqlite_table": "classes; DROP TABLE x"},
+		{"class_config_backend": "sqlite", "sqlite_database": database, "sqlite_table": "missing_table"},
+		{"class_config_backend": "sqlite", "sqlite_driver": "not-linked", "sqlite_database": database},
+	} {
+		Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+		setTestOptions(t, options)
+		_, err := NewFilter(strings.NewReader(""), io.Discard)
+		require.NotNil(t, err, options)
+	}
+}
@@ -0,0 +1,85 @@
+package filter
+
+import (
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/spf13/viper"
+)
+
+// strict mode shifts all class thresholds down by strict_mode_delta during a spam wave
+//
+//	strict_mode_delta: score added to every message while strict mode is active
+//	strict_mode_file:  strict mode is active while this control file exists
+//
+// SIGUSR1 toggles strict mode at runtime
+type strictMode struct {
+	delta  float32
+	file   string
+	active atomic.Uint32
+}
+
+func newStrictMode() *strictMode {
+	delta := float32(viper.GetFloat64(ViperKey("strict_mode_delta")))
+	if delta == 0 {
+		return nil
+	}
+	return &strictMode{delta: delta, file: ViperGetString("strict_mode_file")}
+}
+
+// enable or disable strict mode
+func (f *Filter) SetStrictMode(enabled bool) {
+	if f.strict == nil {
+		Warning("%s: strict_mode_delta is not configured; ignoring strict mode change", f.Name)
+		return
+	}
+	var delta float32
+	if enabled {
+		delta = f.strict.delta
+	}
+	f.strict.active.Store(math.Float32bits(delta))
+	log.Printf("%s: strict mode enabled=%v delta=%v\n", f.Name, enabled, delta)
+}
+
+// return the score adjustment currently in effect
+func (f *Filter) strictDelta() float32 {
+	if f.strict == nil {
+		return 0
+	}
+	delta := math.Float32frombits(f.strict.active.Load())
+	if delta == 0 && f.strict.file != "" {
+		_, err := os.Stat(f.strict.file)
+		if err == nil {
+			delta = f.strict.delta
+		}
+	}
+	return delta
+}
+
+// toggle strict mode on SIGUSR1 until the returned stop function is called
+func (f *Filter) watchStrictSignal() func() {
+	if f.strict == nil {
+		return func() {}
+	}
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for {
+			select {
+			case <-signals:
+				f.SetStrictMode(f.strict.active.Load() == 0)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
@@ -0,0 +1,55 @@
+package filter
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStrictMode(t *testing.T) {
+	control := filepath.Join(t.TempDir(), "strict")
+	options := map[string]any{"strict_mode_delta": 5, "strict_mode_file": control}
+	data := []string{
+		"X-Spam-Score: 7.2 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	classify := func(toggle func(f *Filter)) []string {
+		var output strings.Builder
+		f := newTestFilter(t, options, messageInput(data), &output)
+		toggle(f)
+		f.Run()
+		return filteredLines(t, output.String())
+	}
+	require.Contains(t, classify(func(f *Filter) {}), "X-Spam-Class: suspected_spam")
+
+	// toggled on, the delta promotes the message to spam
+	require.Contains(t, classify(func(f *Filter) { f.SetStrictMode(true) }), "X-Spam-Class: spam")
+
+	// toggled off again, classification reverts
+	require.Contains(t, classify(func(f *Filter) {
+		f.SetStrictMode(true)
+		f.SetStrictMode(false)
+	}), "X-Spam-Class: suspected_spam")
+
+	// the control file enables strict mode while it exists
+	require.Nil(t, os.WriteFile(control, []byte{}, 0600))
+	require.Contains(t, classify(func(f *Filter) {}), "X-Spam-Class: spam")
+	require.Nil(t, os.Remove(control))
+	require.Contains(t, classify(func(f *Filter) {}), "X-Spam-Class: suspected_spam")
+}
+
+func TestStrictModeSignal(t *testing.T) {
+	f := newTestFilter(t, map[string]any{"strict_mode_delta": 5}, "", nil)
+	stop := f.watchStrictSignal()
+	defer stop()
+	require.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGUSR1))
+	require.Eventually(t, func() bool { return f.strictDelta() == 5 }, time.Second, time.Millisecond)
+	require.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGUSR1))
+	require.Eventually(t, func() bool { return f.strictDelta() == 0 }, time.Second, time.Millisecond)
+}
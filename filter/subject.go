@@ -0,0 +1,79 @@
+package filter
+
+import (
+	"log"
+	"mime"
+	"strings"
+)
+
+// return the configured Subject prefix for each class, from option subject_tags
+func newSubjectTags() map[string]string {
+	tags := make(map[string]string)
+	for class, tag := range ViperGetStringMapString("subject_tags") {
+		if strings.TrimSpace(tag) == "" {
+			continue
+		}
+		tag, _ = sanitizeHeaderValue(tag)
+		if !strings.HasSuffix(tag, " ") {
+			tag += " "
+		}
+		tags[class] = tag
+	}
+	return tags
+}
+
+// encode a subject tag for insertion before an existing header value
+//
+// non-ASCII tags become an RFC 2047 encoded word carrying the separating space, since
+// whitespace between adjacent encoded words is not displayed
+func encodeSubjectTag(tag string) string {
+	for _, c := range tag {
+		if c > 127 {
+			return mime.QEncoding.Encode("utf-8", tag) + " "
+		}
+	}
+	return tag
+}
+
+// return the decoded, unfolded value of a header spanning lines
+func decodeHeaderValue(lines []string) string {
+	_, value, _ := strings.Cut(strings.Join(lines, ""), ":")
+	value = strings.TrimSpace(value)
+	decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// return headers with the Subject prefixed by the tag configured for spamClass,
+// leaving subjects already carrying the tag unchanged
+func (f *Filter) tagSubject(name string, headers []string, spamClass string) []string {
+	tag, ok := f.subjectTags[spamClass]
+	if !ok {
+		return headers
+	}
+	for i, line := range headers {
+		header, ok := headerName(line)
+		if !ok || !strings.EqualFold(header, "subject") {
+			continue
+		}
+		end := i + 1
+		for end < len(headers) && isContinuation(headers[end]) {
+			end++
+		}
+		if strings.Contains(decodeHeaderValue(headers[i:end]), strings.TrimSpace(tag)) {
+			if f.verbose {
+				log.Printf("%s.%s: subject already tagged '%s'\n", f.Name, name, strings.TrimSpace(tag))
+			}
+			return headers
+		}
+		_, value, _ := strings.Cut(line, ":")
+		value = strings.TrimLeft(value, " \t")
+		tagged := append([]string{}, headers...)
+		tagged[i] = header + ": " + encodeSubjectTag(tag) + value
+		return tagged
+	}
+	// a message without a Subject gets one holding the tag alone
+	return append(headers, f.formatHeader("Subject", strings.TrimSpace(encodeSubjectTag(tag))))
+}
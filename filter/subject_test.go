@@ -0,0 +1,38 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubjectTags(t *testing.T) {
+	options := map[string]any{"subject_tags": map[string]string{"spam": "[SPAM]", "suspected_spam": "[POSSIBLE SPAM] "}}
+	subject := func(score, line string, more ...string) []string {
+		data := []string{"X-Spam-Score: " + score + " / 100", "To: touser@localdomain.ext", line}
+		data = append(data, more...)
+		return filterMessage(t, options, append(data, "", "body"))
+	}
+	require.Contains(t, subject("50", "Subject: buy now"), "Subject: [SPAM] buy now")
+	require.Contains(t, subject("7.2", "Subject: buy now"), "Subject: [POSSIBLE SPAM] buy now")
+	require.Contains(t, subject("1.155", "Subject: buy now"), "Subject: buy now")
+
+	// already tagged subjects, including encoded ones, are not tagged again
+	require.Contains(t, subject("50", "Subject: Re: [SPAM] buy now"), "Subject: Re: [SPAM] buy now")
+	require.Contains(t, subject("50", "Subject: =?UTF-8?Q?[SPAM]_buy_now?="), "Subject: =?UTF-8?Q?[SPAM]_buy_now?=")
+
+	// encoded and folded subjects keep their encoding and continuation lines
+	require.Contains(t, subject("50", "Subject: =?UTF-8?B?w6lsw6h2ZQ==?="), "Subject: [SPAM] =?UTF-8?B?w6lsw6h2ZQ==?=")
+	output := subject("50", "Subject: first", "  second")
+	require.Contains(t, output, "Subject: [SPAM] first")
+	require.Contains(t, output, "  second")
+
+	// a missing subject is added
+	require.Contains(t, subject("50", "From: fromuser@example.org"), "Subject: [SPAM]")
+}
+
+func TestSubjectTagEncoding(t *testing.T) {
+	require.Equal(t, "[SPAM] ", encodeSubjectTag("[SPAM] "))
+	require.Equal(t, "=?utf-8?q?[Ind=C3=A9sirable]_?= ", encodeSubjectTag("[Indésirable] "))
+	require.Equal(t, "élève", decodeHeaderValue([]string{"Subject: =?UTF-8?B?w6lsw6h2ZQ==?="}))
+}
@@ -0,0 +1,103 @@
+package filter
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+const TRUSTED_ACTION_SKIP = "skip"
+const TRUSTED_ACTION_CLASS = "class"
+
+const DEFAULT_TRUSTED_CLASS = "ham"
+
+const COUNTER_TRUSTED = "trusted"
+
+// client networks whose messages are never junked
+//
+//	trusted_networks:       list of CIDR ranges or addresses matched against the session remote address
+//	trusted_network_action: skip (pass messages unclassified) or class (force trusted_network_class)
+//	trusted_network_class:  class assigned to trusted messages, default DEFAULT_TRUSTED_CLASS
+//
+// trusted clients are also exempt from DNSBL and reputation rejection
+type trustedNetworks struct {
+	Networks []*net.IPNet
+	Action   string
+	Class    string
+}
+
+func newTrustedNetworks() (*trustedNetworks, error) {
+	entries := ViperGetStringSlice("trusted_networks")
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	ViperSetDefault("trusted_network_action", TRUSTED_ACTION_SKIP)
+	ViperSetDefault("trusted_network_class", DEFAULT_TRUSTED_CLASS)
+	t := trustedNetworks{
+		Networks: []*net.IPNet{},
+		Action:   strings.ToLower(ViperGetString("trusted_network_action")),
+		Class:    ViperGetString("trusted_network_class"),
+	}
+	switch t.Action {
+	case TRUSTED_ACTION_SKIP, TRUSTED_ACTION_CLASS:
+	default:
+		return nil, fmt.Errorf("unknown trusted_network_action: %s", t.Action)
+	}
+	for _, entry := range entries {
+		network, err := parseNetwork(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted_networks entry: %v", err)
+		}
+		t.Networks = append(t.Networks, network)
+	}
+	return &t, nil
+}
+
+// parse a CIDR range or a single address as a host network
+func parseNetwork(entry string) (*net.IPNet, error) {
+	if !strings.Contains(entry, "/") {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address: '%s'", entry)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			bits = 32
+		}
+		entry = fmt.Sprintf("%s/%d", entry, bits)
+	}
+	_, network, err := net.ParseCIDR(entry)
+	return network, err
+}
+
+// true if the session's client address is in a trusted network
+func (f *Filter) isTrusted(session *Session) bool {
+	if f.trusted == nil || session == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(session.Remote)
+	if err != nil {
+		host = session.Remote
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range f.trusted.Networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// return true if a trusted session's message should pass unclassified
+func (f *Filter) trustedSkip(name string, session *Session) bool {
+	if f.trusted.Action != TRUSTED_ACTION_SKIP || !f.isTrusted(session) {
+		return false
+	}
+	f.count(COUNTER_TRUSTED)
+	log.Printf("%s.%s: trusted client %s; passing message unclassified\n", f.Name, name, session.Remote)
+	return true
+}
@@ -0,0 +1,62 @@
+package filter
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustedNetworkSkip(t *testing.T) {
+	data := []string{
+		"X-Spam-Score: 50 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	output := filterMessage(t, map[string]any{"trusted_networks": []string{"10.0.0.0/8"}}, data)
+	require.Contains(t, output, "X-Spam-Class: spam")
+
+	output = filterMessage(t, map[string]any{"trusted_networks": []string{"10.0.0.0/8", "1.2.3.0/24"}}, data)
+	require.NotContains(t, output, "X-Spam-Class: spam")
+	require.Contains(t, output, "X-Spam-Score: 50 / 100")
+}
+
+func TestTrustedNetworkClass(t *testing.T) {
+	options := map[string]any{
+		"trusted_networks":       []string{"1.2.3.4"},
+		"trusted_network_action": "class",
+		"trusted_network_class":  "not_spam",
+	}
+	data := []string{
+		"X-Spam-Score: 50 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	output := filterMessage(t, options, data)
+	require.Contains(t, output, "X-Spam-Class: not_spam")
+	require.Contains(t, output, "X-Spam: no")
+}
+
+func TestTrustedNetworkInvalid(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"trusted_networks": []string{"10.0.0.0/33"}})
+	_, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.NotNil(t, err)
+}
+
+func TestTrustedNetworkDNSBLExempt(t *testing.T) {
+	options := map[string]any{
+		"trusted_networks": []string{"1.2.3.0/24"},
+		"dnsbl_zones":      []map[string]any{{"zone": "zen.example.net"}},
+		"dnsbl_action":     "reject",
+	}
+	var output strings.Builder
+	f := newTestFilter(t, options, connectInput([]string{"To: touser@localdomain.ext", ""}), &output)
+	f.dnsbl.lookup = testDNSBLLookup(map[string]string{"4.3.2.1.zen.example.net": "127.0.0.2"})
+	f.Run()
+	require.Contains(t, output.String(), "filter-result|deadbeef|f00dface|proceed\n")
+}
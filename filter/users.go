@@ -0,0 +1,29 @@
+package filter
+
+import (
+	"log"
+	"strings"
+)
+
+// return the class selected by the users entry for the session's authenticated user
+//
+// users entries apply to submission sessions and take precedence over sender and
+// recipient class tables
+func (f *Filter) userClass(name string, session *Session, score float32) (string, bool) {
+	if session.AuthorizedUser == "" {
+		return "", false
+	}
+	users := f.getSection(USERS_KEY)
+	if users == nil {
+		return "", false
+	}
+	list, ok := users.Classes[strings.ToLower(session.AuthorizedUser)]
+	if !ok {
+		return "", false
+	}
+	spamClass := f.scoreClass(list, score)
+	if f.verbose {
+		log.Printf("%s.%s: users entry %s selects class '%s'\n", f.Name, name, session.AuthorizedUser, spamClass)
+	}
+	return spamClass, true
+}
@@ -0,0 +1,53 @@
+package filter
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserClasses(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "classes.json")
+	writeTestClasses(t, filename, `{
+    "touser@localdomain.ext": [{"name": "recipient", "score": 50}],
+    "users": {
+	"AuthUser": [{"name": "outbound_ok", "score": 2}, {"name": "outbound_hold", "score": 50}]
+    },
+    "senders": {
+	"fromuser@example.org": [{"name": "sender", "score": 50}]
+    }
+}`)
+	require.Nil(t, validateClassConfig(filename))
+	data := []string{
+		"X-Spam-Score: 1.155 / 100",
+		"To: touser@localdomain.ext",
+		"",
+		"body",
+	}
+	options := map[string]any{"class_config_file": filename, "emit_reason_header": true}
+	output := filterMessage(t, options, data)
+	require.Contains(t, output, "X-Spam-Class: outbound_ok")
+	require.Contains(t, output, "X-Spam-Class-Reason: reason=auth_user")
+
+	data[0] = "X-Spam-Score: 4 / 100"
+	output = filterMessage(t, options, data)
+	require.Contains(t, output, "X-Spam-Class: outbound_hold")
+
+	// other authenticated users fall through to the sender table
+	data[0] = "X-Spam-Score: 1.155 / 100"
+	var out strings.Builder
+	input := strings.Replace(messageInput(data), "|link-auth|deadbeef|pass|authuser", "|link-auth|deadbeef|pass|someone", 1)
+	f := newTestFilter(t, options, input, &out)
+	f.Run()
+	require.Contains(t, filteredLines(t, out.String()), "X-Spam-Class: sender")
+}
+
+func TestUserClassesInvalid(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "classes.json")
+	writeTestClasses(t, filename, `{"users": {"authuser": []}}`)
+	require.NotNil(t, validateClassConfig(filename))
+	writeTestClasses(t, filename, `{"users": {"": [{"name": "ham", "score": 5}]}}`)
+	require.NotNil(t, validateClassConfig(filename))
+}
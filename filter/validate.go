@@ -0,0 +1,271 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/rstms/rspamd-classes/classes"
+)
+
+const PROBLEM_EMPTY_LIST = "empty class list"
+
+// an invalid class config entry
+//
+// Index is the position of the invalid class in the entry's list, or -1 when the whole
+// entry is invalid; Line is 0 when the file is not JSON
+type configProblem struct {
+	Section string
+	Key     string
+	Index   int
+	Line    int
+	Message string
+}
+
+// return the config path of the problem entry, e.g. "senders.a@example.org[1]"
+func (p configProblem) path() string {
+	path := p.Key
+	if p.Section != "" {
+		path = p.Section + "." + path
+	}
+	if p.Index >= 0 {
+		path += fmt.Sprintf("[%d]", p.Index)
+	}
+	return path
+}
+
+func (p configProblem) format(filename string) string {
+	if p.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s: %s", filename, p.Line, p.path(), p.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", filename, p.path(), p.Message)
+}
+
+// return every invalid entry in a class config, in file order;
+// the error is set only when the config cannot be parsed at all
+func classConfigProblems(filename string) ([]configProblem, error) {
+	config, err := readClassConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+	return config.Problems, nil
+}
+
+// return every invalid entry in the parsed recipient tables and sections of a class config,
+// ordered by the line of each entry in lines
+func configProblems(filename string, data []byte, sections map[string]json.RawMessage, lines map[string]int) ([]configProblem, error) {
+	problems := []configProblem{}
+	config := map[string][]classes.SpamClass{}
+	err := json.Unmarshal(data, &config)
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing %s: %v", filename, err)
+	}
+	regexKeys, err := classRegexKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing %s: %v", filename, err)
+	}
+	regex := make(map[string]bool)
+	for _, key := range regexKeys {
+		regex[key] = true
+	}
+	for key, list := range config {
+		switch {
+		case regex[key]:
+			_, err := regexp.Compile(key)
+			if err != nil {
+				problems = append(problems, configProblem{Key: key, Index: -1, Message: fmt.Sprintf("invalid regex: %v", err)})
+				continue
+			}
+		case key != classes.DEFAULT_NAME && !EMAIL_ADDRESS_PATTERN.MatchString(key) && !DOMAIN_KEY_PATTERN.MatchString(key):
+			problems = append(problems, configProblem{Key: key, Index: -1, Message: "invalid address"})
+			continue
+		}
+		problems = append(problems, classListProblems("", key, list)...)
+	}
+	for _, name := range CLASS_CONFIG_SECTIONS {
+		config, err := parseSectionConfig(name, sections[name])
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing %s: %v", filename, err)
+		}
+		for key, list := range config {
+			switch {
+			case key == "":
+				problems = append(problems, configProblem{Section: name, Key: key, Index: -1, Message: "empty key"})
+				continue
+			case name == SENDERS_KEY && !EMAIL_ADDRESS_PATTERN.MatchString(key) && !DOMAIN_KEY_PATTERN.MatchString(key):
+				problems = append(problems, configProblem{Section: name, Key: key, Index: -1, Message: "invalid address"})
+				continue
+			}
+			problems = append(problems, classListProblems(name, key, list)...)
+		}
+	}
+	for i := range problems {
+		problems[i].Line = lines[problems[i].path()]
+	}
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].Line != problems[j].Line {
+			return problems[i].Line < problems[j].Line
+		}
+		return problems[i].path() < problems[j].path()
+	})
+	return problems, nil
+}
+
+// return a problem for each class in list the classes library would silently repair or drop
+func classListProblems(section, key string, list []classes.SpamClass) []configProblem {
+	if len(list) == 0 {
+		return []configProblem{{Section: section, Key: key, Index: -1, Message: PROBLEM_EMPTY_LIST}}
+	}
+	problems := []configProblem{}
+	names := make(map[string]bool)
+	scores := make(map[float32]bool)
+	for i, class := range list {
+		var message string
+		switch {
+		case class.Name == "":
+			message = "empty class name"
+		case math.IsNaN(float64(class.Score)) || math.IsInf(float64(class.Score), 0):
+			message = "invalid score"
+		case names[class.Name]:
+			message = fmt.Sprintf("duplicate class name '%s'", class.Name)
+		case scores[class.Score]:
+			message = fmt.Sprintf("duplicate score %v", class.Score)
+		}
+		if message != "" {
+			problems = append(problems, configProblem{Section: section, Key: key, Index: i, Message: message})
+			continue
+		}
+		names[class.Name] = true
+		scores[class.Score] = true
+	}
+	return problems
+}
+
+// remove the entries and classes of a config section named by problems
+func skipInvalid(section string, config map[string][]classes.SpamClass, problems []configProblem) {
+	skipped := make(map[string]map[int]bool)
+	for _, problem := range problems {
+		if problem.Section != section {
+			continue
+		}
+		if problem.Index < 0 {
+			delete(config, problem.Key)
+			continue
+		}
+		if skipped[problem.Key] == nil {
+			skipped[problem.Key] = make(map[int]bool)
+		}
+		skipped[problem.Key][problem.Index] = true
+	}
+	for key, indexes := range skipped {
+		list, ok := config[key]
+		if !ok {
+			continue
+		}
+		valid := []classes.SpamClass{}
+		for i, class := range list {
+			if !indexes[i] {
+				valid = append(valid, class)
+			}
+		}
+		config[key] = valid
+	}
+}
+
+// return the config problems as a single error
+func joinProblems(filename string, problems []configProblem) error {
+	errs := []error{}
+	for _, problem := range problems {
+		errs = append(errs, errors.New(problem.format(filename)))
+	}
+	return errors.Join(errs...)
+}
+
+// return the line of each entry and class in a JSON class config file, keyed by config path
+func jsonLines(data []byte) map[string]int {
+	lines := make(map[string]int)
+	// the decoder offset is the end of the previous token; count lines to the start of the next
+	line := func(offset int64) int {
+		for offset < int64(len(data)) && strings.ContainsRune(" \t\r\n,:", rune(data[offset])) {
+			offset++
+		}
+		return bytes.Count(data[:offset], []byte("\n")) + 1
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// walk an object of class lists, recording each key and list item under prefix
+	var walkObject func(prefix string, sections bool) bool
+	walkList := func(path string) bool {
+		token, err := decoder.Token()
+		if err != nil {
+			return false
+		}
+		if token != json.Delim('[') {
+			return skipValue(decoder, token)
+		}
+		for i := 0; decoder.More(); i++ {
+			lines[fmt.Sprintf("%s[%d]", path, i)] = line(decoder.InputOffset())
+			var item json.RawMessage
+			if decoder.Decode(&item) != nil {
+				return false
+			}
+		}
+		_, err = decoder.Token()
+		return err == nil
+	}
+	walkObject = func(prefix string, sections bool) bool {
+		token, err := decoder.Token()
+		if err != nil || token != json.Delim('{') {
+			return false
+		}
+		for decoder.More() {
+			token, err := decoder.Token()
+			if err != nil {
+				return false
+			}
+			key, _ := token.(string)
+			path := prefix + key
+			lines[path] = line(decoder.InputOffset())
+			var ok bool
+			if sections && slices.Contains(CLASS_CONFIG_SECTIONS, key) {
+				ok = walkObject(key+".", false)
+			} else {
+				ok = walkList(path)
+			}
+			if !ok {
+				return false
+			}
+		}
+		_, err = decoder.Token()
+		return err == nil
+	}
+	walkObject("", true)
+	return lines
+}
+
+// consume the remainder of a JSON value whose first token has been read
+func skipValue(decoder *json.Decoder, token json.Token) bool {
+	delim, ok := token.(json.Delim)
+	if !ok || delim == ']' || delim == '}' {
+		return true
+	}
+	for depth := 1; depth > 0; {
+		token, err := decoder.Token()
+		if err != nil {
+			return false
+		}
+		switch token {
+		case json.Delim('['), json.Delim('{'):
+			depth++
+		case json.Delim(']'), json.Delim('}'):
+			depth--
+		}
+	}
+	return true
+}
@@ -0,0 +1,78 @@
+package filter
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testInvalidClasses = `{
+    "touser@localdomain.ext": [
+	{ "name": "low", "score": 1 },
+	{ "name": "", "score": 2 },
+	{ "name": "low", "score": 3 },
+	{ "name": "high", "score": 50 }
+    ],
+    "not an address": [{ "name": "low", "score": 1 }],
+    "username@example.org": [{ "name": "valid", "score": 50 }],
+    "senders": {
+	"bulk.example.com": [{ "name": "bulk", "score": 5 }],
+	"@bulk.example.com": [{ "name": "bulk", "score": 5 }, { "name": "bulk", "score": 6 }]
+    }
+}`
+
+func TestClassConfigProblems(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	filename := filepath.Join(t.TempDir(), "classes.json")
+	writeTestClasses(t, filename, testInvalidClasses)
+	problems, err := classConfigProblems(filename)
+	require.Nil(t, err)
+	reported := []string{}
+	for _, problem := range problems {
+		reported = append(reported, strings.TrimPrefix(problem.format(filename), filename+":"))
+	}
+	require.Equal(t, []string{
+		"4: touser@localdomain.ext[1]: empty class name",
+		"5: touser@localdomain.ext[2]: duplicate class name 'low'",
+		"8: not an address: invalid address",
+		"11: senders.bulk.example.com: invalid address",
+		"12: senders.@bulk.example.com[1]: duplicate class name 'bulk'",
+	}, reported)
+
+	// every problem is reported by validation
+	err = validateClassConfig(filename)
+	require.NotNil(t, err)
+	require.Equal(t, len(problems), len(strings.Split(err.Error(), "\n")))
+}
+
+func TestClassConfigSkipsInvalidEntries(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "classes.json")
+	writeTestClasses(t, filename, testInvalidClasses)
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"class_config_file": filename})
+	log := captureLog(t)
+	f, err := NewFilter(strings.NewReader(""), io.Discard)
+	require.Nil(t, err)
+	require.Contains(t, log.String(), filename+":4: touser@localdomain.ext[1]: empty class name")
+	require.Contains(t, log.String(), filename+":8: not an address: invalid address")
+
+	// valid classes of a partly invalid entry are kept
+	require.Equal(t, "low", f.getClass([]string{"touser@localdomain.ext"}, 0.5))
+	require.Equal(t, "high", f.getClass([]string{"touser@localdomain.ext"}, 3))
+	require.Equal(t, "valid", f.getClass([]string{"username@example.org"}, 1.155))
+	require.NotContains(t, f.getClasses().Classes, "not an address")
+	senders := f.getSection(SENDERS_KEY)
+	require.NotContains(t, senders.Classes, "bulk.example.com")
+	require.Equal(t, "bulk", f.scoreClass(senders.Classes["@bulk.example.com"], 4))
+	require.Len(t, senders.Classes["@bulk.example.com"], 2)
+
+	// YAML problems are reported without line numbers
+	yamlFile := filepath.Join(t.TempDir(), "classes.yaml")
+	writeTestClasses(t, yamlFile, "touser@localdomain.ext:\n  - name: \"\"\n    score: 2\n")
+	problems, err := classConfigProblems(yamlFile)
+	require.Nil(t, err)
+	require.Equal(t, []string{yamlFile + ": touser@localdomain.ext[0]: empty class name"}, []string{problems[0].format(yamlFile)})
+}
@@ -0,0 +1,68 @@
+package filter
+
+import (
+	"log"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// request a class config reload when the class config file changes until the returned stop function is called
+//
+// the containing directory is watched so that editors replacing the file by rename are detected;
+// for a class_config_dir, changes to any *.json fragment are reloaded
+func (f *Filter) watchClassConfig() func() {
+	if !f.reloadPolicy.Watch || f.classConfigFile == "" {
+		return func() {}
+	}
+	filename, err := filepath.Abs(f.classConfigFile)
+	if err != nil {
+		Warning("%s: reload_watch disabled: %v", f.Name, err)
+		return func() {}
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		Warning("%s: reload_watch disabled: %v", f.Name, err)
+		return func() {}
+	}
+	isDir := IsDir(filename)
+	dir := filepath.Dir(filename)
+	if isDir {
+		dir = filename
+	}
+	err = watcher.Add(dir)
+	if err != nil {
+		watcher.Close()
+		Warning("%s: reload_watch disabled: %v", f.Name, err)
+		return func() {}
+	}
+	log.Printf("%s: watching %s for changes\n", f.Name, filename)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				changed := event.Name == filename
+				if isDir {
+					changed = filepath.Dir(event.Name) == filename && filepath.Ext(event.Name) == ".json"
+				}
+				if changed && event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) {
+					f.RequestReload()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				Warning("%s: class config watch failed: %v", f.Name, err)
+			}
+		}
+	}()
+	return func() {
+		watcher.Close()
+		<-done
+	}
+}
@@ -0,0 +1,46 @@
+package filter
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchClassConfig(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "classes.json")
+	writeTestClasses(t, filename, testReloadClasses)
+	f := newTestFilter(t, map[string]any{"class_config_file": filename, "reload_debounce": "10ms", "reload_watch": true}, "", io.Discard)
+	stop := f.watchClassConfig()
+	defer stop()
+
+	writeTestClasses(t, filename, `{"touser@localdomain.ext": [{"name": "watched", "score": 1}]}`)
+	require.Eventually(t, func() bool { return f.Counter(COUNTER_RELOADED) == 1 }, 2*time.Second, time.Millisecond)
+	require.Equal(t, "watched", f.getClasses().GetClass([]string{"touser@localdomain.ext"}, 0))
+
+	// a parse error keeps the previous config
+	writeTestClasses(t, filename, testReloadBadClasses)
+	require.Eventually(t, func() bool { return f.Counter(COUNTER_RELOAD_FAILED) > 0 }, 2*time.Second, time.Millisecond)
+	require.Equal(t, "watched", f.getClasses().GetClass([]string{"touser@localdomain.ext"}, 0))
+
+	// replacing the file by rename is detected
+	replacement := filepath.Join(filepath.Dir(filename), "classes.tmp")
+	writeTestClasses(t, replacement, `{"touser@localdomain.ext": [{"name": "renamed", "score": 1}]}`)
+	require.Nil(t, os.Rename(replacement, filename))
+	require.Eventually(t, func() bool { return f.getClasses().GetClass([]string{"touser@localdomain.ext"}, 0) == "renamed" }, 2*time.Second, time.Millisecond)
+}
+
+func TestWatchClassConfigDisabled(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "classes.json")
+	writeTestClasses(t, filename, testReloadClasses)
+	f := newTestFilter(t, map[string]any{"class_config_file": filename, "reload_debounce": "1ms", "reload_watch": false}, "", io.Discard)
+	stop := f.watchClassConfig()
+	defer stop()
+
+	writeTestClasses(t, filename, `{"touser@localdomain.ext": [{"name": "watched", "score": 1}]}`)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int64(0), f.Counter(COUNTER_RELOADED))
+}
@@ -0,0 +1,278 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const DEFAULT_WEBHOOK_TIMEOUT = "5s"
+const DEFAULT_WEBHOOK_BACKOFF = "30s"
+const DEFAULT_WEBHOOK_MAX_BACKOFF = "10m"
+const MAX_WEBHOOK_RESPONSE_BYTES = 64 * 1024
+
+var DEFAULT_WEBHOOK_HEADERS = []string{"From", "To", "Subject", "Date", "Message-Id"}
+
+const COUNTER_WEBHOOK_OVERRIDES = "webhook_overrides"
+const COUNTER_WEBHOOK_FAILED = "webhook_failed"
+const COUNTER_WEBHOOK_SKIPPED = "webhook_skipped"
+
+// an external policy engine consulted for each classified message
+//
+//	policy_webhook_url:         URL the message summary is posted to as JSON; disabled when unset
+//	policy_webhook_timeout:     HTTP request timeout, default DEFAULT_WEBHOOK_TIMEOUT
+//	policy_webhook_headers:     message headers included in the summary, default DEFAULT_WEBHOOK_HEADERS
+//	policy_webhook_token:       optional bearer token sent in the Authorization header
+//	policy_webhook_backoff:     time the webhook is not consulted after a failure, doubling with
+//	                            each further failure, default DEFAULT_WEBHOOK_BACKOFF
+//	policy_webhook_max_backoff: limit of the doubled backoff, default DEFAULT_WEBHOOK_MAX_BACKOFF
+//
+// a 200 response may return a PolicyResponse replacing the class or action the filter chose;
+// a 204 response, empty fields or a failed request keep the filter's decision; the request
+// is made off the protocol loop, holding the message's output and commit decision until it
+// returns, and the backoff keeps a failing webhook from delaying every message
+type PolicyWebhook struct {
+	URL        string
+	Headers    []string
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	token      string
+	client     *http.Client
+	failures   int
+	suspended  time.Time
+}
+
+// the message summary posted to the policy webhook
+type PolicyRequest struct {
+	Session       string              `json:"session"`
+	Message       string              `json:"message"`
+	Remote        string              `json:"remote"`
+	RDNS          string              `json:"rdns"`
+	FCrDNS        bool                `json:"fcrdns"`
+	Helo          string              `json:"helo"`
+	AuthUser      string              `json:"auth_user"`
+	Country       string              `json:"country,omitempty"`
+	EnvelopeFrom  []string            `json:"envelope_from"`
+	EnvelopeTo    []string            `json:"envelope_to"`
+	Recipient     string              `json:"recipient"`
+	Score         float32             `json:"score"`
+	OriginalScore float32             `json:"original_score"`
+	Class         string              `json:"class"`
+	Reason        string              `json:"reason"`
+	Symbols       []string            `json:"symbols"`
+	AuthResults   []string            `json:"auth_results"`
+	Virus         string              `json:"virus,omitempty"`
+	Headers       map[string][]string `json:"headers"`
+}
+
+// the policy webhook's decision; empty fields keep the filter's choice
+type PolicyResponse struct {
+	Class  string `json:"class"`
+	Action string `json:"action"`
+}
+
+func newPolicyWebhook() (*PolicyWebhook, error) {
+	webhookURL := ViperGetString("policy_webhook_url")
+	if webhookURL == "" {
+		return nil, nil
+	}
+	parsed, err := url.Parse(webhookURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return nil, fmt.Errorf("invalid policy_webhook_url: '%s'", webhookURL)
+	}
+	ViperSetDefault("policy_webhook_timeout", DEFAULT_WEBHOOK_TIMEOUT)
+	ViperSetDefault("policy_webhook_headers", DEFAULT_WEBHOOK_HEADERS)
+	ViperSetDefault("policy_webhook_backoff", DEFAULT_WEBHOOK_BACKOFF)
+	ViperSetDefault("policy_webhook_max_backoff", DEFAULT_WEBHOOK_MAX_BACKOFF)
+	durations := map[string]time.Duration{}
+	for _, key := range []string{"policy_webhook_timeout", "policy_webhook_backoff", "policy_webhook_max_backoff"} {
+		duration, err := time.ParseDuration(ViperGetString(key))
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing %s: %v", key, err)
+		}
+		if duration < 0 {
+			return nil, fmt.Errorf("negative %s: %s", key, duration)
+		}
+		durations[key] = duration
+	}
+	w := PolicyWebhook{
+		URL:        webhookURL,
+		Backoff:    durations["policy_webhook_backoff"],
+		MaxBackoff: max(durations["policy_webhook_max_backoff"], durations["policy_webhook_backoff"]),
+		token:      ViperGetString("policy_webhook_token"),
+		client:     &http.Client{Timeout: durations["policy_webhook_timeout"]},
+	}
+	for _, header := range ViperGetStringSlice("policy_webhook_headers") {
+		w.Headers = append(w.Headers, textproto.CanonicalMIMEHeaderKey(header))
+	}
+	return &w, nil
+}
+
+// record the outcome of a webhook request, suspending requests after a failure
+func (w *PolicyWebhook) result(failed bool, now time.Time) {
+	if !failed {
+		w.failures = 0
+		return
+	}
+	backoff := w.Backoff
+	for i := 0; i < w.failures && backoff < w.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	w.failures++
+	w.suspended = now.Add(min(backoff, w.MaxBackoff))
+}
+
+// post a JSON message summary, returning the webhook's decision; safe to call off the protocol loop
+func (w *PolicyWebhook) Post(body []byte) (*PolicyResponse, error) {
+	post, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	post.Header.Set("Content-Type", "application/json")
+	if w.token != "" {
+		post.Header.Set("Authorization", "Bearer "+w.token)
+	}
+	response, err := w.client.Do(post)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(response.Body, MAX_WEBHOOK_RESPONSE_BYTES))
+	if err != nil {
+		return nil, err
+	}
+	decision := PolicyResponse{}
+	switch response.StatusCode {
+	case http.StatusNoContent:
+		return &decision, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(data)))
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return &decision, nil
+	}
+	err = json.Unmarshal(data, &decision)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing webhook response: %v", err)
+	}
+	return &decision, nil
+}
+
+// return the unfolded values of the selected headers in buffered header lines
+func selectHeaders(lines []string, names []string) map[string][]string {
+	selected := make(map[string][]string)
+	index := -1
+	current := ""
+	for _, line := range lines {
+		if isContinuation(line) {
+			if index >= 0 {
+				selected[current][index] += " " + strings.TrimSpace(line)
+			}
+			continue
+		}
+		index = -1
+		header, ok := headerName(line)
+		if !ok {
+			continue
+		}
+		current = textproto.CanonicalMIMEHeaderKey(header)
+		for _, name := range names {
+			if name == current {
+				_, value, _ := strings.Cut(line, ":")
+				selected[current] = append(selected[current], strings.TrimSpace(value))
+				index = len(selected[current]) - 1
+			}
+		}
+	}
+	return selected
+}
+
+// the output of a message held for the policy webhook
+type heldOutput struct {
+	sid   string
+	token string
+	lines []string
+}
+
+// buffer data lines written while the message is held
+func (h *heldOutput) hold(sid, token string, lines []string) {
+	h.sid, h.token = sid, token
+	h.lines = append(h.lines, lines...)
+}
+
+// return the policy webhook summary of a classified message
+func (f *Filter) policyRequest(session *Session, message *Message, headers []string, address string, score, original float32, spamClass, reason string) *PolicyRequest {
+	return &PolicyRequest{
+		Session:       session.Id,
+		Message:       message.Id,
+		Remote:        session.Remote,
+		RDNS:          session.RDNS,
+		FCrDNS:        session.Confirmed,
+		Helo:          session.Helo,
+		AuthUser:      session.AuthorizedUser,
+		Country:       session.Country,
+		EnvelopeFrom:  message.EnvelopeFrom,
+		EnvelopeTo:    message.EnvelopeTo,
+		Recipient:     address,
+		Score:         score,
+		OriginalScore: original,
+		Class:         spamClass,
+		Reason:        reason,
+		Symbols:       message.Symbols,
+		AuthResults:   message.AuthResults,
+		Virus:         message.Virus,
+		Headers:       selectHeaders(headers, f.webhook.Headers),
+	}
+}
+
+// post a message summary to the policy webhook off the protocol loop, holding the message
+// until finish has generated its headers with the decision; returns false without holding
+// the message if the webhook is suspended
+func (f *Filter) requestPolicy(name string, session *Session, message *Message, request *PolicyRequest, finish func(*PolicyResponse) []string) bool {
+	if f.now().Before(f.webhook.suspended) {
+		f.count(COUNTER_WEBHOOK_SKIPPED)
+		return false
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		Warning("%s.%s: policy webhook request failed: %v", f.Name, name, err)
+		return false
+	}
+	message.Hold = &heldOutput{}
+	message.Scanning = true
+	f.async(func() func() {
+		decision, err := f.webhook.Post(body)
+		return func() {
+			output := finish(f.policyDecision(name, decision, err))
+			hold := message.Hold
+			message.Hold = nil
+			f.writeDataLines(name, hold.sid, hold.token, session, message, append(output, hold.lines...))
+			f.releaseMessage(message)
+		}
+	})
+	return true
+}
+
+// record the outcome of a policy webhook request, returning its decision; a failed request
+// returns an empty decision
+func (f *Filter) policyDecision(name string, decision *PolicyResponse, err error) *PolicyResponse {
+	f.webhook.result(err != nil, f.now())
+	if err != nil {
+		f.count(COUNTER_WEBHOOK_FAILED)
+		Warning("%s.%s: policy webhook failed: %v; suspended until %s", f.Name, name, err, f.webhook.suspended.Format(time.RFC3339))
+		return &PolicyResponse{}
+	}
+	if decision.Class != "" || decision.Action != "" {
+		f.count(COUNTER_WEBHOOK_OVERRIDES)
+		log.Printf("%s.%s: policy webhook returned class='%s' action='%s'\n", f.Name, name, decision.Class, decision.Action)
+	}
+	return decision
+}
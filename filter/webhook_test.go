@@ -0,0 +1,200 @@
+package filter
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// return a policy webhook test server answering with status and body, recording the last request
+func testWebhookServer(t *testing.T, status int, body string) (*httptest.Server, chan *http.Request, chan PolicyRequest) {
+	requests := make(chan *http.Request, 1)
+	summaries := make(chan PolicyRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var summary PolicyRequest
+		data, _ := io.ReadAll(r.Body)
+		json.Unmarshal(data, &summary)
+		select {
+		case requests <- r:
+			summaries <- summary
+		default:
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests, summaries
+}
+
+var webhookData = []string{
+	"X-Spam-Score: 1.155 / 100",
+	"To: touser@localdomain.ext",
+	"Subject: quarterly",
+	"\treport",
+	"",
+	"body",
+}
+
+func TestPolicyWebhookSummary(t *testing.T) {
+	server, requests, summaries := testWebhookServer(t, http.StatusNoContent, "")
+	options := map[string]any{
+		"policy_webhook_url":     server.URL + "/policy",
+		"policy_webhook_token":   "secret",
+		"policy_webhook_headers": []string{"subject", "x-missing"},
+	}
+	var output strings.Builder
+	f := newTestFilter(t, options, commitInput(webhookData), &output)
+	f.Run()
+	request := <-requests
+	require.Equal(t, "/policy", request.URL.Path)
+	require.Equal(t, "Bearer secret", request.Header.Get("Authorization"))
+	require.Equal(t, "application/json", request.Header.Get("Content-Type"))
+	summary := <-summaries
+	require.Equal(t, "deadbeef", summary.Session)
+	require.Equal(t, "cafebabe", summary.Message)
+	require.Equal(t, "1.2.3.4:11223", summary.Remote)
+	require.Equal(t, "sendhost.example.org", summary.RDNS)
+	require.True(t, summary.FCrDNS)
+	require.Equal(t, "authuser", summary.AuthUser)
+	require.Equal(t, []string{"fromuser@example.org"}, summary.EnvelopeFrom)
+	require.Equal(t, "touser@localdomain.ext", summary.Recipient)
+	require.Equal(t, float32(1.155), summary.Score)
+	require.Equal(t, "applied_class", summary.Class)
+	require.Equal(t, "threshold", summary.Reason)
+	require.Equal(t, map[string][]string{"Subject": {"quarterly report"}}, summary.Headers)
+	require.Contains(t, output.String(), "register|filter|smtp-in|commit\n")
+	require.Contains(t, output.String(), "filter-result|deadbeef|c0ffee|proceed\n")
+	require.Contains(t, filteredLines(t, output.String()), "X-Spam-Class: applied_class")
+	require.Equal(t, int64(0), f.Counter(COUNTER_WEBHOOK_OVERRIDES))
+}
+
+func TestPolicyWebhookOverride(t *testing.T) {
+	run := func(status int, body string) (string, *Filter) {
+		server, _, _ := testWebhookServer(t, status, body)
+		var output strings.Builder
+		f := newTestFilter(t, map[string]any{"policy_webhook_url": server.URL}, commitInput(webhookData), &output)
+		f.Run()
+		return output.String(), f
+	}
+	output, f := run(http.StatusOK, `{"class": "spam"}`)
+	require.Contains(t, filteredLines(t, output), "X-Spam-Class: spam")
+	require.Contains(t, output, "filter-result|deadbeef|c0ffee|proceed\n")
+	require.Equal(t, int64(1), f.Counter(COUNTER_WEBHOOK_OVERRIDES))
+
+	output, _ = run(http.StatusOK, `{"action": "REJECT"}`)
+	require.Contains(t, filteredLines(t, output), "X-Spam-Class: applied_class")
+	require.Contains(t, filteredLines(t, output), "X-Spam: yes")
+	require.Contains(t, output, "filter-result|deadbeef|c0ffee|reject|"+DEFAULT_REJECT_STATUS+"\n")
+
+	// unknown actions tag the message
+	output, _ = run(http.StatusOK, `{"action": "discard"}`)
+	require.Contains(t, filteredLines(t, output), "X-Spam: no")
+	require.Contains(t, output, "filter-result|deadbeef|c0ffee|proceed\n")
+
+	// failures keep the filter's decision
+	for _, response := range []struct {
+		status int
+		body   string
+	}{
+		{http.StatusInternalServerError, "down"},
+		{http.StatusOK, "not json"},
+	} {
+		output, f = run(response.status, response.body)
+		require.Contains(t, filteredLines(t, output), "X-Spam-Class: applied_class")
+		require.Contains(t, output, "filter-result|deadbeef|c0ffee|proceed\n")
+		require.Equal(t, int64(1), f.Counter(COUNTER_WEBHOOK_FAILED))
+	}
+}
+
+func TestPolicyWebhookBackoff(t *testing.T) {
+	server, _, _ := testWebhookServer(t, http.StatusServiceUnavailable, "down")
+	second := strings.Split(strings.NewReplacer("deadbeef", "00000002", "cafebabe", "cafe0002").Replace(messageInput(webhookData)), "\n")
+	reader, writer := io.Pipe()
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	setTestOptions(t, map[string]any{"policy_webhook_url": server.URL})
+	var output strings.Builder
+	f, err := NewFilter(reader, &output)
+	require.Nil(t, err)
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	f.now = func() time.Time { return now }
+	go func() {
+		defer writer.Close()
+		io.WriteString(writer, messageInput(webhookData))
+		// the second message arrives once the first request has failed
+		for deadline := time.Now().Add(time.Second); f.Counter(COUNTER_WEBHOOK_FAILED) == 0 && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+		io.WriteString(writer, strings.Join(second[len(initLines):], "\n"))
+	}()
+	f.Run()
+	// the second message is classified without waiting for the failed webhook
+	require.Equal(t, int64(1), f.Counter(COUNTER_WEBHOOK_FAILED))
+	require.Equal(t, int64(1), f.Counter(COUNTER_WEBHOOK_SKIPPED))
+	require.Equal(t, now.Add(30*time.Second), f.webhook.suspended)
+	require.Contains(t, output.String(), "filter-dataline|00000002|baadf00d|X-Spam-Class: applied_class")
+
+	webhook := PolicyWebhook{Backoff: time.Second, MaxBackoff: 3 * time.Second}
+	now = time.Now()
+	for _, backoff := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		webhook.result(true, now)
+		require.Equal(t, now.Add(backoff), webhook.suspended)
+	}
+	webhook.result(false, now)
+	webhook.result(true, now)
+	require.Equal(t, now.Add(time.Second), webhook.suspended)
+}
+
+func TestPolicyWebhookDoesNotBlockSessions(t *testing.T) {
+	fast := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var summary PolicyRequest
+		data, _ := io.ReadAll(r.Body)
+		json.Unmarshal(data, &summary)
+		if summary.Session == "deadbeef" {
+			select {
+			case <-fast:
+			case <-time.After(5 * time.Second):
+			}
+			// leave time for the other message to be written
+			time.Sleep(500 * time.Millisecond)
+		} else {
+			close(fast)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+	other := strings.Split(strings.NewReplacer("deadbeef", "00000002", "cafebabe", "cafe0002").Replace(commitInput(webhookData)), "\n")
+	input := commitInput(webhookData) + strings.Join(other[len(initLines):], "\n")
+	var output strings.Builder
+	f := newTestFilter(t, map[string]any{"policy_webhook_url": server.URL}, input, &output)
+	start := time.Now()
+	f.Run()
+	require.Less(t, time.Since(start), 5*time.Second)
+	lines := output.String()
+	slow := strings.Index(lines, "filter-dataline|deadbeef|baadf00d|X-Spam-Class: applied_class")
+	fastLine := strings.Index(lines, "filter-dataline|00000002|baadf00d|X-Spam-Class: applied_class")
+	require.True(t, slow > 0 && fastLine > 0)
+	require.Less(t, fastLine, slow)
+	// the held message's commit decision follows its data lines
+	require.Less(t, slow, strings.Index(lines, "filter-result|deadbeef|c0ffee|proceed"))
+}
+
+func TestPolicyWebhookConfig(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	for _, options := range []map[string]any{
+		{"policy_webhook_url": "ftp://policy.example.org"},
+		{"policy_webhook_url": "http://localhost:8080", "policy_webhook_timeout": "soon"},
+		{"policy_webhook_url": "http://localhost:8080", "policy_webhook_backoff": "-1m"},
+	} {
+		setTestOptions(t, options)
+		_, err := NewFilter(strings.NewReader(""), io.Discard)
+		require.NotNil(t, err, options)
+	}
+}